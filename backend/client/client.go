@@ -0,0 +1,368 @@
+// Package client sends and receives tube shares from Go programs. It speaks the
+// protocol described in documentation/Protocol.md and encrypts payloads as
+// described in documentation/Encryption.md, so it can share files with browsers
+// and the tube command.
+//
+// Senders and receivers joining a share retry connections the relay fails, and
+// resume the share if their connection drops while chunks are being relayed.
+// Errors from the relay wrap the Err values of this package.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/tubecrypto"
+)
+
+// Share code as shown to users and given to Receive
+type ShareCode string
+
+// Progress of a share being sent, received from the channel returned by Send
+type Progress struct {
+	// Bytes the receiver has acknowledged and bytes in the share, the total of a
+	// streamed share is 0 until its reader ends
+	Done  uint64
+	Total uint64
+	// From protocol version 17 while the share waits for receivers, how many have
+	// joined and how many have sent their key
+	ReceiversJoined int
+	ReceiversReady  int
+	// Set once the relay warns the share is about to expire, when it stops waiting for receivers
+	Expires time.Time
+	// Set on the final Progress if the share failed, the channel is closed after it
+	Err error
+}
+
+// A file sent with SendFiles
+type File struct {
+	// Path the receiver saves the file to, relative with "/" separators
+	Name     string
+	Contents io.Reader
+	// Bytes read from Contents, when 0 the size is found from Contents which must
+	// then have a Len method or be an io.Seeker. UnknownSize streams Contents until
+	// it ends, only a share of one file can be streamed.
+	Size int64
+}
+
+// Size of a file streamed until its reader ends, streamed shares need protocol version 11
+const UnknownSize int64 = -1
+
+type SendOptions struct {
+	// Size of the reader given to Send, see File.Size
+	Size int64
+	// PIN receivers must give before joining, empty for no PIN. It keeps out
+	// receivers who learn the share code but not the relay, which learns enough
+	// to answer the challenge, see Pake.
+	Pin string
+	// How long the share waits for a receiver, 0 for the relay's default
+	TimeToLive time.Duration
+	// Unacknowledged chunks in flight, 0 for 64
+	WindowSize uint16
+	// Receivers that may join the share, more than 1 makes a broadcast share
+	// which needs protocol version 13 and can't be protected by a PIN. The relay
+	// may allow fewer receivers than asked for.
+	Receivers int
+	// Whether a broadcast share carries on without a receiver that fell behind
+	// or left, by default the share ends for everyone
+	ContinueWithoutDropped bool
+	// Agree the share's key with PAKE from a secret added to the share code after
+	// a colon, so a relay that swaps the receiver's key can't read the share. Needs
+	// protocol version 8 and can't be used for broadcast shares or share requests.
+	Pake bool
+	// Called with the short authentication string once the receiver has joined,
+	// the users compare it with the receiver's before any data is sent. Returning
+	// nil confirms they match, an error tells the receiver they differ and is the
+	// share's final error. Needs protocol version 9 and can't be used for
+	// broadcast shares.
+	Verify func(ShortAuthenticationString) error
+}
+
+const defaultWindowSize = 64
+
+// Send a single file, see SendFiles
+func Send(ctx context.Context, serverURL string, contents io.Reader, name string, options SendOptions) (ShareCode, <-chan Progress, error) {
+	return SendFiles(ctx, serverURL, []File{{Name: name, Contents: contents, Size: options.Size}}, options)
+}
+
+// Create a share of the files, returns once the relay has given the share code.
+// The files are sent once a receiver joins, progress is sent on the channel which
+// is closed when the share ends. Values may be dropped if the channel isn't read,
+// the final value is always sent. Cancelling the context cancels the share.
+func SendFiles(ctx context.Context, serverURL string, files []File, options SendOptions) (ShareCode, <-chan Progress, error) {
+	return sendFiles(ctx, serverURL, nil, files, options)
+}
+
+// Send the files to the receiver that created the share request with the code,
+// see Request. The receiver has already joined so the files are sent straight
+// away, progress is sent on the channel as for SendFiles. Share requests need
+// protocol version 12 and can't be protected by a PIN.
+func SendFilesTo(ctx context.Context, serverURL string, code ShareCode, files []File, options SendOptions) (<-chan Progress, error) {
+	if options.Pin != "" {
+		return nil, fmt.Errorf("Share requests can't be protected by a PIN.")
+	}
+
+	_, progress, err := sendFiles(ctx, serverURL, url.Values{"share_code": {string(code)}}, files, options)
+
+	return progress, err
+}
+
+// Create a share of the files, or join a share request when the query has a share code
+func sendFiles(ctx context.Context, serverURL string, query url.Values, files []File, options SendOptions) (ShareCode, <-chan Progress, error) {
+	// sizes found from the readers are filled in
+	files = append([]File(nil), files...)
+	manifest, err := manifestOf(files)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	streamed := protocol.IsStreamed(manifest)
+
+	initiation := protocol.SenderInitiation{
+		Versions:     clientVersions,
+		WindowSize:   options.WindowSize,
+		TimeToLive:   uint32(options.TimeToLive / time.Second),
+		KeyAgreement: protocol.KeyAgreementPublicKey,
+	}
+
+	if initiation.WindowSize == 0 {
+		initiation.WindowSize = defaultWindowSize
+	}
+
+	if streamed {
+		initiation.Versions.Lowest = protocol.StreamingVersion
+	}
+
+	if query.Has("share_code") {
+		initiation.Versions.Lowest = protocol.IntroducedIn(protocol.REQUEST_ACCEPTED)
+	}
+
+	var pakeSecret string
+
+	if options.Pake {
+		if query.Has("share_code") {
+			return "", nil, fmt.Errorf("Share requests can't use PAKE key agreement.")
+		}
+
+		pakeSecret, err = newPakeSecret()
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		initiation.KeyAgreement = protocol.KeyAgreementPake
+		initiation.Versions.Lowest = max(initiation.Versions.Lowest, protocol.IntroducedIn(protocol.PAKE))
+	}
+
+	if options.Verify != nil {
+		initiation.Versions.Lowest = max(initiation.Versions.Lowest, protocol.IntroducedIn(protocol.VERIFY))
+	}
+
+	if options.Receivers > 1 {
+		if options.Pin != "" || query.Has("share_code") || options.Pake || options.Verify != nil {
+			return "", nil, fmt.Errorf("Broadcast shares can't be protected by a PIN, PAKE or short authentication strings or sent to a share request.")
+		}
+
+		if options.Receivers > protocol.MaxBroadcastReceivers {
+			return "", nil, fmt.Errorf("A share must have at most %v receivers.", protocol.MaxBroadcastReceivers)
+		}
+
+		initiation.Versions.Lowest = protocol.IntroducedIn(protocol.BROADCAST_READY)
+		initiation.Receivers = uint8(options.Receivers)
+
+		if options.ContinueWithoutDropped {
+			initiation.DropPolicy = protocol.DropPolicyContinue
+		}
+	}
+
+	if options.Pin != "" {
+		initiation.PinSalt = make([]byte, protocol.PinSaltLength)
+
+		_, err = rand.Read(initiation.PinSalt)
+
+		if err != nil {
+			return "", nil, fmt.Errorf("Random bytes failed")
+		}
+
+		initiation.PinVerifier, err = protocol.PinVerifier(options.Pin, initiation.PinSalt)
+
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	p, err := newPeer(ctx, serverURL, "/send", query)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	shareCode, err := createShare(p, initiation)
+
+	if err != nil {
+		p.close()
+		return "", nil, err
+	}
+
+	if options.Pake {
+		// the receiver gives the relay only the part before the colon
+		shareCode += ShareCode(":" + pakeSecret)
+	}
+
+	progress := make(chan Progress, 1)
+
+	s := &sender{
+		peer:       p,
+		files:      files,
+		manifest:   manifest,
+		progress:   progress,
+		streamed:   streamed,
+		pakeSecret: pakeSecret,
+		verify:     options.Verify,
+	}
+	p.onStatus = s.acceptStatus
+
+	if streamed {
+		// the number of chunks is known once the reader ends
+		s.totalChunks = protocol.StreamedNumberOfChunks
+	} else {
+		for _, entry := range manifest {
+			s.total += entry.Size
+			s.totalChunks += entry.NumberOfChunks
+		}
+	}
+
+	go s.run()
+
+	return shareCode, progress, nil
+}
+
+// Size of a reader that has a Len method or is an io.Seeker
+func sizeOf(contents io.Reader) (int64, error) {
+	switch r := contents.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), nil
+	case io.Seeker:
+		current, err := r.Seek(0, io.SeekCurrent)
+
+		if err != nil {
+			return 0, err
+		}
+
+		end, err := r.Seek(0, io.SeekEnd)
+
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = r.Seek(current, io.SeekStart)
+
+		return end - current, err
+	default:
+		return 0, fmt.Errorf("Size of the reader is unknown, give the size.")
+	}
+}
+
+func numberOfChunks(size uint64) uint32 {
+	return uint32((size + tubecrypto.ChunkSize - 1) / tubecrypto.ChunkSize)
+}
+
+// Manifest entries of the files, without their paths which are sealed once the content key is known
+func manifestOf(files []File) ([]protocol.ManifestEntry, error) {
+	if len(files) == 0 || len(files) > protocol.MaxManifestFiles {
+		return nil, fmt.Errorf("A share must have between 1 and %v files has %v.", protocol.MaxManifestFiles, len(files))
+	}
+
+	if len(files) == 1 && files[0].Size == UnknownSize {
+		if !isValidPath(files[0].Name) {
+			return nil, fmt.Errorf("File name %q is not a relative path.", files[0].Name)
+		}
+
+		return []protocol.ManifestEntry{{Size: protocol.StreamedFileSize, NumberOfChunks: protocol.StreamedNumberOfChunks}}, nil
+	}
+
+	manifest := make([]protocol.ManifestEntry, len(files))
+
+	for i := range files {
+		if !isValidPath(files[i].Name) {
+			return nil, fmt.Errorf("File name %q is not a relative path.", files[i].Name)
+		}
+
+		if files[i].Size == 0 {
+			size, err := sizeOf(files[i].Contents)
+
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", files[i].Name, err)
+			}
+
+			files[i].Size = size
+		}
+
+		if files[i].Size == UnknownSize {
+			return nil, fmt.Errorf("%v: only a share of one file can be streamed.", files[i].Name)
+		}
+
+		if files[i].Size < 0 {
+			return nil, fmt.Errorf("%v: size must not be negative.", files[i].Name)
+		}
+
+		manifest[i] = protocol.ManifestEntry{Size: uint64(files[i].Size), NumberOfChunks: numberOfChunks(uint64(files[i].Size))}
+	}
+
+	var totalChunks uint64
+
+	for _, entry := range manifest {
+		totalChunks += uint64(entry.NumberOfChunks)
+	}
+
+	if totalChunks > uint64(protocol.MaxNumberOfChunks(clientVersions.Lowest)) {
+		return nil, fmt.Errorf("A share must have at most %v chunks has %v.", protocol.MaxNumberOfChunks(clientVersions.Lowest), totalChunks)
+	}
+
+	return manifest, nil
+}
+
+// Send SENDER_INITIATION and return the share code from SENDER_ACCEPTED
+func createShare(p *peer, initiation protocol.SenderInitiation) (ShareCode, error) {
+	blob, err := protocol.EncodeSenderInitiation(initiation)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = p.send(blob)
+
+	if err != nil {
+		return "", err
+	}
+
+	blob, err = p.next(messageTimeout)
+
+	if err != nil {
+		return "", err
+	}
+
+	acceptance, err := protocol.DecodeSenderAcceptance(blob)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode sender acceptance message. %v", err)
+	}
+
+	p.resumeToken = acceptance.ResumeToken
+	p.shareCode = acceptance.ShareCode
+	p.relayVersion = acceptance.Versions.Highest
+
+	// the share code text was added in version 6, before it codes are shown in base64
+	if acceptance.ShareCodeText != "" {
+		return ShareCode(acceptance.ShareCodeText), nil
+	}
+
+	return ShareCode(base64.StdEncoding.EncodeToString(acceptance.ShareCode)), nil
+}
@@ -0,0 +1,976 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/server"
+	"github.com/billyedmoore/tube/internal/sharecode"
+)
+
+func newRelay(t *testing.T) string {
+	relay := httptest.NewServer(server.NewServeMux(server.DefaultConfig()))
+	t.Cleanup(relay.Close)
+	return relay.URL
+}
+
+func randomBytes(size int) []byte {
+	contents := make([]byte, size)
+	rand.Read(contents)
+	return contents
+}
+
+// Read every progress value, returns the final one
+func finalProgress(progress <-chan Progress) Progress {
+	var last Progress
+	for update := range progress {
+		last = update
+	}
+	return last
+}
+
+func TestSendAndReceive(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	files := []File{
+		{Name: "a.bin", Contents: bytes.NewReader(randomBytes(200 * 1024))},
+		{Name: "empty", Contents: bytes.NewReader(nil)},
+		{Name: "dir/b.bin", Contents: bytes.NewReader(randomBytes(128 * 1024))},
+	}
+
+	var wanted []byte
+
+	for _, file := range files {
+		contents, _ := io.ReadAll(file.Contents)
+		file.Contents.(*bytes.Reader).Seek(0, io.SeekStart)
+		wanted = append(wanted, contents...)
+	}
+
+	for _, keyType := range []KeyType{KeyTypeX25519, KeyTypeP256, KeyTypeRSA} {
+		for _, file := range files {
+			file.Contents.(*bytes.Reader).Seek(0, io.SeekStart)
+		}
+
+		shareCode, progress, err := SendFiles(ctx, relay, files, SendOptions{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metadata, contents, err := ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{KeyType: keyType})
+
+		if err != nil {
+			t.Fatalf("Key type %v: %v", keyType, err)
+		}
+
+		received, err := io.ReadAll(contents)
+		contents.Close()
+
+		if err != nil || !bytes.Equal(received, wanted) {
+			t.Errorf("Key type %v: contents were not received intact (%v)", keyType, err)
+		}
+
+		if len(metadata.Files) != 3 || metadata.Files[2].Name != "dir/b.bin" || metadata.Size() != uint64(len(wanted)) {
+			t.Errorf("Key type %v: metadata should describe the files is %+v", keyType, metadata)
+		}
+
+		final := finalProgress(progress)
+
+		if final.Err != nil || final.Done != final.Total || final.Total != uint64(len(wanted)) {
+			t.Errorf("Key type %v: final progress should be complete is %+v", keyType, final)
+		}
+
+		if final.ReceiversJoined != 1 || final.ReceiversReady != 1 {
+			t.Errorf("Key type %v: final progress should count the receiver is %+v", keyType, final)
+		}
+	}
+}
+
+func TestSendStreamed(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	for _, size := range []int{0, 300 * 1024} {
+		wanted := randomBytes(size)
+
+		// hides the reader's length, as for a pipe
+		contents := io.MultiReader(bytes.NewReader(wanted))
+
+		shareCode, progress, err := Send(ctx, relay, contents, "stream", SendOptions{Size: UnknownSize})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metadata, reader, err := Receive(ctx, relay, shareCode)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !metadata.Streamed || metadata.Files[0].Name != "stream" {
+			t.Errorf("Metadata should describe a streamed file is %+v", metadata)
+		}
+
+		received, err := io.ReadAll(reader)
+		reader.Close()
+
+		if err != nil || !bytes.Equal(received, wanted) {
+			t.Errorf("Streaming %v bytes: contents were not received intact (%v)", size, err)
+		}
+
+		final := finalProgress(progress)
+
+		if final.Err != nil || final.Total != uint64(size) || final.Done != uint64(size) {
+			t.Errorf("Streaming %v bytes: final progress should be complete is %+v", size, final)
+		}
+	}
+}
+
+func TestReceiveErrors(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	_, _, err := Receive(ctx, relay, "AAAAAAA=")
+
+	if !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("Receiving an unknown share should fail with ErrShareNotFound not %v", err)
+	}
+
+	shareCode, progress, err := Send(ctx, relay, bytes.NewReader([]byte("secret")), "secret.txt", SendOptions{Pin: "2468"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = Receive(ctx, relay, shareCode)
+
+	if !errors.Is(err, ErrPinRequired) {
+		t.Errorf("Receiving a PIN protected share without a PIN should fail with ErrPinRequired not %v", err)
+	}
+
+	if final := finalProgress(progress); final.Err == nil {
+		t.Errorf("Sender should fail once the receiver gives up")
+	}
+
+	shareCode, progress, err = Send(ctx, relay, bytes.NewReader([]byte("secret")), "secret.txt", SendOptions{Pin: "2468"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongPin := func(int) (string, error) { return "1357", nil }
+
+	_, _, err = ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{AskForPin: wrongPin})
+
+	if !errors.Is(err, ErrIncorrectPin) {
+		t.Errorf("Receiving with the wrong PIN should fail with ErrIncorrectPin not %v", err)
+	}
+
+	finalProgress(progress)
+}
+
+func TestReceiveWithPin(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	shareCode, progress, err := Send(ctx, relay, bytes.NewReader([]byte("secret")), "secret.txt", SendOptions{Pin: "2468"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asked := 0
+	askForPin := func(int) (string, error) {
+		asked++
+		return "2468", nil
+	}
+
+	_, contents, err := ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{Pin: "1357", AskForPin: askForPin})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := io.ReadAll(contents)
+
+	if err != nil || string(received) != "secret" || asked != 1 {
+		t.Errorf("Share should be received after asking for the PIN once, asked %v times (%q, %v)", asked, received, err)
+	}
+
+	finalProgress(progress)
+}
+
+func TestPake(t *testing.T) {
+	ctx := context.Background()
+
+	for _, shareCodes := range []sharecode.Generator{sharecode.Base64{}, sharecode.Words{}} {
+		config := server.DefaultConfig()
+		config.ShareCodes = shareCodes
+		relay := httptest.NewServer(server.NewServeMux(config))
+		defer relay.Close()
+
+		wanted := randomBytes(100 * 1024)
+		shareCode, progress, err := Send(ctx, relay.URL, bytes.NewReader(wanted), "agreed.bin", SendOptions{Pake: true})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		text, secret, ok := strings.Cut(string(shareCode), ":")
+
+		if !ok || len(secret) != pakeSecretLength {
+			t.Fatalf("Share code should end with a colon and the secret is %q", shareCode)
+		}
+
+		// the secret is read ignoring case
+		_, contents, err := Receive(ctx, relay.URL, ShareCode(text+":"+strings.ToLower(secret)))
+
+		if err != nil {
+			t.Fatalf("%T: %v", shareCodes, err)
+		}
+
+		received, err := io.ReadAll(contents)
+		contents.Close()
+
+		if err != nil || !bytes.Equal(received, wanted) {
+			t.Errorf("%T: contents were not received intact (%v)", shareCodes, err)
+		}
+
+		if final := finalProgress(progress); final.Err != nil {
+			t.Errorf("%T: sender failed: %v", shareCodes, final.Err)
+		}
+	}
+}
+
+func TestPakeWrongSecret(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	shareCode, progress, err := Send(ctx, relay, bytes.NewReader([]byte("secret")), "secret.txt", SendOptions{Pake: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, secret, _ := strings.Cut(string(shareCode), ":")
+	wrongSecret := "0000"
+
+	if secret == wrongSecret {
+		wrongSecret = "1111"
+	}
+
+	_, _, err = Receive(ctx, relay, ShareCode(text+":"+wrongSecret))
+
+	if !errors.Is(err, ErrPeerDisconnected) {
+		t.Errorf("Receiving with the wrong secret should fail with ErrPeerDisconnected not %v", err)
+	}
+
+	if final := finalProgress(progress); !errors.Is(final.Err, ErrWrongSecret) {
+		t.Errorf("Sender should fail with ErrWrongSecret not %v", final.Err)
+	}
+
+	// a receiver without the secret can't join a PAKE share
+	shareCode, progress, err = Send(ctx, relay, bytes.NewReader([]byte("secret")), "secret.txt", SendOptions{Pake: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, _, _ = strings.Cut(string(shareCode), ":")
+
+	_, _, err = Receive(ctx, relay, ShareCode(text))
+
+	if err == nil {
+		t.Errorf("Receiving a PAKE share without the secret should fail")
+	}
+
+	if final := finalProgress(progress); final.Err == nil {
+		t.Errorf("Sender should fail once the receiver gives up")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	for _, pake := range []bool{false, true} {
+		var senderString, receiverString ShortAuthenticationString
+
+		options := SendOptions{Pake: pake, Verify: func(s ShortAuthenticationString) error {
+			senderString = s
+			return nil
+		}}
+
+		shareCode, progress, err := Send(ctx, relay, bytes.NewReader([]byte("checked")), "checked.txt", options)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, contents, err := ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{Verify: func(s ShortAuthenticationString) error {
+			receiverString = s
+			return nil
+		}})
+
+		if err != nil {
+			t.Fatalf("PAKE %v: %v", pake, err)
+		}
+
+		received, err := io.ReadAll(contents)
+		contents.Close()
+
+		if err != nil || string(received) != "checked" {
+			t.Errorf("PAKE %v: contents were not received intact (%q, %v)", pake, received, err)
+		}
+
+		if final := finalProgress(progress); final.Err != nil {
+			t.Errorf("PAKE %v: sender failed: %v", pake, final.Err)
+		}
+
+		if senderString.Words == "" || senderString != receiverString {
+			t.Errorf("PAKE %v: both users should be shown the same string, %+v and %+v", pake, senderString, receiverString)
+		}
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	confirm := func(ShortAuthenticationString) error { return nil }
+	differs := errors.New("Strings differ.")
+
+	shareCode, progress, err := Send(ctx, relay, bytes.NewReader([]byte("secret")), "secret.txt", SendOptions{Verify: confirm})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{Verify: func(ShortAuthenticationString) error { return differs }})
+
+	if err != differs {
+		t.Errorf("Receiver should fail with the error from Verify not %v", err)
+	}
+
+	if final := finalProgress(progress); !errors.Is(final.Err, ErrKeyMismatch) {
+		t.Errorf("Sender should fail with ErrKeyMismatch not %v", final.Err)
+	}
+
+	// the sender's user can report a mismatch too
+	shareCode, progress, err = Send(ctx, relay, bytes.NewReader([]byte("secret")), "secret.txt",
+		SendOptions{Verify: func(ShortAuthenticationString) error { return differs }})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{Verify: confirm})
+
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Receiver should fail with ErrKeyMismatch not %v", err)
+	}
+
+	if final := finalProgress(progress); final.Err != differs {
+		t.Errorf("Sender should fail with the error from Verify not %v", final.Err)
+	}
+
+	// a receiver that can't show the string gives up
+	shareCode, progress, err = Send(ctx, relay, bytes.NewReader([]byte("secret")), "secret.txt", SendOptions{Verify: confirm})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = Receive(ctx, relay, shareCode)
+
+	if err == nil {
+		t.Errorf("Receiving without Verify should fail when the sender asks to compare strings")
+	}
+
+	finalProgress(progress)
+}
+
+// Forwards connections to the relay and can drop every open connection
+type droppingProxy struct {
+	listener net.Listener
+	lock     sync.Mutex
+	open     []net.Conn
+}
+
+func newDroppingProxy(t *testing.T, relay string) *droppingProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &droppingProxy{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	relayAddress := relay[len("http://"):]
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			upstream, err := net.Dial("tcp", relayAddress)
+
+			if err != nil {
+				client.Close()
+				continue
+			}
+
+			proxy.lock.Lock()
+			proxy.open = append(proxy.open, client, upstream)
+			proxy.lock.Unlock()
+
+			go io.Copy(upstream, client)
+			go io.Copy(client, upstream)
+		}
+	}()
+
+	return proxy
+}
+
+func (proxy *droppingProxy) url() string {
+	return "http://" + proxy.listener.Addr().String()
+}
+
+func (proxy *droppingProxy) dropConnections() {
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+
+	for _, conn := range proxy.open {
+		conn.Close()
+	}
+
+	proxy.open = nil
+}
+
+func TestResumeAfterDroppedConnection(t *testing.T) {
+	wanted := randomBytes(2 * 1024 * 1024)
+
+	for _, dropped := range []string{"sender", "receiver"} {
+		relay := newRelay(t)
+		proxy := newDroppingProxy(t, relay)
+		ctx := context.Background()
+
+		senderRelay, receiverRelay := relay, relay
+
+		if dropped == "sender" {
+			senderRelay = proxy.url()
+		} else {
+			receiverRelay = proxy.url()
+		}
+
+		shareCode, progress, err := Send(ctx, senderRelay, bytes.NewReader(wanted), "big.bin", SendOptions{WindowSize: 8})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, contents, err := Receive(ctx, receiverRelay, shareCode)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received := make([]byte, 512*1024)
+		_, err = io.ReadFull(contents, received)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxy.dropConnections()
+
+		rest, err := io.ReadAll(contents)
+		received = append(received, rest...)
+
+		if err != nil || !bytes.Equal(received, wanted) {
+			t.Errorf("Dropping the %v's connection: contents were not received intact (%v)", dropped, err)
+		}
+
+		if final := finalProgress(progress); final.Err != nil {
+			t.Errorf("Dropping the %v's connection: sender failed: %v", dropped, final.Err)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	request, err := Request(ctx, relay, ReceiveOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := randomBytes(150 * 1024)
+	progress, err := SendFilesTo(ctx, relay, request.Code, []File{{Name: "requested.bin", Contents: bytes.NewReader(wanted)}}, SendOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, contents, err := request.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := io.ReadAll(contents)
+	contents.Close()
+
+	if err != nil || !bytes.Equal(received, wanted) || metadata.Files[0].Name != "requested.bin" {
+		t.Errorf("Requested file was not received intact (%v)", err)
+	}
+
+	if final := finalProgress(progress); final.Err != nil {
+		t.Errorf("Sender failed: %v", final.Err)
+	}
+}
+
+func TestRequestRoles(t *testing.T) {
+	relay := newRelay(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request, err := Request(ctx, relay, ReceiveOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer request.Close()
+
+	// a receiver can't join another receiver's request
+	_, _, err = Receive(ctx, relay, request.Code)
+
+	if !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("Receiving a share request should fail with ErrShareNotFound not %v", err)
+	}
+
+	// nor a sender another sender's share
+	shareCode, _, err := Send(ctx, relay, bytes.NewReader([]byte("hello")), "hello.txt", SendOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = SendFilesTo(ctx, relay, shareCode, []File{{Name: "a", Contents: bytes.NewReader(nil)}}, SendOptions{})
+
+	if !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("Sending to a sender's share should fail with ErrShareNotFound not %v", err)
+	}
+
+	_, err = SendFilesTo(ctx, relay, request.Code, []File{{Name: "a", Contents: bytes.NewReader(nil)}}, SendOptions{Pin: "1234"})
+
+	if err == nil {
+		t.Errorf("Share requests shouldn't accept a PIN")
+	}
+}
+
+func TestRequestExpires(t *testing.T) {
+	config := server.DefaultConfig()
+	config.ShareTTL = time.Second
+	relay := httptest.NewServer(server.NewServeMux(config))
+	defer relay.Close()
+
+	request, err := Request(context.Background(), relay.URL, ReceiveOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = request.Wait()
+
+	if !errors.Is(err, ErrShareExpired) {
+		t.Errorf("Request that no sender joined should fail with ErrShareExpired not %v", err)
+	}
+
+	_, err = SendFilesTo(context.Background(), relay.URL, request.Code, []File{{Name: "a", Contents: bytes.NewReader(nil)}}, SendOptions{})
+
+	if !errors.Is(err, ErrShareExpired) {
+		t.Errorf("Sending to an expired request should fail with ErrShareExpired not %v", err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+	keyTypes := []KeyType{KeyTypeX25519, KeyTypeP256, KeyTypeRSA}
+
+	wanted := randomBytes(300 * 1024)
+	shareCode, progress, err := Send(ctx, relay, bytes.NewReader(wanted), "broadcast.bin", SendOptions{Receivers: len(keyTypes)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, keyType := range keyTypes {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			metadata, contents, err := ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{KeyType: keyType})
+
+			if err != nil {
+				t.Errorf("Key type %v: %v", keyType, err)
+				return
+			}
+
+			received, err := io.ReadAll(contents)
+			contents.Close()
+
+			if err != nil || !bytes.Equal(received, wanted) || metadata.Files[0].Name != "broadcast.bin" {
+				t.Errorf("Key type %v: contents were not received intact (%v)", keyType, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if final := finalProgress(progress); final.Err != nil || final.Done != uint64(len(wanted)) {
+		t.Errorf("Final progress should be complete is %+v", final)
+	}
+
+	// every place was taken so the share stopped being offered
+	_, _, err = Receive(ctx, relay, shareCode)
+
+	if err == nil {
+		t.Errorf("Receiver joining a broadcast share that started should fail")
+	}
+}
+
+func TestBroadcastSlowReceiver(t *testing.T) {
+	config := server.DefaultConfig()
+	config.SlowReceiverTimeout = 200 * time.Millisecond
+	relay := httptest.NewServer(server.NewServeMux(config))
+	defer relay.Close()
+
+	ctx := context.Background()
+	wanted := randomBytes(1024 * 1024)
+
+	for _, continueWithoutDropped := range []bool{true, false} {
+		shareCode, progress, err := Send(ctx, relay.URL, bytes.NewReader(wanted), "broadcast.bin",
+			SendOptions{Receivers: 2, WindowSize: 2, ContinueWithoutDropped: continueWithoutDropped})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type joined struct {
+			contents io.ReadCloser
+			err      error
+		}
+
+		joins := make(chan joined, 2)
+
+		for range 2 {
+			go func() {
+				_, contents, err := Receive(ctx, relay.URL, shareCode)
+				joins <- joined{contents, err}
+			}()
+		}
+
+		// the first receiver reads the share while the second never does
+		reader, slow := <-joins, <-joins
+
+		if reader.err != nil || slow.err != nil {
+			t.Fatalf("Receivers failed to join: %v %v", reader.err, slow.err)
+		}
+
+		received, err := io.ReadAll(reader.contents)
+		reader.contents.Close()
+		final := finalProgress(progress)
+
+		if continueWithoutDropped {
+			if err != nil || !bytes.Equal(received, wanted) || final.Err != nil {
+				t.Errorf("Share should continue without the slow receiver (%v, %v)", err, final.Err)
+			}
+		} else if !errors.Is(err, ErrReceiverDropped) || !errors.Is(final.Err, ErrReceiverDropped) {
+			t.Errorf("Share should end with ErrReceiverDropped not (%v, %v)", err, final.Err)
+		}
+
+		_, err = io.ReadAll(slow.contents)
+		slow.contents.Close()
+
+		if !errors.Is(err, ErrReceiverDropped) {
+			t.Errorf("Slow receiver should fail with ErrReceiverDropped not %v", err)
+		}
+	}
+}
+
+func TestBroadcastSlowAccept(t *testing.T) {
+	config := server.DefaultConfig()
+	config.SlowReceiverTimeout = 100 * time.Millisecond
+	relay := httptest.NewServer(server.NewServeMux(config))
+	defer relay.Close()
+
+	ctx := context.Background()
+	wanted := randomBytes(64 * 1024)
+
+	shareCode, progress, err := Send(ctx, relay.URL, bytes.NewReader(wanted), "broadcast.bin", SendOptions{Receivers: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, delay := range []time.Duration{0, 5 * config.SlowReceiverTimeout} {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// the user takes longer than the slow receiver timeout to accept the share
+			accept := func(Metadata) error {
+				time.Sleep(delay)
+				return nil
+			}
+
+			_, contents, err := ReceiveWithOptions(ctx, relay.URL, shareCode, ReceiveOptions{Accept: accept})
+
+			if err != nil {
+				t.Errorf("Receiver accepting after %v: %v", delay, err)
+				return
+			}
+
+			received, err := io.ReadAll(contents)
+			contents.Close()
+
+			if err != nil || !bytes.Equal(received, wanted) {
+				t.Errorf("Receiver accepting after %v: contents were not received intact (%v)", delay, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if final := finalProgress(progress); final.Err != nil {
+		t.Errorf("Share should finish once both receivers accepted, ended with %v", final.Err)
+	}
+}
+
+func TestDecline(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+
+	declines := []struct {
+		err    error
+		wanted DeclinedError
+	}{
+		{&DeclinedError{Reason: DeclineTooLarge, Message: "Only 1 KiB free."}, DeclinedError{DeclineTooLarge, "Only 1 KiB free."}},
+		{errors.New("Not now."), DeclinedError{DeclineUnspecified, "Not now."}},
+	}
+
+	for _, decline := range declines {
+		shareCode, progress, err := Send(ctx, relay, bytes.NewReader(randomBytes(64*1024)), "large.bin", SendOptions{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		accept := func(metadata Metadata) error {
+			if metadata.Files[0].Name != "large.bin" {
+				t.Errorf("Accept should be given the share's metadata is %+v", metadata)
+			}
+			return decline.err
+		}
+
+		_, _, err = ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{Accept: accept})
+
+		if !errors.Is(err, ErrDeclined) {
+			t.Errorf("Receiving a declined share should fail with ErrDeclined not %v", err)
+		}
+
+		final := finalProgress(progress)
+		var declined *DeclinedError
+
+		if !errors.As(final.Err, &declined) || *declined != decline.wanted || !errors.Is(final.Err, ErrDeclined) {
+			t.Errorf("Sender should be told the share was declined with %+v not %v", decline.wanted, final.Err)
+		}
+	}
+}
+
+func TestBroadcastDecline(t *testing.T) {
+	relay := newRelay(t)
+	ctx := context.Background()
+	wanted := randomBytes(100 * 1024)
+
+	shareCode, progress, err := Send(ctx, relay, bytes.NewReader(wanted), "broadcast.bin", SendOptions{Receivers: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+
+	go func() {
+		_, _, err := ReceiveWithOptions(ctx, relay, shareCode, ReceiveOptions{Accept: func(Metadata) error {
+			return &DeclinedError{Reason: DeclineRejected}
+		}})
+		errs <- err
+	}()
+
+	go func() {
+		_, contents, err := Receive(ctx, relay, shareCode)
+
+		if err == nil {
+			received, _ := io.ReadAll(contents)
+			contents.Close()
+
+			if !bytes.Equal(received, wanted) {
+				err = errors.New("Contents were not received intact.")
+			}
+		}
+
+		errs <- err
+	}()
+
+	results := []error{<-errs, <-errs}
+
+	// the receiver that declined leaves without ending the share for the other
+	if !slices.ContainsFunc(results, func(err error) bool { return errors.Is(err, ErrDeclined) }) ||
+		!slices.Contains(results, nil) {
+		t.Errorf("One receiver should decline and the other receive the share, got %v", results)
+	}
+
+	if final := finalProgress(progress); final.Err != nil {
+		t.Errorf("Sender should finish the share is %v", final.Err)
+	}
+}
+
+func TestCancelWhileWaiting(t *testing.T) {
+	relay := newRelay(t)
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	shareCode, progress, err := Send(ctx, relay, bytes.NewReader(randomBytes(1024)), "file.bin", SendOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel(errors.New("Sent the wrong file."))
+
+	if final := finalProgress(progress); !errors.Is(final.Err, context.Canceled) {
+		t.Errorf("Cancelled sender should fail with context.Canceled not %v", final.Err)
+	}
+
+	// the relay may not have withdrawn the share yet, if so the receiver is told it was cancelled
+	_, _, err = Receive(context.Background(), relay, shareCode)
+
+	if !errors.Is(err, ErrShareNotFound) && !errors.Is(err, ErrCancelled) {
+		t.Errorf("Receiving a cancelled share should fail with ErrShareNotFound or ErrCancelled not %v", err)
+	}
+}
+
+func TestCancelDuringTransfer(t *testing.T) {
+	relay := newRelay(t)
+
+	for _, senderCancels := range []bool{true, false} {
+		senderCtx, cancelSender := context.WithCancelCause(context.Background())
+		receiverCtx, cancelReceiver := context.WithCancelCause(context.Background())
+		reason := errors.New("Changed my mind.")
+
+		// a window of one chunk keeps the share open until the receiver reads the chunks
+		shareCode, progress, err := Send(senderCtx, relay, bytes.NewReader(randomBytes(8*64*1024)), "large.bin",
+			SendOptions{WindowSize: 1})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, reader, err := Receive(receiverCtx, relay, shareCode)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = io.ReadFull(reader, make([]byte, 64*1024))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if senderCancels {
+			cancelSender(reason)
+
+			_, err = io.ReadAll(reader)
+			reader.Close()
+
+			if !errors.Is(err, ErrCancelled) || !strings.Contains(err.Error(), reason.Error()) {
+				t.Errorf("Receiver should be told the sender cancelled with its reason not %v", err)
+			}
+
+			finalProgress(progress)
+		} else {
+			cancelReceiver(reason)
+			reader.Close()
+
+			final := finalProgress(progress)
+
+			if !errors.Is(final.Err, ErrCancelled) || !strings.Contains(final.Err.Error(), reason.Error()) {
+				t.Errorf("Sender should be told the receiver cancelled with its reason not %v", final.Err)
+			}
+		}
+
+		cancelSender(nil)
+		cancelReceiver(nil)
+	}
+}
+
+func TestErrorMessageErrors(t *testing.T) {
+	cases := []struct {
+		version uint8
+		code    protocol.ErrorCode
+		reason  string
+		wanted  error
+	}{
+		{16, protocol.E_TIMEOUT, "Handshake did not finish within 1m0s.", ErrTimeout},
+		{16, protocol.E_EXPIRED, "Share expired before a receiver joined.", ErrShareExpired},
+		// from version 16 the reason isn't matched
+		{16, protocol.E_UNSPECIFIED, "Too many incorrect PINs, the share has been cancelled.", nil},
+		{16, protocol.ErrorCode(0xFF), "A failure added later.", nil},
+		{15, protocol.E_UNSPECIFIED, "Too many incorrect PINs, the share has been cancelled.", ErrIncorrectPin},
+	}
+
+	for _, c := range cases {
+		blob, err := protocol.EncodeError(c.version, c.code, c.reason, protocol.VersionRange{Lowest: 0, Highest: c.version})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var relayErr *RelayError
+		err = errorMessageError(blob)
+
+		if !errors.As(err, &relayErr) || relayErr.Reason != c.reason || errors.Unwrap(err) != c.wanted {
+			t.Errorf("Version %v ERROR with code %v and reason %q should wrap %v is %v",
+				c.version, c.code, c.reason, c.wanted, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// Reasons a share can fail, errors returned by this package wrap them so they
+// can be checked with errors.Is
+var (
+	// The relay refused the share code (404, 410, 409 or 400 before the upgrade)
+	ErrShareNotFound    = errors.New("No share exists with the share code.")
+	ErrShareExpired     = errors.New("Share expired before the other peer joined.")
+	ErrShareClaimed     = errors.New("Share already has a receiver.")
+	ErrInvalidShareCode = errors.New("Share code is not valid.")
+	// Too many shares created or attempts to join made from this address (429)
+	ErrRateLimited = errors.New("Relay is rate limiting this client.")
+	// The sender, receiver and relay have no protocol version in common
+	ErrNoCommonVersion = errors.New("No protocol version is supported by every party.")
+	// The share has a PIN and none was given, or too many incorrect PINs were given
+	ErrPinRequired  = errors.New("Share is protected by a PIN.")
+	ErrIncorrectPin = errors.New("Too many incorrect PINs.")
+	// The other peer left the share and didn't resume it
+	ErrPeerDisconnected = errors.New("Other peer disconnected.")
+	// This peer couldn't resume the share after its connection dropped
+	ErrResumeFailed = errors.New("Share could not be resumed.")
+	// A peer reported the short authentication strings differ, the relay may be malicious
+	ErrKeyMismatch = errors.New("Peer reported a key mismatch.")
+	// PAKE key confirmation failed, the receiver gave the wrong secret or the relay
+	// tampered with the exchange
+	ErrWrongSecret = errors.New("Key confirmation failed, the secret doesn't match.")
+	// A receiver of a broadcast share fell too far behind and was dropped
+	ErrReceiverDropped = errors.New("Receiver was dropped from the broadcast share.")
+	// The receiver declined the share after seeing its metadata, see ReceiveOptions.Accept
+	ErrDeclined = errors.New("Receiver declined the share.")
+	// The other peer cancelled the share, from version 15 a peer whose context is
+	// cancelled tells the other peer why
+	ErrCancelled = errors.New("Other peer cancelled the share.")
+	// A peer didn't send a message the relay was waiting for in time
+	ErrTimeout = errors.New("Peer did not respond in time.")
+	// A peer sent a malformed message or one the relay wasn't expecting
+	ErrProtocolViolation = errors.New("Peer broke the protocol.")
+	// The share exceeded a limit of the relay, such as the number of handshake messages
+	ErrLimitExceeded = errors.New("Share exceeded a limit of the relay.")
+	ErrRelayShutdown = errors.New("Relay is shutting down.")
+	ErrRelayFailed   = errors.New("Relay failed.")
+)
+
+// An ERROR sent by the relay or a connection it refused, Unwrap gives the Err value
+// matching its code (or reason before version 16) or nil if there isn't one
+type RelayError struct {
+	// Reason given by the relay
+	Reason string
+	// Status code of a refused connection, 0 for an ERROR message
+	StatusCode int
+	// Versions supported by the relay, sent with ERROR from version 1
+	LowestVersion  uint8
+	HighestVersion uint8
+	err            error
+}
+
+func (e *RelayError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("Relay refused the connection with status %v. %v", e.StatusCode, e.Reason)
+	}
+	return fmt.Sprintf("Relay ended the share. %v", e.Reason)
+}
+
+func (e *RelayError) Unwrap() error {
+	return e.err
+}
+
+// Errors for the codes sent in ERROR from version 16
+var errorCodes = map[protocol.ErrorCode]error{
+	protocol.E_VERSION:      ErrNoCommonVersion,
+	protocol.E_PEER_GONE:    ErrPeerDisconnected,
+	protocol.E_TIMEOUT:      ErrTimeout,
+	protocol.E_SEQUENCE:     ErrProtocolViolation,
+	protocol.E_LIMIT:        ErrLimitExceeded,
+	protocol.E_SHUTDOWN:     ErrRelayShutdown,
+	protocol.E_EXPIRED:      ErrShareExpired,
+	protocol.E_PIN:          ErrIncorrectPin,
+	protocol.E_KEY_MISMATCH: ErrKeyMismatch,
+	protocol.E_RESUME:       ErrResumeFailed,
+	protocol.E_DROPPED:      ErrReceiverDropped,
+	protocol.E_CLAIMED:      ErrShareClaimed,
+	protocol.E_INTERNAL:     ErrRelayFailed,
+}
+
+// ERROR reasons sent by relays before version 16, matched by prefix
+var errorReasons = []struct {
+	prefix string
+	err    error
+}{
+	{"No protocol version is supported", ErrNoCommonVersion},
+	{"Too many incorrect PINs", ErrIncorrectPin},
+	{"Receiver did not answer the pin challenge", ErrPinRequired},
+	{"Sender disconnected", ErrPeerDisconnected},
+	{"Receiver disconnected", ErrPeerDisconnected},
+	{"Receiver failed to connect", ErrPeerDisconnected},
+	{"Sender failed to connect", ErrPeerDisconnected},
+	{"Share was not resumed within", ErrPeerDisconnected},
+	{"No share can be resumed", ErrResumeFailed},
+	{"Share is no longer accepting resumptions", ErrResumeFailed},
+	{"A resumption of this share is already pending", ErrResumeFailed},
+	{"Share expired before a receiver joined", ErrShareExpired},
+	{"Share expired before a sender joined", ErrShareExpired},
+	{"Peer reported a key mismatch", ErrKeyMismatch},
+	{"Receiver fell too far behind the broadcast share", ErrReceiverDropped},
+	{"Every receiver left the broadcast share", ErrPeerDisconnected},
+	{"Broadcast share started before the receiver joined", ErrShareClaimed},
+	{"Sender cancelled the share", ErrCancelled},
+	{"Receiver cancelled the share", ErrCancelled},
+}
+
+// Why a receiver declined a share
+type DeclineReason uint8
+
+const (
+	DeclineUnspecified  = DeclineReason(protocol.DeclineUnspecified)
+	DeclineTooLarge     = DeclineReason(protocol.DeclineTooLarge)
+	DeclineUnwantedType = DeclineReason(protocol.DeclineUnwantedType)
+	DeclineRejected     = DeclineReason(protocol.DeclineRejected)
+)
+
+func (reason DeclineReason) String() string {
+	switch reason {
+	case DeclineTooLarge:
+		return "too large"
+	case DeclineUnwantedType:
+		return "unwanted file type"
+	case DeclineRejected:
+		return "rejected"
+	default:
+		return "unspecified"
+	}
+}
+
+// A share the receiver declined, returned by ReceiveOptions.Accept to decline a
+// share and given to the sender as its final progress error. It matches ErrDeclined.
+type DeclinedError struct {
+	Reason DeclineReason
+	// Explanation for the sender's user, may be empty
+	Message string
+}
+
+func (e *DeclinedError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Receiver declined the share (%v).", e.Reason)
+	}
+	return fmt.Sprintf("Receiver declined the share (%v). %v", e.Reason, e.Message)
+}
+
+func (e *DeclinedError) Is(target error) bool {
+	return target == ErrDeclined
+}
+
+// Error for a DECLINE message
+func declineMessageError(blob []byte, version uint8) error {
+	decline, err := protocol.DecodeDecline(blob, version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode decline message. %v", err)
+	}
+
+	return &DeclinedError{Reason: DeclineReason(decline.Reason), Message: decline.Message}
+}
+
+// Error for a CANCEL message
+func cancelMessageError(blob []byte) error {
+	_, reason, err := protocol.DecodeCancel(blob)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode cancel message. %v", err)
+	}
+
+	return fmt.Errorf("%w %v", ErrCancelled, reason)
+}
+
+// Error for an ERROR message
+func errorMessageError(blob []byte) error {
+	version, code, reason, versions, err := protocol.DecodeError(blob)
+
+	if err != nil {
+		return fmt.Errorf("Relay sent a malformed ERROR message.")
+	}
+
+	relayErr := &RelayError{Reason: reason, LowestVersion: versions.Lowest, HighestVersion: versions.Highest}
+
+	if version >= protocol.ErrorCodesVersion {
+		relayErr.err = errorCodes[code]
+		return relayErr
+	}
+
+	for _, known := range errorReasons {
+		if strings.HasPrefix(reason, known.prefix) {
+			relayErr.err = known.err
+			break
+		}
+	}
+
+	return relayErr
+}
+
+// Error for a connection the relay refused before the upgrade
+func refusedConnectionError(refused *websocket.HandshakeError) *RelayError {
+	relayErr := &RelayError{Reason: refused.Message, StatusCode: refused.StatusCode}
+
+	switch refused.StatusCode {
+	case http.StatusNotFound:
+		relayErr.err = ErrShareNotFound
+	case http.StatusGone:
+		relayErr.err = ErrShareExpired
+	case http.StatusConflict:
+		relayErr.err = ErrShareClaimed
+	case http.StatusBadRequest:
+		relayErr.err = ErrInvalidShareCode
+	case http.StatusTooManyRequests:
+		relayErr.err = ErrRateLimited
+	}
+
+	return relayErr
+}
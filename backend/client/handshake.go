@@ -0,0 +1,403 @@
+package client
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/billyedmoore/tube/internal/pake"
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/sas"
+	"github.com/billyedmoore/tube/internal/sharecode"
+	"github.com/billyedmoore/tube/internal/tubecrypto"
+)
+
+// Short authentication string both users compare to check the sender has the
+// receiver's key, see SendOptions.Verify. The words and the emoji are two ways
+// of showing the same check, users compare either.
+type ShortAuthenticationString struct {
+	// 4 words from the share code word list, for example "orbit lemon tiger sail"
+	Words string
+	// 6 emoji
+	Emoji string
+}
+
+func shortAuthenticationString(shareCode []byte, receiverPublicKey []byte, nonce []byte) ShortAuthenticationString {
+	digest := sas.Derive(shareCode, receiverPublicKey, nonce)
+	return ShortAuthenticationString{Words: sas.Words(digest), Emoji: sas.Emoji(digest)}
+}
+
+// Symbols of the PAKE secret, Crockford base32 so the secret is easy to read out
+const pakeSecretAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// 20 bits, each wrong guess costs an attacker a whole exchange with the sender
+const pakeSecretLength = 4
+
+func newPakeSecret() (string, error) {
+	randomBytes := make([]byte, pakeSecretLength)
+
+	_, err := rand.Read(randomBytes)
+
+	if err != nil {
+		return "", fmt.Errorf("Random bytes failed")
+	}
+
+	var secret strings.Builder
+
+	for _, b := range randomBytes {
+		secret.WriteByte(pakeSecretAlphabet[b&0x1F])
+	}
+
+	return secret.String(), nil
+}
+
+// Read a secret typed in by a user the way it was generated, ignoring case and
+// reading I and L as 1 and O as 0
+func normalisePakeSecret(secret string) string {
+	return strings.NewReplacer("I", "1", "L", "1", "O", "0").Replace(strings.ToUpper(strings.TrimSpace(secret)))
+}
+
+// Formats of share code text the relay may use. A receiver joining with a code
+// only has its text, the 5 bytes PAKE and the short authentication string are
+// bound to are found by parsing it. Shares on a relay with a format of its own
+// can't use either.
+var shareCodeFormats = []sharecode.Generator{
+	sharecode.Base64{},
+	sharecode.Words{},
+	sharecode.Crockford{},
+	sharecode.Numeric{},
+}
+
+func parseShareCode(text ShareCode) ([]byte, error) {
+	for _, format := range shareCodeFormats {
+		shareCode, err := format.Parse(string(text))
+
+		if err == nil {
+			return shareCode[:], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Share code %q isn't in a format the client knows, PAKE and short authentication strings need its bytes.", text)
+}
+
+func (p *peer) sendPake(payload []byte) error {
+	blob, err := protocol.EncodePake(p.version, payload)
+
+	if err != nil {
+		return err
+	}
+
+	return p.send(blob)
+}
+
+// Tell the other peer the short authentication strings differ, the relay closes
+// the share once it has forwarded KEY_MISMATCH
+func (p *peer) sendKeyMismatch() {
+	blob, err := protocol.EncodeKeyMismatch(p.version)
+
+	if err == nil && p.send(blob) == nil {
+		p.waitForClose()
+	}
+}
+
+// Whether the relay forwarded a KEY_MISMATCH before closing the connection, a
+// failed send may be noticed before it is read
+func (p *peer) queuedKeyMismatch() bool {
+	for {
+		blob, err := p.next(closeTimeout)
+
+		if err != nil {
+			return false
+		}
+
+		if opcodeOf(blob) == protocol.KEY_MISMATCH {
+			return true
+		}
+	}
+}
+
+// Agree the content key with the receiver by running SPAKE2 over PAKE messages,
+// returns the cipher and the key header
+func (s *sender) agreeContentKey() (*tubecrypto.Cipher, []byte, error) {
+	exchange, err := pake.New(pake.Sender, pake.TubeIdentities, []byte(s.pakeSecret), s.shareCode, s.shareCode)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.sendPake(exchange.Message())
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the receiver replies with its message then its key confirmation
+	var replies [2][]byte
+
+	for i := range replies {
+		blob, err := s.next(messageTimeout)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if opcodeOf(blob) != protocol.PAKE {
+			return nil, nil, fmt.Errorf("Unexpected %v message from the relay.", opcodeOf(blob))
+		}
+
+		replies[i], err = protocol.DecodePake(blob, s.version)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to decode pake message. %v", err)
+		}
+	}
+
+	confirmation, err := exchange.Finish(replies[0])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := exchange.Verify(replies[1])
+
+	if err != nil {
+		return nil, nil, ErrWrongSecret
+	}
+
+	err = s.sendPake(confirmation)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return derivedContentKey(key, s.shareCode)
+}
+
+func derivedContentKey(key []byte, shareCode []byte) (*tubecrypto.Cipher, []byte, error) {
+	contentKey, err := tubecrypto.DeriveContentKey(key, shareCode)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyHeader, err := tubecrypto.EncodeKeyHeader(tubecrypto.KeyDerived, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipher, err := tubecrypto.NewCipher(contentKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cipher, keyHeader, nil
+}
+
+// Ask the receiver to compare short authentication strings, the share carries on
+// once both users have confirmed they match. The VERIFY carries a nonce the
+// strings are derived from, sent only now the relay has committed to a key.
+func (s *sender) verifyReceiverKey(receiverPublicKey []byte) error {
+	nonce := make([]byte, sas.NonceLength)
+
+	_, err := rand.Read(nonce)
+
+	if err != nil {
+		return fmt.Errorf("Random bytes failed")
+	}
+
+	blob, err := protocol.EncodeVerify(s.version, nonce)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.send(blob)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.verify(shortAuthenticationString(s.shareCode, receiverPublicKey, nonce))
+
+	if err != nil {
+		s.sendKeyMismatch()
+		return err
+	}
+
+	// the receiver's user may still be comparing, the relay limits the handshake
+	blob, err = s.next(0)
+
+	if err != nil {
+		return err
+	}
+
+	switch opcodeOf(blob) {
+	case protocol.VERIFY:
+		_, err = protocol.DecodeVerify(blob, s.version)
+
+		if err != nil {
+			return fmt.Errorf("Failed to decode verify message. %v", err)
+		}
+
+		return nil
+	case protocol.KEY_MISMATCH:
+		return ErrKeyMismatch
+	default:
+		return fmt.Errorf("Unexpected %v message from the relay.", opcodeOf(blob))
+	}
+}
+
+// Answer the PAKE and VERIFY messages the sender sends between READY and the
+// MANIFEST, which is returned
+func (r *receiver) handshake() ([]byte, error) {
+	for {
+		// the sender's user may be comparing short authentication strings
+		blob, err := r.next(0)
+
+		if errors.Is(err, ErrPeerDisconnected) && r.exchange != nil && r.pakeKey == nil {
+			// the sender leaves when key confirmation fails
+			return nil, fmt.Errorf("%w The secret may be wrong.", err)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcodeOf(blob) {
+		case protocol.PAKE:
+			err = r.acceptPake(blob)
+		case protocol.VERIFY:
+			err = r.acceptVerify(blob)
+		case protocol.KEY_MISMATCH:
+			return nil, ErrKeyMismatch
+		default:
+			if r.pakeSecret != "" && r.pakeKey == nil {
+				return nil, fmt.Errorf("Sender didn't agree a key with PAKE, the share code shouldn't have a secret.")
+			}
+
+			return blob, nil
+		}
+
+		if err == errDisconnected && r.queuedKeyMismatch() {
+			return nil, ErrKeyMismatch
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reply to the sender's SPAKE2 message with the receiver's message and key
+// confirmation, then check the sender's key confirmation
+func (r *receiver) acceptPake(blob []byte) error {
+	payload, err := protocol.DecodePake(blob, r.version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode pake message. %v", err)
+	}
+
+	if r.pakeSecret == "" {
+		return fmt.Errorf("Share uses PAKE key agreement, give the secret shown after the share code.")
+	}
+
+	if r.pakeKey != nil {
+		return fmt.Errorf("Unexpected %v message from the relay.", protocol.PAKE)
+	}
+
+	if r.exchange != nil {
+		r.pakeKey, err = r.exchange.Verify(payload)
+
+		if err != nil {
+			return ErrWrongSecret
+		}
+
+		return nil
+	}
+
+	shareCode, err := r.rawShareCode()
+
+	if err != nil {
+		return err
+	}
+
+	r.exchange, err = pake.New(pake.Receiver, pake.TubeIdentities, []byte(r.pakeSecret), shareCode, shareCode)
+
+	if err != nil {
+		return err
+	}
+
+	confirmation, err := r.exchange.Finish(payload)
+
+	if err != nil {
+		return err
+	}
+
+	err = r.sendPake(r.exchange.Message())
+
+	if err != nil {
+		return err
+	}
+
+	return r.sendPake(confirmation)
+}
+
+// Show the short authentication string derived with the sender's nonce, VERIFY
+// tells the sender the user confirmed it matches and KEY_MISMATCH that it doesn't
+func (r *receiver) acceptVerify(blob []byte) error {
+	nonce, err := protocol.DecodeVerify(blob, r.version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode verify message. %v", err)
+	}
+
+	if len(nonce) != sas.NonceLength {
+		return fmt.Errorf("Verify message should carry a %v byte nonce not %v bytes.", sas.NonceLength, len(nonce))
+	}
+
+	if r.options.Verify == nil {
+		return fmt.Errorf("Sender asked to compare short authentication strings, which needs ReceiveOptions.Verify.")
+	}
+
+	shareCode, err := r.rawShareCode()
+
+	if err != nil {
+		return err
+	}
+
+	err = r.options.Verify(shortAuthenticationString(shareCode, r.key.publicKey.Key, nonce))
+
+	if err != nil {
+		r.sendKeyMismatch()
+		return err
+	}
+
+	blob, err = protocol.EncodeVerify(r.version, nil)
+
+	if err != nil {
+		return err
+	}
+
+	return r.send(blob)
+}
+
+// The 5 bytes of the share code, parsed from the text the receiver joined with
+// unless the relay gave them when the share request was created
+func (r *receiver) rawShareCode() ([]byte, error) {
+	if r.shareCode != nil {
+		return r.shareCode, nil
+	}
+
+	shareCode, err := parseShareCode(r.shareCodeText)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.shareCode = shareCode
+
+	return shareCode, nil
+}
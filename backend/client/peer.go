@@ -0,0 +1,328 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// Versions spoken by the client, the payload format needs a MANIFEST
+var clientVersions = protocol.VersionRange{
+	Lowest:  protocol.IntroducedIn(protocol.MANIFEST),
+	Highest: protocol.HighestVersion,
+}
+
+// How long to wait for a message once both peers have joined, there is no limit
+// while waiting for the other peer to join or for a PIN
+const messageTimeout = 2 * time.Minute
+
+// How long to wait for the relay to close the connection after END
+const closeTimeout = 10 * time.Second
+
+// Waits between attempts to connect to the relay
+var connectRetryDelays = []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}
+
+// Waits between attempts to resume a share, the relay gives a disconnected peer 2 minutes
+var resumeRetryDelays = []time.Duration{
+	500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second,
+	8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second,
+}
+
+// Times a share is resumed before giving up, a relay accepting the resumption
+// and dropping the connection again would otherwise be retried forever
+const maxResumptions = 10
+
+// Returned by next and send when the connection to the relay is lost
+var errDisconnected = errors.New("Relay closed the connection.")
+
+// One side of a share, its connection to the relay can be replaced when the share is resumed
+type peer struct {
+	ctx        context.Context
+	server     string
+	connection *websocket.Connection
+	// Negotiated version, 0 until it is known
+	version uint8
+	// Highest version this peer and the relay support, 0 until the relay accepts the peer
+	relayVersion uint8
+	resumeToken  []byte
+	resumptions  int
+	// The 5 bytes of the share code, nil until the relay gives them (a receiver
+	// joining with a code is only given its text)
+	shareCode []byte
+	// Called with each STATUS the relay sends, from version 17, nil to ignore them
+	onStatus func(protocol.Status)
+}
+
+// URL of an endpoint of the relay at server, an http(s) or ws(s) URL
+func relayURL(server string, endpoint string, query url.Values) (string, error) {
+	u, err := url.Parse(server)
+
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("Invalid relay URL %q.", server)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + endpoint
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// A refused connection is worth retrying if the relay failed rather than refused it
+func isTransientRefusal(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError
+}
+
+// Connect to an endpoint of the relay, retrying after network errors and server errors
+func dial(ctx context.Context, server string, endpoint string, query url.Values, retryDelays []time.Duration) (*websocket.Connection, error) {
+	address, err := relayURL(server, endpoint, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		connection, err := websocket.Dial(address)
+
+		if err == nil {
+			return connection, nil
+		}
+
+		var refused *websocket.HandshakeError
+
+		if errors.As(err, &refused) {
+			err = refusedConnectionError(refused)
+
+			if !isTransientRefusal(refused.StatusCode) {
+				return nil, err
+			}
+		} else {
+			err = fmt.Errorf("Couldn't connect to the relay. %w", err)
+		}
+
+		if attempt >= len(retryDelays) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryDelays[attempt]):
+		}
+	}
+}
+
+func newPeer(ctx context.Context, server string, endpoint string, query url.Values) (*peer, error) {
+	connection, err := dial(ctx, server, endpoint, query, connectRetryDelays)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &peer{ctx: ctx, server: server, connection: connection}, nil
+}
+
+// Wait for the next message from the relay, an ERROR is returned as a *RelayError
+// and STATUS is passed to onStatus. A timeout of 0 waits until the connection
+// closes or the context is done.
+func (p *peer) next(timeout time.Duration) ([]byte, error) {
+	var expired <-chan time.Time
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case blob, ok := <-p.connection.Incoming:
+			if !ok {
+				return nil, errDisconnected
+			}
+
+			switch opcodeOf(blob) {
+			case protocol.ERROR:
+				return nil, errorMessageError(blob)
+			case protocol.CANCEL:
+				return nil, cancelMessageError(blob)
+			case protocol.STATUS:
+				p.acceptStatus(blob)
+				continue
+			}
+
+			return blob, nil
+		case <-expired:
+			return nil, fmt.Errorf("Relay sent nothing for %v.", timeout)
+		case <-p.ctx.Done():
+			return nil, p.ctx.Err()
+		}
+	}
+}
+
+// Pass a STATUS to onStatus, a malformed STATUS is ignored like one with an unknown event
+func (p *peer) acceptStatus(blob []byte) {
+	_, status, err := protocol.DecodeStatus(blob)
+
+	if err == nil && p.onStatus != nil {
+		p.onStatus(status)
+	}
+}
+
+func (p *peer) send(blob []byte) error {
+	err := websocket.SendBlobData(p.connection, blob)
+
+	if err != nil {
+		return errDisconnected
+	}
+
+	return nil
+}
+
+// Whether the share can be resumed if the connection drops, only while chunks are being relayed
+func (p *peer) canResume() bool {
+	// broadcast shares can't be resumed and are given an all zero token
+	return p.version >= protocol.IntroducedIn(protocol.RESUME) && len(p.resumeToken) == protocol.ResumeTokenLength &&
+		!bytes.Equal(p.resumeToken, make([]byte, protocol.ResumeTokenLength))
+}
+
+// Why the relay closed a connection that can't be resumed, a failed send may be
+// noticed before an ERROR the relay sent before closing the connection is read
+func (p *peer) closedReason() error {
+	for {
+		_, err := p.next(messageTimeout)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// An ERROR or CANCEL the relay sent before the connection dropped, messages
+// that have been received but not read are discarded
+func (p *peer) queuedReason() error {
+	for {
+		select {
+		case blob, ok := <-p.connection.Incoming:
+			if !ok {
+				return nil
+			}
+
+			switch opcodeOf(blob) {
+			case protocol.ERROR:
+				return errorMessageError(blob)
+			case protocol.CANCEL:
+				return cancelMessageError(blob)
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// Reconnect to the relay's resume endpoint after the connection dropped, the
+// relay sends RESUMED once every disconnected peer has resumed
+func (p *peer) resume() error {
+	if !p.canResume() {
+		return p.closedReason()
+	}
+
+	err := p.queuedReason()
+
+	if err != nil {
+		return err
+	}
+
+	if p.resumptions == maxResumptions {
+		return fmt.Errorf("%w Connection dropped %v times.", ErrResumeFailed, maxResumptions)
+	}
+
+	p.resumptions++
+
+	websocket.Close(p.connection)
+
+	connection, err := dial(p.ctx, p.server, "/resume", nil, resumeRetryDelays)
+
+	if err != nil {
+		return fmt.Errorf("%w %v", ErrResumeFailed, err)
+	}
+
+	resume, err := protocol.EncodeResume(p.version, p.resumeToken)
+
+	if err != nil {
+		websocket.Close(connection)
+		return err
+	}
+
+	p.connection = connection
+
+	return p.send(resume)
+}
+
+// Close the connection, from version 15 the other peer is sent CANCEL if the
+// share is closed because the context was cancelled
+func (p *peer) close() {
+	if p.ctx.Err() != nil {
+		p.sendCancel(context.Cause(p.ctx).Error())
+	}
+
+	websocket.Close(p.connection)
+}
+
+// Send CANCEL if the relay understands it, the connection is closed afterwards either way
+func (p *peer) sendCancel(reason string) {
+	version := p.version
+
+	if version == 0 {
+		version = p.relayVersion
+	}
+
+	if version < protocol.IntroducedIn(protocol.CANCEL) {
+		return
+	}
+
+	if len(reason) > protocol.MaxCancelReasonLength {
+		reason = strings.ToValidUTF8(reason[:protocol.MaxCancelReasonLength], "")
+	}
+
+	blob, err := protocol.EncodeCancel(version, reason)
+
+	if err == nil {
+		p.send(blob)
+	}
+}
+
+// Wait for the relay to close the connection once the share has finished
+func (p *peer) waitForClose() {
+	expired := time.After(closeTimeout)
+
+	for {
+		select {
+		case _, ok := <-p.connection.Incoming:
+			if !ok {
+				return
+			}
+		case <-expired:
+			websocket.Close(p.connection)
+			return
+		case <-p.ctx.Done():
+			// the share has finished so there is nothing to cancel
+			websocket.Close(p.connection)
+			return
+		}
+	}
+}
+
+func opcodeOf(blob []byte) protocol.Opcode {
+	if len(blob) == 0 {
+		return 0
+	}
+	return protocol.Opcode(blob[0])
+}
@@ -0,0 +1,676 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/billyedmoore/tube/internal/pake"
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/tubecrypto"
+)
+
+// Type of the key pair a receiver generates for a share
+type KeyType string
+
+const (
+	KeyTypeX25519 KeyType = "x25519"
+	KeyTypeP256   KeyType = "p256"
+	// Slow to generate but understood by senders before protocol version 10
+	KeyTypeRSA KeyType = "rsa"
+)
+
+type ReceiveOptions struct {
+	// PIN given to the first PIN challenge, may be empty
+	Pin string
+	// Asks for the PIN when Pin is empty or was incorrect, when nil Receive fails
+	// with ErrPinRequired or ErrIncorrectPin instead
+	AskForPin func(attemptsRemaining int) (string, error)
+	// Key pair type, X25519 when empty
+	KeyType KeyType
+	// Called with the share's metadata before any data is sent, an error declines
+	// the share and is returned by Receive. A *DeclinedError gives the sender its
+	// reason and message, any other error is sent as its text with DeclineUnspecified.
+	// Declining needs protocol version 14, before it the receiver just leaves.
+	Accept func(Metadata) error
+	// Called with the short authentication string when the sender asks the users
+	// to compare them, see SendOptions.Verify. Returning nil confirms they match,
+	// an error tells the sender they differ and is returned by Receive. When nil
+	// a share whose sender asks fails instead.
+	Verify func(ShortAuthenticationString) error
+}
+
+// A file of a share being received
+type FileInfo struct {
+	// Path relative to the directory the share is saved to with "/" separators,
+	// it has no empty, "." or ".." components
+	Name string
+	// 0 for the file of a streamed share
+	Size uint64
+}
+
+type Metadata struct {
+	// Files of the share in the order their contents are read
+	Files []FileInfo
+	// Whether the share is streamed, it has one file whose size is only known
+	// once the reader ends
+	Streamed bool
+}
+
+// Bytes in the share
+func (m Metadata) Size() uint64 {
+	var size uint64
+	for _, file := range m.Files {
+		size += file.Size
+	}
+	return size
+}
+
+// Receive a share with the default options, see ReceiveWithOptions
+func Receive(ctx context.Context, serverURL string, code ShareCode) (Metadata, io.ReadCloser, error) {
+	return ReceiveWithOptions(ctx, serverURL, code, ReceiveOptions{})
+}
+
+// Join the share with the code, returns once the sender has sent the share's
+// metadata. The code of a share using PAKE key agreement ends with a colon and
+// the secret, only the part before the colon is given to the relay. The contents of the files are read one after another from the
+// returned reader, each chunk is acknowledged once it has been read. Reading
+// fails if the share fails, closing the reader or cancelling the context cancels
+// the share.
+func ReceiveWithOptions(ctx context.Context, serverURL string, code ShareCode, options ReceiveOptions) (Metadata, io.ReadCloser, error) {
+	text, secret, usesPake := strings.Cut(string(code), ":")
+
+	var key receiverKeyPair
+	var err error
+
+	if usesPake {
+		key, err = unusedReceiverKey(options.KeyType)
+	} else {
+		key, err = generateReceiverKey(options.KeyType)
+	}
+
+	if err != nil {
+		return Metadata{}, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	p, err := newPeer(ctx, serverURL, "/receive", url.Values{"share_code": {text}})
+
+	if err != nil {
+		cancel()
+		return Metadata{}, nil, err
+	}
+
+	r := &receiver{peer: p, key: key, options: options, shareCodeText: ShareCode(text), pakeSecret: normalisePakeSecret(secret)}
+
+	err = r.initiate(receiverVersions(key))
+
+	if err != nil {
+		p.close()
+		cancel()
+		return Metadata{}, nil, err
+	}
+
+	return r.start(cancel)
+}
+
+// Wait to be accepted and for the manifest then start receiving the chunks,
+// cancel cancels the context of the receiver's peer
+func (r *receiver) start(cancel context.CancelFunc) (Metadata, io.ReadCloser, error) {
+	metadata, err := r.join()
+
+	if err != nil {
+		r.close()
+		cancel()
+		return Metadata{}, nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	r.output = pipeWriter
+
+	go r.run()
+
+	return metadata, &shareReader{PipeReader: pipeReader, cancel: cancel}, nil
+}
+
+type shareReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (s *shareReader) Close() error {
+	s.cancel()
+	return s.PipeReader.Close()
+}
+
+// The receiver's key pair, only one of the private keys is set
+type receiverKeyPair struct {
+	publicKey     protocol.ReceiverKey
+	rsaPrivateKey *rsa.PrivateKey
+	ecdhKey       *ecdh.PrivateKey
+}
+
+func generateReceiverKey(keyType KeyType) (receiverKeyPair, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		privateKey, err := tubecrypto.GenerateKeyPair()
+
+		if err != nil {
+			return receiverKeyPair{}, err
+		}
+
+		encoded, err := tubecrypto.EncodePublicKey(&privateKey.PublicKey)
+
+		if err != nil {
+			return receiverKeyPair{}, err
+		}
+
+		return receiverKeyPair{
+			publicKey:     protocol.ReceiverKey{KeyType: protocol.KeyTypeRsa4096, Key: encoded},
+			rsaPrivateKey: privateKey,
+		}, nil
+	case KeyTypeP256, KeyTypeX25519, "":
+		curve := tubecrypto.KeyTypeX25519
+
+		if keyType == KeyTypeP256 {
+			curve = tubecrypto.KeyTypeP256
+		}
+
+		privateKey, err := tubecrypto.GenerateECDHKey(curve)
+
+		if err != nil {
+			return receiverKeyPair{}, err
+		}
+
+		return receiverKeyPair{
+			publicKey: protocol.ReceiverKey{KeyType: uint8(curve), Key: privateKey.PublicKey().Bytes()},
+			ecdhKey:   privateKey,
+		}, nil
+	default:
+		return receiverKeyPair{}, fmt.Errorf("Unknown key type %q, use x25519, p256 or rsa.", keyType)
+	}
+}
+
+// With PAKE key agreement the receiver's public key is unused and sent as zeros,
+// no key pair is generated
+func unusedReceiverKey(keyType KeyType) (receiverKeyPair, error) {
+	curve := tubecrypto.KeyTypeX25519
+
+	switch keyType {
+	case KeyTypeRSA:
+		curve = tubecrypto.KeyTypeRSA4096
+	case KeyTypeP256:
+		curve = tubecrypto.KeyTypeP256
+	case KeyTypeX25519, "":
+	default:
+		return receiverKeyPair{}, fmt.Errorf("Unknown key type %q, use x25519, p256 or rsa.", keyType)
+	}
+
+	return receiverKeyPair{
+		publicKey: protocol.ReceiverKey{KeyType: uint8(curve), Key: make([]byte, curve.PublicKeyLength())},
+	}, nil
+}
+
+// Versions a receiver with the key can join shares at
+func receiverVersions(key receiverKeyPair) protocol.VersionRange {
+	versions := clientVersions
+
+	if key.publicKey.KeyType != protocol.KeyTypeRsa4096 {
+		versions.Lowest = max(versions.Lowest, protocol.KeyTypesVersion)
+	}
+
+	return versions
+}
+
+// Whether a path from a manifest is relative with no empty, "." or ".." components
+func isValidPath(path string) bool {
+	if path == "" || !utf8.ValidString(path) || strings.ContainsRune(path, 0) {
+		return false
+	}
+
+	for _, component := range strings.Split(path, "/") {
+		if component == "" || component == "." || component == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A share being received
+type receiver struct {
+	*peer
+	key     receiverKeyPair
+	options ReceiveOptions
+	cipher  *tubecrypto.Cipher
+	output  *io.PipeWriter
+	// Digest of the chunks received so far, checked against END from version 11
+	digest hash.Hash
+
+	// Text of the share code joined with, empty for a share request
+	shareCodeText ShareCode
+	// Secret given after the share code of a share using PAKE key agreement, the
+	// exchange and the key it agreed once the sender starts it
+	pakeSecret string
+	exchange   *pake.Exchange
+	pakeKey    []byte
+
+	files               []FileInfo
+	fileChunkBoundaries []uint32
+	// A streamed share has StreamedNumberOfChunks chunks until END
+	streamed    bool
+	totalChunks uint32
+	// Next chunk to write and bytes written of each file
+	expected uint32
+	written  []uint64
+}
+
+// Send RECEIVER_INITIATION with the receiver's public key
+func (r *receiver) initiate(versions protocol.VersionRange) error {
+	initiation, err := protocol.EncodeReceiverInitiation(versions, r.key.publicKey)
+
+	if err != nil {
+		return err
+	}
+
+	return r.send(initiation)
+}
+
+// Join the share once initiated and acknowledge its manifest
+func (r *receiver) join() (Metadata, error) {
+	err := r.answerPinChallenges()
+
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	blob, err := r.handshake()
+
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	manifest, err := protocol.DecodeManifest(blob, r.version)
+
+	if err != nil {
+		return Metadata{}, fmt.Errorf("Failed to decode manifest message. %v", err)
+	}
+
+	err = r.openManifest(manifest)
+
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	metadata := Metadata{Files: r.files, Streamed: r.streamed}
+
+	if r.options.Accept != nil {
+		err = r.options.Accept(metadata)
+
+		if err != nil {
+			return Metadata{}, r.decline(err)
+		}
+	}
+
+	err = r.send(protocol.EncodeMetadataAcknowledge(r.version))
+
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return metadata, nil
+}
+
+// Send DECLINE for the error returned by Accept, returns it as a *DeclinedError
+func (r *receiver) decline(err error) error {
+	declined, ok := err.(*DeclinedError)
+
+	if !ok {
+		declined = &DeclinedError{Reason: DeclineUnspecified, Message: err.Error()}
+	}
+
+	if r.version < protocol.IntroducedIn(protocol.DECLINE) {
+		return declined
+	}
+
+	message := declined.Message
+
+	if len(message) > protocol.MaxDeclineMessageLength {
+		message = strings.ToValidUTF8(message[:protocol.MaxDeclineMessageLength], "")
+	}
+
+	blob, encodeErr := protocol.EncodeDecline(r.version, protocol.Decline{Reason: uint8(declined.Reason), Message: message})
+
+	if encodeErr != nil {
+		return fmt.Errorf("Failed to encode decline message. %v", encodeErr)
+	}
+
+	// the relay closes the share once it has forwarded DECLINE
+	if r.send(blob) == nil {
+		r.waitForClose()
+	}
+
+	return declined
+}
+
+// Answer PIN challenges until the relay accepts the receiver
+func (r *receiver) answerPinChallenges() error {
+	pin := r.options.Pin
+
+	for attempt := 0; ; attempt++ {
+		// the sender may wait for the receiver to answer
+		blob, err := r.next(0)
+
+		if err != nil {
+			return err
+		}
+
+		if opcodeOf(blob) != protocol.PIN_CHALLENGE {
+			version, resumeToken, err := protocol.DecodeReceiverAcceptance(blob)
+
+			if err != nil {
+				return fmt.Errorf("Failed to decode receiver acceptance message. %v", err)
+			}
+
+			r.version = version
+			r.resumeToken = resumeToken
+
+			return nil
+		}
+
+		// the challenge is sent at the negotiated version
+		version := blob[1]
+		pinSalt, nonce, attemptsRemaining, err := protocol.DecodePinChallenge(blob, version)
+
+		if err != nil {
+			return fmt.Errorf("Failed to decode pin challenge message. %v", err)
+		}
+
+		if pin == "" || attempt > 0 {
+			if r.options.AskForPin == nil && pin == "" {
+				return ErrPinRequired
+			}
+
+			if r.options.AskForPin == nil {
+				return ErrIncorrectPin
+			}
+
+			pin, err = r.options.AskForPin(int(attemptsRemaining))
+
+			if err != nil {
+				return err
+			}
+		}
+
+		verifier, err := protocol.PinVerifier(pin, pinSalt)
+
+		if err != nil {
+			return err
+		}
+
+		response, err := protocol.EncodePinResponse(version, protocol.PinProof(verifier, nonce))
+
+		if err != nil {
+			return err
+		}
+
+		err = r.send(response)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Find the content key of a broadcast share in the entry for this receiver, the
+// receiver doesn't know which entry is its own so every entry is tried
+func (r *receiver) openBroadcastKey(key []byte) ([]byte, error) {
+	entries, err := tubecrypto.DecodeKeyEntries(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		var contentKey []byte
+
+		if r.key.rsaPrivateKey != nil {
+			contentKey, err = tubecrypto.UnwrapContentKey(r.key.rsaPrivateKey, entry)
+		} else {
+			contentKey, err = tubecrypto.OpenContentKey(r.key.ecdhKey, entry)
+		}
+
+		if err == nil {
+			return contentKey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No key in the broadcast share was sealed for this receiver.")
+}
+
+// Recover the content key from the key header and open the paths of the files
+func (r *receiver) openManifest(manifest []protocol.ManifestEntry) error {
+	mode, headerKey, firstPath, err := tubecrypto.DecodeKeyHeader(manifest[0].Path)
+
+	if err != nil {
+		return err
+	}
+
+	var contentKey []byte
+
+	switch {
+	case mode == tubecrypto.KeyWrapped && r.key.rsaPrivateKey != nil:
+		contentKey, err = tubecrypto.UnwrapContentKey(r.key.rsaPrivateKey, headerKey)
+	case mode == tubecrypto.KeyAgreed && r.key.ecdhKey != nil:
+		contentKey, err = tubecrypto.ReceiveContentKey(r.key.ecdhKey, headerKey)
+	case mode == tubecrypto.KeyBroadcast:
+		contentKey, err = r.openBroadcastKey(headerKey)
+	case mode == tubecrypto.KeyDerived && r.pakeKey != nil:
+		contentKey, err = tubecrypto.DeriveContentKey(r.pakeKey, r.shareCode)
+	default:
+		return fmt.Errorf("Sender used key mode %#02x which doesn't match the receiver's key.", mode)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.cipher, err = tubecrypto.NewCipher(contentKey)
+
+	if err != nil {
+		return err
+	}
+
+	r.files = make([]FileInfo, len(manifest))
+
+	for i, entry := range manifest {
+		sealedPath := entry.Path
+
+		if i == 0 {
+			sealedPath = firstPath
+		}
+
+		path, err := r.cipher.OpenMetadata(uint16(i), 0, sealedPath)
+
+		if err != nil {
+			return fmt.Errorf("Path of file %v failed to decrypt. %v", i, err)
+		}
+
+		if !isValidPath(string(path)) {
+			return fmt.Errorf("Sender sent the path %q which is not a relative path.", path)
+		}
+
+		r.files[i] = FileInfo{Name: string(path), Size: entry.Size}
+	}
+
+	r.streamed = protocol.IsStreamed(manifest)
+
+	if r.streamed {
+		r.files[0].Size = 0
+	}
+
+	r.digest = tubecrypto.NewDigest()
+	r.fileChunkBoundaries = protocol.ChunkBoundaries(manifest)
+	r.totalChunks = r.fileChunkBoundaries[len(r.fileChunkBoundaries)-1]
+	r.written = make([]uint64, len(manifest))
+
+	return nil
+}
+
+func (r *receiver) run() {
+	err := r.transfer()
+
+	if err != nil {
+		r.close()
+		r.output.CloseWithError(err)
+		return
+	}
+
+	r.output.Close()
+	r.waitForClose()
+}
+
+// Receive chunks until END, resuming the share if the connection drops
+func (r *receiver) transfer() error {
+	for {
+		ended, err := r.step()
+
+		if err == errDisconnected {
+			err = r.resume()
+		}
+
+		if err != nil || ended {
+			return err
+		}
+	}
+}
+
+// Handle one message from the relay, returns whether it was the END
+func (r *receiver) step() (bool, error) {
+	blob, err := r.next(messageTimeout)
+
+	if err != nil {
+		return false, err
+	}
+
+	switch opcodeOf(blob) {
+	case protocol.DATA_CHUNK:
+		return false, r.acceptChunk(blob)
+	case protocol.RESUMED:
+		return false, r.acceptResumed(blob)
+	case protocol.END:
+		return true, r.acceptEnd(blob)
+	default:
+		return false, fmt.Errorf("Unexpected %v message from the relay.", opcodeOf(blob))
+	}
+}
+
+func (r *receiver) acceptChunk(blob []byte) error {
+	fileIndex, chunkNumber, payload, err := protocol.DecodeDataChunk(blob, r.version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode data chunk. %v", err)
+	}
+
+	// chunks in flight when the share was resumed are resent
+	if chunkNumber < r.expected {
+		return r.acknowledge(chunkNumber)
+	}
+
+	if chunkNumber != r.expected || int(fileIndex) != protocol.FileOfChunk(r.fileChunkBoundaries, chunkNumber) {
+		return fmt.Errorf("Received chunk %X of file %v, expected chunk %X.", chunkNumber, fileIndex, r.expected)
+	}
+
+	// chunks of a streamed share are never final, END says how many there are
+	final := !r.streamed && chunkNumber == r.totalChunks-1
+	plaintext, err := r.cipher.OpenChunk(fileIndex, chunkNumber, final, payload)
+
+	if err != nil {
+		return fmt.Errorf("Chunk %X failed to decrypt. %v", chunkNumber, err)
+	}
+
+	if !r.streamed && r.written[fileIndex]+uint64(len(plaintext)) > r.files[fileIndex].Size {
+		return fmt.Errorf("Sender sent more than the %v bytes of %v.", r.files[fileIndex].Size, r.files[fileIndex].Name)
+	}
+
+	// blocks until the chunk has been read
+	_, err = r.output.Write(plaintext)
+
+	if err != nil {
+		return err
+	}
+
+	r.digest.Write(plaintext)
+	r.written[fileIndex] += uint64(len(plaintext))
+	r.expected++
+
+	return r.acknowledge(chunkNumber)
+}
+
+func (r *receiver) acknowledge(chunkNumber uint32) error {
+	acknowledge, err := protocol.EncodeAcknowledge(r.version, chunkNumber)
+
+	if err != nil {
+		return err
+	}
+
+	return r.send(acknowledge)
+}
+
+// Chunks from the next chunk onwards are resent, any already written are skipped
+func (r *receiver) acceptResumed(blob []byte) error {
+	_, nextChunk, err := protocol.DecodeResumed(blob, r.version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode resumed message. %v", err)
+	}
+
+	if nextChunk > r.expected {
+		return fmt.Errorf("Relay resumed the share at chunk %X, chunk %X was never received.", nextChunk, r.expected)
+	}
+
+	return nil
+}
+
+func (r *receiver) acceptEnd(blob []byte) error {
+	numberOfChunks, sealedDigest, err := protocol.DecodeEnd(blob, r.version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode end message. %v", err)
+	}
+
+	if r.version >= protocol.StreamingVersion {
+		if numberOfChunks != r.expected {
+			return fmt.Errorf("Sender ended the share after %v chunks, %v were received.", numberOfChunks, r.expected)
+		}
+
+		err = r.cipher.OpenEnd(numberOfChunks, sealedDigest, r.digest.Sum(nil))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.streamed {
+		return nil
+	}
+
+	if r.expected != r.totalChunks {
+		return fmt.Errorf("Sender ended the share after %v of %v chunks.", r.expected, r.totalChunks)
+	}
+
+	for i, file := range r.files {
+		if r.written[i] != file.Size {
+			return fmt.Errorf("%v should be %v bytes, received %v.", file.Name, file.Size, r.written[i])
+		}
+	}
+
+	return nil
+}
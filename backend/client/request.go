@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+)
+
+// A share request created with Request, waiting for a sender to join with its code
+type ShareRequest struct {
+	// Code the sender gives to SendFilesTo
+	Code ShareCode
+	// When the request expires if no sender has joined
+	Expires time.Time
+
+	receiver *receiver
+	cancel   context.CancelFunc
+}
+
+// Create a share request, returns once the relay has given the share code. A
+// sender joins with the code and sends files to this receiver, call Wait to
+// receive them. Share requests need protocol version 12 and can't be protected
+// by a PIN. Cancelling the context cancels the request.
+func Request(ctx context.Context, serverURL string, options ReceiveOptions) (*ShareRequest, error) {
+	key, err := generateReceiverKey(options.KeyType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	p, err := newPeer(ctx, serverURL, "/receive", nil)
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	r := &receiver{peer: p, key: key, options: options}
+
+	versions := receiverVersions(key)
+	versions.Lowest = max(versions.Lowest, protocol.IntroducedIn(protocol.REQUEST_ACCEPTED))
+
+	request, err := r.request(versions)
+
+	if err != nil {
+		p.close()
+		cancel()
+		return nil, err
+	}
+
+	request.cancel = cancel
+
+	return request, nil
+}
+
+// Send RECEIVER_INITIATION without a share code and read REQUEST_ACCEPTED
+func (r *receiver) request(versions protocol.VersionRange) (*ShareRequest, error) {
+	err := r.initiate(versions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := r.next(messageTimeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	acceptance, err := protocol.DecodeRequestAcceptance(blob)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode request acceptance message. %v", err)
+	}
+
+	request := &ShareRequest{
+		Code:     ShareCode(acceptance.ShareCodeText),
+		Expires:  time.Now().Add(time.Duration(acceptance.TimeToLive) * time.Second),
+		receiver: r,
+	}
+
+	r.relayVersion = acceptance.Versions.Highest
+	r.shareCode = acceptance.ShareCode
+
+	if acceptance.ShareCodeText == "" {
+		request.Code = ShareCode(base64.StdEncoding.EncodeToString(acceptance.ShareCode))
+	}
+
+	return request, nil
+}
+
+// Wait for a sender to join and send the share's metadata, then receive the
+// share as ReceiveWithOptions does. The request fails with ErrShareExpired if
+// no sender joins before it expires.
+func (req *ShareRequest) Wait() (Metadata, io.ReadCloser, error) {
+	return req.receiver.start(req.cancel)
+}
+
+// Cancel the request, a sender that joins afterwards is refused
+func (req *ShareRequest) Close() {
+	req.cancel()
+	req.receiver.close()
+}
@@ -0,0 +1,565 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/tubecrypto"
+)
+
+// A share being sent once SENDER_ACCEPTED has been received
+type sender struct {
+	*peer
+	files    []File
+	manifest []protocol.ManifestEntry
+	progress chan Progress
+	cipher   *tubecrypto.Cipher
+	// Secret the content key is agreed from with PAKE, empty to use the receiver's key
+	pakeSecret string
+	// See SendOptions.Verify, nil when short authentication strings aren't compared
+	verify func(ShortAuthenticationString) error
+	// Digest of the chunks read so far, sent in END from version 11
+	digest hash.Hash
+
+	// A streamed share has StreamedNumberOfChunks chunks until its reader ends
+	streamed    bool
+	total       uint64
+	totalChunks uint32
+	windowSize  uint16
+	// Chunks sent and acknowledged, after a resumption sent is the next chunk the relay expects
+	sent         uint32
+	acknowledged uint32
+	// Sealed DATA_CHUNKs from acknowledged onwards, kept until they are
+	// acknowledged in case they must be resent after a resumption
+	inFlight [][]byte
+	// Chunks read from the files so far, only more than sent after a resumption
+	read uint32
+	// Bytes of plaintext up to and including each chunk, for progress
+	bytesThrough []uint64
+	// Position in the files
+	fileIndex int
+	fileRead  uint64
+	buffer    []byte
+	endSent   bool
+	// From the relay's STATUS messages while the share waits for receivers
+	receiversJoined int
+	receiversReady  int
+	expires         time.Time
+}
+
+func (s *sender) run() {
+	err := s.share()
+
+	if err != nil {
+		s.close()
+	} else {
+		s.waitForClose()
+	}
+
+	s.report(err)
+	close(s.progress)
+}
+
+// Send progress without blocking, an unread value is replaced so the final value always fits
+func (s *sender) report(err error) {
+	update := Progress{
+		Total:           s.total,
+		ReceiversJoined: s.receiversJoined,
+		ReceiversReady:  s.receiversReady,
+		Expires:         s.expires,
+		Err:             err,
+	}
+
+	if s.acknowledged > 0 {
+		update.Done = s.bytesThrough[s.acknowledged-1]
+	}
+
+	select {
+	case <-s.progress:
+	default:
+	}
+
+	s.progress <- update
+}
+
+// Record a STATUS from the relay and report it, events added to later versions are ignored
+func (s *sender) acceptStatus(status protocol.Status) {
+	switch status.Event {
+	case protocol.StatusPeerJoined:
+		s.receiversJoined = int(status.Value)
+	case protocol.StatusReceiverKey:
+		s.receiversReady = int(status.Value)
+	case protocol.StatusExpiring:
+		s.expires = time.Now().Add(time.Duration(status.Value) * time.Second)
+	default:
+		return
+	}
+
+	s.report(nil)
+}
+
+func (s *sender) share() error {
+	// the share waits for a receiver until it expires
+	blob, err := s.next(0)
+
+	if err != nil {
+		return err
+	}
+
+	var version uint8
+	var cipher *tubecrypto.Cipher
+	var keyHeader []byte
+
+	if opcodeOf(blob) == protocol.BROADCAST_READY {
+		ready, err := protocol.DecodeBroadcastReady(blob)
+
+		if err != nil {
+			return fmt.Errorf("Failed to decode broadcast ready message. %v", err)
+		}
+
+		version, s.windowSize = ready.Version, ready.WindowSize
+		s.version = version
+		cipher, keyHeader, err = broadcastContentKey(ready.ReceiverKeys)
+	} else {
+		var receiverKey protocol.ReceiverKey
+		version, receiverKey, s.windowSize, err = protocol.DecodeReady(blob)
+
+		if err != nil {
+			return fmt.Errorf("Failed to decode ready message. %v", err)
+		}
+
+		s.version = version
+
+		if s.pakeSecret != "" {
+			cipher, keyHeader, err = s.agreeContentKey()
+		} else {
+			cipher, keyHeader, err = sendContentKey(receiverKey)
+		}
+
+		if err == nil && s.verify != nil {
+			err = s.verifyReceiverKey(receiverKey.Key)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.cipher = cipher
+
+	for i, file := range s.files {
+		s.manifest[i].Path = cipher.SealMetadata(uint16(i), 0, []byte(file.Name))
+	}
+
+	s.manifest[0].Path = append(keyHeader, s.manifest[0].Path...)
+
+	blob, err = protocol.EncodeManifest(version, s.manifest)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.send(blob)
+
+	if err != nil {
+		return err
+	}
+
+	// from version 14 the receiver may be asking its user whether to accept the share
+	timeout := messageTimeout
+
+	if version >= protocol.IntroducedIn(protocol.DECLINE) {
+		timeout = 0
+	}
+
+	blob, err = s.next(timeout)
+
+	if err != nil {
+		return err
+	}
+
+	if opcodeOf(blob) == protocol.DECLINE {
+		return declineMessageError(blob, version)
+	}
+
+	err = protocol.DecodeMetadataAcknowledge(blob, version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode metadata acknowledgement. %v", err)
+	}
+
+	s.buffer = make([]byte, tubecrypto.ChunkSize)
+	s.digest = tubecrypto.NewDigest()
+
+	if !s.streamed {
+		s.bytesThrough = make([]uint64, 0, s.totalChunks)
+	}
+
+	return s.transfer()
+}
+
+// Send the chunks keeping at most windowSize unacknowledged then END, resuming
+// the share if the connection drops
+func (s *sender) transfer() error {
+	for {
+		err := s.step()
+
+		if err == errDisconnected && s.endSent {
+			// the relay closes the share once it has forwarded END
+			return nil
+		}
+
+		if err == errDisconnected {
+			err = s.resume()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Send what the window allows and handle one message from the relay
+func (s *sender) step() error {
+	err := s.fillWindow()
+
+	if err != nil {
+		return err
+	}
+
+	if s.acknowledged == s.totalChunks && !s.endSent {
+		err = s.sendEnd()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	blob, err := s.next(messageTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	switch opcodeOf(blob) {
+	case protocol.ACKNOWLEDGE:
+		return s.acceptAcknowledge(blob)
+	case protocol.RESUMED:
+		return s.acceptResumed(blob)
+	default:
+		return fmt.Errorf("Unexpected %v message from the relay.", opcodeOf(blob))
+	}
+}
+
+func (s *sender) sendEnd() error {
+	var sealedDigest []byte
+
+	if s.version >= protocol.StreamingVersion {
+		sealedDigest = s.cipher.SealEnd(s.totalChunks, s.digest.Sum(nil))
+	}
+
+	blob, err := protocol.EncodeEnd(s.version, s.totalChunks, sealedDigest)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.send(blob)
+
+	if err != nil {
+		return err
+	}
+
+	s.endSent = true
+
+	return nil
+}
+
+// Send chunks until the window is full or every chunk has been sent
+func (s *sender) fillWindow() error {
+	for s.sent < s.totalChunks && s.sent-s.acknowledged < uint32(s.windowSize) {
+		if s.sent == s.read {
+			err := s.readChunk()
+
+			if err != nil {
+				return err
+			}
+
+			// a streamed share ends when its reader does
+			if s.sent == s.totalChunks {
+				break
+			}
+		}
+
+		err := s.send(s.inFlight[s.sent-s.acknowledged])
+
+		if err != nil {
+			return err
+		}
+
+		s.sent++
+	}
+
+	return nil
+}
+
+// Read, seal and encode the next chunk of the share
+func (s *sender) readChunk() error {
+	if s.streamed {
+		return s.readStreamedChunk()
+	}
+
+	chunkNumber := s.read
+
+	// files without chunks are skipped
+	for s.fileIndex < len(s.files) && s.fileRead == s.manifest[s.fileIndex].Size {
+		s.fileIndex++
+		s.fileRead = 0
+	}
+
+	file := s.files[s.fileIndex]
+	length := min(uint64(tubecrypto.ChunkSize), s.manifest[s.fileIndex].Size-s.fileRead)
+
+	_, err := io.ReadFull(file.Contents, s.buffer[:length])
+
+	if err != nil {
+		return fmt.Errorf("%v ended before its %v bytes were read. %v", file.Name, file.Size, err)
+	}
+
+	s.fileRead += length
+
+	return s.sealChunk(s.buffer[:length], chunkNumber == s.totalChunks-1)
+}
+
+// Read the next chunk of a streamed share, when the reader has ended the number
+// of chunks becomes the chunks read
+func (s *sender) readStreamedChunk() error {
+	file := s.files[0]
+
+	if s.read == protocol.StreamedNumberOfChunks {
+		return fmt.Errorf("%v is too long to stream.", file.Name)
+	}
+
+	length, err := io.ReadFull(file.Contents, s.buffer)
+
+	if errors.Is(err, io.EOF) {
+		s.totalChunks = s.read
+
+		if s.read > 0 {
+			s.total = s.bytesThrough[s.read-1]
+		}
+
+		return nil
+	}
+
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("Failed to read %v. %v", file.Name, err)
+	}
+
+	// the final chunk isn't known when it is sealed, END carries the number of chunks
+	return s.sealChunk(s.buffer[:length], false)
+}
+
+// Seal and encode the plaintext of the next chunk, keeping it until it is acknowledged
+func (s *sender) sealChunk(plaintext []byte, final bool) error {
+	chunkNumber := s.read
+	payload := s.cipher.SealChunk(uint16(s.fileIndex), chunkNumber, final, plaintext)
+
+	blob, err := protocol.EncodeDataChunk(s.version, uint16(s.fileIndex), chunkNumber, payload)
+
+	if err != nil {
+		return err
+	}
+
+	s.digest.Write(plaintext)
+	s.inFlight = append(s.inFlight, blob)
+
+	previous := uint64(0)
+
+	if chunkNumber > 0 {
+		previous = s.bytesThrough[chunkNumber-1]
+	}
+
+	s.bytesThrough = append(s.bytesThrough, previous+uint64(len(plaintext)))
+	s.read++
+
+	return nil
+}
+
+// Drop in flight chunks below acknowledged
+func (s *sender) setAcknowledged(acknowledged uint32) {
+	s.inFlight = s.inFlight[acknowledged-s.acknowledged:]
+	s.acknowledged = acknowledged
+	s.report(nil)
+}
+
+func (s *sender) acceptAcknowledge(blob []byte) error {
+	chunkNumber, err := protocol.DecodeAcknowledge(blob, s.version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode acknowledgement. %v", err)
+	}
+
+	if chunkNumber < s.acknowledged || chunkNumber >= s.sent {
+		return fmt.Errorf("Received acknowledgement for chunk %X which is not awaiting acknowledgement.", chunkNumber)
+	}
+
+	s.setAcknowledged(chunkNumber + 1)
+
+	return nil
+}
+
+// Carry on from the chunks the relay says were acknowledged and sent, the
+// RESUMED is echoed so the relay knows later chunks were sent after it
+func (s *sender) acceptResumed(blob []byte) error {
+	acknowledged, nextChunk, err := protocol.DecodeResumed(blob, s.version)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decode resumed message. %v", err)
+	}
+
+	if acknowledged < s.acknowledged || acknowledged > nextChunk || nextChunk > s.sent {
+		return fmt.Errorf("Relay resumed the share at chunk %X, chunks %X to %X are in flight.", nextChunk, s.acknowledged, s.sent)
+	}
+
+	s.setAcknowledged(acknowledged)
+	s.sent = nextChunk
+
+	err = s.send(blob)
+
+	if err != nil {
+		return err
+	}
+
+	// END is resent if the relay didn't forward it
+	s.endSent = false
+
+	return nil
+}
+
+// Agree a content key for the receiver's public key, returns the cipher and the key header
+func sendContentKey(receiverKey protocol.ReceiverKey) (*tubecrypto.Cipher, []byte, error) {
+	var contentKey []byte
+	var keyHeader []byte
+
+	keyType := tubecrypto.KeyType(receiverKey.KeyType)
+
+	if keyType == tubecrypto.KeyTypeRSA4096 {
+		publicKey, err := tubecrypto.DecodePublicKey(receiverKey.Key)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		contentKey, err = tubecrypto.NewContentKey()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		wrappedKey, err := tubecrypto.WrapContentKey(publicKey, contentKey)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keyHeader, err = tubecrypto.EncodeKeyHeader(tubecrypto.KeyWrapped, wrappedKey)
+
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		publicKey, err := tubecrypto.DecodeECDHPublicKey(keyType, receiverKey.Key)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var ephemeralPublicKey []byte
+		contentKey, ephemeralPublicKey, err = tubecrypto.AgreeContentKey(publicKey)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keyHeader, err = tubecrypto.EncodeKeyHeader(tubecrypto.KeyAgreed, ephemeralPublicKey)
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cipher, err := tubecrypto.NewCipher(contentKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cipher, keyHeader, nil
+}
+
+// Give a new content key to every receiver of a broadcast share, wrapped for RSA
+// receivers and sealed for ECDH receivers. Returns the cipher and the key header.
+func broadcastContentKey(receiverKeys []protocol.ReceiverKey) (*tubecrypto.Cipher, []byte, error) {
+	contentKey, err := tubecrypto.NewContentKey()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([][]byte, len(receiverKeys))
+
+	for i, receiverKey := range receiverKeys {
+		keyType := tubecrypto.KeyType(receiverKey.KeyType)
+
+		if keyType == tubecrypto.KeyTypeRSA4096 {
+			publicKey, err := tubecrypto.DecodePublicKey(receiverKey.Key)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			entries[i], err = tubecrypto.WrapContentKey(publicKey, contentKey)
+
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			publicKey, err := tubecrypto.DecodeECDHPublicKey(keyType, receiverKey.Key)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			entries[i], err = tubecrypto.SealContentKey(publicKey, contentKey)
+
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	key, err := tubecrypto.EncodeKeyEntries(entries)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyHeader, err := tubecrypto.EncodeKeyHeader(tubecrypto.KeyBroadcast, key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipher, err := tubecrypto.NewCipher(contentKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cipher, keyHeader, nil
+}
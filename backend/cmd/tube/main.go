@@ -0,0 +1,259 @@
+// Command tube sends and receives files through a tube relay from a terminal,
+// using the same end to end encryption as the browser client.
+//
+//	tube send FILE... --server URL [--pin PIN | --to CODE | --receivers N] [--pake] [--verify]
+//	tube send - --server URL [--name NAME] [--pin PIN | --to CODE | --receivers N] [--pake]
+//	tube receive CODE --server URL [-o DIR|-] [--pin PIN] [--key-type x25519|p256|rsa]
+//	tube receive --request --server URL [-o DIR|-] [--key-type x25519|p256|rsa]
+//
+// "tube send -" streams stdin until it ends and "tube receive -o -" writes the
+// share to stdout, so tube can be used in a pipeline. "tube receive --request"
+// prints a code a sender gives to "tube send --to" to send files to it.
+// "tube send --receivers N" lets up to N receivers join with the same code.
+// "tube send --pake" agrees the share's key from a secret printed after the
+// share code and "tube send --verify" asks both users to compare a short
+// authentication string, either stops a relay swapping in its own key. The
+// relay URL may also be set with the TUBE_SERVER environment variable.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+
+	"github.com/billyedmoore/tube/client"
+)
+
+const usage = `Usage:
+  tube send FILE... --server URL [--pin PIN | --to CODE | --receivers N] [--pake] [--verify]
+  tube send - --server URL [--name NAME] [--pin PIN | --to CODE | --receivers N] [--pake]
+  tube receive CODE --server URL [-o DIR|-] [--pin PIN] [--key-type x25519|p256|rsa]
+  tube receive --request --server URL [-o DIR|-] [--key-type x25519|p256|rsa]
+
+The relay URL may also be set with the TUBE_SERVER environment variable.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// interrupting cancels the share so the relay tells the other peer
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+
+	switch os.Args[1] {
+	case "send":
+		err = runSend(ctx, os.Args[2:])
+	case "receive":
+		err = runReceive(ctx, os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err == flag.ErrHelp {
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tube: %v\n", err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+// Flags shared by send and receive
+type commonFlags struct {
+	server  string
+	pin     string
+	verbose bool
+}
+
+func addCommonFlags(flags *flag.FlagSet, common *commonFlags) {
+	flags.StringVar(&common.server, "server", os.Getenv("TUBE_SERVER"), "URL of the relay, defaults to $TUBE_SERVER")
+	flags.StringVar(&common.pin, "pin", "", "PIN protecting the share")
+	flags.BoolVar(&common.verbose, "verbose", false, "log why connections to the relay were closed")
+}
+
+// Parse flags given before, between or after the positional arguments, returns
+// the positional arguments
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		err := flags.Parse(args)
+
+		if err != nil {
+			return nil, err
+		}
+
+		args = flags.Args()
+
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func setUp(common commonFlags) error {
+	// the websocket package logs failed reads and the messages it refused with
+	// log.Printf, which only helps when debugging a connection to the relay
+	if !common.verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	if common.server == "" {
+		return fmt.Errorf("No relay given, use --server URL or set TUBE_SERVER.")
+	}
+
+	return nil
+}
+
+func runSend(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("tube send", flag.ContinueOnError)
+	var common commonFlags
+	addCommonFlags(flags, &common)
+	streamName := flags.String("name", "stdin", "name the receiver saves a share streamed from stdin as")
+	to := flags.String("to", "", "code of a share request to send the files to")
+	receivers := flags.Int("receivers", 1, "receivers that may join, the share starts once they have all joined or it expires")
+	usePake := flags.Bool("pake", false, "agree the share's key from a secret printed after the share code")
+	verify := flags.Bool("verify", false, "compare a short authentication string with the receiver before sending")
+
+	paths, err := parseArgs(flags, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 {
+		return fmt.Errorf("No files given.\n\n%s", usage)
+	}
+
+	if *receivers < 1 || (*receivers > 1 && (*to != "" || common.pin != "")) {
+		return fmt.Errorf("--receivers must be at least 1 and can't be used with --to or --pin.\n\n%s", usage)
+	}
+
+	if (*usePake && *to != "") || (*receivers > 1 && (*usePake || *verify)) {
+		return fmt.Errorf("--pake can't be used with --to or --receivers, --verify can't be used with --receivers.\n\n%s", usage)
+	}
+
+	var stdin io.Reader
+
+	if slices.Contains(paths, "-") {
+		if len(paths) != 1 {
+			return fmt.Errorf("Stdin can't be sent with other files.")
+		}
+
+		if *verify {
+			return fmt.Errorf("--verify asks for confirmation on stdin, which can't also be sent.")
+		}
+
+		stdin = os.Stdin
+	}
+
+	err = setUp(common)
+
+	if err != nil {
+		return err
+	}
+
+	var askToVerify func(client.ShortAuthenticationString) error
+
+	if *verify {
+		askToVerify = promptToVerify
+	}
+
+	return send(ctx, sendOptions{
+		server:     common.server,
+		paths:      paths,
+		stdin:      stdin,
+		streamName: *streamName,
+		pin:        common.pin,
+		to:         *to,
+		receivers:  *receivers,
+		pake:       *usePake,
+		verify:     askToVerify,
+		onShareCode: func(shareCode string) {
+			fmt.Println(shareCode)
+			fmt.Fprintf(os.Stderr, "Waiting for a receiver, run: tube receive '%s'\n", shareCode)
+		},
+		progress: terminalOrNil(os.Stderr),
+	})
+}
+
+func runReceive(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("tube receive", flag.ContinueOnError)
+	var common commonFlags
+	addCommonFlags(flags, &common)
+	outputDirectory := flags.String("o", ".", "directory to write the received files to, - for stdout")
+	keyType := flags.String("key-type", "x25519", "receiver key type, x25519, p256 or rsa (slow to generate)")
+	request := flags.Bool("request", false, "create a share request and print its code for a sender")
+
+	codes, err := parseArgs(flags, args)
+
+	if err != nil {
+		return err
+	}
+
+	if *request {
+		if len(codes) != 0 {
+			return fmt.Errorf("A share request doesn't take a share code.\n\n%s", usage)
+		}
+
+		// an empty share code creates a share request
+		codes = []string{""}
+	}
+
+	if len(codes) != 1 {
+		return fmt.Errorf("Expected one share code got %v.\n\n%s", len(codes), usage)
+	}
+
+	err = setUp(common)
+
+	if err != nil {
+		return err
+	}
+
+	var stdout io.Writer
+
+	if *outputDirectory == "-" {
+		stdout = os.Stdout
+	}
+
+	return receive(ctx, receiveOptions{
+		server:          common.server,
+		shareCode:       codes[0],
+		outputDirectory: *outputDirectory,
+		stdout:          stdout,
+		keyType:         *keyType,
+		pin:             common.pin,
+		askForPin:       promptForPin,
+		verify:          promptToVerify,
+		onShareCode: func(shareCode string) {
+			// the share is written to stdout with -o -
+			if stdout == nil {
+				fmt.Println(shareCode)
+			}
+			fmt.Fprintf(os.Stderr, "Waiting for a sender, run: tube send FILE... --to '%s'\n", shareCode)
+		},
+		onReceived: func(path string) {
+			fmt.Println(path)
+		},
+		progress: terminalOrNil(os.Stderr),
+	})
+}
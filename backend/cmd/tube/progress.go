@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/billyedmoore/tube/client"
+)
+
+// Width of the bar in characters
+const progressBarWidth = 30
+
+// Shortest time between redraws of the bar
+const progressRedrawInterval = 100 * time.Millisecond
+
+// A progress bar redrawn in place on a terminal, a nil output draws nothing
+type progressBar struct {
+	output   io.Writer
+	label    string
+	total    uint64
+	done     uint64
+	started  time.Time
+	lastDraw time.Time
+	// Set while the total of a streamed share isn't known, only bytes and rate are drawn
+	unknownTotal bool
+}
+
+func newProgressBar(output io.Writer, label string, total uint64) *progressBar {
+	return &progressBar{output: output, label: label, total: total, started: time.Now()}
+}
+
+func (bar *progressBar) set(done uint64) {
+	bar.done = done
+
+	if bar.output == nil || time.Since(bar.lastDraw) < progressRedrawInterval {
+		return
+	}
+
+	bar.draw()
+}
+
+// Draw the bar at its final value and move to the next line
+func (bar *progressBar) finish() {
+	if bar.output == nil {
+		return
+	}
+
+	bar.draw()
+	fmt.Fprintln(bar.output)
+}
+
+func (bar *progressBar) draw() {
+	bar.lastDraw = time.Now()
+
+	rate := float64(bar.done) / max(time.Since(bar.started).Seconds(), 0.001)
+
+	if bar.unknownTotal {
+		fmt.Fprintf(bar.output, "\r%v %v %v/s ", bar.label, formatBytes(bar.done), formatBytes(uint64(rate)))
+		return
+	}
+
+	fraction := 1.0
+
+	if bar.total > 0 {
+		fraction = float64(bar.done) / float64(bar.total)
+	}
+
+	filled := int(fraction * progressBarWidth)
+
+	fmt.Fprintf(bar.output, "\r%v [%v%v] %3.0f%% %v / %v %v/s ", bar.label,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		fraction*100, formatBytes(bar.done), formatBytes(bar.total), formatBytes(uint64(rate)))
+}
+
+// Size in bytes with a binary unit, 1.5 MiB
+func formatBytes(size uint64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%v B", size)
+	}
+
+	value := float64(size) / unit
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	i := 0
+
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %v", value, units[i])
+}
+
+// The file if it is a terminal, progress bars aren't drawn when output is redirected
+func terminalOrNil(file *os.File) io.Writer {
+	info, err := file.Stat()
+
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+
+	return file
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// Ask for the share's PIN on the terminal, the PIN is echoed as it is typed
+func promptForPin(attemptsRemaining int) (string, error) {
+	fmt.Fprintf(os.Stderr, "PIN (%v attempts remaining): ", attemptsRemaining)
+
+	line, err := stdin.ReadString('\n')
+
+	if err != nil && line == "" {
+		return "", fmt.Errorf("No PIN given.")
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+// Show the short authentication string and ask whether the other user sees the same
+func promptToVerify(sas client.ShortAuthenticationString) error {
+	fmt.Fprintf(os.Stderr, "Check the other screen shows: %v (%v)\nDo they match? [y/N] ", sas.Words, sas.Emoji)
+
+	line, _ := stdin.ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("Short authentication strings don't match, the relay may be reading the share.")
+	}
+
+	return nil
+}
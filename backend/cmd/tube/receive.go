@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/billyedmoore/tube/client"
+)
+
+type receiveOptions struct {
+	server string
+	// Share code to join, when empty a share request is created for a sender to join
+	shareCode string
+	// Called with the code of the share request once the relay has accepted it
+	onShareCode func(shareCode string)
+	// Directory the received files are written to, it must exist
+	outputDirectory string
+	// The contents of every file are written here instead of to outputDirectory when set
+	stdout io.Writer
+	// Key type of the receiver's key pair, x25519, p256 or rsa
+	keyType string
+	// PIN to answer the first PIN challenge with, may be empty
+	pin string
+	// Asks for the PIN when there is no pin or it was wrong, nil to fail instead
+	askForPin func(attemptsRemaining int) (string, error)
+	// Asks whether the users see the same short authentication string when the
+	// sender wants them compared, nil to fail instead
+	verify func(client.ShortAuthenticationString) error
+	// Called with the path of each file once the share has been received
+	onReceived func(path string)
+	// Where to draw the progress bar, nil for no progress bar
+	progress io.Writer
+}
+
+func receive(ctx context.Context, options receiveOptions) error {
+	if options.stdout == nil {
+		info, err := os.Stat(options.outputDirectory)
+
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("%v is not a directory.", options.outputDirectory)
+		}
+	}
+
+	metadata, contents, err := join(ctx, options)
+
+	if err != nil {
+		return err
+	}
+
+	defer contents.Close()
+
+	bar := newProgressBar(options.progress, "Receiving", metadata.Size())
+	bar.unknownTotal = metadata.Streamed
+	reader := &progressReader{reader: contents, bar: bar}
+
+	if options.stdout != nil {
+		_, err = io.Copy(options.stdout, reader)
+
+		if err == nil {
+			bar.unknownTotal = false
+			bar.total = reader.read
+			bar.finish()
+		}
+
+		return err
+	}
+
+	paths, err := writeFiles(options.outputDirectory, metadata, reader)
+
+	if err != nil {
+		// partially received files are removed
+		for _, path := range paths {
+			os.Remove(path)
+		}
+
+		return err
+	}
+
+	if options.onReceived != nil {
+		for _, path := range paths {
+			options.onReceived(path)
+		}
+	}
+
+	return nil
+}
+
+// Join the share with the code or create a share request and wait for a sender
+func join(ctx context.Context, options receiveOptions) (client.Metadata, io.ReadCloser, error) {
+	receiving := client.ReceiveOptions{
+		Pin:       options.pin,
+		AskForPin: options.askForPin,
+		KeyType:   client.KeyType(options.keyType),
+		Verify:    options.verify,
+	}
+
+	if options.shareCode != "" {
+		return client.ReceiveWithOptions(ctx, options.server, client.ShareCode(options.shareCode), receiving)
+	}
+
+	request, err := client.Request(ctx, options.server, receiving)
+
+	if err != nil {
+		return client.Metadata{}, nil, err
+	}
+
+	if options.onShareCode != nil {
+		options.onShareCode(string(request.Code))
+	}
+
+	return request.Wait()
+}
+
+// Write the files of the share, returns the paths of the files created even on failure
+func writeFiles(outputDirectory string, metadata client.Metadata, contents *progressReader) ([]string, error) {
+	var paths []string
+	var files []*os.File
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	// every file is created before any are written so existing files are found early
+	for _, received := range metadata.Files {
+		path, file, err := createFile(outputDirectory, received.Name)
+
+		if err != nil {
+			return paths, err
+		}
+
+		paths = append(paths, path)
+		files = append(files, file)
+	}
+
+	for i, received := range metadata.Files {
+		var err error
+
+		// a streamed share is one file which ends with the reader
+		if metadata.Streamed {
+			_, err = io.Copy(files[i], contents)
+		} else {
+			_, err = io.CopyN(files[i], contents, int64(received.Size))
+		}
+
+		if err != nil {
+			return paths, err
+		}
+	}
+
+	// the share has only been received intact once the reader ends
+	extra, err := io.Copy(io.Discard, contents)
+
+	if err == nil && extra != 0 {
+		err = fmt.Errorf("Sender sent %v bytes more than its files hold.", extra)
+	}
+
+	if err != nil {
+		return paths, err
+	}
+
+	contents.bar.unknownTotal = false
+	contents.bar.total = contents.read
+	contents.bar.finish()
+
+	return paths, nil
+}
+
+// Create a file for a path from the share, paths leaving the output directory
+// are rejected and existing files are never overwritten
+func createFile(outputDirectory string, path string) (string, *os.File, error) {
+	local := filepath.FromSlash(path)
+
+	if !filepath.IsLocal(local) {
+		return "", nil, fmt.Errorf("Sender sent the path %q which is outside the output directory.", path)
+	}
+
+	fullPath := filepath.Join(outputDirectory, local)
+
+	err := os.MkdirAll(filepath.Dir(fullPath), 0o755)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return fullPath, file, nil
+}
+
+// Advances a progress bar as the share is read
+type progressReader struct {
+	reader io.Reader
+	bar    *progressBar
+	read   uint64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += uint64(n)
+	r.bar.set(r.read)
+	return n, err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/billyedmoore/tube/client"
+)
+
+type sendOptions struct {
+	server string
+	// Files to send, each is sent under its base name
+	paths []string
+	// Streamed as a file named streamName instead of sending paths when set
+	stdin      io.Reader
+	streamName string
+	// PIN the receiver must give, empty for no PIN
+	pin string
+	// Code of a share request to send to instead of creating a share
+	to string
+	// Receivers that may join, more than 1 makes a broadcast share
+	receivers int
+	// Whether the key is agreed with PAKE, the secret is printed after the share code
+	pake bool
+	// Asks whether the users see the same short authentication string, nil not to compare them
+	verify func(client.ShortAuthenticationString) error
+	// Called with the share code once the relay has accepted the share
+	onShareCode func(shareCode string)
+	// Where to draw the progress bar, nil for no progress bar
+	progress io.Writer
+}
+
+func send(ctx context.Context, options sendOptions) error {
+	files, err := outgoingFiles(options)
+	defer closeFiles(files)
+
+	if err != nil {
+		return err
+	}
+
+	var shareCode client.ShareCode
+	var progress <-chan client.Progress
+
+	sending := client.SendOptions{Pin: options.pin, Pake: options.pake, Verify: options.verify}
+
+	if options.to != "" {
+		progress, err = client.SendFilesTo(ctx, options.server, client.ShareCode(options.to), files, sending)
+	} else {
+		sending.Receivers = options.receivers
+		shareCode, progress, err = client.SendFiles(ctx, options.server, files, sending)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if options.onShareCode != nil && options.to == "" {
+		options.onShareCode(string(shareCode))
+	}
+
+	var bar *progressBar
+	var final, waiting client.Progress
+
+	for final = range progress {
+		if bar == nil && options.progress != nil {
+			reportWaiting(options.progress, waiting, final, options.receivers)
+			waiting = final
+		}
+
+		if bar == nil && final.Done > 0 {
+			bar = newProgressBar(options.progress, "Sending", final.Total)
+			bar.unknownTotal = options.stdin != nil
+		}
+
+		if bar != nil {
+			bar.total = final.Total
+			bar.set(final.Done)
+		}
+	}
+
+	if bar != nil && final.Err == nil {
+		bar.unknownTotal = false
+		bar.finish()
+	}
+
+	return final.Err
+}
+
+// Print what changed while the share waits for its receivers, the relay reports it from version 17
+func reportWaiting(output io.Writer, last client.Progress, update client.Progress, receivers int) {
+	if receivers > 1 && update.ReceiversReady != last.ReceiversReady {
+		fmt.Fprintf(output, "%v of %v receivers ready\n", update.ReceiversReady, receivers)
+	}
+
+	if !update.Expires.IsZero() && last.Expires.IsZero() {
+		fmt.Fprintf(output, "Share stops waiting for receivers at %v.\n", update.Expires.Format(time.TimeOnly))
+	}
+}
+
+// Open the files of the share, files opened before an error are returned with it
+func outgoingFiles(options sendOptions) ([]client.File, error) {
+	if options.stdin != nil {
+		return []client.File{{Name: options.streamName, Contents: options.stdin, Size: client.UnknownSize}}, nil
+	}
+
+	var files []client.File
+
+	for _, path := range options.paths {
+		f, err := os.Open(path)
+
+		if err != nil {
+			return files, err
+		}
+
+		files = append(files, client.File{Name: filepath.Base(path), Contents: f})
+
+		info, err := f.Stat()
+
+		if err != nil {
+			return files, err
+		}
+
+		if !info.Mode().IsRegular() {
+			return files, fmt.Errorf("%v is not a regular file.", path)
+		}
+
+		files[len(files)-1].Size = info.Size()
+	}
+
+	return files, nil
+}
+
+func closeFiles(files []client.File) {
+	for _, file := range files {
+		if closer, ok := file.Contents.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billyedmoore/tube/client"
+	"github.com/billyedmoore/tube/internal/server"
+)
+
+// Send files through a relay and receive them, returns the directory they were received to
+func sendAndReceive(t *testing.T, paths []string, sendPin string, options receiveOptions) (string, error) {
+	return sendAndReceiveWith(t, sendOptions{paths: paths, pin: sendPin}, options)
+}
+
+// Send with the options through a relay and receive, returns the directory the files were received to
+func sendAndReceiveWith(t *testing.T, sending sendOptions, options receiveOptions) (string, error) {
+	relay := httptest.NewServer(server.NewServeMux(server.DefaultConfig()))
+	defer relay.Close()
+
+	shareCodes := make(chan string, 1)
+	sendErrors := make(chan error, 1)
+
+	sending.server = relay.URL
+	sending.onShareCode = func(shareCode string) { shareCodes <- shareCode }
+
+	go func() {
+		sendErrors <- send(context.Background(), sending)
+		close(shareCodes)
+	}()
+
+	shareCode, ok := <-shareCodes
+
+	if !ok {
+		t.Fatalf("Sender failed before a share code was given: %v", <-sendErrors)
+	}
+
+	options.server = relay.URL
+	options.shareCode = shareCode
+	options.outputDirectory = t.TempDir()
+
+	receiveErr := receive(context.Background(), options)
+	sendErr := <-sendErrors
+
+	if receiveErr == nil && sendErr != nil {
+		t.Errorf("Sender failed: %v", sendErr)
+	}
+
+	return options.outputDirectory, receiveErr
+}
+
+func writeRandomFile(t *testing.T, name string, size int) (string, []byte) {
+	contents := make([]byte, size)
+	rand.Read(contents)
+
+	path := filepath.Join(t.TempDir(), name)
+
+	err := os.WriteFile(path, contents, 0o644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, contents
+}
+
+func TestSendAndReceive(t *testing.T) {
+	// an empty file and files ending part way through and at the end of a chunk
+	first, firstContents := writeRandomFile(t, "first.bin", 200*1024)
+	empty, _ := writeRandomFile(t, "empty.txt", 0)
+	last, lastContents := writeRandomFile(t, "last.bin", 2*64*1024)
+
+	wanted := map[string][]byte{"first.bin": firstContents, "empty.txt": {}, "last.bin": lastContents}
+
+	for _, keyType := range []string{"x25519", "p256", "rsa"} {
+		directory, err := sendAndReceive(t, []string{first, empty, last}, "", receiveOptions{keyType: keyType})
+
+		if err != nil {
+			t.Errorf("Key type %v: %v", keyType, err)
+			continue
+		}
+
+		for name, contents := range wanted {
+			received, err := os.ReadFile(filepath.Join(directory, name))
+
+			if err != nil || !bytes.Equal(received, contents) {
+				t.Errorf("Key type %v: %v was not received intact (%v)", keyType, name, err)
+			}
+		}
+	}
+}
+
+func TestReceivePin(t *testing.T) {
+	path, contents := writeRandomFile(t, "secret.txt", 1000)
+
+	asked := 0
+	askForPin := func(attemptsRemaining int) (string, error) {
+		asked++
+		return "2468", nil
+	}
+
+	directory, err := sendAndReceive(t, []string{path}, "2468", receiveOptions{keyType: "x25519", pin: "1357", askForPin: askForPin})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := os.ReadFile(filepath.Join(directory, "secret.txt"))
+
+	if err != nil || !bytes.Equal(received, contents) || asked != 1 {
+		t.Errorf("File should be received after asking for the PIN once, asked %v times (%v)", asked, err)
+	}
+
+	// without a way to ask the receiver gives up and the partial file is never created
+	directory, err = sendAndReceive(t, []string{path}, "2468", receiveOptions{keyType: "x25519"})
+
+	if err == nil {
+		t.Errorf("Receiving without the PIN should fail")
+	}
+
+	entries, _ := os.ReadDir(directory)
+
+	if len(entries) != 0 {
+		t.Errorf("Failed share should leave no files, left %v", entries)
+	}
+}
+
+func TestStreamStdinToStdout(t *testing.T) {
+	contents := make([]byte, 200*1024)
+	rand.Read(contents)
+
+	var stdout bytes.Buffer
+
+	sending := sendOptions{stdin: bytes.NewReader(contents), streamName: "stdin"}
+	_, err := sendAndReceiveWith(t, sending, receiveOptions{keyType: "x25519", stdout: &stdout})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stdout.Bytes(), contents) {
+		t.Errorf("Stdin should be written to stdout intact, received %v of %v bytes", stdout.Len(), len(contents))
+	}
+
+	// without stdout the stream is saved under its name
+	directory, err := sendAndReceiveWith(t, sendOptions{stdin: bytes.NewReader(contents), streamName: "backup.tar"},
+		receiveOptions{keyType: "x25519"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := os.ReadFile(filepath.Join(directory, "backup.tar"))
+
+	if err != nil || !bytes.Equal(received, contents) {
+		t.Errorf("Stream should be saved as backup.tar (%v)", err)
+	}
+}
+
+func TestRequestAndSendTo(t *testing.T) {
+	relay := httptest.NewServer(server.NewServeMux(server.DefaultConfig()))
+	defer relay.Close()
+
+	path, contents := writeRandomFile(t, "requested.bin", 100*1024)
+
+	shareCodes := make(chan string, 1)
+	receiveErrors := make(chan error, 1)
+	directory := t.TempDir()
+
+	go func() {
+		receiveErrors <- receive(context.Background(), receiveOptions{
+			server:          relay.URL,
+			outputDirectory: directory,
+			keyType:         "x25519",
+			onShareCode:     func(shareCode string) { shareCodes <- shareCode },
+		})
+		close(shareCodes)
+	}()
+
+	shareCode, ok := <-shareCodes
+
+	if !ok {
+		t.Fatalf("Receiver failed before a share code was given: %v", <-receiveErrors)
+	}
+
+	err := send(context.Background(), sendOptions{server: relay.URL, paths: []string{path}, to: shareCode})
+
+	if err != nil {
+		t.Errorf("Sender failed: %v", err)
+	}
+
+	if err = <-receiveErrors; err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := os.ReadFile(filepath.Join(directory, "requested.bin"))
+
+	if err != nil || !bytes.Equal(received, contents) {
+		t.Errorf("Requested file was not received intact (%v)", err)
+	}
+}
+
+func TestPakeAndVerify(t *testing.T) {
+	path, contents := writeRandomFile(t, "agreed.bin", 100*1024)
+
+	var senderString, receiverString client.ShortAuthenticationString
+
+	sending := sendOptions{paths: []string{path}, pake: true, verify: func(s client.ShortAuthenticationString) error {
+		senderString = s
+		return nil
+	}}
+
+	directory, err := sendAndReceiveWith(t, sending, receiveOptions{keyType: "x25519", verify: func(s client.ShortAuthenticationString) error {
+		receiverString = s
+		return nil
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := os.ReadFile(filepath.Join(directory, "agreed.bin"))
+
+	if err != nil || !bytes.Equal(received, contents) {
+		t.Errorf("File should be received intact with a key agreed by PAKE (%v)", err)
+	}
+
+	if senderString.Words == "" || senderString != receiverString {
+		t.Errorf("Both users should be shown the same string, %+v and %+v", senderString, receiverString)
+	}
+}
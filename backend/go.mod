@@ -1,3 +1,10 @@
 module github.com/billyedmoore/tube
 
 go 1.24.0
+
+require (
+	filippo.io/bigmod v0.1.0
+	filippo.io/nistec v0.0.4
+)
+
+require golang.org/x/sys v0.36.0 // indirect
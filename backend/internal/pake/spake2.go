@@ -0,0 +1,329 @@
+// Package pake implements SPAKE2 (RFC 9382) over P-256 with SHA-256, HKDF-SHA256
+// and HMAC-SHA256 so a sender and receiver can agree a key from a short secret
+// the relay never sees. The relay only forwards the messages, it can't learn the
+// key or swap in its own without the key confirmation failing.
+package pake
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"filippo.io/bigmod"
+	"filippo.io/nistec"
+)
+
+type Role uint8
+
+const (
+	// Party A of RFC 9382, the sender of a share
+	Sender Role = iota
+	// Party B of RFC 9382, the receiver of a share
+	Receiver
+)
+
+// Identities of party A and party B, both are bound into the transcript
+type Identities struct {
+	Sender   string
+	Receiver string
+}
+
+// Identities tube's senders and receivers use
+var TubeIdentities = Identities{Sender: "tube sender", Receiver: "tube receiver"}
+
+// Length of the messages and confirmations exchanged
+const (
+	MessageLength      = 65 // uncompressed P-256 point
+	ConfirmationLength = sha256.Size
+	// Length of the key returned by Verify
+	KeyLength = sha256.Size / 2
+)
+
+// PBKDF2-HMAC-SHA256 iterations used to derive the password scalar
+const passwordIterations = 100_000
+
+// Scalars are reduced from this many bytes so the bias of the reduction is negligible
+const wideScalarLength = 40
+
+// The fixed points M and N for P-256 from RFC 9382
+var (
+	pointM = mustDecodePoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	pointN = mustDecodePoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+// The order of the P-256 group, and 2^320 + 1 which holds any wideScalarLength byte value
+var (
+	order       = mustDecodeModulus("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551")
+	wideModulus = mustDecodeModulus("01" + strings.Repeat("00", wideScalarLength-1) + "01")
+)
+
+func mustDecodePoint(compressed string) *nistec.P256Point {
+	encoded, err := hex.DecodeString(compressed)
+
+	if err != nil {
+		panic(err)
+	}
+
+	point, err := nistec.NewP256Point().SetBytes(encoded)
+
+	if err != nil {
+		panic(fmt.Sprintf("%v is not a P-256 point.", compressed))
+	}
+
+	return point
+}
+
+func mustDecodeModulus(value string) *bigmod.Modulus {
+	encoded, err := hex.DecodeString(value)
+
+	if err != nil {
+		panic(err)
+	}
+
+	modulus, err := bigmod.NewModulus(encoded)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return modulus
+}
+
+// One side of a SPAKE2 exchange, call Message and send the result to the peer,
+// pass the peer's message to Finish and send the returned confirmation, then pass
+// the peer's confirmation to Verify to get the shared key
+type Exchange struct {
+	role       Role
+	identities Identities
+	// additional authenticated data, both parties must use the same
+	aad []byte
+	// w and x (or y) from RFC 9382 as 32 big endian bytes
+	w        []byte
+	scalar   []byte
+	message  []byte
+	expected []byte
+	key      []byte
+}
+
+// Start an exchange. The password is the secret shared out of band, the
+// identities, salt and aad are public values both parties agree on (tube uses
+// TubeIdentities and the share code for both salt and aad).
+func New(role Role, identities Identities, password []byte, salt []byte, aad []byte) (*Exchange, error) {
+	w, err := passwordScalar(password, salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scalar, err := randomScalar()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newWithScalars(role, identities, w, scalar, aad), nil
+}
+
+func newWithScalars(role Role, identities Identities, w []byte, scalar []byte, aad []byte) *Exchange {
+	blinding := pointM
+	if role == Receiver {
+		blinding = pointN
+	}
+
+	// X = x*G + w*M for the sender, Y = y*G + w*N for the receiver
+	message := nistec.NewP256Point().Add(scalarBaseMult(scalar), scalarMult(blinding, w))
+
+	return &Exchange{
+		role:       role,
+		identities: identities,
+		aad:        aad,
+		w:          w,
+		scalar:     scalar,
+		message:    message.Bytes(),
+	}
+}
+
+// Message to send to the peer
+func (e *Exchange) Message() []byte {
+	return e.message
+}
+
+// Takes the peer's message and returns the key confirmation to send to the peer
+func (e *Exchange) Finish(peerMessage []byte) ([]byte, error) {
+	sharedPoint, err := e.sharedPoint(peerMessage)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageA, messageB := e.message, peerMessage
+	if e.role == Receiver {
+		messageA, messageB = peerMessage, e.message
+	}
+
+	transcript := transcript(e.identities, messageA, messageB, sharedPoint, e.w)
+	ke, confirmationKeyA, confirmationKeyB, err := keySchedule(transcript, e.aad)
+
+	if err != nil {
+		return nil, err
+	}
+
+	confirmationA := mac(confirmationKeyA, transcript)
+	confirmationB := mac(confirmationKeyB, transcript)
+
+	e.key = ke
+
+	if e.role == Sender {
+		e.expected = confirmationB
+		return confirmationA, nil
+	}
+
+	e.expected = confirmationA
+	return confirmationB, nil
+}
+
+// K from RFC 9382, x*(Y - w*N) for the sender and y*(X - w*M) for the receiver
+// (the cofactor is 1), fails for invalid messages and the identity
+func (e *Exchange) sharedPoint(peerMessage []byte) ([]byte, error) {
+	if len(peerMessage) != MessageLength {
+		return nil, fmt.Errorf("Message should be %v bytes is %v.", MessageLength, len(peerMessage))
+	}
+
+	// SetBytes checks the point is on the curve
+	peerPoint, err := nistec.NewP256Point().SetBytes(peerMessage)
+
+	if err != nil {
+		return nil, fmt.Errorf("Message is not a P-256 point.")
+	}
+
+	peerBlinding := pointN
+	if e.role == Receiver {
+		peerBlinding = pointM
+	}
+
+	unblinded := nistec.NewP256Point().Add(peerPoint, nistec.NewP256Point().Negate(scalarMult(peerBlinding, e.w)))
+	sharedPoint := scalarMult(unblinded, e.scalar)
+
+	if sharedPoint.IsInfinity() == 1 {
+		return nil, fmt.Errorf("Shared point is the identity.")
+	}
+
+	return sharedPoint.Bytes(), nil
+}
+
+// Ke and the confirmation keys KcA and KcB from the transcript, Hash(TT) is split
+// into Ke and Ka and the confirmation keys are derived from Ka with HKDF
+func keySchedule(transcript []byte, aad []byte) ([]byte, []byte, []byte, error) {
+	keys := sha256.Sum256(transcript)
+	ke, ka := keys[:KeyLength], keys[KeyLength:]
+
+	confirmationKeys, err := hkdf.Key(sha256.New, ka, nil, "ConfirmationKeys"+string(aad), 2*KeyLength)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return ke, confirmationKeys[:KeyLength], confirmationKeys[KeyLength:], nil
+}
+
+// Takes the peer's key confirmation and returns the shared key, fails if the
+// peer used a different password or the messages were tampered with
+func (e *Exchange) Verify(peerConfirmation []byte) ([]byte, error) {
+	if e.expected == nil {
+		return nil, fmt.Errorf("Finish must be called before Verify.")
+	}
+
+	if !hmac.Equal(peerConfirmation, e.expected) {
+		return nil, fmt.Errorf("Key confirmation failed, the secrets don't match.")
+	}
+
+	return e.key, nil
+}
+
+// TT from RFC 9382, each value prefixed with its length as 8 little endian bytes
+func transcript(identities Identities, messageA []byte, messageB []byte, sharedPoint []byte, w []byte) []byte {
+	var transcript []byte
+
+	for _, value := range [][]byte{[]byte(identities.Sender), []byte(identities.Receiver), messageA, messageB, sharedPoint, w} {
+		transcript = binary.LittleEndian.AppendUint64(transcript, uint64(len(value)))
+		transcript = append(transcript, value...)
+	}
+
+	return transcript
+}
+
+func mac(key []byte, message []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+// w from RFC 9382, the password stretched with PBKDF2 and reduced modulo the group order
+func passwordScalar(password []byte, salt []byte) ([]byte, error) {
+	stretched, err := pbkdf2.Key(sha256.New, string(password), salt, passwordIterations, wideScalarLength)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return reduceScalar(stretched), nil
+}
+
+func randomScalar() ([]byte, error) {
+	random := make([]byte, wideScalarLength)
+
+	for {
+		_, err := rand.Read(random)
+
+		if err != nil {
+			return nil, fmt.Errorf("Random bytes failed")
+		}
+
+		scalar := reduceScalar(random)
+
+		if subtle.ConstantTimeCompare(scalar, make([]byte, len(scalar))) == 0 {
+			return scalar, nil
+		}
+	}
+}
+
+// A big endian value of up to wideScalarLength bytes modulo the group order as
+// 32 big endian bytes, in constant time
+func reduceScalar(value []byte) []byte {
+	wide, err := bigmod.NewNat().SetBytes(value, wideModulus)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return bigmod.NewNat().Mod(wide, order).Bytes(order)
+}
+
+// scalar*G, scalars are always 32 bytes so this can't fail
+func scalarBaseMult(scalar []byte) *nistec.P256Point {
+	product, err := nistec.NewP256Point().ScalarBaseMult(scalar)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return product
+}
+
+// scalar*point, scalars are always 32 bytes so this can't fail
+func scalarMult(point *nistec.P256Point, scalar []byte) *nistec.P256Point {
+	product, err := nistec.NewP256Point().ScalarMult(point, scalar)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return product
+}
@@ -0,0 +1,206 @@
+package pake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	decoded, err := hex.DecodeString(s)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+// Appendix B of RFC 9382, SPAKE2-P256-SHA256-HKDF-SHA256-HMAC-SHA256 with
+// A = "server", B = "client" and no additional data. The RFC doesn't give the
+// scalars x and y so X and Y are taken as given.
+func TestRFC9382Vectors(t *testing.T) {
+	identities := Identities{Sender: "server", Receiver: "client"}
+	w := mustHex(t, "2ee57912099d31560b3a44b1184b9b4866e904c49d12ac5042c97dca461b1a5f")
+	x := mustHex(t, "04a56fa807caaa53a4d28dbb9853b9815c61a411118a6fe516a8798434751470f9"+
+		"010153ac33d0d5f2047ffdb1a3e42c9b4e6be662766e1eeb4116988ede5f912c")
+	y := mustHex(t, "0406557e482bd03097ad0cbaa5df82115460d951e3451962f1eaf4367a420676d0"+
+		"9857ccbc522686c83d1852abfa8ed6e4a1155cf8f1543ceca528afb591a1e0b7")
+	k := mustHex(t, "0412af7e89717850671913e6b469ace67bd90a4df8ce45c2af19010175e37eed69"+
+		"f75897996d539356e2fa6a406d528501f907e04d97515fbe83db277b715d3325")
+
+	// X and Y are valid messages, Finish would accept them
+	exchange := newWithScalars(Sender, identities, w, reduceScalar([]byte{1}), nil)
+
+	for _, message := range [][]byte{x, y} {
+		if _, err := exchange.sharedPoint(message); err != nil {
+			t.Errorf("Message %x should be accepted: %v", message, err)
+		}
+	}
+
+	tt := transcript(identities, x, y, k, w)
+
+	if hash, wanted := sha256.Sum256(tt), mustHex(t, "0e0672dc86f8e45565d338b0540abe6915bdf72e2b35b5c9e5663168e960a91b"); !bytes.Equal(hash[:], wanted) {
+		t.Errorf("Hash(TT) should be %x is %x", wanted, hash)
+	}
+
+	ke, confirmationKeyA, confirmationKeyB, err := keySchedule(tt, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vectors := []struct {
+		name   string
+		value  []byte
+		wanted string
+	}{
+		{"Ke", ke, "0e0672dc86f8e45565d338b0540abe69"},
+		{"KcA", confirmationKeyA, "00c12546835755c86d8c0db7851ae86f"},
+		{"KcB", confirmationKeyB, "a9fa3406c3b781b93d804485430ca27a"},
+		{"A conf", mac(confirmationKeyA, tt), "58ad4aa88e0b60d5061eb6b5dd93e80d9c4f00d127c65b3b35b1b5281fee38f0"},
+		{"B conf", mac(confirmationKeyB, tt), "d3e2e547f1ae04f2dbdbf0fc4b79f8ecff2dff314b5d32fe9fcef2fb26dc459b"},
+	}
+
+	for _, vector := range vectors {
+		if wanted := mustHex(t, vector.wanted); !bytes.Equal(vector.value, wanted) {
+			t.Errorf("%v should be %x is %x", vector.name, wanted, vector.value)
+		}
+	}
+}
+
+// Regression vector for tube's identities and password stretching, computed with
+// fixed scalars by this implementation
+func TestGoldenExchange(t *testing.T) {
+	shareCode := []byte{0x01, 0x02, 0x03, 0x04, 0x05}
+
+	w, err := passwordScalar([]byte("4821"), shareCode)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(w, mustHex(t, "98c3d1d57e42d74674f4b89d031337364040c38e04a3c77e38e00f5976926f14")) {
+		t.Errorf("Password scalar is %x", w)
+	}
+
+	x := mustHex(t, "8b0ad5b58f1c4c3b61a7fe1f7e3c1d6b33d5d1c2b0a9f8e7d6c5b4a392817060")
+	y := mustHex(t, "2f1e0d9c8b7a69584736251403f2e1d0c9b8a7968574635241302f1e0d0c0b0a")
+
+	sender := newWithScalars(Sender, TubeIdentities, w, x, shareCode)
+	receiver := newWithScalars(Receiver, TubeIdentities, w, y, shareCode)
+
+	wantedX := mustHex(t, "0426042d0da6a0d74ee737108881d573b804a8e41af2f42c339f9d1e5fa49d4bd5"+
+		"fa0c0cab02bdc5a0ce83f17f84b790778d5dd74c804fd69a9d46b5367cc41ec1")
+	wantedY := mustHex(t, "0476f965b1bfeacd3a53b59a42cf37be4b614de603ededc6222b793e5421a303b4"+
+		"d8f92b4a6f10ca996498015d508293d0dd74a0406d920d3612122cf2117c4f7c")
+
+	if !bytes.Equal(sender.Message(), wantedX) {
+		t.Errorf("Sender message should be %x is %x", wantedX, sender.Message())
+	}
+	if !bytes.Equal(receiver.Message(), wantedY) {
+		t.Errorf("Receiver message should be %x is %x", wantedY, receiver.Message())
+	}
+
+	confirmationA, err := sender.Finish(receiver.Message())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirmationB, err := receiver.Finish(sender.Message())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wanted := mustHex(t, "625cda39afc6d8e52f9b3bf887823c66e34b2efaa75b29d352ae0d9218a054db"); !bytes.Equal(confirmationA, wanted) {
+		t.Errorf("Sender confirmation should be %x is %x", wanted, confirmationA)
+	}
+	if wanted := mustHex(t, "c0e8dc2cb55a0d5770c2437dccecee9db29b75732a3ef428803bf3c8ea93aa6e"); !bytes.Equal(confirmationB, wanted) {
+		t.Errorf("Receiver confirmation should be %x is %x", wanted, confirmationB)
+	}
+
+	senderKey, err := sender.Verify(confirmationB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiverKey, err := receiver.Verify(confirmationA)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantedKey := mustHex(t, "3b00431e9445074050985fad2300c879")
+
+	if !bytes.Equal(senderKey, wantedKey) || !bytes.Equal(receiverKey, wantedKey) {
+		t.Errorf("Keys should be %x are %x and %x", wantedKey, senderKey, receiverKey)
+	}
+}
+
+func exchange(t *testing.T, senderPassword string, receiverPassword string) (error, error) {
+	shareCode := []byte{0x01, 0x02, 0x03, 0x04, 0x05}
+
+	sender, err := New(Sender, TubeIdentities, []byte(senderPassword), shareCode, shareCode)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := New(Receiver, TubeIdentities, []byte(receiverPassword), shareCode, shareCode)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirmationA, err := sender.Finish(receiver.Message())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirmationB, err := receiver.Finish(sender.Message())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, senderErr := sender.Verify(confirmationB)
+	_, receiverErr := receiver.Verify(confirmationA)
+
+	return senderErr, receiverErr
+}
+
+func TestExchangeAgreesOnlyWithMatchingPasswords(t *testing.T) {
+	if senderErr, receiverErr := exchange(t, "4821", "4821"); senderErr != nil || receiverErr != nil {
+		t.Errorf("Matching passwords should agree a key: %v %v", senderErr, receiverErr)
+	}
+
+	if senderErr, receiverErr := exchange(t, "4821", "4812"); senderErr == nil || receiverErr == nil {
+		t.Errorf("Different passwords should fail key confirmation")
+	}
+}
+
+func TestFinishRejectsInvalidMessages(t *testing.T) {
+	w := reduceScalar([]byte{0x12, 0x34})
+	sender := newWithScalars(Sender, TubeIdentities, w, reduceScalar([]byte{7}), nil)
+
+	// Y = w*N cancels out to the identity
+	identity := scalarMult(pointN, w).Bytes()
+
+	offCurve := bytes.Clone(identity)
+	offCurve[MessageLength-1] ^= 0x01
+
+	for _, message := range [][]byte{nil, identity[:MessageLength-1], offCurve, identity} {
+		if _, err := sender.Finish(message); err == nil {
+			t.Errorf("Message %x should be rejected", message)
+		}
+	}
+
+	if _, err := sender.Verify(make([]byte, ConfirmationLength)); err == nil {
+		t.Errorf("Verify before a successful Finish should fail")
+	}
+}
@@ -0,0 +1,29 @@
+package protocol
+
+// From version 13 a sender may ask for a broadcast share in SENDER_INITIATION,
+// several receivers join it with the same share code. The relay sends the sender
+// BROADCAST_READY with the key of every receiver rather than READY, forwards
+// each message from the sender to every receiver and acknowledges a chunk to the
+// sender once every receiver has acknowledged it.
+const MaxBroadcastReceivers = 255
+
+// What the relay does when a receiver of a broadcast share disconnects or falls behind
+const (
+	// The share is errored out for everyone
+	DropPolicyEndShare uint8 = 0x00
+	// The receiver is dropped and the share continues with the others
+	DropPolicyContinue uint8 = 0x01
+)
+
+func IsValidDropPolicy(dropPolicy uint8) bool {
+	return dropPolicy == DropPolicyEndShare || dropPolicy == DropPolicyContinue
+}
+
+// Fields of BROADCAST_READY
+type BroadcastReady struct {
+	// Negotiated version, at least 13
+	Version    uint8
+	WindowSize uint16
+	// Keys of the receivers that joined in the order they joined, 1 to MaxBroadcastReceivers
+	ReceiverKeys []ReceiverKey
+}
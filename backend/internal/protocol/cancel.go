@@ -0,0 +1,6 @@
+package protocol
+
+// From version 15 either peer may send CANCEL at any point of a share, the relay
+// forwards it to the other peer and closes the share. It may be sent before the
+// share's version is negotiated so its version is any the relay supports.
+const MaxCancelReasonLength = 1024
@@ -0,0 +1,24 @@
+package protocol
+
+// From version 14 a receiver may decline a share instead of acknowledging its
+// metadata, the relay forwards DECLINE to the sender and closes the share.
+const MaxDeclineMessageLength = 1024
+
+// Why a receiver declined a share
+const (
+	DeclineUnspecified  uint8 = 0x00
+	DeclineTooLarge     uint8 = 0x01
+	DeclineUnwantedType uint8 = 0x02
+	DeclineRejected     uint8 = 0x03
+)
+
+func IsValidDeclineReason(reason uint8) bool {
+	return reason <= DeclineRejected
+}
+
+// Fields of DECLINE
+type Decline struct {
+	Reason uint8
+	// Explanation for the sender's user, may be empty
+	Message string
+}
@@ -0,0 +1,895 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+func assertVersion(version uint8, expectedVersion uint8) error {
+	if version != expectedVersion {
+		return fmt.Errorf("Protocol version {%v} is not supported", version)
+	}
+	return nil
+}
+
+// Takes a recieved blob and returns (opcode, protocol version, operation specific blob, error)
+func commonDecoding(blob []byte) (Opcode, uint8, []byte, error) {
+	if len(blob) == 0 {
+		return 0, 0, nil, fmt.Errorf("No data to decode")
+	} else if len(blob) == 1 {
+		return 0, 0, nil, fmt.Errorf("No version byte provided")
+	}
+
+	if blob[0] == 0 || blob[0] > HighestOpCode {
+		return 0, 0, nil, fmt.Errorf("Invalid opcode provided")
+	}
+	return Opcode(blob[0]), blob[1], blob[2:], nil
+}
+
+// Checks the opcode and version of a blob and returns the operation specific blob
+func expectMessage(blob []byte, expectedOp Opcode, expectedVersion uint8) ([]byte, error) {
+	op, ver, remainingBlob, err := commonDecoding(blob)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if op != expectedOp {
+		return nil, fmt.Errorf("Message is not a %v is a %v.", expectedOp, op)
+	}
+
+	err = assertVersion(ver, expectedVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ver < IntroducedIn(op) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", op, ver)
+	}
+
+	return remainingBlob, nil
+}
+
+// Reads the range of versions from an initiation or acceptance message and returns
+// (versions, operation specific blob, error)
+func decodeVersionRange(blob []byte, expectedOp Opcode) (VersionRange, []byte, error) {
+	op, ver, remainingBlob, err := commonDecoding(blob)
+
+	if err != nil {
+		return VersionRange{}, nil, err
+	}
+
+	if op != expectedOp {
+		return VersionRange{}, nil, fmt.Errorf("Message is not a %v is a %v.", expectedOp, op)
+	}
+
+	if ver == 0 {
+		return VersionRange{Lowest: 0, Highest: 0}, remainingBlob, nil
+	}
+
+	if len(remainingBlob) < 1 {
+		return VersionRange{}, nil, fmt.Errorf("Incomplete message.")
+	}
+
+	versions := VersionRange{Lowest: remainingBlob[0], Highest: ver}
+
+	if versions.Lowest > versions.Highest {
+		return VersionRange{}, nil, fmt.Errorf("Lowest version %v is higher than highest version %v.",
+			versions.Lowest, versions.Highest)
+	}
+
+	return versions, remainingBlob[1:], nil
+}
+
+// Checks the opcode of a blob and that its version is one this package supports,
+// returns (protocol version, operation specific blob, error)
+func expectSupportedMessage(blob []byte, expectedOp Opcode) (uint8, []byte, error) {
+	if len(blob) < 2 {
+		return 0, nil, fmt.Errorf("Incomplete message.")
+	}
+
+	version := blob[1]
+
+	if !IsSupportedVersion(version) {
+		return 0, nil, fmt.Errorf("Protocol version {%v} is not supported", version)
+	}
+
+	remainingBlob, err := expectMessage(blob, expectedOp, version)
+
+	return version, remainingBlob, err
+}
+
+// Takes a recieved blob and returns its fields, senders that don't support version 2
+// request a window size of 1
+func DecodeSenderInitiation(blob []byte) (SenderInitiation, error) {
+	versions, remainingBlob, err := decodeVersionRange(blob, SENDER_INITIATION)
+
+	if err != nil {
+		return SenderInitiation{}, err
+	}
+
+	initiation := SenderInitiation{Versions: versions, WindowSize: 1}
+
+	if versions.Highest < 2 {
+		return initiation, nil
+	}
+
+	initiation.WindowSize, err = decodeWindowSize(remainingBlob)
+
+	if err != nil {
+		return SenderInitiation{}, err
+	}
+
+	remainingBlob = remainingBlob[2:]
+
+	if versions.Highest < 5 {
+		return initiation, nil
+	}
+
+	if len(remainingBlob) < 4 {
+		return SenderInitiation{}, fmt.Errorf("Too few bytes (expected %v got %v).", 4, len(remainingBlob))
+	}
+
+	initiation.TimeToLive = readUint(remainingBlob[:4])
+	remainingBlob = remainingBlob[4:]
+
+	if versions.Highest < IntroducedIn(PIN_CHALLENGE) {
+		return initiation, nil
+	}
+
+	if len(remainingBlob) < 1 {
+		return SenderInitiation{}, fmt.Errorf("Incomplete message.")
+	}
+
+	pinProtected := remainingBlob[0]
+	remainingBlob = remainingBlob[1:]
+
+	switch pinProtected {
+	case 0x00:
+	case 0x01:
+		if len(remainingBlob) < PinSaltLength+PinVerifierLength {
+			return SenderInitiation{}, fmt.Errorf("Too few bytes (expected %v got %v).",
+				PinSaltLength+PinVerifierLength, len(remainingBlob))
+		}
+
+		initiation.PinSalt = remainingBlob[:PinSaltLength]
+		initiation.PinVerifier = remainingBlob[PinSaltLength : PinSaltLength+PinVerifierLength]
+		remainingBlob = remainingBlob[PinSaltLength+PinVerifierLength:]
+	default:
+		return SenderInitiation{}, fmt.Errorf("pin_protected must be 0x00 or 0x01 is %#02x.", pinProtected)
+	}
+
+	if versions.Highest < IntroducedIn(PAKE) {
+		return initiation, nil
+	}
+
+	if len(remainingBlob) < 1 {
+		return SenderInitiation{}, fmt.Errorf("Incomplete message.")
+	}
+
+	initiation.KeyAgreement = remainingBlob[0]
+	remainingBlob = remainingBlob[1:]
+
+	if !IsValidKeyAgreement(initiation.KeyAgreement) {
+		return SenderInitiation{}, fmt.Errorf("key_agreement must be 0x00 or 0x01 is %#02x.", initiation.KeyAgreement)
+	}
+
+	if versions.Highest < IntroducedIn(BROADCAST_READY) {
+		return initiation, nil
+	}
+
+	if len(remainingBlob) < 2 {
+		return SenderInitiation{}, fmt.Errorf("Incomplete message.")
+	}
+
+	initiation.Receivers = remainingBlob[0]
+	initiation.DropPolicy = remainingBlob[1]
+
+	if !IsValidDropPolicy(initiation.DropPolicy) {
+		return SenderInitiation{}, fmt.Errorf("drop_policy must be 0x00 or 0x01 is %#02x.", initiation.DropPolicy)
+	}
+
+	return initiation, nil
+}
+
+func DecodeSenderAcceptance(blob []byte) (SenderAcceptance, error) {
+	versions, remainingBlob, err := decodeVersionRange(blob, SENDER_ACCEPTED)
+
+	if err != nil {
+		return SenderAcceptance{}, err
+	}
+
+	if len(remainingBlob) < ShareCodeLength {
+		return SenderAcceptance{}, fmt.Errorf("Too few bytes (expected %v got %v).", ShareCodeLength, len(remainingBlob))
+	}
+
+	acceptance := SenderAcceptance{Versions: versions, ShareCode: remainingBlob[:ShareCodeLength]}
+	remainingBlob = remainingBlob[ShareCodeLength:]
+
+	if versions.Highest < 3 {
+		return acceptance, nil
+	}
+
+	acceptance.ResumeToken, err = decodeResumeToken(remainingBlob)
+
+	if err != nil {
+		return SenderAcceptance{}, err
+	}
+
+	remainingBlob = remainingBlob[ResumeTokenLength:]
+
+	if versions.Highest < 5 {
+		return acceptance, nil
+	}
+
+	if len(remainingBlob) < 4 {
+		return SenderAcceptance{}, fmt.Errorf("Too few bytes (expected %v got %v).", 4, len(remainingBlob))
+	}
+
+	acceptance.TimeToLive = readUint(remainingBlob[:4])
+	remainingBlob = remainingBlob[4:]
+
+	if acceptance.TimeToLive == 0 {
+		return SenderAcceptance{}, fmt.Errorf("time_to_live must be at least 1 second.")
+	}
+
+	if versions.Highest < 6 {
+		return acceptance, nil
+	}
+
+	if len(remainingBlob) < 1 || len(remainingBlob[1:]) < int(remainingBlob[0]) {
+		return SenderAcceptance{}, fmt.Errorf("Incomplete message.")
+	}
+
+	acceptance.ShareCodeText = string(remainingBlob[1 : 1+int(remainingBlob[0])])
+
+	if !IsValidShareCodeText(acceptance.ShareCodeText) {
+		return SenderAcceptance{}, fmt.Errorf("share_code_text must be 1 to %v printable ascii characters.",
+			MaxShareCodeTextLength)
+	}
+
+	return acceptance, nil
+}
+
+func DecodeRequestAcceptance(blob []byte) (RequestAcceptance, error) {
+	versions, remainingBlob, err := decodeVersionRange(blob, REQUEST_ACCEPTED)
+
+	if err != nil {
+		return RequestAcceptance{}, err
+	}
+
+	if versions.Lowest < IntroducedIn(REQUEST_ACCEPTED) {
+		return RequestAcceptance{}, fmt.Errorf("%v is not defined in protocol version {%v}.", REQUEST_ACCEPTED, versions.Lowest)
+	}
+
+	if len(remainingBlob) < ShareCodeLength+4+1 {
+		return RequestAcceptance{}, fmt.Errorf("Too few bytes (expected %v got %v).", ShareCodeLength+4+1, len(remainingBlob))
+	}
+
+	acceptance := RequestAcceptance{
+		Versions:   versions,
+		ShareCode:  remainingBlob[:ShareCodeLength],
+		TimeToLive: readUint(remainingBlob[ShareCodeLength : ShareCodeLength+4]),
+	}
+	remainingBlob = remainingBlob[ShareCodeLength+4:]
+
+	if acceptance.TimeToLive == 0 {
+		return RequestAcceptance{}, fmt.Errorf("time_to_live must be at least 1 second.")
+	}
+
+	if len(remainingBlob[1:]) < int(remainingBlob[0]) {
+		return RequestAcceptance{}, fmt.Errorf("Incomplete message.")
+	}
+
+	acceptance.ShareCodeText = string(remainingBlob[1 : 1+int(remainingBlob[0])])
+
+	if !IsValidShareCodeText(acceptance.ShareCodeText) {
+		return RequestAcceptance{}, fmt.Errorf("share_code_text must be 1 to %v printable ascii characters.",
+			MaxShareCodeTextLength)
+	}
+
+	return acceptance, nil
+}
+
+// Takes a recieved blob and returns (supported versions, client_public_key, error)
+func DecodeReceiverInitiation(blob []byte) (VersionRange, ReceiverKey, error) {
+	versions, remainingBlob, err := decodeVersionRange(blob, RECEIVER_INITIATION)
+
+	if err != nil {
+		return VersionRange{}, ReceiverKey{}, err
+	}
+
+	key, _, err := decodeReceiverKey(remainingBlob, versions.Highest)
+
+	if err != nil {
+		return VersionRange{}, ReceiverKey{}, err
+	}
+
+	return versions, key, nil
+}
+
+// Takes a recieved blob and returns (negotiated version, resume_token, error),
+// the resume token is nil before version 3
+func DecodeReceiverAcceptance(blob []byte) (uint8, []byte, error) {
+	version, remainingBlob, err := expectSupportedMessage(blob, RECEIVER_ACCEPTED)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if version < 3 {
+		return version, nil, nil
+	}
+
+	resumeToken, err := decodeResumeToken(remainingBlob)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return version, resumeToken, nil
+}
+
+func decodeResumeToken(blob []byte) ([]byte, error) {
+	if len(blob) < ResumeTokenLength {
+		return nil, fmt.Errorf("Too few bytes (expected %v got %v).", ResumeTokenLength, len(blob))
+	}
+
+	return blob[:ResumeTokenLength], nil
+}
+
+// Takes a recieved blob and returns (negotiated version, client_public_key, window size, error),
+// the window size is 1 before version 2
+func DecodeReady(blob []byte) (uint8, ReceiverKey, uint16, error) {
+	version, remainingBlob, err := expectSupportedMessage(blob, READY)
+
+	if err != nil {
+		return 0, ReceiverKey{}, 0, err
+	}
+
+	publicKey, remainingBlob, err := decodeReceiverKey(remainingBlob, version)
+
+	if err != nil {
+		return 0, ReceiverKey{}, 0, err
+	}
+
+	if version < 2 {
+		return version, publicKey, 1, nil
+	}
+
+	windowSize, err := decodeWindowSize(remainingBlob)
+
+	if err != nil {
+		return 0, ReceiverKey{}, 0, err
+	}
+
+	return version, publicKey, windowSize, nil
+}
+
+func DecodeBroadcastReady(blob []byte) (BroadcastReady, error) {
+	version, remainingBlob, err := expectSupportedMessage(blob, BROADCAST_READY)
+
+	if err != nil {
+		return BroadcastReady{}, err
+	}
+
+	if version < IntroducedIn(BROADCAST_READY) {
+		return BroadcastReady{}, fmt.Errorf("Broadcast ready requires version %v.", IntroducedIn(BROADCAST_READY))
+	}
+
+	windowSize, err := decodeWindowSize(remainingBlob)
+
+	if err != nil {
+		return BroadcastReady{}, err
+	}
+
+	remainingBlob = remainingBlob[2:]
+
+	if len(remainingBlob) < 1 {
+		return BroadcastReady{}, fmt.Errorf("Incomplete message.")
+	}
+
+	numberOfReceivers := int(remainingBlob[0])
+	remainingBlob = remainingBlob[1:]
+
+	if numberOfReceivers == 0 {
+		return BroadcastReady{}, fmt.Errorf("Broadcast ready must have at least one receiver.")
+	}
+
+	ready := BroadcastReady{Version: version, WindowSize: windowSize, ReceiverKeys: make([]ReceiverKey, numberOfReceivers)}
+
+	for i := range ready.ReceiverKeys {
+		ready.ReceiverKeys[i], remainingBlob, err = decodeReceiverKey(remainingBlob, version)
+
+		if err != nil {
+			return BroadcastReady{}, err
+		}
+	}
+
+	return ready, nil
+}
+
+func decodeWindowSize(blob []byte) (uint16, error) {
+	if len(blob) < 2 {
+		return 0, fmt.Errorf("Incomplete message.")
+	}
+
+	windowSize := uint16(readUint(blob[:2]))
+
+	if windowSize == 0 {
+		return 0, fmt.Errorf("Window size must be at least 1.")
+	}
+
+	return windowSize, nil
+}
+
+// Takes a recieved blob and returns (file_name, number_of_chunks, error)
+func DecodeMetadata(blob []byte, version uint8) ([]byte, uint32, error) {
+	remainingBlob, err := expectMessage(blob, METADATA, version)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(remainingBlob) == 0 {
+		return nil, 0, fmt.Errorf("Incomplete message.")
+	}
+
+	filenameLength := int(remainingBlob[0])
+
+	if filenameLength == 0 {
+		return nil, 0, fmt.Errorf("file_name length must be at least 1 byte.")
+	}
+
+	expectedNumberOfBytes := 1 + filenameLength + CounterLength(version)
+
+	if len(remainingBlob) < expectedNumberOfBytes {
+		return nil, 0, fmt.Errorf("Too few bytes (expected %v got %v).", expectedNumberOfBytes, len(remainingBlob))
+	}
+
+	filename := remainingBlob[1 : 1+filenameLength]
+	numberOfChunks := readUint(remainingBlob[1+filenameLength : expectedNumberOfBytes])
+
+	if numberOfChunks > MaxNumberOfChunks(version) {
+		return nil, 0, fmt.Errorf("number_of_chunks must be at most %v is %v.", MaxNumberOfChunks(version), numberOfChunks)
+	}
+
+	return filename, numberOfChunks, nil
+}
+
+// In version 0 the metadata is acknowledged with an ACKNOWLEDGE for chunk 0xFF,
+// from version 1 it has its own METADATA_ACKNOWLEDGE message
+func DecodeMetadataAcknowledge(blob []byte, version uint8) error {
+	if version == 0 {
+		remainingBlob, err := expectMessage(blob, ACKNOWLEDGE, version)
+
+		if err != nil {
+			return err
+		}
+
+		if len(remainingBlob) < 2 {
+			return fmt.Errorf("Incomplete message.")
+		}
+
+		chunkNumber := readUint(remainingBlob[:2])
+
+		if chunkNumber != MetadataChunkNumberV0 {
+			return fmt.Errorf("Recieved awknowledgement for chunk %X which not yet been sent.", chunkNumber)
+		}
+
+		return nil
+	}
+
+	_, err := expectMessage(blob, METADATA_ACKNOWLEDGE, version)
+	return err
+}
+
+// Takes a recieved blob and returns (chunk_number, payload, error)
+// Takes a recieved blob and returns (files, error)
+func DecodeManifest(blob []byte, version uint8) ([]ManifestEntry, error) {
+	remainingBlob, err := expectMessage(blob, MANIFEST, version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remainingBlob) < 2 {
+		return nil, fmt.Errorf("Incomplete message.")
+	}
+
+	numberOfFiles := int(readUint(remainingBlob[:2]))
+	remainingBlob = remainingBlob[2:]
+
+	// don't trust numberOfFiles for the allocation, each entry is at least 2 bytes
+	files := make([]ManifestEntry, 0, min(numberOfFiles, len(remainingBlob)/2))
+
+	for range numberOfFiles {
+		if len(remainingBlob) < 2 {
+			return nil, fmt.Errorf("Incomplete message.")
+		}
+
+		pathLength := int(readUint(remainingBlob[:2]))
+		entryLength := 2 + pathLength + 8 + CounterLength(version)
+
+		if len(remainingBlob) < entryLength {
+			return nil, fmt.Errorf("Too few bytes (expected %v got %v).", entryLength, len(remainingBlob))
+		}
+
+		files = append(files, ManifestEntry{
+			Path:           remainingBlob[2 : 2+pathLength],
+			Size:           binary.LittleEndian.Uint64(remainingBlob[2+pathLength : 2+pathLength+8]),
+			NumberOfChunks: readUint(remainingBlob[2+pathLength+8 : entryLength]),
+		})
+
+		remainingBlob = remainingBlob[entryLength:]
+	}
+
+	err = ValidateManifest(version, files)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Takes a recieved blob and returns (number_of_chunks, digest, error), both are
+// only carried from version 11
+func DecodeEnd(blob []byte, version uint8) (uint32, []byte, error) {
+	remainingBlob, err := expectMessage(blob, END, version)
+
+	if err != nil || version < StreamingVersion {
+		return 0, nil, err
+	}
+
+	headerLength := CounterLength(version) + 2
+
+	if len(remainingBlob) < headerLength {
+		return 0, nil, fmt.Errorf("Incomplete message.")
+	}
+
+	numberOfChunks := readUint(remainingBlob[:CounterLength(version)])
+	length := int(readUint(remainingBlob[CounterLength(version):headerLength]))
+	remainingBlob = remainingBlob[headerLength:]
+
+	if length == 0 || length > MaxEndDigestLength {
+		return 0, nil, fmt.Errorf("Digest must be 1 to %v bytes is %v.", MaxEndDigestLength, length)
+	}
+
+	if len(remainingBlob) < length {
+		return 0, nil, fmt.Errorf("Too few bytes (expected %v got %v).", length, len(remainingBlob))
+	}
+
+	return numberOfChunks, remainingBlob[:length], nil
+}
+
+// Takes a recieved blob and returns (file_index, chunk_number, payload, error),
+// the file index is always 0 before version 4
+func DecodeDataChunk(blob []byte, version uint8) (uint16, uint32, []byte, error) {
+	remainingBlob, err := expectMessage(blob, DATA_CHUNK, version)
+
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	headerLength := FileIndexLength(version) + CounterLength(version) + PayloadLengthLength(version)
+
+	if len(remainingBlob) < headerLength {
+		return 0, 0, nil, fmt.Errorf("Incomplete message.")
+	}
+
+	var fileIndex uint16
+
+	if FileIndexLength(version) > 0 {
+		fileIndex = uint16(readUint(remainingBlob[:FileIndexLength(version)]))
+		remainingBlob = remainingBlob[FileIndexLength(version):]
+		headerLength -= FileIndexLength(version)
+	}
+
+	chunkNumber := readUint(remainingBlob[:CounterLength(version)])
+	payloadLength := readUint(remainingBlob[CounterLength(version):headerLength])
+
+	if chunkNumber > MaxChunkNumber(version) {
+		return 0, 0, nil, fmt.Errorf("chunk_number must be at most %X is %X.", MaxChunkNumber(version), chunkNumber)
+	}
+
+	if payloadLength > uint32(MaxPayloadLength(version)) {
+		return 0, 0, nil, fmt.Errorf("payload length must be at most %v is %v.", MaxPayloadLength(version), payloadLength)
+	}
+
+	if len(remainingBlob[headerLength:]) < int(payloadLength) {
+		return 0, 0, nil, fmt.Errorf("Too few bytes (expected %v got %v).", payloadLength, len(remainingBlob[headerLength:]))
+	}
+
+	return fileIndex, chunkNumber, remainingBlob[headerLength : headerLength+int(payloadLength)], nil
+}
+
+// Takes a recieved blob and returns (chunk_number, error)
+func DecodeAcknowledge(blob []byte, version uint8) (uint32, error) {
+	remainingBlob, err := expectMessage(blob, ACKNOWLEDGE, version)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(remainingBlob) < CounterLength(version) {
+		return 0, fmt.Errorf("Incomplete message.")
+	}
+
+	chunkNumber := readUint(remainingBlob[:CounterLength(version)])
+
+	if chunkNumber > MaxChunkNumber(version) {
+		return 0, fmt.Errorf("chunk_number must be at most %X is %X.", MaxChunkNumber(version), chunkNumber)
+	}
+
+	return chunkNumber, nil
+}
+
+// Takes a recieved blob and returns (protocol version, resume_token, error)
+func DecodeResume(blob []byte) (uint8, []byte, error) {
+	version, remainingBlob, err := expectSupportedMessage(blob, RESUME)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resumeToken, err := decodeResumeToken(remainingBlob)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return version, resumeToken, nil
+}
+
+// Takes a recieved blob and returns (acknowledged_chunks, next_chunk, error)
+func DecodeResumed(blob []byte, version uint8) (uint32, uint32, error) {
+	remainingBlob, err := expectMessage(blob, RESUMED, version)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(remainingBlob) < 8 {
+		return 0, 0, fmt.Errorf("Incomplete message.")
+	}
+
+	acknowledgedChunks := readUint(remainingBlob[:4])
+	nextChunk := readUint(remainingBlob[4:8])
+
+	if nextChunk < acknowledgedChunks {
+		return 0, 0, fmt.Errorf("next_chunk %v must not be below acknowledged_chunks %v.", nextChunk, acknowledgedChunks)
+	}
+
+	return acknowledgedChunks, nextChunk, nil
+}
+
+// Takes a recieved blob and returns (version, error code, error_reason, versions supported by the
+// relay, error), the supported versions are only sent from version 1 and the code from version 16
+func DecodeError(blob []byte) (uint8, ErrorCode, string, VersionRange, error) {
+	version, remainingBlob, err := expectSupportedMessage(blob, ERROR)
+
+	if err != nil {
+		return 0, 0, "", VersionRange{}, err
+	}
+
+	if len(remainingBlob) < 2 {
+		return 0, 0, "", VersionRange{}, fmt.Errorf("Incomplete message.")
+	}
+
+	length := int(readUint(remainingBlob[:2]))
+
+	if len(remainingBlob[2:]) < length {
+		return 0, 0, "", VersionRange{}, fmt.Errorf("Too few bytes (expected %v got %v).", length, len(remainingBlob[2:]))
+	}
+
+	errorReason := remainingBlob[2 : 2+length]
+
+	if !utf8.Valid(errorReason) {
+		return 0, 0, "", VersionRange{}, fmt.Errorf("Error string is not valid utf-8.")
+	}
+
+	var supportedVersions VersionRange
+
+	if version >= 1 {
+		remainingBlob = remainingBlob[2+length:]
+
+		if len(remainingBlob) < 2 {
+			return 0, 0, "", VersionRange{}, fmt.Errorf("Incomplete message.")
+		}
+
+		supportedVersions = VersionRange{Lowest: remainingBlob[0], Highest: remainingBlob[1]}
+
+		if supportedVersions.Lowest > supportedVersions.Highest {
+			return 0, 0, "", VersionRange{}, fmt.Errorf("Lowest version %v is higher than highest version %v.",
+				supportedVersions.Lowest, supportedVersions.Highest)
+		}
+	}
+
+	code := E_UNSPECIFIED
+
+	if version >= ErrorCodesVersion {
+		remainingBlob = remainingBlob[2:]
+
+		if len(remainingBlob) < 1 {
+			return 0, 0, "", VersionRange{}, fmt.Errorf("Incomplete message.")
+		}
+
+		code = ErrorCode(remainingBlob[0])
+	}
+
+	return version, code, string(errorReason), supportedVersions, nil
+}
+
+// Takes a recieved blob and returns (pin salt, nonce, attempts remaining, error)
+func DecodePinChallenge(blob []byte, version uint8) ([]byte, []byte, uint8, error) {
+	remainingBlob, err := expectMessage(blob, PIN_CHALLENGE, version)
+
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if len(remainingBlob) < PinSaltLength+PinNonceLength+1 {
+		return nil, nil, 0, fmt.Errorf("Incomplete message.")
+	}
+
+	pinSalt := remainingBlob[:PinSaltLength]
+	nonce := remainingBlob[PinSaltLength : PinSaltLength+PinNonceLength]
+	attemptsRemaining := remainingBlob[PinSaltLength+PinNonceLength]
+
+	if attemptsRemaining == 0 {
+		return nil, nil, 0, fmt.Errorf("attempts_remaining must be at least 1.")
+	}
+
+	return pinSalt, nonce, attemptsRemaining, nil
+}
+
+// Takes a recieved blob and returns (proof, error)
+func DecodePinResponse(blob []byte, version uint8) ([]byte, error) {
+	remainingBlob, err := expectMessage(blob, PIN_RESPONSE, version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remainingBlob) < PinProofLength {
+		return nil, fmt.Errorf("Too few bytes (expected %v got %v).", PinProofLength, len(remainingBlob))
+	}
+
+	return remainingBlob[:PinProofLength], nil
+}
+
+// Takes a recieved blob and returns (payload, error)
+func DecodePake(blob []byte, version uint8) ([]byte, error) {
+	remainingBlob, err := expectMessage(blob, PAKE, version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remainingBlob) < 2 {
+		return nil, fmt.Errorf("Incomplete message.")
+	}
+
+	length := int(readUint(remainingBlob[:2]))
+
+	if length == 0 {
+		return nil, fmt.Errorf("payload must be at least 1 byte.")
+	}
+
+	if len(remainingBlob[2:]) < length {
+		return nil, fmt.Errorf("Too few bytes (expected %v got %v).", length, len(remainingBlob[2:]))
+	}
+
+	return remainingBlob[2 : 2+length], nil
+}
+
+// Takes a recieved blob and returns (payload, error)
+func DecodeVerify(blob []byte, version uint8) ([]byte, error) {
+	remainingBlob, err := expectMessage(blob, VERIFY, version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remainingBlob) < 2 {
+		return nil, fmt.Errorf("Incomplete message.")
+	}
+
+	length := int(readUint(remainingBlob[:2]))
+
+	if len(remainingBlob[2:]) < length {
+		return nil, fmt.Errorf("Too few bytes (expected %v got %v).", length, len(remainingBlob[2:]))
+	}
+
+	return remainingBlob[2 : 2+length], nil
+}
+
+func DecodeKeyMismatch(blob []byte, version uint8) error {
+	_, err := expectMessage(blob, KEY_MISMATCH, version)
+	return err
+}
+
+func DecodeDecline(blob []byte, version uint8) (Decline, error) {
+	remainingBlob, err := expectMessage(blob, DECLINE, version)
+
+	if err != nil {
+		return Decline{}, err
+	}
+
+	if len(remainingBlob) < 3 {
+		return Decline{}, fmt.Errorf("Incomplete message.")
+	}
+
+	if !IsValidDeclineReason(remainingBlob[0]) {
+		return Decline{}, fmt.Errorf("Unknown decline reason %#02x.", remainingBlob[0])
+	}
+
+	length := int(readUint(remainingBlob[1:3]))
+
+	if length > MaxDeclineMessageLength {
+		return Decline{}, fmt.Errorf("Decline message must be at most %v bytes is %v.", MaxDeclineMessageLength, length)
+	}
+
+	if len(remainingBlob[3:]) < length {
+		return Decline{}, fmt.Errorf("Too few bytes (expected %v got %v).", length, len(remainingBlob[3:]))
+	}
+
+	message := remainingBlob[3 : 3+length]
+
+	if !utf8.Valid(message) {
+		return Decline{}, fmt.Errorf("Decline message is not valid utf-8.")
+	}
+
+	return Decline{Reason: remainingBlob[0], Message: string(message)}, nil
+}
+
+// Takes a recieved blob and returns (version, reason, error), any supported
+// version from 15 is accepted
+func DecodeCancel(blob []byte) (uint8, string, error) {
+	version, remainingBlob, err := expectSupportedMessage(blob, CANCEL)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	if len(remainingBlob) < 2 {
+		return 0, "", fmt.Errorf("Incomplete message.")
+	}
+
+	length := int(readUint(remainingBlob[:2]))
+
+	if length > MaxCancelReasonLength {
+		return 0, "", fmt.Errorf("Cancel reason must be at most %v bytes is %v.", MaxCancelReasonLength, length)
+	}
+
+	if len(remainingBlob[2:]) < length {
+		return 0, "", fmt.Errorf("Too few bytes (expected %v got %v).", length, len(remainingBlob[2:]))
+	}
+
+	reason := remainingBlob[2 : 2+length]
+
+	if !utf8.Valid(reason) {
+		return 0, "", fmt.Errorf("Cancel reason is not valid utf-8.")
+	}
+
+	return version, string(reason), nil
+}
+
+// Takes a recieved blob and returns (version, status, error), any supported
+// version from 17 is accepted and events this package doesn't know are returned
+func DecodeStatus(blob []byte) (uint8, Status, error) {
+	version, remainingBlob, err := expectSupportedMessage(blob, STATUS)
+
+	if err != nil {
+		return 0, Status{}, err
+	}
+
+	if len(remainingBlob) < 5 {
+		return 0, Status{}, fmt.Errorf("Incomplete message.")
+	}
+
+	return version, Status{Event: remainingBlob[0], Value: readUint(remainingBlob[1:5])}, nil
+}
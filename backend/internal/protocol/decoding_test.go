@@ -0,0 +1,599 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The fuzz targets check that no input makes a decoder panic and that every
+// blob a decoder accepts re-encodes to exactly the bytes it was decoded from
+// (extra bytes after the expected number of bytes are ignored).
+
+func checkRoundTrip(t *testing.T, blob []byte, encoded []byte, err error) {
+	if err != nil {
+		t.Fatalf("Failed to re-encode decoded message %v: %v", blob, err)
+	}
+	if len(encoded) > len(blob) || !bytes.Equal(encoded, blob[:len(encoded)]) {
+		t.Fatalf("Re-encoded message %v doesn't match original %v", encoded, blob)
+	}
+}
+
+func FuzzDecodeSenderInitiation(f *testing.F) {
+	f.Add([]byte{0x01, 0x00})
+	f.Add([]byte{0x01, 0x01, 0x00})
+	f.Add([]byte{0x01, 0x02, 0x00, 0x40, 0x00})
+	f.Add([]byte{0x01, 0x02, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x01, 0x05, 0x00, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x01, 0x05, 0x00, 0x40, 0x00, 0x3C})
+	f.Add([]byte{0x01, 0x05, 0x02, 0x01})
+	f.Add([]byte{0x01, 0x07, 0x00, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00})
+	f.Add(append(append([]byte{0x01, 0x07, 0x07, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x01}, goldenPinSalt...), goldenPinVerifier...))
+	f.Add(append([]byte{0x01, 0x07, 0x07, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x01}, goldenPinSalt...))
+	f.Add([]byte{0x01, 0x08, 0x00, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x01})
+	f.Add([]byte{0x01, 0x08, 0x00, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x02})
+	f.Add([]byte{0x01, 0x0D, 0x00, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 0x01})
+	f.Add([]byte{0x01, 0x0D, 0x00, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08})
+	f.Add([]byte{0x01, 0x01, 0x02})
+	f.Add([]byte{0x01, 0x01})
+	f.Add([]byte{0x01})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		initiation, err := DecodeSenderInitiation(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeSenderInitiation(initiation)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeSenderAcceptance(f *testing.F) {
+	f.Add([]byte{0x02, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05})
+	f.Add([]byte{0x02, 0x01, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05})
+	f.Add(append([]byte{0x02, 0x03, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...))
+	f.Add([]byte{0x02, 0x03, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0xCD})
+	f.Add(append(append([]byte{0x02, 0x05, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...), 0x3C, 0x00, 0x00, 0x00))
+	f.Add(append(append([]byte{0x02, 0x05, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...), 0x00, 0x00, 0x00, 0x00))
+	f.Add(append(append([]byte{0x02, 0x06, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...),
+		0x3C, 0x00, 0x00, 0x00, 0x03, 0x41, 0x42, 0x43))
+	f.Add(append(append([]byte{0x02, 0x06, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...),
+		0x3C, 0x00, 0x00, 0x00, 0x03, 0x41, 0x42))
+	f.Add([]byte{0x02, 0x00, 0x01, 0x02})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		acceptance, err := DecodeSenderAcceptance(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeSenderAcceptance(acceptance)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeRequestAcceptance(f *testing.F) {
+	f.Add([]byte{0x14, 0x0C, 0x0C, 0x01, 0x02, 0x03, 0x04, 0x05, 0x58, 0x02, 0x00, 0x00, 0x03, 0x41, 0x42, 0x43})
+	f.Add([]byte{0x14, 0x0C, 0x0C, 0x01, 0x02, 0x03, 0x04, 0x05, 0x58, 0x02, 0x00, 0x00, 0x03, 0x41})
+	f.Add([]byte{0x14, 0x0C, 0x0B, 0x01, 0x02, 0x03, 0x04, 0x05, 0x58, 0x02, 0x00, 0x00, 0x01, 0x41})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		acceptance, err := DecodeRequestAcceptance(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeRequestAcceptance(acceptance)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeReceiverInitiation(f *testing.F) {
+	f.Add(append([]byte{0x03, 0x00}, goldenPublicKey...))
+	f.Add(append([]byte{0x03, 0x01, 0x00}, goldenPublicKey...))
+	f.Add(append([]byte{0x03, 0x0A, 0x0A, 0x02, 0x20, 0x00}, goldenX25519Key.Key...))
+	f.Add([]byte{0x03, 0x00, 0xAB})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		versions, publicKey, err := DecodeReceiverInitiation(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeReceiverInitiation(versions, publicKey)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeReceiverAcceptance(f *testing.F) {
+	f.Add([]byte{0x04, 0x00})
+	f.Add([]byte{0x04, 0x01})
+	f.Add([]byte{0x04, 0x02})
+	f.Add(append([]byte{0x04, 0x03}, goldenResumeToken...))
+	f.Add([]byte{0x04, 0x03, 0xCD})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		version, resumeToken, err := DecodeReceiverAcceptance(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeReceiverAcceptance(version, resumeToken)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeReady(f *testing.F) {
+	f.Add(append([]byte{0x05, 0x00}, goldenPublicKey...))
+	f.Add(append([]byte{0x05, 0x01}, goldenPublicKey...))
+	f.Add(append(append([]byte{0x05, 0x02}, goldenPublicKey...), 0x10, 0x00))
+	f.Add(append([]byte{0x05, 0x02}, goldenPublicKey...))
+	f.Add(append(append([]byte{0x05, 0x0A, 0x02, 0x20, 0x00}, goldenX25519Key.Key...), 0x10, 0x00))
+	f.Add([]byte{0x05, 0x00, 0xAB})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		version, publicKey, windowSize, err := DecodeReady(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeReady(version, publicKey, windowSize)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeBroadcastReady(f *testing.F) {
+	f.Add(append([]byte{0x15, 0x0D, 0x10, 0x00, 0x01, 0x02, 0x20, 0x00}, goldenX25519Key.Key...))
+	f.Add(append([]byte{0x15, 0x0D, 0x10, 0x00, 0x02, 0x02, 0x20, 0x00}, goldenX25519Key.Key...))
+	f.Add([]byte{0x15, 0x0D, 0x10, 0x00, 0x00})
+	f.Add([]byte{0x15, 0x0C, 0x10, 0x00, 0x01})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		ready, err := DecodeBroadcastReady(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeBroadcastReady(ready)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeDecline(f *testing.F) {
+	f.Add([]byte{0x16, 0x0E, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x16, 0x0E, 0x01, 0x03, 0x00, 0x62, 0x69, 0x67})
+	f.Add([]byte{0x16, 0x0E, 0x04, 0x00, 0x00})
+	f.Add([]byte{0x16, 0x0E, 0x03, 0x02, 0x00, 0xC3})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		decline, err := DecodeDecline(blob, 14)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeDecline(14, decline)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeCancel(f *testing.F) {
+	f.Add([]byte{0x17, 0x0F, 0x00, 0x00})
+	f.Add([]byte{0x17, 0x0F, 0x03, 0x00, 0x62, 0x79, 0x65})
+	f.Add([]byte{0x17, 0x0E, 0x00, 0x00})
+	f.Add([]byte{0x17, 0x0F, 0x02, 0x00, 0xC3})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		version, reason, err := DecodeCancel(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeCancel(version, reason)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeStatus(f *testing.F) {
+	f.Add([]byte{0x18, 0x11, 0x00, 0x01, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x18, 0x11, 0x02, 0x3C, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x18, 0x10, 0x00, 0x01, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x18, 0x11, 0x01, 0x01})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		version, status, err := DecodeStatus(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeStatus(version, status)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeMetadata(f *testing.F) {
+	f.Add([]byte{0x06, 0x00, 0x05, 0x61, 0x2E, 0x74, 0x78, 0x74, 0x03, 0x00}, uint8(0))
+	f.Add([]byte{0x06, 0x00, 0x05, 0x61, 0x2E, 0x74, 0x78, 0x74, 0x03, 0x00, 0xFF, 0xFF}, uint8(0))
+	f.Add([]byte{0x06, 0x00, 0x01, 0x61, 0x00, 0x01}, uint8(0))
+	f.Add([]byte{0x06, 0x00, 0x00, 0x00, 0x00}, uint8(0))
+	f.Add([]byte{0x06, 0x00, 0x05, 0x61}, uint8(0))
+	f.Add([]byte{0x06, 0x01, 0x01, 0x61, 0xFF, 0xFF, 0xFF, 0xFF}, uint8(1))
+	f.Add([]byte{0x06, 0x01, 0x01, 0x61, 0xFF, 0xFF}, uint8(1))
+
+	f.Fuzz(func(t *testing.T, blob []byte, version uint8) {
+		filename, numberOfChunks, err := DecodeMetadata(blob, version)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeMetadata(version, filename, numberOfChunks)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeMetadataAcknowledge(f *testing.F) {
+	f.Add([]byte{0x08, 0x00, 0xFF, 0x00}, uint8(0))
+	f.Add([]byte{0x08, 0x00, 0xFE, 0x00}, uint8(0))
+	f.Add([]byte{0x0A, 0x01}, uint8(1))
+	f.Add([]byte{0x0A, 0x00}, uint8(0))
+
+	f.Fuzz(func(t *testing.T, blob []byte, version uint8) {
+		if err := DecodeMetadataAcknowledge(blob, version); err != nil {
+			return
+		}
+		checkRoundTrip(t, blob, EncodeMetadataAcknowledge(version), nil)
+	})
+}
+
+func FuzzDecodeDataChunk(f *testing.F) {
+	f.Add([]byte{0x07, 0x00, 0x02, 0x00, 0x04, 0x00, 0xDE, 0xAD, 0xBE, 0xEF}, uint8(0))
+	f.Add([]byte{0x07, 0x00, 0xFF, 0x00, 0x00, 0x00}, uint8(0))
+	f.Add([]byte{0x07, 0x00, 0x02, 0x00, 0x04, 0x00, 0xDE}, uint8(0))
+	f.Add([]byte{0x07, 0x01, 0x00, 0x00, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 0xDE, 0xAD, 0xBE, 0xEF}, uint8(1))
+	f.Add([]byte{0x07, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00}, uint8(1))
+	f.Add([]byte{0x07, 0x01, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF}, uint8(1))
+	f.Add([]byte{0x07, 0x04, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0xDE}, uint8(4))
+	f.Add([]byte{0x07, 0x04, 0x01, 0x00, 0x02, 0x00, 0x00}, uint8(4))
+
+	f.Fuzz(func(t *testing.T, blob []byte, version uint8) {
+		fileIndex, chunkNumber, payload, err := DecodeDataChunk(blob, version)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeDataChunk(version, fileIndex, chunkNumber, payload)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeManifest(f *testing.F) {
+	f.Add([]byte{0x0D, 0x04, 0x01, 0x00, 0x01, 0x00, 0x61, 0x05, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00, 0x00}, uint8(4))
+	f.Add([]byte{0x0D, 0x04, 0x02, 0x00, 0x01, 0x00, 0x61, 0x05, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00, 0x00}, uint8(4))
+	f.Add([]byte{0x0D, 0x04, 0x00, 0x00}, uint8(4))
+	f.Add([]byte{0x0D, 0x04, 0xFF, 0xFF, 0x00, 0x00}, uint8(4))
+	f.Add([]byte{0x0D, 0x03, 0x01, 0x00, 0x01, 0x00, 0x61, 0x05, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00, 0x00}, uint8(3))
+
+	f.Fuzz(func(t *testing.T, blob []byte, version uint8) {
+		files, err := DecodeManifest(blob, version)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeManifest(version, files)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeEnd(f *testing.F) {
+	f.Add([]byte{0x0E, 0x04}, uint8(4))
+	f.Add([]byte{0x0E, 0x03}, uint8(3))
+	f.Add([]byte{0x0E}, uint8(4))
+	f.Add([]byte{0x0E, 0x0B, 0x03, 0x00, 0x00, 0x00, 0x02, 0x00, 0xAA, 0xBB}, uint8(11))
+
+	f.Fuzz(func(t *testing.T, blob []byte, version uint8) {
+		numberOfChunks, digest, err := DecodeEnd(blob, version)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeEnd(version, numberOfChunks, digest)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeAcknowledge(f *testing.F) {
+	f.Add([]byte{0x08, 0x00, 0x00, 0x00}, uint8(0))
+	f.Add([]byte{0x08, 0x00, 0xFF, 0x00}, uint8(0))
+	f.Add([]byte{0x08, 0x00, 0x00, 0x01}, uint8(0))
+	f.Add([]byte{0x08, 0x00, 0x00}, uint8(0))
+	f.Add([]byte{0x08, 0x01, 0xFF, 0x00, 0x00, 0x00}, uint8(1))
+	f.Add([]byte{0x08, 0x01, 0xFF, 0xFF, 0xFF, 0xFF}, uint8(1))
+
+	f.Fuzz(func(t *testing.T, blob []byte, version uint8) {
+		chunkNumber, err := DecodeAcknowledge(blob, version)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeAcknowledge(version, chunkNumber)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeResume(f *testing.F) {
+	f.Add(append([]byte{0x0B, 0x03}, goldenResumeToken...))
+	f.Add([]byte{0x0B, 0x03, 0xCD})
+	f.Add(append([]byte{0x0B, 0x02}, goldenResumeToken...))
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		version, resumeToken, err := DecodeResume(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeResume(version, resumeToken)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeResumed(f *testing.F) {
+	f.Add([]byte{0x0C, 0x03, 0x10, 0x00, 0x00, 0x00, 0x14, 0x01, 0x00, 0x00}, uint8(3))
+	f.Add([]byte{0x0C, 0x03, 0x14, 0x01, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00}, uint8(3))
+	f.Add([]byte{0x0C, 0x03, 0x10, 0x00, 0x00}, uint8(3))
+	f.Add([]byte{0x0C, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, uint8(2))
+
+	f.Fuzz(func(t *testing.T, blob []byte, version uint8) {
+		acknowledgedChunks, nextChunk, err := DecodeResumed(blob, version)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeResumed(version, acknowledgedChunks, nextChunk)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodePinChallenge(f *testing.F) {
+	f.Add(append(append([]byte{0x0F, 0x07}, goldenPinSalt...), append(bytes.Repeat([]byte{0x11}, PinNonceLength), 0x05)...))
+	f.Add(append([]byte{0x0F, 0x07}, goldenPinSalt...))
+	f.Add([]byte{0x0F, 0x06})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		pinSalt, nonce, attemptsRemaining, err := DecodePinChallenge(blob, 7)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodePinChallenge(7, pinSalt, nonce, attemptsRemaining)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodePinResponse(f *testing.F) {
+	f.Add(append([]byte{0x10, 0x07}, bytes.Repeat([]byte{0x22}, PinProofLength)...))
+	f.Add([]byte{0x10, 0x07, 0x22})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		proof, err := DecodePinResponse(blob, 7)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodePinResponse(7, proof)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodePake(f *testing.F) {
+	f.Add([]byte{0x11, 0x08, 0x03, 0x00, 0x04, 0xAA, 0xBB})
+	f.Add([]byte{0x11, 0x08, 0x03, 0x00, 0x04})
+	f.Add([]byte{0x11, 0x08, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		payload, err := DecodePake(blob, 8)
+		if err != nil || len(payload) > MaxPakePayloadLength {
+			return
+		}
+		encoded, err := EncodePake(8, payload)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeVerify(f *testing.F) {
+	f.Add([]byte{0x12, 0x09, 0x00, 0x00})
+	f.Add([]byte{0x12, 0x09, 0x02, 0x00, 0x01, 0x02})
+	f.Add([]byte{0x12, 0x09, 0x02, 0x00, 0x01})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		payload, err := DecodeVerify(blob, 9)
+		if err != nil || len(payload) > MaxVerifyPayloadLength {
+			return
+		}
+		encoded, err := EncodeVerify(9, payload)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func FuzzDecodeError(f *testing.F) {
+	f.Add([]byte{0x09, 0x00, 0x04, 0x00, 0x6F, 0x6F, 0x70, 0x73})
+	f.Add([]byte{0x09, 0x01, 0x04, 0x00, 0x6F, 0x6F, 0x70, 0x73, 0x00, 0x01})
+	f.Add([]byte{0x09, 0x01, 0x04, 0x00, 0x6F, 0x6F, 0x70, 0x73, 0x01})
+	f.Add([]byte{0x09, 0x00, 0x01, 0x00, 0xFF})
+	f.Add([]byte{0x09, 0x00, 0x10, 0x00, 0x6F})
+	f.Add([]byte{0x09, 0x10, 0x04, 0x00, 0x6F, 0x6F, 0x70, 0x73, 0x00, 0x10, 0x03})
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		version, code, errorReason, supportedVersions, err := DecodeError(blob)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeError(version, code, errorReason, supportedVersions)
+		checkRoundTrip(t, blob, encoded, err)
+	})
+}
+
+func TestDecodeRejectsMalformedMessages(t *testing.T) {
+	malformed := []struct {
+		name   string
+		decode func([]byte) error
+		blob   []byte
+	}{
+		{"empty", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err }, []byte{}},
+		{"no version", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err }, []byte{0x01}},
+		{"opcode zero", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err }, []byte{0x00, 0x00}},
+		{"unknown opcode", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err }, []byte{HighestOpCode + 1, 0x00}},
+		{"wrong opcode", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err }, []byte{0x03, 0x00}},
+		{"initiation missing lowest version", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x01}},
+		{"initiation v2 missing window size", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x02, 0x00, 0x01}},
+		{"initiation v2 window size zero", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x02, 0x00, 0x00, 0x00}},
+		{"ready v2 missing window size", func(b []byte) error { _, _, _, err := DecodeReady(b); return err },
+			append([]byte{0x05, 0x02}, goldenPublicKey...)},
+		{"initiation lowest above highest", func(b []byte) error { _, _, err := DecodeReceiverInitiation(b); return err },
+			append([]byte{0x03, 0x01, 0x02}, goldenPublicKey...)},
+		{"initiation v10 unknown key type", func(b []byte) error { _, _, err := DecodeReceiverInitiation(b); return err },
+			append([]byte{0x03, 0x0A, 0x0A, 0x03, 0x20, 0x00}, goldenX25519Key.Key...)},
+		{"initiation v10 key length doesn't match type", func(b []byte) error { _, _, err := DecodeReceiverInitiation(b); return err },
+			append([]byte{0x03, 0x0A, 0x0A, 0x01, 0x20, 0x00}, goldenX25519Key.Key...)},
+		{"ready v10 truncated key", func(b []byte) error { _, _, _, err := DecodeReady(b); return err },
+			append([]byte{0x05, 0x0A, 0x02, 0x20, 0x00}, goldenX25519Key.Key[:16]...)},
+		{"initiation v5 missing time to live", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x05, 0x00, 0x01, 0x00}},
+		{"initiation v7 missing pin protected", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x07, 0x00, 0x01, 0x00, 0x3C, 0x00, 0x00, 0x00}},
+		{"initiation v7 invalid pin protected", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x07, 0x00, 0x01, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x02}},
+		{"initiation v7 missing pin verifier", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			append([]byte{0x01, 0x07, 0x00, 0x01, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x01}, goldenPinSalt...)},
+		{"initiation v8 missing key agreement", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x08, 0x00, 0x01, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00}},
+		{"initiation v8 unknown key agreement", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x08, 0x00, 0x01, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x02}},
+		{"pake before version 8", func(b []byte) error { _, err := DecodePake(b, 7); return err },
+			[]byte{0x11, 0x07, 0x01, 0x00, 0xAA}},
+		{"pake empty payload", func(b []byte) error { _, err := DecodePake(b, 8); return err },
+			[]byte{0x11, 0x08, 0x00, 0x00}},
+		{"pake truncated payload", func(b []byte) error { _, err := DecodePake(b, 8); return err },
+			[]byte{0x11, 0x08, 0x03, 0x00, 0xAA}},
+		{"verify before version 9", func(b []byte) error { _, err := DecodeVerify(b, 8); return err },
+			[]byte{0x12, 0x08, 0x00, 0x00}},
+		{"verify truncated payload", func(b []byte) error { _, err := DecodeVerify(b, 9); return err },
+			[]byte{0x12, 0x09, 0x02, 0x00, 0x01}},
+		{"key mismatch before version 9", func(b []byte) error { return DecodeKeyMismatch(b, 8) },
+			[]byte{0x13, 0x08}},
+		{"pin challenge before version 7", func(b []byte) error { _, _, _, err := DecodePinChallenge(b, 6); return err },
+			append(append([]byte{0x0F, 0x06}, goldenPinSalt...), append(bytes.Repeat([]byte{0x11}, PinNonceLength), 0x05)...)},
+		{"pin challenge no attempts remaining", func(b []byte) error { _, _, _, err := DecodePinChallenge(b, 7); return err },
+			append(append([]byte{0x0F, 0x07}, goldenPinSalt...), append(bytes.Repeat([]byte{0x11}, PinNonceLength), 0x00)...)},
+		{"pin response missing proof", func(b []byte) error { _, err := DecodePinResponse(b, 7); return err },
+			[]byte{0x10, 0x07, 0x22}},
+		{"sender acceptance v5 time to live zero", func(b []byte) error { _, err := DecodeSenderAcceptance(b); return err },
+			append(append([]byte{0x02, 0x05, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...), 0x00, 0x00, 0x00, 0x00)},
+		{"sender acceptance v6 share code text not printable", func(b []byte) error { _, err := DecodeSenderAcceptance(b); return err },
+			append(append([]byte{0x02, 0x06, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...),
+				0x3C, 0x00, 0x00, 0x00, 0x01, 0x0A)},
+		{"sender acceptance v3 missing resume token", func(b []byte) error { _, err := DecodeSenderAcceptance(b); return err },
+			[]byte{0x02, 0x03, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}},
+		{"receiver acceptance v3 missing resume token", func(b []byte) error { _, _, err := DecodeReceiverAcceptance(b); return err },
+			[]byte{0x04, 0x03}},
+		{"resume before version 3", func(b []byte) error { _, _, err := DecodeResume(b); return err },
+			append([]byte{0x0B, 0x02}, goldenResumeToken...)},
+		{"resumed next chunk below acknowledged", func(b []byte) error { _, _, err := DecodeResumed(b, 3); return err },
+			[]byte{0x0C, 0x03, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}},
+		{"unsupported version", func(b []byte) error { _, _, err := DecodeReceiverAcceptance(b); return err },
+			[]byte{0x04, HighestVersion + 1}},
+		{"version mismatch", func(b []byte) error { _, _, err := DecodeMetadata(b, 1); return err },
+			[]byte{0x06, 0x00, 0x01, 0x61, 0x01, 0x00}},
+		{"metadata empty filename", func(b []byte) error { _, _, err := DecodeMetadata(b, 0); return err },
+			[]byte{0x06, 0x00, 0x00, 0x01, 0x00}},
+		{"metadata truncated chunk count", func(b []byte) error { _, _, err := DecodeMetadata(b, 0); return err },
+			[]byte{0x06, 0x00, 0x01, 0x61, 0x01}},
+		{"metadata too many chunks", func(b []byte) error { _, _, err := DecodeMetadata(b, 0); return err },
+			[]byte{0x06, 0x00, 0x01, 0x61, 0x00, 0x01}},
+		{"metadata v1 truncated chunk count", func(b []byte) error { _, _, err := DecodeMetadata(b, 1); return err },
+			[]byte{0x06, 0x01, 0x01, 0x61, 0x01, 0x00}},
+		{"metadata acknowledge v0 wrong chunk", func(b []byte) error { return DecodeMetadataAcknowledge(b, 0) },
+			[]byte{0x08, 0x00, 0x00, 0x00}},
+		{"metadata acknowledge opcode in v0", func(b []byte) error { return DecodeMetadataAcknowledge(b, 0) },
+			[]byte{0x0A, 0x00}},
+		{"data chunk truncated payload", func(b []byte) error { _, _, _, err := DecodeDataChunk(b, 0); return err },
+			[]byte{0x07, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01}},
+		{"data chunk number 0xFF", func(b []byte) error { _, _, _, err := DecodeDataChunk(b, 0); return err },
+			[]byte{0x07, 0x00, 0xFF, 0x00, 0x00, 0x00}},
+		{"data chunk v1 payload too long", func(b []byte) error { _, _, _, err := DecodeDataChunk(b, 1); return err },
+			[]byte{0x07, 0x01, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"data chunk v4 missing file index", func(b []byte) error { _, _, _, err := DecodeDataChunk(b, 4); return err },
+			[]byte{0x07, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"manifest without files", func(b []byte) error { _, err := DecodeManifest(b, 4); return err },
+			[]byte{0x0D, 0x04, 0x00, 0x00}},
+		{"manifest truncated entry", func(b []byte) error { _, err := DecodeManifest(b, 4); return err },
+			[]byte{0x0D, 0x04, 0x01, 0x00, 0x01, 0x00, 0x61, 0x05, 0x00}},
+		{"manifest empty path", func(b []byte) error { _, err := DecodeManifest(b, 4); return err },
+			[]byte{0x0D, 0x04, 0x01, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x00, 0x00, 0x00}},
+		{"manifest too many chunks", func(b []byte) error { _, err := DecodeManifest(b, 4); return err },
+			[]byte{0x0D, 0x04, 0x02, 0x00,
+				0x01, 0x00, 0x61, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF,
+				0x01, 0x00, 0x62, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00, 0x00}},
+		{"end before version 4", func(b []byte) error { _, _, err := DecodeEnd(b, 3); return err },
+			[]byte{0x0E, 0x03}},
+		{"request acceptance before version 12", func(b []byte) error { _, err := DecodeRequestAcceptance(b); return err },
+			[]byte{0x14, 0x0C, 0x0B, 0x01, 0x02, 0x03, 0x04, 0x05, 0x58, 0x02, 0x00, 0x00, 0x01, 0x41}},
+		{"request acceptance time to live zero", func(b []byte) error { _, err := DecodeRequestAcceptance(b); return err },
+			[]byte{0x14, 0x0C, 0x0C, 0x01, 0x02, 0x03, 0x04, 0x05, 0x00, 0x00, 0x00, 0x00, 0x01, 0x41}},
+		{"request acceptance truncated share code text", func(b []byte) error { _, err := DecodeRequestAcceptance(b); return err },
+			[]byte{0x14, 0x0C, 0x0C, 0x01, 0x02, 0x03, 0x04, 0x05, 0x58, 0x02, 0x00, 0x00, 0x03, 0x41}},
+		{"sender initiation v13 missing drop policy", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x0D, 0x00, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08}},
+		{"sender initiation v13 unknown drop policy", func(b []byte) error { _, err := DecodeSenderInitiation(b); return err },
+			[]byte{0x01, 0x0D, 0x00, 0x40, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 0x02}},
+		{"broadcast ready before version 13", func(b []byte) error { _, err := DecodeBroadcastReady(b); return err },
+			append([]byte{0x15, 0x0C, 0x10, 0x00, 0x01, 0x02, 0x20, 0x00}, goldenX25519Key.Key...)},
+		{"broadcast ready without receivers", func(b []byte) error { _, err := DecodeBroadcastReady(b); return err },
+			[]byte{0x15, 0x0D, 0x10, 0x00, 0x00}},
+		{"broadcast ready missing receiver key", func(b []byte) error { _, err := DecodeBroadcastReady(b); return err },
+			append([]byte{0x15, 0x0D, 0x10, 0x00, 0x02, 0x02, 0x20, 0x00}, goldenX25519Key.Key...)},
+		{"decline before version 14", func(b []byte) error { _, err := DecodeDecline(b, 13); return err },
+			[]byte{0x16, 0x0D, 0x00, 0x00, 0x00}},
+		{"decline unknown reason", func(b []byte) error { _, err := DecodeDecline(b, 14); return err },
+			[]byte{0x16, 0x0E, 0x04, 0x00, 0x00}},
+		{"decline truncated message", func(b []byte) error { _, err := DecodeDecline(b, 14); return err },
+			[]byte{0x16, 0x0E, 0x01, 0x03, 0x00, 0x62}},
+		{"decline message not utf-8", func(b []byte) error { _, err := DecodeDecline(b, 14); return err },
+			[]byte{0x16, 0x0E, 0x01, 0x01, 0x00, 0xFF}},
+		{"cancel before version 15", func(b []byte) error { _, _, err := DecodeCancel(b); return err },
+			[]byte{0x17, 0x0E, 0x00, 0x00}},
+		{"cancel truncated reason", func(b []byte) error { _, _, err := DecodeCancel(b); return err },
+			[]byte{0x17, 0x0F, 0x03, 0x00, 0x62}},
+		{"cancel reason not utf-8", func(b []byte) error { _, _, err := DecodeCancel(b); return err },
+			[]byte{0x17, 0x0F, 0x01, 0x00, 0xFF}},
+		{"status before version 17", func(b []byte) error { _, _, err := DecodeStatus(b); return err },
+			[]byte{0x18, 0x10, 0x00, 0x01, 0x00, 0x00, 0x00}},
+		{"status truncated value", func(b []byte) error { _, _, err := DecodeStatus(b); return err },
+			[]byte{0x18, 0x11, 0x01, 0x01, 0x00}},
+		{"end v11 missing number of chunks", func(b []byte) error { _, _, err := DecodeEnd(b, 11); return err },
+			[]byte{0x0E, 0x0B}},
+		{"end v11 empty digest", func(b []byte) error { _, _, err := DecodeEnd(b, 11); return err },
+			[]byte{0x0E, 0x0B, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"end v11 truncated digest", func(b []byte) error { _, _, err := DecodeEnd(b, 11); return err },
+			[]byte{0x0E, 0x0B, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0xAA}},
+		{"manifest streamed before version 11", func(b []byte) error { _, err := DecodeManifest(b, 10); return err },
+			[]byte{0x0D, 0x0A, 0x01, 0x00, 0x01, 0x00, 0x61,
+				0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"manifest streamed with two files", func(b []byte) error { _, err := DecodeManifest(b, 11); return err },
+			[]byte{0x0D, 0x0B, 0x02, 0x00,
+				0x01, 0x00, 0x61, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+				0x01, 0x00, 0x62, 0, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x00, 0x00, 0x00}},
+		{"acknowledge out of range", func(b []byte) error { _, err := DecodeAcknowledge(b, 0); return err },
+			[]byte{0x08, 0x00, 0x00, 0x01}},
+		{"acknowledge v0 metadata", func(b []byte) error { _, err := DecodeAcknowledge(b, 0); return err },
+			[]byte{0x08, 0x00, 0xFF, 0x00}},
+		{"error invalid utf-8", func(b []byte) error { _, _, _, _, err := DecodeError(b); return err },
+			[]byte{0x09, 0x00, 0x01, 0x00, 0xFF}},
+		{"error v1 missing supported versions", func(b []byte) error { _, _, _, _, err := DecodeError(b); return err },
+			[]byte{0x09, 0x01, 0x01, 0x00, 0x61}},
+		{"error v16 missing code", func(b []byte) error { _, _, _, _, err := DecodeError(b); return err },
+			[]byte{0x09, 0x10, 0x01, 0x00, 0x61, 0x00, 0x10}},
+	}
+
+	for _, message := range malformed {
+		if err := message.decode(message.blob); err == nil {
+			t.Errorf("Malformed message %q (%v) should not decode", message.name, message.blob)
+		}
+	}
+}
+
+func TestDecodeMetadataIgnoresExtraBytes(t *testing.T) {
+	blob := []byte{0x06, 0x00, 0x01, 0x61, 0x02, 0x00, 0xFF, 0xFF}
+
+	filename, numberOfChunks, err := DecodeMetadata(blob, 0)
+
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if !bytes.Equal(filename, []byte("a")) || numberOfChunks != 2 {
+		t.Errorf("Decoded (%v, %v) should be (%v, %v)", filename, numberOfChunks, []byte("a"), 2)
+	}
+}
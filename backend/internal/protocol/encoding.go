@@ -0,0 +1,699 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+func commonEncoding(op Opcode, version uint8) []byte {
+	return []byte{uint8(op), version}
+}
+
+// From version 1 initiation and acceptance messages carry a range of versions,
+// the version byte is the highest version and is followed by the lowest
+func encodeVersionRange(op Opcode, versions VersionRange) ([]byte, error) {
+	if versions.Lowest > versions.Highest {
+		return nil, fmt.Errorf("Lowest version %v is higher than highest version %v.", versions.Lowest, versions.Highest)
+	}
+
+	blob := commonEncoding(op, versions.Highest)
+
+	if versions.Highest == 0 {
+		return blob, nil
+	}
+
+	return append(blob, versions.Lowest), nil
+}
+
+// From version 1 errors carry the versions supported by the relay and from
+// version 16 an error code, the code is ignored before version 16
+func EncodeError(version uint8, code ErrorCode, errorReason string, supportedVersions VersionRange) ([]byte, error) {
+	blob := commonEncoding(ERROR, version)
+
+	maxValue := 65535 // 2^16 - 1
+
+	length := len(errorReason)
+
+	if length > maxValue {
+		return nil, fmt.Errorf("Argument `errorReason` must be less than 2^16 bytes in length.")
+	}
+
+	if !utf8.ValidString(errorReason) {
+		return nil, fmt.Errorf("Argument `errorReason` must be valid utf-8.")
+	}
+
+	lengthBytes := make([]byte, 2)
+	putUint(lengthBytes, uint32(length))
+
+	blob = append(blob, lengthBytes...)
+	blob = append(blob, []byte(errorReason)...)
+
+	if version >= 1 {
+		if supportedVersions.Lowest > supportedVersions.Highest {
+			return nil, fmt.Errorf("Lowest version %v is higher than highest version %v.",
+				supportedVersions.Lowest, supportedVersions.Highest)
+		}
+		blob = append(blob, supportedVersions.Lowest, supportedVersions.Highest)
+	}
+
+	if version >= ErrorCodesVersion {
+		blob = append(blob, uint8(code))
+	}
+
+	return blob, nil
+}
+
+// Fields of SENDER_INITIATION, fields added by later versions are ignored when the
+// highest version supported by the sender is below the version that added them
+type SenderInitiation struct {
+	Versions VersionRange
+	// From version 2, the requested window size (at least 1)
+	WindowSize uint16
+	// From version 5, the requested time to live in seconds (0 for the relay's default)
+	TimeToLive uint32
+	// From version 7, the salt and verifier of the share's PIN, both empty if the
+	// share isn't protected by a PIN
+	PinSalt     []byte
+	PinVerifier []byte
+	// From version 8, how the sender and receiver agree the share's key
+	KeyAgreement uint8
+	// From version 13, the most receivers that may join (0 or 1 for a share with
+	// one receiver) and what happens when one of them drops
+	Receivers  uint8
+	DropPolicy uint8
+}
+
+func EncodeSenderInitiation(initiation SenderInitiation) ([]byte, error) {
+	blob, err := encodeVersionRange(SENDER_INITIATION, initiation.Versions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if initiation.Versions.Highest >= 2 {
+		if initiation.WindowSize == 0 {
+			return nil, fmt.Errorf("Argument `windowSize` must be at least 1.")
+		}
+
+		windowSizeBytes := make([]byte, 2)
+		putUint(windowSizeBytes, uint32(initiation.WindowSize))
+		blob = append(blob, windowSizeBytes...)
+	}
+
+	if initiation.Versions.Highest >= 5 {
+		timeToLiveBytes := make([]byte, 4)
+		putUint(timeToLiveBytes, initiation.TimeToLive)
+		blob = append(blob, timeToLiveBytes...)
+	}
+
+	if initiation.Versions.Highest >= IntroducedIn(PIN_CHALLENGE) {
+		if len(initiation.PinSalt) == 0 && len(initiation.PinVerifier) == 0 {
+			blob = append(blob, 0x00)
+		} else {
+			if len(initiation.PinSalt) != PinSaltLength || len(initiation.PinVerifier) != PinVerifierLength {
+				return nil, fmt.Errorf("Arguments `pinSalt` and `pinVerifier` should be of length %d and %d are actually of length %d and %d.",
+					PinSaltLength, PinVerifierLength, len(initiation.PinSalt), len(initiation.PinVerifier))
+			}
+
+			blob = append(blob, 0x01)
+			blob = append(blob, initiation.PinSalt...)
+			blob = append(blob, initiation.PinVerifier...)
+		}
+	}
+
+	if initiation.Versions.Highest >= IntroducedIn(PAKE) {
+		if !IsValidKeyAgreement(initiation.KeyAgreement) {
+			return nil, fmt.Errorf("Argument `keyAgreement` must be 0x00 or 0x01 is %#02x.", initiation.KeyAgreement)
+		}
+		blob = append(blob, initiation.KeyAgreement)
+	}
+
+	if initiation.Versions.Highest >= IntroducedIn(BROADCAST_READY) {
+		if !IsValidDropPolicy(initiation.DropPolicy) {
+			return nil, fmt.Errorf("Argument `dropPolicy` must be 0x00 or 0x01 is %#02x.", initiation.DropPolicy)
+		}
+		blob = append(blob, initiation.Receivers, initiation.DropPolicy)
+	}
+
+	return blob, nil
+}
+
+// Fields of SENDER_ACCEPTED, fields added by later versions are ignored when the
+// highest common version is below the version that added them
+type SenderAcceptance struct {
+	// Versions supported by both the sender and relay
+	Versions  VersionRange
+	ShareCode []byte
+	// From version 3
+	ResumeToken []byte
+	// From version 5, seconds the share waits for a receiver
+	TimeToLive uint32
+	// From version 6, share code as text for the receiver to type in (printable ascii)
+	ShareCodeText string
+}
+
+func EncodeSenderAcceptance(acceptance SenderAcceptance) ([]byte, error) {
+	if len(acceptance.ShareCode) != ShareCodeLength {
+		return nil, fmt.Errorf("Argument `share_code` should be of length %d is actually of length %d.",
+			ShareCodeLength, len(acceptance.ShareCode))
+	}
+
+	blob, err := encodeVersionRange(SENDER_ACCEPTED, acceptance.Versions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blob = append(blob, acceptance.ShareCode...)
+
+	if acceptance.Versions.Highest >= 3 {
+		if len(acceptance.ResumeToken) != ResumeTokenLength {
+			return nil, fmt.Errorf("Argument `resumeToken` should be of length %d is actually of length %d.",
+				ResumeTokenLength, len(acceptance.ResumeToken))
+		}
+		blob = append(blob, acceptance.ResumeToken...)
+	}
+
+	if acceptance.Versions.Highest >= 5 {
+		if acceptance.TimeToLive == 0 {
+			return nil, fmt.Errorf("Argument `timeToLive` must be at least 1.")
+		}
+
+		timeToLiveBytes := make([]byte, 4)
+		putUint(timeToLiveBytes, acceptance.TimeToLive)
+		blob = append(blob, timeToLiveBytes...)
+	}
+
+	if acceptance.Versions.Highest >= 6 {
+		if !IsValidShareCodeText(acceptance.ShareCodeText) {
+			return nil, fmt.Errorf("Argument `shareCodeText` must be 1 to %v printable ascii characters.",
+				MaxShareCodeTextLength)
+		}
+
+		blob = append(blob, uint8(len(acceptance.ShareCodeText)))
+		blob = append(blob, acceptance.ShareCodeText...)
+	}
+
+	return blob, nil
+}
+
+// Sent to a receiver that created a share request, from version 12
+type RequestAcceptance struct {
+	// Versions supported by both the receiver and relay, the lowest is at least 12
+	Versions  VersionRange
+	ShareCode []byte
+	// Seconds the request waits for a sender
+	TimeToLive uint32
+	// Share code as text for the sender to type in (printable ascii)
+	ShareCodeText string
+}
+
+func EncodeRequestAcceptance(acceptance RequestAcceptance) ([]byte, error) {
+	if acceptance.Versions.Lowest < IntroducedIn(REQUEST_ACCEPTED) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", REQUEST_ACCEPTED, acceptance.Versions.Lowest)
+	}
+
+	if len(acceptance.ShareCode) != ShareCodeLength {
+		return nil, fmt.Errorf("Argument `share_code` should be of length %d is actually of length %d.",
+			ShareCodeLength, len(acceptance.ShareCode))
+	}
+
+	if acceptance.TimeToLive == 0 {
+		return nil, fmt.Errorf("Argument `timeToLive` must be at least 1.")
+	}
+
+	if !IsValidShareCodeText(acceptance.ShareCodeText) {
+		return nil, fmt.Errorf("Argument `shareCodeText` must be 1 to %v printable ascii characters.",
+			MaxShareCodeTextLength)
+	}
+
+	blob, err := encodeVersionRange(REQUEST_ACCEPTED, acceptance.Versions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	timeToLiveBytes := make([]byte, 4)
+	putUint(timeToLiveBytes, acceptance.TimeToLive)
+
+	blob = append(blob, acceptance.ShareCode...)
+	blob = append(blob, timeToLiveBytes...)
+	blob = append(blob, uint8(len(acceptance.ShareCodeText)))
+	blob = append(blob, acceptance.ShareCodeText...)
+
+	return blob, nil
+}
+
+func EncodeReceiverInitiation(supportedVersions VersionRange, publicKey ReceiverKey) ([]byte, error) {
+	blob, err := encodeVersionRange(RECEIVER_INITIATION, supportedVersions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := encodeKeyFor(supportedVersions.Highest, publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(blob, key...), nil
+}
+
+// Before version 10 only the 512 byte RSA-4096 modulus is sent
+func encodeKeyFor(version uint8, publicKey ReceiverKey) ([]byte, error) {
+	if version >= KeyTypesVersion {
+		return encodeReceiverKey(publicKey)
+	}
+
+	if publicKey.KeyType != KeyTypeRsa4096 {
+		return nil, fmt.Errorf("Key type %#02x requires version %v.", publicKey.KeyType, KeyTypesVersion)
+	}
+
+	if len(publicKey.Key) != PublicKeyLength {
+		return nil, fmt.Errorf("Public key should be %d bytes is actually %d.",
+			PublicKeyLength, len(publicKey.Key))
+	}
+
+	return publicKey.Key, nil
+}
+
+// Takes the negotiated version, from version 3 the receiver's resume token is
+// sent as well, it is ignored for lower versions
+func EncodeReceiverAcceptance(version uint8, resumeToken []byte) ([]byte, error) {
+	blob := commonEncoding(RECEIVER_ACCEPTED, version)
+
+	if version >= 3 {
+		if len(resumeToken) != ResumeTokenLength {
+			return nil, fmt.Errorf("Argument `resumeToken` should be of length %d is actually of length %d.",
+				ResumeTokenLength, len(resumeToken))
+		}
+		blob = append(blob, resumeToken...)
+	}
+
+	return blob, nil
+}
+
+// Takes the negotiated version, from version 2 the negotiated window size is
+// sent as well, it is ignored for lower versions
+func EncodeReady(version uint8, publicKey ReceiverKey, windowSize uint16) ([]byte, error) {
+	key, err := encodeKeyFor(version, publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blob := commonEncoding(READY, version)
+
+	blob = append(blob, key...)
+
+	if version >= 2 {
+		if windowSize == 0 {
+			return nil, fmt.Errorf("Argument `windowSize` must be at least 1.")
+		}
+
+		windowSizeBytes := make([]byte, 2)
+		putUint(windowSizeBytes, uint32(windowSize))
+		blob = append(blob, windowSizeBytes...)
+	}
+
+	return blob, nil
+}
+
+func EncodeBroadcastReady(ready BroadcastReady) ([]byte, error) {
+	if ready.Version < IntroducedIn(BROADCAST_READY) {
+		return nil, fmt.Errorf("Broadcast ready requires version %v.", IntroducedIn(BROADCAST_READY))
+	}
+
+	if ready.WindowSize == 0 {
+		return nil, fmt.Errorf("Argument `windowSize` must be at least 1.")
+	}
+
+	if len(ready.ReceiverKeys) == 0 || len(ready.ReceiverKeys) > MaxBroadcastReceivers {
+		return nil, fmt.Errorf("Argument `receiverKeys` should have between 1 and %v keys has %v.",
+			MaxBroadcastReceivers, len(ready.ReceiverKeys))
+	}
+
+	blob := commonEncoding(BROADCAST_READY, ready.Version)
+
+	windowSizeBytes := make([]byte, 2)
+	putUint(windowSizeBytes, uint32(ready.WindowSize))
+	blob = append(blob, windowSizeBytes...)
+	blob = append(blob, uint8(len(ready.ReceiverKeys)))
+
+	for _, receiverKey := range ready.ReceiverKeys {
+		key, err := encodeReceiverKey(receiverKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		blob = append(blob, key...)
+	}
+
+	return blob, nil
+}
+
+func EncodeMetadata(version uint8, filename []byte, numberOfChunks uint32) ([]byte, error) {
+	if len(filename) == 0 || len(filename) > 255 {
+		return nil, fmt.Errorf("Argument `filename` should be between 1 and 255 bytes is actually %d.", len(filename))
+	}
+
+	if numberOfChunks > MaxNumberOfChunks(version) {
+		return nil, fmt.Errorf("Argument `numberOfChunks` must be at most %v is %v.", MaxNumberOfChunks(version), numberOfChunks)
+	}
+
+	blob := commonEncoding(METADATA, version)
+
+	numberOfChunksBytes := make([]byte, CounterLength(version))
+	putUint(numberOfChunksBytes, numberOfChunks)
+
+	blob = append(blob, uint8(len(filename)))
+	blob = append(blob, filename...)
+	blob = append(blob, numberOfChunksBytes...)
+
+	return blob, nil
+}
+
+// In version 0 the metadata is acknowledged with an ACKNOWLEDGE for chunk 0xFF,
+// from version 1 it has its own METADATA_ACKNOWLEDGE message
+func EncodeMetadataAcknowledge(version uint8) []byte {
+	if version == 0 {
+		blob := commonEncoding(ACKNOWLEDGE, version)
+		return append(blob, MetadataChunkNumberV0, 0x00)
+	}
+	return commonEncoding(METADATA_ACKNOWLEDGE, version)
+}
+
+// From version 4 chunks carry the index of the file in the manifest they belong to,
+// the file index is ignored for lower versions
+func EncodeDataChunk(version uint8, fileIndex uint16, chunkNumber uint32, payload []byte) ([]byte, error) {
+	if chunkNumber > MaxChunkNumber(version) {
+		return nil, fmt.Errorf("Argument `chunkNumber` must be at most %X is %X.", MaxChunkNumber(version), chunkNumber)
+	}
+
+	if len(payload) > MaxPayloadLength(version) {
+		return nil, fmt.Errorf("Argument `payload` must be at most %v bytes in length.", MaxPayloadLength(version))
+	}
+
+	blob := commonEncoding(DATA_CHUNK, version)
+
+	if FileIndexLength(version) > 0 {
+		fileIndexBytes := make([]byte, FileIndexLength(version))
+		putUint(fileIndexBytes, uint32(fileIndex))
+		blob = append(blob, fileIndexBytes...)
+	}
+
+	chunkNumberBytes := make([]byte, CounterLength(version))
+	putUint(chunkNumberBytes, chunkNumber)
+	payloadLengthBytes := make([]byte, PayloadLengthLength(version))
+	putUint(payloadLengthBytes, uint32(len(payload)))
+
+	blob = append(blob, chunkNumberBytes...)
+	blob = append(blob, payloadLengthBytes...)
+	blob = append(blob, payload...)
+
+	return blob, nil
+}
+
+func EncodeAcknowledge(version uint8, chunkNumber uint32) ([]byte, error) {
+	if chunkNumber > MaxChunkNumber(version) {
+		return nil, fmt.Errorf("Argument `chunkNumber` must be at most %X is %X.", MaxChunkNumber(version), chunkNumber)
+	}
+
+	blob := commonEncoding(ACKNOWLEDGE, version)
+
+	chunkNumberBytes := make([]byte, CounterLength(version))
+	putUint(chunkNumberBytes, chunkNumber)
+
+	blob = append(blob, chunkNumberBytes...)
+
+	return blob, nil
+}
+
+func EncodeResume(version uint8, resumeToken []byte) ([]byte, error) {
+	if version < IntroducedIn(RESUME) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", RESUME, version)
+	}
+
+	if len(resumeToken) != ResumeTokenLength {
+		return nil, fmt.Errorf("Argument `resumeToken` should be of length %d is actually of length %d.",
+			ResumeTokenLength, len(resumeToken))
+	}
+
+	blob := commonEncoding(RESUME, version)
+
+	blob = append(blob, resumeToken...)
+
+	return blob, nil
+}
+
+// Takes the number of chunks acknowledged by the receiver and the next chunk the sender should send
+func EncodeResumed(version uint8, acknowledgedChunks uint32, nextChunk uint32) ([]byte, error) {
+	if version < IntroducedIn(RESUMED) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", RESUMED, version)
+	}
+
+	if nextChunk < acknowledgedChunks {
+		return nil, fmt.Errorf("Argument `nextChunk` %v must not be below `acknowledgedChunks` %v.",
+			nextChunk, acknowledgedChunks)
+	}
+
+	blob := commonEncoding(RESUMED, version)
+
+	countersBytes := make([]byte, 8)
+	putUint(countersBytes[:4], acknowledgedChunks)
+	putUint(countersBytes[4:], nextChunk)
+
+	blob = append(blob, countersBytes...)
+
+	return blob, nil
+}
+
+// From version 4 the sender describes every file of the share in a MANIFEST instead of METADATA
+func EncodeManifest(version uint8, files []ManifestEntry) ([]byte, error) {
+	if version < IntroducedIn(MANIFEST) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", MANIFEST, version)
+	}
+
+	err := ValidateManifest(version, files)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blob := commonEncoding(MANIFEST, version)
+
+	numberOfFilesBytes := make([]byte, 2)
+	putUint(numberOfFilesBytes, uint32(len(files)))
+	blob = append(blob, numberOfFilesBytes...)
+
+	for _, file := range files {
+		pathLengthBytes := make([]byte, 2)
+		putUint(pathLengthBytes, uint32(len(file.Path)))
+		sizeBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(sizeBytes, file.Size)
+		numberOfChunksBytes := make([]byte, CounterLength(version))
+		putUint(numberOfChunksBytes, file.NumberOfChunks)
+
+		blob = append(blob, pathLengthBytes...)
+		blob = append(blob, file.Path...)
+		blob = append(blob, sizeBytes...)
+		blob = append(blob, numberOfChunksBytes...)
+	}
+
+	return blob, nil
+}
+
+// Takes the number of chunks in the share and an opaque digest of them for the
+// receiver, both are only sent from version 11
+func EncodeEnd(version uint8, numberOfChunks uint32, digest []byte) ([]byte, error) {
+	if version < IntroducedIn(END) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", END, version)
+	}
+
+	blob := commonEncoding(END, version)
+
+	if version < StreamingVersion {
+		return blob, nil
+	}
+
+	if len(digest) == 0 || len(digest) > MaxEndDigestLength {
+		return nil, fmt.Errorf("Argument `digest` must be 1 to %v bytes is %v.", MaxEndDigestLength, len(digest))
+	}
+
+	numberOfChunksBytes := make([]byte, CounterLength(version))
+	putUint(numberOfChunksBytes, numberOfChunks)
+
+	lengthBytes := make([]byte, 2)
+	putUint(lengthBytes, uint32(len(digest)))
+
+	blob = append(blob, numberOfChunksBytes...)
+	blob = append(blob, lengthBytes...)
+	blob = append(blob, digest...)
+
+	return blob, nil
+}
+
+// Takes the salt of the share's PIN, a random nonce and how many more incorrect
+// PINs the receiver may give before the share is cancelled
+func EncodePinChallenge(version uint8, pinSalt []byte, nonce []byte, attemptsRemaining uint8) ([]byte, error) {
+	if version < IntroducedIn(PIN_CHALLENGE) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", PIN_CHALLENGE, version)
+	}
+
+	if len(pinSalt) != PinSaltLength {
+		return nil, fmt.Errorf("Argument `pinSalt` should be of length %d is actually of length %d.", PinSaltLength, len(pinSalt))
+	}
+
+	if len(nonce) != PinNonceLength {
+		return nil, fmt.Errorf("Argument `nonce` should be of length %d is actually of length %d.", PinNonceLength, len(nonce))
+	}
+
+	if attemptsRemaining == 0 {
+		return nil, fmt.Errorf("Argument `attemptsRemaining` must be at least 1.")
+	}
+
+	blob := commonEncoding(PIN_CHALLENGE, version)
+
+	blob = append(blob, pinSalt...)
+	blob = append(blob, nonce...)
+	blob = append(blob, attemptsRemaining)
+
+	return blob, nil
+}
+
+// Takes the receiver's proof, HMAC-SHA256 of the challenge nonce keyed with its PIN verifier
+func EncodePinResponse(version uint8, proof []byte) ([]byte, error) {
+	if version < IntroducedIn(PIN_RESPONSE) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", PIN_RESPONSE, version)
+	}
+
+	if len(proof) != PinProofLength {
+		return nil, fmt.Errorf("Argument `proof` should be of length %d is actually of length %d.", PinProofLength, len(proof))
+	}
+
+	blob := commonEncoding(PIN_RESPONSE, version)
+
+	blob = append(blob, proof...)
+
+	return blob, nil
+}
+
+// Takes an opaque key agreement message to forward to the other peer
+func EncodePake(version uint8, payload []byte) ([]byte, error) {
+	if version < IntroducedIn(PAKE) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", PAKE, version)
+	}
+
+	if len(payload) == 0 || len(payload) > MaxPakePayloadLength {
+		return nil, fmt.Errorf("Argument `payload` must be 1 to %v bytes is %v.", MaxPakePayloadLength, len(payload))
+	}
+
+	blob := commonEncoding(PAKE, version)
+
+	lengthBytes := make([]byte, 2)
+	putUint(lengthBytes, uint32(len(payload)))
+
+	blob = append(blob, lengthBytes...)
+	blob = append(blob, payload...)
+
+	return blob, nil
+}
+
+// Takes an opaque payload to forward to the other peer, it may be empty
+func EncodeVerify(version uint8, payload []byte) ([]byte, error) {
+	if version < IntroducedIn(VERIFY) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", VERIFY, version)
+	}
+
+	if len(payload) > MaxVerifyPayloadLength {
+		return nil, fmt.Errorf("Argument `payload` must be at most %v bytes is %v.", MaxVerifyPayloadLength, len(payload))
+	}
+
+	blob := commonEncoding(VERIFY, version)
+
+	lengthBytes := make([]byte, 2)
+	putUint(lengthBytes, uint32(len(payload)))
+
+	blob = append(blob, lengthBytes...)
+	blob = append(blob, payload...)
+
+	return blob, nil
+}
+
+func EncodeKeyMismatch(version uint8) ([]byte, error) {
+	if version < IntroducedIn(KEY_MISMATCH) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", KEY_MISMATCH, version)
+	}
+
+	return commonEncoding(KEY_MISMATCH, version), nil
+}
+
+func EncodeDecline(version uint8, decline Decline) ([]byte, error) {
+	if version < IntroducedIn(DECLINE) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", DECLINE, version)
+	}
+
+	if !IsValidDeclineReason(decline.Reason) {
+		return nil, fmt.Errorf("Unknown decline reason %#02x.", decline.Reason)
+	}
+
+	if len(decline.Message) > MaxDeclineMessageLength {
+		return nil, fmt.Errorf("Argument `message` must be at most %v bytes is %v.", MaxDeclineMessageLength, len(decline.Message))
+	}
+
+	if !utf8.ValidString(decline.Message) {
+		return nil, fmt.Errorf("Argument `message` must be valid utf-8.")
+	}
+
+	blob := commonEncoding(DECLINE, version)
+	blob = append(blob, decline.Reason)
+
+	lengthBytes := make([]byte, 2)
+	putUint(lengthBytes, uint32(len(decline.Message)))
+
+	blob = append(blob, lengthBytes...)
+	blob = append(blob, decline.Message...)
+
+	return blob, nil
+}
+
+func EncodeCancel(version uint8, reason string) ([]byte, error) {
+	if version < IntroducedIn(CANCEL) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", CANCEL, version)
+	}
+
+	if len(reason) > MaxCancelReasonLength {
+		return nil, fmt.Errorf("Argument `reason` must be at most %v bytes is %v.", MaxCancelReasonLength, len(reason))
+	}
+
+	if !utf8.ValidString(reason) {
+		return nil, fmt.Errorf("Argument `reason` must be valid utf-8.")
+	}
+
+	blob := commonEncoding(CANCEL, version)
+
+	lengthBytes := make([]byte, 2)
+	putUint(lengthBytes, uint32(len(reason)))
+
+	blob = append(blob, lengthBytes...)
+	blob = append(blob, reason...)
+
+	return blob, nil
+}
+
+func EncodeStatus(version uint8, status Status) ([]byte, error) {
+	if version < IntroducedIn(STATUS) {
+		return nil, fmt.Errorf("%v is not defined in protocol version {%v}.", STATUS, version)
+	}
+
+	blob := commonEncoding(STATUS, version)
+	blob = append(blob, status.Event)
+
+	valueBytes := make([]byte, 4)
+	putUint(valueBytes, status.Value)
+
+	return append(blob, valueBytes...), nil
+}
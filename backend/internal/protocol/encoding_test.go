@@ -0,0 +1,854 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Golden test vectors for every message type in documentation/Protocol.md,
+// each vector is checked against both the encoder and the decoder.
+
+var goldenPublicKey = bytes.Repeat([]byte{0xAB}, PublicKeyLength)
+
+var goldenRsaKey = ReceiverKey{KeyType: KeyTypeRsa4096, Key: goldenPublicKey}
+
+var goldenX25519Key = ReceiverKey{KeyType: KeyTypeX25519, Key: bytes.Repeat([]byte{0x25}, 32)}
+
+var goldenResumeToken = bytes.Repeat([]byte{0xCD}, ResumeTokenLength)
+
+var goldenPinSalt = bytes.Repeat([]byte{0x5A}, PinSaltLength)
+
+var goldenPinVerifier = bytes.Repeat([]byte{0x7E}, PinVerifierLength)
+
+func TestGoldenSenderInitiation(t *testing.T) {
+	vectors := []struct {
+		initiation SenderInitiation
+		wanted     []byte
+	}{
+		{SenderInitiation{Versions: VersionRange{0, 0}, WindowSize: 1}, []byte{0x01, 0x00}},
+		{SenderInitiation{Versions: VersionRange{0, 1}, WindowSize: 1}, []byte{0x01, 0x01, 0x00}},
+		{SenderInitiation{Versions: VersionRange{0, 2}, WindowSize: 0x140}, []byte{0x01, 0x02, 0x00, 0x40, 0x01}},
+		{SenderInitiation{Versions: VersionRange{0, 5}, WindowSize: 0x140, TimeToLive: 0x258},
+			[]byte{0x01, 0x05, 0x00, 0x40, 0x01, 0x58, 0x02, 0x00, 0x00}},
+		{SenderInitiation{Versions: VersionRange{0, 7}, WindowSize: 0x140, TimeToLive: 0x258},
+			[]byte{0x01, 0x07, 0x00, 0x40, 0x01, 0x58, 0x02, 0x00, 0x00, 0x00}},
+		{SenderInitiation{Versions: VersionRange{7, 7}, WindowSize: 0x140, TimeToLive: 0x258,
+			PinSalt: goldenPinSalt, PinVerifier: goldenPinVerifier},
+			append(append([]byte{0x01, 0x07, 0x07, 0x40, 0x01, 0x58, 0x02, 0x00, 0x00, 0x01}, goldenPinSalt...), goldenPinVerifier...)},
+		{SenderInitiation{Versions: VersionRange{0, 8}, WindowSize: 0x140, TimeToLive: 0x258, KeyAgreement: KeyAgreementPake},
+			[]byte{0x01, 0x08, 0x00, 0x40, 0x01, 0x58, 0x02, 0x00, 0x00, 0x00, 0x01}},
+		{SenderInitiation{Versions: VersionRange{0, 8}, WindowSize: 0x140, TimeToLive: 0x258,
+			PinSalt: goldenPinSalt, PinVerifier: goldenPinVerifier},
+			append(append(append([]byte{0x01, 0x08, 0x00, 0x40, 0x01, 0x58, 0x02, 0x00, 0x00, 0x01}, goldenPinSalt...), goldenPinVerifier...), 0x00)},
+		{SenderInitiation{Versions: VersionRange{0, 13}, WindowSize: 0x140, TimeToLive: 0x258, Receivers: 0x0C, DropPolicy: DropPolicyContinue},
+			[]byte{0x01, 0x0D, 0x00, 0x40, 0x01, 0x58, 0x02, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x01}},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeSenderInitiation(vector.initiation)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		initiation, err := DecodeSenderInitiation(vector.wanted)
+
+		if err != nil {
+			t.Fatalf("Failed to decode %v: %v", vector.wanted, err)
+		}
+
+		if initiation.Versions != vector.initiation.Versions || initiation.WindowSize != vector.initiation.WindowSize ||
+			initiation.TimeToLive != vector.initiation.TimeToLive || initiation.KeyAgreement != vector.initiation.KeyAgreement ||
+			initiation.Receivers != vector.initiation.Receivers || initiation.DropPolicy != vector.initiation.DropPolicy ||
+			!bytes.Equal(initiation.PinSalt, vector.initiation.PinSalt) ||
+			!bytes.Equal(initiation.PinVerifier, vector.initiation.PinVerifier) {
+			t.Errorf("Decoded %+v should be %+v", initiation, vector.initiation)
+		}
+	}
+}
+
+func TestGoldenSenderAcceptance(t *testing.T) {
+	shareCode := []byte{0x01, 0x02, 0x03, 0x04, 0x05}
+	vectors := []struct {
+		acceptance SenderAcceptance
+		wanted     []byte
+	}{
+		{SenderAcceptance{Versions: VersionRange{0, 0}, ShareCode: shareCode},
+			[]byte{0x02, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}},
+		{SenderAcceptance{Versions: VersionRange{0, 1}, ShareCode: shareCode},
+			[]byte{0x02, 0x01, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}},
+		{SenderAcceptance{Versions: VersionRange{1, 3}, ShareCode: shareCode, ResumeToken: goldenResumeToken},
+			append([]byte{0x02, 0x03, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...)},
+		{SenderAcceptance{Versions: VersionRange{1, 5}, ShareCode: shareCode, ResumeToken: goldenResumeToken, TimeToLive: 0x258},
+			append(append([]byte{0x02, 0x05, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...), 0x58, 0x02, 0x00, 0x00)},
+		{SenderAcceptance{Versions: VersionRange{1, 6}, ShareCode: shareCode, ResumeToken: goldenResumeToken, TimeToLive: 0x258,
+			ShareCodeText: "AQIDBAU="},
+			append(append([]byte{0x02, 0x06, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05}, goldenResumeToken...),
+				0x58, 0x02, 0x00, 0x00, 0x08, 0x41, 0x51, 0x49, 0x44, 0x42, 0x41, 0x55, 0x3D)},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeSenderAcceptance(vector.acceptance)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		acceptance, err := DecodeSenderAcceptance(vector.wanted)
+
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+
+		if acceptance.Versions != vector.acceptance.Versions || !bytes.Equal(acceptance.ShareCode, shareCode) ||
+			!bytes.Equal(acceptance.ResumeToken, vector.acceptance.ResumeToken) ||
+			acceptance.TimeToLive != vector.acceptance.TimeToLive ||
+			acceptance.ShareCodeText != vector.acceptance.ShareCodeText {
+			t.Errorf("Decoded %v should be %v", acceptance, vector.acceptance)
+		}
+	}
+}
+
+func TestGoldenRequestAcceptance(t *testing.T) {
+	acceptance := RequestAcceptance{
+		Versions:      VersionRange{12, 12},
+		ShareCode:     []byte{0x01, 0x02, 0x03, 0x04, 0x05},
+		TimeToLive:    0x258,
+		ShareCodeText: "AQIDBAU=",
+	}
+	wanted := []byte{0x14, 0x0C, 0x0C, 0x01, 0x02, 0x03, 0x04, 0x05, 0x58, 0x02, 0x00, 0x00,
+		0x08, 0x41, 0x51, 0x49, 0x44, 0x42, 0x41, 0x55, 0x3D}
+
+	data, err := EncodeRequestAcceptance(acceptance)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	decoded, err := DecodeRequestAcceptance(wanted)
+
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if decoded.Versions != acceptance.Versions || !bytes.Equal(decoded.ShareCode, acceptance.ShareCode) ||
+		decoded.TimeToLive != acceptance.TimeToLive || decoded.ShareCodeText != acceptance.ShareCodeText {
+		t.Errorf("Decoded %v should be %v", decoded, acceptance)
+	}
+}
+
+func TestGoldenReceiverInitiation(t *testing.T) {
+	vectors := []struct {
+		versions VersionRange
+		key      ReceiverKey
+		wanted   []byte
+	}{
+		{VersionRange{0, 0}, goldenRsaKey, append([]byte{0x03, 0x00}, goldenPublicKey...)},
+		{VersionRange{0, 1}, goldenRsaKey, append([]byte{0x03, 0x01, 0x00}, goldenPublicKey...)},
+		{VersionRange{0, 10}, goldenRsaKey, append([]byte{0x03, 0x0A, 0x00, 0x00, 0x00, 0x02}, goldenPublicKey...)},
+		{VersionRange{10, 10}, goldenX25519Key, append([]byte{0x03, 0x0A, 0x0A, 0x02, 0x20, 0x00}, goldenX25519Key.Key...)},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeReceiverInitiation(vector.versions, vector.key)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		versions, decoded, err := DecodeReceiverInitiation(vector.wanted)
+
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+
+		if versions != vector.versions || decoded.KeyType != vector.key.KeyType || !bytes.Equal(decoded.Key, vector.key.Key) {
+			t.Errorf("Decoded (%v, %v) should be (%v, %v)", versions, decoded, vector.versions, vector.key)
+		}
+	}
+}
+
+func TestGoldenReceiverAcceptance(t *testing.T) {
+	vectors := []struct {
+		version     uint8
+		resumeToken []byte
+		wanted      []byte
+	}{
+		{0, nil, []byte{0x04, 0x00}},
+		{1, nil, []byte{0x04, 0x01}},
+		{3, goldenResumeToken, append([]byte{0x04, 0x03}, goldenResumeToken...)},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeReceiverAcceptance(vector.version, vector.resumeToken)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		version, resumeToken, err := DecodeReceiverAcceptance(vector.wanted)
+
+		if err != nil {
+			t.Fatalf("Failed to decode %v: %v", vector.wanted, err)
+		}
+
+		if version != vector.version || !bytes.Equal(resumeToken, vector.resumeToken) {
+			t.Errorf("Decoded (%v, %v) should be (%v, %v)", version, resumeToken, vector.version, vector.resumeToken)
+		}
+	}
+}
+
+func TestGoldenReady(t *testing.T) {
+	vectors := []struct {
+		version    uint8
+		key        ReceiverKey
+		windowSize uint16
+		wanted     []byte
+	}{
+		{1, goldenRsaKey, 1, append([]byte{0x05, 0x01}, goldenPublicKey...)},
+		{2, goldenRsaKey, 0x10, append(append([]byte{0x05, 0x02}, goldenPublicKey...), 0x10, 0x00)},
+		{10, goldenX25519Key, 0x10, append(append([]byte{0x05, 0x0A, 0x02, 0x20, 0x00}, goldenX25519Key.Key...), 0x10, 0x00)},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeReady(vector.version, vector.key, vector.windowSize)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		version, decoded, windowSize, err := DecodeReady(vector.wanted)
+
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+
+		if version != vector.version || decoded.KeyType != vector.key.KeyType ||
+			!bytes.Equal(decoded.Key, vector.key.Key) || windowSize != vector.windowSize {
+			t.Errorf("Decoded (%v, %v, %v) should be (%v, %v, %v)",
+				version, decoded, windowSize, vector.version, vector.key, vector.windowSize)
+		}
+	}
+}
+
+func TestGoldenBroadcastReady(t *testing.T) {
+	ready := BroadcastReady{Version: 13, WindowSize: 0x10, ReceiverKeys: []ReceiverKey{goldenX25519Key, goldenRsaKey}}
+	wanted := append(append(append([]byte{0x15, 0x0D, 0x10, 0x00, 0x02, 0x02, 0x20, 0x00}, goldenX25519Key.Key...),
+		0x00, 0x00, 0x02), goldenPublicKey...)
+
+	data, err := EncodeBroadcastReady(ready)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	decoded, err := DecodeBroadcastReady(wanted)
+
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if decoded.Version != ready.Version || decoded.WindowSize != ready.WindowSize || len(decoded.ReceiverKeys) != 2 ||
+		decoded.ReceiverKeys[0].KeyType != KeyTypeX25519 || !bytes.Equal(decoded.ReceiverKeys[1].Key, goldenPublicKey) {
+		t.Errorf("Decoded %v should be %v", decoded, ready)
+	}
+}
+
+func TestGoldenMetadata(t *testing.T) {
+	filename := []byte("a.txt")
+	vectors := []struct {
+		version        uint8
+		numberOfChunks uint32
+		wanted         []byte
+	}{
+		{0, 3, []byte{0x06, 0x00, 0x05, 0x61, 0x2E, 0x74, 0x78, 0x74, 0x03, 0x00}},
+		{1, 0x01020304, []byte{0x06, 0x01, 0x05, 0x61, 0x2E, 0x74, 0x78, 0x74, 0x04, 0x03, 0x02, 0x01}},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeMetadata(vector.version, filename, vector.numberOfChunks)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		decodedFilename, numberOfChunks, err := DecodeMetadata(vector.wanted, vector.version)
+
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+
+		if !bytes.Equal(decodedFilename, filename) || numberOfChunks != vector.numberOfChunks {
+			t.Errorf("Decoded (%v, %v) should be (%v, %v)", decodedFilename, numberOfChunks, filename, vector.numberOfChunks)
+		}
+	}
+}
+
+func TestGoldenMetadataAcknowledge(t *testing.T) {
+	vectors := []struct {
+		version uint8
+		wanted  []byte
+	}{
+		{0, []byte{0x08, 0x00, 0xFF, 0x00}},
+		{1, []byte{0x0A, 0x01}},
+	}
+
+	for _, vector := range vectors {
+		data := EncodeMetadataAcknowledge(vector.version)
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		if err := DecodeMetadataAcknowledge(vector.wanted, vector.version); err != nil {
+			t.Errorf("Failed to decode %v: %v", vector.wanted, err)
+		}
+	}
+}
+
+func TestGoldenDataChunk(t *testing.T) {
+	payload := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+	vectors := []struct {
+		version     uint8
+		fileIndex   uint16
+		chunkNumber uint32
+		wanted      []byte
+	}{
+		{0, 0, 2, []byte{0x07, 0x00, 0x02, 0x00, 0x04, 0x00, 0xDE, 0xAD, 0xBE, 0xEF}},
+		{1, 0, 0x10000, []byte{0x07, 0x01, 0x00, 0x00, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 0xDE, 0xAD, 0xBE, 0xEF}},
+		{4, 0x102, 0x10000,
+			[]byte{0x07, 0x04, 0x02, 0x01, 0x00, 0x00, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 0xDE, 0xAD, 0xBE, 0xEF}},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeDataChunk(vector.version, vector.fileIndex, vector.chunkNumber, payload)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		fileIndex, chunkNumber, decodedPayload, err := DecodeDataChunk(vector.wanted, vector.version)
+
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+
+		if fileIndex != vector.fileIndex || chunkNumber != vector.chunkNumber || !bytes.Equal(decodedPayload, payload) {
+			t.Errorf("Decoded (%v, %v, %v) should be (%v, %v, %v)",
+				fileIndex, chunkNumber, decodedPayload, vector.fileIndex, vector.chunkNumber, payload)
+		}
+	}
+}
+
+func TestGoldenManifest(t *testing.T) {
+	files := []ManifestEntry{
+		{Path: []byte("a"), Size: 5, NumberOfChunks: 1},
+		{Path: []byte("d/b"), Size: 0x10000, NumberOfChunks: 0x100},
+	}
+	wanted := []byte{0x0D, 0x04, 0x02, 0x00,
+		0x01, 0x00, 0x61, 0x05, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00, 0x00,
+		0x03, 0x00, 0x64, 0x2F, 0x62, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00}
+
+	data, err := EncodeManifest(4, files)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	decoded, err := DecodeManifest(wanted, 4)
+
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if len(decoded) != len(files) {
+		t.Fatalf("Decoded %v files should be %v", len(decoded), len(files))
+	}
+
+	for i := range files {
+		if !bytes.Equal(decoded[i].Path, files[i].Path) || decoded[i].Size != files[i].Size ||
+			decoded[i].NumberOfChunks != files[i].NumberOfChunks {
+			t.Errorf("Decoded file %v should be %v", decoded[i], files[i])
+		}
+	}
+}
+
+func TestGoldenEnd(t *testing.T) {
+	vectors := []struct {
+		version        uint8
+		numberOfChunks uint32
+		digest         []byte
+		wanted         []byte
+	}{
+		{4, 0, nil, []byte{0x0E, 0x04}},
+		{11, 0x0103, []byte{0xAA, 0xBB}, []byte{0x0E, 0x0B, 0x03, 0x01, 0x00, 0x00, 0x02, 0x00, 0xAA, 0xBB}},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeEnd(vector.version, vector.numberOfChunks, vector.digest)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		numberOfChunks, digest, err := DecodeEnd(vector.wanted, vector.version)
+
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+
+		if numberOfChunks != vector.numberOfChunks || !bytes.Equal(digest, vector.digest) {
+			t.Errorf("Decoded (%v, %v) should be (%v, %v)", numberOfChunks, digest, vector.numberOfChunks, vector.digest)
+		}
+	}
+}
+
+func TestGoldenAcknowledge(t *testing.T) {
+	vectors := []struct {
+		version     uint8
+		chunkNumber uint32
+		wanted      []byte
+	}{
+		{0, 0x00, []byte{0x08, 0x00, 0x00, 0x00}},
+		{0, 0xFE, []byte{0x08, 0x00, 0xFE, 0x00}},
+		{1, 0xFF, []byte{0x08, 0x01, 0xFF, 0x00, 0x00, 0x00}},
+		{1, 0xFFFFFFFE, []byte{0x08, 0x01, 0xFE, 0xFF, 0xFF, 0xFF}},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeAcknowledge(vector.version, vector.chunkNumber)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		chunkNumber, err := DecodeAcknowledge(vector.wanted, vector.version)
+
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+
+		if chunkNumber != vector.chunkNumber {
+			t.Errorf("Chunk number should be %v but is %v", vector.chunkNumber, chunkNumber)
+		}
+	}
+}
+
+func TestGoldenResume(t *testing.T) {
+	wanted := append([]byte{0x0B, 0x03}, goldenResumeToken...)
+
+	data, err := EncodeResume(3, goldenResumeToken)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	version, resumeToken, err := DecodeResume(wanted)
+
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if version != 3 || !bytes.Equal(resumeToken, goldenResumeToken) {
+		t.Errorf("Decoded (%v, %v) should be (%v, %v)", version, resumeToken, 3, goldenResumeToken)
+	}
+}
+
+func TestGoldenResumed(t *testing.T) {
+	wanted := []byte{0x0C, 0x03, 0x10, 0x00, 0x00, 0x00, 0x14, 0x01, 0x00, 0x00}
+
+	data, err := EncodeResumed(3, 0x10, 0x114)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	acknowledgedChunks, nextChunk, err := DecodeResumed(wanted, 3)
+
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if acknowledgedChunks != 0x10 || nextChunk != 0x114 {
+		t.Errorf("Decoded (%v, %v) should be (%v, %v)", acknowledgedChunks, nextChunk, 0x10, 0x114)
+	}
+}
+
+func TestGoldenPinChallenge(t *testing.T) {
+	nonce := bytes.Repeat([]byte{0x11}, PinNonceLength)
+	wanted := append(append([]byte{0x0F, 0x07}, goldenPinSalt...), append(nonce, 0x05)...)
+
+	data, err := EncodePinChallenge(7, goldenPinSalt, nonce, 5)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	pinSalt, decodedNonce, attemptsRemaining, err := DecodePinChallenge(wanted, 7)
+
+	if err != nil {
+		t.Fatalf("Failed to decode %v: %v", wanted, err)
+	}
+
+	if !bytes.Equal(pinSalt, goldenPinSalt) || !bytes.Equal(decodedNonce, nonce) || attemptsRemaining != 5 {
+		t.Errorf("Decoded (%v, %v, %v) should be (%v, %v, %v)", pinSalt, decodedNonce, attemptsRemaining, goldenPinSalt, nonce, 5)
+	}
+}
+
+func TestGoldenPinResponse(t *testing.T) {
+	proof := bytes.Repeat([]byte{0x22}, PinProofLength)
+	wanted := append([]byte{0x10, 0x07}, proof...)
+
+	data, err := EncodePinResponse(7, proof)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	decodedProof, err := DecodePinResponse(wanted, 7)
+
+	if err != nil {
+		t.Fatalf("Failed to decode %v: %v", wanted, err)
+	}
+
+	if !bytes.Equal(decodedProof, proof) {
+		t.Errorf("Decoded %v should be %v", decodedProof, proof)
+	}
+}
+
+func TestGoldenPake(t *testing.T) {
+	payload := []byte{0x04, 0xAA, 0xBB}
+	wanted := []byte{0x11, 0x08, 0x03, 0x00, 0x04, 0xAA, 0xBB}
+
+	data, err := EncodePake(8, payload)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	decodedPayload, err := DecodePake(wanted, 8)
+
+	if err != nil {
+		t.Fatalf("Failed to decode %v: %v", wanted, err)
+	}
+
+	if !bytes.Equal(decodedPayload, payload) {
+		t.Errorf("Decoded %v should be %v", decodedPayload, payload)
+	}
+}
+
+func TestGoldenVerify(t *testing.T) {
+	vectors := []struct {
+		payload []byte
+		wanted  []byte
+	}{
+		{[]byte{}, []byte{0x12, 0x09, 0x00, 0x00}},
+		{[]byte{0x01, 0x02}, []byte{0x12, 0x09, 0x02, 0x00, 0x01, 0x02}},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeVerify(9, vector.payload)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		payload, err := DecodeVerify(vector.wanted, 9)
+
+		if err != nil {
+			t.Fatalf("Failed to decode %v: %v", vector.wanted, err)
+		}
+
+		if !bytes.Equal(payload, vector.payload) {
+			t.Errorf("Decoded %v should be %v", payload, vector.payload)
+		}
+	}
+}
+
+func TestGoldenKeyMismatch(t *testing.T) {
+	wanted := []byte{0x13, 0x09}
+
+	data, err := EncodeKeyMismatch(9)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	if err := DecodeKeyMismatch(wanted, 9); err != nil {
+		t.Errorf("Failed to decode %v: %v", wanted, err)
+	}
+}
+
+func TestGoldenDecline(t *testing.T) {
+	vectors := []struct {
+		decline Decline
+		wanted  []byte
+	}{
+		{Decline{Reason: DeclineUnspecified}, []byte{0x16, 0x0E, 0x00, 0x00, 0x00}},
+		{Decline{Reason: DeclineTooLarge, Message: "big"}, []byte{0x16, 0x0E, 0x01, 0x03, 0x00, 0x62, 0x69, 0x67}},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeDecline(14, vector.decline)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		decline, err := DecodeDecline(vector.wanted, 14)
+
+		if err != nil {
+			t.Fatalf("Failed to decode %v: %v", vector.wanted, err)
+		}
+
+		if decline != vector.decline {
+			t.Errorf("Decoded %+v should be %+v", decline, vector.decline)
+		}
+	}
+}
+
+func TestGoldenCancel(t *testing.T) {
+	wanted := []byte{0x17, 0x0F, 0x03, 0x00, 0x62, 0x79, 0x65}
+
+	data, err := EncodeCancel(15, "bye")
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	version, reason, err := DecodeCancel(wanted)
+
+	if err != nil || version != 15 || reason != "bye" {
+		t.Errorf("Decoded (%v, %q, %v) should be (15, \"bye\", nil)", version, reason, err)
+	}
+}
+
+func TestGoldenStatus(t *testing.T) {
+	wanted := []byte{0x18, 0x11, 0x02, 0x3C, 0x00, 0x00, 0x00}
+	expiring := Status{Event: StatusExpiring, Value: 60}
+
+	data, err := EncodeStatus(17, expiring)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, wanted) {
+		t.Errorf("Data should be %v but is %v", wanted, data)
+	}
+
+	version, status, err := DecodeStatus(wanted)
+
+	if err != nil || version != 17 || status != expiring {
+		t.Errorf("Decoded (%v, %+v, %v) should be (17, %+v, nil)", version, status, err, expiring)
+	}
+}
+
+func TestGoldenError(t *testing.T) {
+	vectors := []struct {
+		version  uint8
+		code     ErrorCode
+		versions VersionRange
+		wanted   []byte
+	}{
+		{0, E_UNSPECIFIED, VersionRange{0, 0}, []byte{0x09, 0x00, 0x04, 0x00, 0x6F, 0x6F, 0x70, 0x73}},
+		{1, E_UNSPECIFIED, VersionRange{0, 1}, []byte{0x09, 0x01, 0x04, 0x00, 0x6F, 0x6F, 0x70, 0x73, 0x00, 0x01}},
+		{16, E_TIMEOUT, VersionRange{0, 16}, []byte{0x09, 0x10, 0x04, 0x00, 0x6F, 0x6F, 0x70, 0x73, 0x00, 0x10, 0x03}},
+	}
+
+	for _, vector := range vectors {
+		data, err := EncodeError(vector.version, vector.code, "oops", vector.versions)
+
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+
+		if !bytes.Equal(data, vector.wanted) {
+			t.Errorf("Data should be %v but is %v", vector.wanted, data)
+		}
+
+		version, code, errorReason, versions, err := DecodeError(vector.wanted)
+
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+
+		if version != vector.version || code != vector.code || errorReason != "oops" || versions != vector.versions {
+			t.Errorf("Decoded (%v, %v, %q, %v) should be (%v, %v, %q, %v)",
+				version, code, errorReason, versions, vector.version, vector.code, "oops", vector.versions)
+		}
+	}
+
+	// codes are only sent from version 16
+	data, err := EncodeError(15, E_TIMEOUT, "oops", VersionRange{0, 15})
+
+	if err != nil || len(data) != 10 {
+		t.Errorf("Version 15 error should not carry a code is %v (%v)", data, err)
+	}
+}
+
+func TestEncodeRejectsOutOfRangeValues(t *testing.T) {
+	if _, err := EncodeMetadata(0, []byte{}, 1); err == nil {
+		t.Errorf("Empty filename should not encode")
+	}
+	if _, err := EncodeMetadata(0, bytes.Repeat([]byte{0x61}, 256), 1); err == nil {
+		t.Errorf("256 byte filename should not encode")
+	}
+	if _, err := EncodeMetadata(0, []byte("a"), 0x100); err == nil {
+		t.Errorf("Too many chunks should not encode")
+	}
+	if _, err := EncodeDataChunk(0, 0, MetadataChunkNumberV0, nil); err == nil {
+		t.Errorf("Chunk number 0xFF should not encode as a version 0 data chunk")
+	}
+	if _, err := EncodeDataChunk(0, 0, 0, make([]byte, 65536)); err == nil {
+		t.Errorf("65536 byte payload should not encode in version 0")
+	}
+	if _, err := EncodeDataChunk(1, 0, 0, make([]byte, maxPayloadLengthV1+1)); err == nil {
+		t.Errorf("Payload over the version 1 limit should not encode")
+	}
+	if _, err := EncodeAcknowledge(0, MetadataChunkNumberV0); err == nil {
+		t.Errorf("Chunk number 0xFF should not encode as a version 0 chunk acknowledgement")
+	}
+	if _, err := EncodeError(0, E_UNSPECIFIED, string([]byte{0xFF}), VersionRange{LowestVersion, HighestVersion}); err == nil {
+		t.Errorf("Invalid utf-8 should not encode")
+	}
+	if _, err := EncodeSenderInitiation(SenderInitiation{Versions: VersionRange{2, 1}, WindowSize: 1}); err == nil {
+		t.Errorf("Lowest version above highest version should not encode")
+	}
+	if _, err := EncodeSenderInitiation(SenderInitiation{Versions: VersionRange{0, 2}}); err == nil {
+		t.Errorf("Window size of 0 should not encode")
+	}
+	if _, err := EncodeManifest(4, nil); err == nil {
+		t.Errorf("Manifest without files should not encode")
+	}
+	if _, err := EncodeManifest(3, []ManifestEntry{{Path: []byte("a"), NumberOfChunks: 1}}); err == nil {
+		t.Errorf("Manifest should not encode before version 4")
+	}
+	if _, err := EncodeRequestAcceptance(RequestAcceptance{Versions: VersionRange{11, 12}, ShareCode: make([]byte, 5),
+		TimeToLive: 1, ShareCodeText: "A"}); err == nil {
+		t.Errorf("Request acceptance should not encode for versions before 12")
+	}
+	if _, err := EncodeEnd(11, 1, nil); err == nil {
+		t.Errorf("End without a digest should not encode from version 11")
+	}
+	if _, err := EncodeCancel(14, ""); err == nil {
+		t.Errorf("Cancel should not encode before version 15")
+	}
+	if _, err := EncodeDecline(14, Decline{Reason: 0x04}); err == nil {
+		t.Errorf("Unknown decline reason should not encode")
+	}
+	if _, err := EncodeDecline(13, Decline{}); err == nil {
+		t.Errorf("Decline should not encode before version 14")
+	}
+	if _, err := EncodeBroadcastReady(BroadcastReady{Version: 13, WindowSize: 1}); err == nil {
+		t.Errorf("Broadcast ready without receivers should not encode")
+	}
+	if _, err := EncodeSenderInitiation(SenderInitiation{Versions: VersionRange{13, 13}, WindowSize: 1, DropPolicy: 0x02}); err == nil {
+		t.Errorf("Unknown drop policy should not encode")
+	}
+}
+
+func TestVersion1AllowsLargePayloads(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x61}, 70000)
+
+	data, err := EncodeDataChunk(1, 0, 0x100, payload)
+
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	_, chunkNumber, decodedPayload, err := DecodeDataChunk(data, 1)
+
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if chunkNumber != 0x100 || !bytes.Equal(decodedPayload, payload) {
+		t.Errorf("Decoded chunk %v of %v bytes should be chunk %v of %v bytes",
+			chunkNumber, len(decodedPayload), 0x100, len(payload))
+	}
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import "fmt"
+
+// From version 16 ERROR carries a code saying why the share failed, the reason
+// is only meant for people and may change. Codes added later may be received,
+// they should be treated as E_UNSPECIFIED.
+const ErrorCodesVersion uint8 = 16
+
+type ErrorCode uint8
+
+const (
+	// Any failure without a more specific code
+	E_UNSPECIFIED ErrorCode = 0x00
+	// No protocol version is supported by every party
+	E_VERSION ErrorCode = 0x01
+	// The other peer disconnected, failed to connect or didn't resume the share
+	E_PEER_GONE ErrorCode = 0x02
+	// A peer didn't send a message the relay was waiting for in time
+	E_TIMEOUT ErrorCode = 0x03
+	// A message was malformed or not expected at that point of the share
+	E_SEQUENCE ErrorCode = 0x04
+	// A limit of the relay was exceeded, such as the number of handshake messages
+	E_LIMIT ErrorCode = 0x05
+	// The relay is shutting down
+	E_SHUTDOWN ErrorCode = 0x06
+	// The share expired before the other peer joined
+	E_EXPIRED ErrorCode = 0x07
+	// Too many incorrect PINs were given
+	E_PIN ErrorCode = 0x08
+	// A peer reported a key mismatch
+	E_KEY_MISMATCH ErrorCode = 0x09
+	// The share can't be resumed
+	E_RESUME ErrorCode = 0x0A
+	// The receiver fell too far behind a broadcast share
+	E_DROPPED ErrorCode = 0x0B
+	// The share isn't accepting more receivers
+	E_CLAIMED ErrorCode = 0x0C
+	// The relay failed
+	E_INTERNAL ErrorCode = 0x0D
+)
+
+func (code ErrorCode) String() string {
+	switch code {
+	case E_UNSPECIFIED:
+		return "E_UNSPECIFIED"
+	case E_VERSION:
+		return "E_VERSION"
+	case E_PEER_GONE:
+		return "E_PEER_GONE"
+	case E_TIMEOUT:
+		return "E_TIMEOUT"
+	case E_SEQUENCE:
+		return "E_SEQUENCE"
+	case E_LIMIT:
+		return "E_LIMIT"
+	case E_SHUTDOWN:
+		return "E_SHUTDOWN"
+	case E_EXPIRED:
+		return "E_EXPIRED"
+	case E_PIN:
+		return "E_PIN"
+	case E_KEY_MISMATCH:
+		return "E_KEY_MISMATCH"
+	case E_RESUME:
+		return "E_RESUME"
+	case E_DROPPED:
+		return "E_DROPPED"
+	case E_CLAIMED:
+		return "E_CLAIMED"
+	case E_INTERNAL:
+		return "E_INTERNAL"
+	default:
+		return fmt.Sprintf("UNKNOWN(%#x)", uint8(code))
+	}
+}
@@ -0,0 +1,24 @@
+package protocol
+
+// From version 8 the sender chooses how the peers agree the share's key in
+// SENDER_INITIATION. With KeyAgreementPake the sender and receiver run a password
+// authenticated key exchange keyed on a secret the relay never sees, exchanging
+// PAKE messages during the handshake between READY and METADATA (or MANIFEST).
+// The receiver's public key in RECEIVER_INITIATION and READY is unused.
+const (
+	KeyAgreementPublicKey uint8 = 0x00
+	KeyAgreementPake      uint8 = 0x01
+)
+
+// Largest PAKE payload
+const MaxPakePayloadLength = 1024
+
+func IsValidKeyAgreement(keyAgreement uint8) bool {
+	return keyAgreement == KeyAgreementPublicKey || keyAgreement == KeyAgreementPake
+}
+
+// Largest VERIFY payload
+const MaxVerifyPayloadLength = 1024
+
+// Largest END digest
+const MaxEndDigestLength = 256
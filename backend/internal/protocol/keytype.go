@@ -0,0 +1,97 @@
+package protocol
+
+import "fmt"
+
+// From version 10 RECEIVER_INITIATION and READY carry the type and length of the
+// receiver's public key, before version 10 the key is always a 512 byte RSA-4096
+// modulus. The relay forwards the key as is, it only checks the length matches
+// the type.
+const KeyTypesVersion uint8 = 10
+
+const (
+	KeyTypeRsa4096 uint8 = 0x00
+	KeyTypeP256    uint8 = 0x01
+	KeyTypeX25519  uint8 = 0x02
+)
+
+// The receiver's public key as sent in RECEIVER_INITIATION
+type ReceiverKey struct {
+	KeyType uint8
+	Key     []byte
+}
+
+// Length of the public keys of each type, an RSA modulus, an uncompressed P-256
+// point or an X25519 u-coordinate
+func KeyLengthOf(keyType uint8) (int, bool) {
+	switch keyType {
+	case KeyTypeRsa4096:
+		return PublicKeyLength, true
+	case KeyTypeP256:
+		return 65, true
+	case KeyTypeX25519:
+		return 32, true
+	default:
+		return 0, false
+	}
+}
+
+func validateReceiverKey(key ReceiverKey) error {
+	length, ok := KeyLengthOf(key.KeyType)
+
+	if !ok {
+		return fmt.Errorf("Unknown key type %#02x.", key.KeyType)
+	}
+
+	if len(key.Key) != length {
+		return fmt.Errorf("Public key should be %d bytes is actually %d.", length, len(key.Key))
+	}
+
+	return nil
+}
+
+// The key type, key length and key appended to RECEIVER_INITIATION and READY from version 10
+func encodeReceiverKey(key ReceiverKey) ([]byte, error) {
+	err := validateReceiverKey(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blob := []byte{key.KeyType, 0x00, 0x00}
+	putUint(blob[1:], uint32(len(key.Key)))
+
+	return append(blob, key.Key...), nil
+}
+
+// Returns (key, rest of the blob, error)
+func decodeReceiverKey(blob []byte, version uint8) (ReceiverKey, []byte, error) {
+	if version < KeyTypesVersion {
+		if len(blob) < PublicKeyLength {
+			return ReceiverKey{}, nil, fmt.Errorf("Too few bytes (expected %v got %v).", PublicKeyLength, len(blob))
+		}
+
+		return ReceiverKey{KeyType: KeyTypeRsa4096, Key: blob[:PublicKeyLength]}, blob[PublicKeyLength:], nil
+	}
+
+	if len(blob) < 3 {
+		return ReceiverKey{}, nil, fmt.Errorf("Incomplete message.")
+	}
+
+	keyType := blob[0]
+	length := int(readUint(blob[1:3]))
+	blob = blob[3:]
+
+	if len(blob) < length {
+		return ReceiverKey{}, nil, fmt.Errorf("Too few bytes (expected %v got %v).", length, len(blob))
+	}
+
+	key := ReceiverKey{KeyType: keyType, Key: blob[:length]}
+
+	err := validateReceiverKey(key)
+
+	if err != nil {
+		return ReceiverKey{}, nil, err
+	}
+
+	return key, blob[length:], nil
+}
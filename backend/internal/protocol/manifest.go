@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// One file of a version 4 share. Chunk numbers run across the whole share, the
+// chunks of each file follow those of the file before it in the manifest.
+type ManifestEntry struct {
+	// Path relative to the root of the share with "/" separators (encrypted)
+	Path []byte
+	// Size of the file in bytes before encryption
+	Size           uint64
+	NumberOfChunks uint32
+}
+
+const MaxManifestFiles = 65535 // 2^16 - 1
+
+// From version 11 a share may be streamed, its length isn't known until the sender
+// sends END. A streamed share has one file whose size and number of chunks are these
+// values, the number of chunks is carried by END.
+const (
+	StreamingVersion uint8 = 11
+	StreamedFileSize       = math.MaxUint64
+	// Chunk numbers of a streamed share run up to 0xFFFFFFFE
+	StreamedNumberOfChunks = math.MaxUint32
+)
+
+// Whether the manifest is for a streamed share, see StreamingVersion
+func IsStreamed(files []ManifestEntry) bool {
+	return len(files) == 1 && files[0].NumberOfChunks == StreamedNumberOfChunks && files[0].Size == StreamedFileSize
+}
+
+func ValidateManifest(version uint8, files []ManifestEntry) error {
+	if len(files) == 0 || len(files) > MaxManifestFiles {
+		return fmt.Errorf("Manifest must list between 1 and %v files lists %v.", MaxManifestFiles, len(files))
+	}
+
+	var totalChunks uint64
+
+	for i, file := range files {
+		if len(file.Path) == 0 || len(file.Path) > 65535 {
+			return fmt.Errorf("Path of file %v should be between 1 and 65535 bytes is actually %d.", i, len(file.Path))
+		}
+
+		if file.NumberOfChunks == StreamedNumberOfChunks && file.Size == StreamedFileSize && len(files) != 1 {
+			return fmt.Errorf("File %v is streamed, only a share of one file can be streamed.", i)
+		}
+
+		totalChunks += uint64(file.NumberOfChunks)
+	}
+
+	if IsStreamed(files) {
+		if version < StreamingVersion {
+			return fmt.Errorf("Streamed shares require version %v.", StreamingVersion)
+		}
+
+		return nil
+	}
+
+	if totalChunks > uint64(MaxNumberOfChunks(version)) {
+		return fmt.Errorf("Manifest must have at most %v chunks has %v.", MaxNumberOfChunks(version), totalChunks)
+	}
+
+	return nil
+}
+
+// Returns the chunk number following the last chunk of each file, the final
+// value is the number of chunks in the share
+func ChunkBoundaries(files []ManifestEntry) []uint32 {
+	boundaries := make([]uint32, len(files))
+
+	var total uint32
+
+	for i, file := range files {
+		total += file.NumberOfChunks
+		boundaries[i] = total
+	}
+
+	return boundaries
+}
+
+// Index of the file a chunk belongs to, files without chunks are skipped
+func FileOfChunk(boundaries []uint32, chunkNumber uint32) int {
+	return sort.Search(len(boundaries), func(i int) bool {
+		return boundaries[i] > chunkNumber
+	})
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import "testing"
+
+func TestFileOfChunk(t *testing.T) {
+	// files of 2, 0, 3 and 1 chunks
+	boundaries := ChunkBoundaries([]ManifestEntry{
+		{Path: []byte("a"), NumberOfChunks: 2},
+		{Path: []byte("b"), NumberOfChunks: 0},
+		{Path: []byte("c"), NumberOfChunks: 3},
+		{Path: []byte("d"), NumberOfChunks: 1},
+	})
+
+	wanted := []int{0, 0, 2, 2, 2, 3}
+
+	for chunkNumber, wantedFile := range wanted {
+		if file := FileOfChunk(boundaries, uint32(chunkNumber)); file != wantedFile {
+			t.Errorf("Chunk %v should belong to file %v but belongs to %v", chunkNumber, wantedFile, file)
+		}
+	}
+
+	if boundaries[len(boundaries)-1] != 6 {
+		t.Errorf("Share should have 6 chunks has %v", boundaries[len(boundaries)-1])
+	}
+}
+
+func TestValidateStreamedManifest(t *testing.T) {
+	streamed := []ManifestEntry{{Path: []byte("a"), Size: StreamedFileSize, NumberOfChunks: StreamedNumberOfChunks}}
+
+	if !IsStreamed(streamed) {
+		t.Errorf("Manifest should be streamed")
+	}
+
+	if err := ValidateManifest(StreamingVersion, streamed); err != nil {
+		t.Errorf("Streamed manifest should be valid from version %v: %v", StreamingVersion, err)
+	}
+
+	if err := ValidateManifest(StreamingVersion-1, streamed); err == nil {
+		t.Errorf("Streamed manifest should be invalid before version %v", StreamingVersion)
+	}
+}
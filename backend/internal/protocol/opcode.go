@@ -0,0 +1,111 @@
+// Package protocol encodes and decodes the messages of the tube message protocol
+// described in documentation/Protocol.md. It is shared by the relay and clients,
+// decoders check a message is well formed but not that it is expected.
+package protocol
+
+import "fmt"
+
+type Opcode uint8
+
+const HighestOpCode = 0x18
+
+const (
+	SENDER_INITIATION   Opcode = 0x1
+	SENDER_ACCEPTED     Opcode = 0x2
+	RECEIVER_INITIATION Opcode = 0x3
+	RECEIVER_ACCEPTED   Opcode = 0x4
+	READY               Opcode = 0x5
+	METADATA            Opcode = 0x6
+	DATA_CHUNK          Opcode = 0x7
+	ACKNOWLEDGE         Opcode = 0x8
+	ERROR               Opcode = 0x9
+	// Introduced in version 1
+	METADATA_ACKNOWLEDGE Opcode = 0xA
+	// Introduced in version 3
+	RESUME  Opcode = 0xB
+	RESUMED Opcode = 0xC
+	// Introduced in version 4
+	MANIFEST Opcode = 0xD
+	END      Opcode = 0xE
+	// Introduced in version 7
+	PIN_CHALLENGE Opcode = 0xF
+	PIN_RESPONSE  Opcode = 0x10
+	// Introduced in version 8
+	PAKE Opcode = 0x11
+	// Introduced in version 9
+	VERIFY       Opcode = 0x12
+	KEY_MISMATCH Opcode = 0x13
+	// Introduced in version 12
+	REQUEST_ACCEPTED Opcode = 0x14
+	// Introduced in version 13
+	BROADCAST_READY Opcode = 0x15
+	// Introduced in version 14
+	DECLINE Opcode = 0x16
+	// Introduced in version 15
+	CANCEL Opcode = 0x17
+	// Introduced in version 17
+	STATUS Opcode = 0x18
+)
+
+const (
+	ShareCodeLength   = 5
+	PublicKeyLength   = 512
+	ResumeTokenLength = 16
+	// ACKNOWLEDGE chunk number used to acknowledge the metadata in version 0
+	MetadataChunkNumberV0 = 0xFF
+)
+
+func (op Opcode) String() string {
+	switch op {
+	case SENDER_INITIATION:
+		return "SENDER_INITIATION"
+	case SENDER_ACCEPTED:
+		return "SENDER_ACCEPTED"
+	case RECEIVER_INITIATION:
+		return "RECEIVER_INITIATION"
+	case RECEIVER_ACCEPTED:
+		return "RECEIVER_ACCEPTED"
+	case READY:
+		return "READY"
+	case METADATA:
+		return "METADATA"
+	case DATA_CHUNK:
+		return "DATA_CHUNK"
+	case ACKNOWLEDGE:
+		return "ACKNOWLEDGE"
+	case ERROR:
+		return "ERROR"
+	case METADATA_ACKNOWLEDGE:
+		return "METADATA_ACKNOWLEDGE"
+	case RESUME:
+		return "RESUME"
+	case RESUMED:
+		return "RESUMED"
+	case MANIFEST:
+		return "MANIFEST"
+	case END:
+		return "END"
+	case PIN_CHALLENGE:
+		return "PIN_CHALLENGE"
+	case PIN_RESPONSE:
+		return "PIN_RESPONSE"
+	case PAKE:
+		return "PAKE"
+	case VERIFY:
+		return "VERIFY"
+	case KEY_MISMATCH:
+		return "KEY_MISMATCH"
+	case REQUEST_ACCEPTED:
+		return "REQUEST_ACCEPTED"
+	case BROADCAST_READY:
+		return "BROADCAST_READY"
+	case DECLINE:
+		return "DECLINE"
+	case CANCEL:
+		return "CANCEL"
+	case STATUS:
+		return "STATUS"
+	default:
+		return fmt.Sprintf("UNKNOWN(%#x)", uint8(op))
+	}
+}
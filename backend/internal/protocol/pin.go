@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+)
+
+// From version 7 a sender may protect a share with a PIN. The sender derives a
+// verifier from the PIN and a random salt and sends both in SENDER_INITIATION,
+// before RECEIVER_ACCEPTED the relay sends the receiver PIN_CHALLENGE with the
+// salt and a random nonce and the receiver proves it knows the PIN by replying
+// with the HMAC of the nonce keyed with the verifier. The PIN never leaves the
+// sender or receiver and a proof can't be replayed for another nonce.
+//
+// The PIN only keeps out receivers who learn the share code, not the relay. The
+// verifier works as the PIN itself so the relay can answer challenges, and a
+// short PIN can be brute forced offline from one challenge and its response.
+const (
+	PinSaltLength     = 16
+	PinVerifierLength = 32
+	PinNonceLength    = 16
+	PinProofLength    = sha256.Size
+	// PBKDF2-HMAC-SHA256 iterations used to derive the verifier from the PIN
+	pinVerifierIterations = 100_000
+)
+
+// Verifier for a PIN, computed by the sender for SENDER_INITIATION and by the
+// receiver to answer PIN_CHALLENGE
+func PinVerifier(pin string, pinSalt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, pin, pinSalt, pinVerifierIterations, PinVerifierLength)
+}
+
+// Proof of knowing the PIN for a challenge nonce
+func PinProof(verifier []byte, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, verifier)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
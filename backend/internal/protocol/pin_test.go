@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"testing"
+)
+
+func TestPinProof(t *testing.T) {
+	verifier, err := PinVerifier("1234", goldenPinSalt)
+
+	if err != nil {
+		t.Fatalf("Failed to derive verifier: %v", err)
+	}
+
+	if len(verifier) != PinVerifierLength {
+		t.Fatalf("Verifier should be %v bytes is %v", PinVerifierLength, len(verifier))
+	}
+
+	nonce := bytes.Repeat([]byte{0x11}, PinNonceLength)
+	proof := PinProof(verifier, nonce)
+
+	wrongPin, _ := PinVerifier("1235", goldenPinSalt)
+	otherSalt, _ := PinVerifier("1234", bytes.Repeat([]byte{0x5B}, PinSaltLength))
+
+	if hmac.Equal(proof, PinProof(wrongPin, nonce)) {
+		t.Errorf("Proof for the wrong PIN should not match")
+	}
+	if hmac.Equal(proof, PinProof(otherSalt, nonce)) {
+		t.Errorf("Proof for a verifier with another salt should not match")
+	}
+	if hmac.Equal(proof, PinProof(verifier, bytes.Repeat([]byte{0x12}, PinNonceLength))) {
+		t.Errorf("Proof for another nonce should not match")
+	}
+}
@@ -0,0 +1,18 @@
+package protocol
+
+// Longest share code text the receiver endpoint will parse
+const MaxShareCodeTextLength = 64
+
+func IsValidShareCodeText(text string) bool {
+	if len(text) == 0 || len(text) > MaxShareCodeTextLength {
+		return false
+	}
+
+	for i := range len(text) {
+		if text[i] < 0x20 || text[i] > 0x7E {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,21 @@
+package protocol
+
+// From version 17 the relay sends STATUS to the peer that created a share while
+// it waits for the other peer, so it can tell its user how the wait is going. It
+// may be sent before the share's version is negotiated so its version is any the
+// relay supports. Events added later may be received, they should be ignored.
+const (
+	// A peer connected with the share code, Value counts the peers that have
+	StatusPeerJoined uint8 = 0x00
+	// The receiver sent its key, Value counts the receivers that have. READY
+	// follows once the receiver is accepted, for example after its PIN.
+	StatusReceiverKey uint8 = 0x01
+	// The share stops waiting for peers in Value seconds
+	StatusExpiring uint8 = 0x02
+)
+
+// Fields of STATUS
+type Status struct {
+	Event uint8
+	Value uint32
+}
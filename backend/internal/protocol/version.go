@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Protocol versions this package can encode and decode
+const (
+	LowestVersion  uint8 = 0
+	HighestVersion uint8 = 17
+)
+
+// An inclusive range of protocol versions
+type VersionRange struct {
+	Lowest  uint8
+	Highest uint8
+}
+
+// Returns the versions in both ranges and false if there are none
+func (r VersionRange) Intersect(other VersionRange) (VersionRange, bool) {
+	overlap := VersionRange{Lowest: max(r.Lowest, other.Lowest), Highest: min(r.Highest, other.Highest)}
+	return overlap, overlap.Lowest <= overlap.Highest
+}
+
+// Largest DATA_CHUNK payload from version 1
+const maxPayloadLengthV1 = 16 * 1024 * 1024
+
+func IsSupportedVersion(version uint8) bool {
+	return version >= LowestVersion && version <= HighestVersion
+}
+
+// Lowest version in which each opcode is defined
+func IntroducedIn(op Opcode) uint8 {
+	switch op {
+	case METADATA_ACKNOWLEDGE:
+		return 1
+	case RESUME, RESUMED:
+		return 3
+	case MANIFEST, END:
+		return 4
+	case PIN_CHALLENGE, PIN_RESPONSE:
+		return 7
+	case PAKE:
+		return 8
+	case VERIFY, KEY_MISMATCH:
+		return 9
+	case REQUEST_ACCEPTED:
+		return 12
+	case BROADCAST_READY:
+		return 13
+	case DECLINE:
+		return 14
+	case CANCEL:
+		return 15
+	case STATUS:
+		return 17
+	default:
+		return 0
+	}
+}
+
+// Number of bytes used for chunk numbers and chunk counts
+func CounterLength(version uint8) int {
+	if version == 0 {
+		return 2
+	}
+	return 4
+}
+
+// Number of bytes used for the DATA_CHUNK file index, chunks only carry one from version 4
+func FileIndexLength(version uint8) int {
+	if version < 4 {
+		return 0
+	}
+	return 2
+}
+
+// Number of bytes used for the DATA_CHUNK payload length
+func PayloadLengthLength(version uint8) int {
+	if version == 0 {
+		return 2
+	}
+	return 4
+}
+
+// In version 0 chunk numbers are 0x00 -> 0xFE, 0xFF is reserved to acknowledge the metadata
+func MaxNumberOfChunks(version uint8) uint32 {
+	if version == 0 {
+		return 0xFF
+	}
+	return math.MaxUint32
+}
+
+func MaxChunkNumber(version uint8) uint32 {
+	return MaxNumberOfChunks(version) - 1
+}
+
+func MaxPayloadLength(version uint8) int {
+	if version == 0 {
+		return math.MaxUint16
+	}
+	return maxPayloadLengthV1
+}
+
+func putUint(blob []byte, value uint32) {
+	switch len(blob) {
+	case 2:
+		binary.LittleEndian.PutUint16(blob, uint16(value))
+	case 4:
+		binary.LittleEndian.PutUint32(blob, value)
+	default:
+		panic(fmt.Sprintf("Unsupported field length %v.", len(blob)))
+	}
+}
+
+func readUint(blob []byte) uint32 {
+	switch len(blob) {
+	case 2:
+		return uint32(binary.LittleEndian.Uint16(blob))
+	case 4:
+		return binary.LittleEndian.Uint32(blob)
+	default:
+		panic(fmt.Sprintf("Unsupported field length %v.", len(blob)))
+	}
+}
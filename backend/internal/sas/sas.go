@@ -0,0 +1,78 @@
+// Package sas derives the short authentication string both peers of a share
+// show from version 9. If the relay replaced the receiver's public key in READY
+// the sender and receiver derive different strings, the users compare them (out
+// loud or side by side) and the sender aborts with KEY_MISMATCH if they differ.
+package sas
+
+import (
+	"crypto/sha256"
+	"strings"
+
+	"github.com/billyedmoore/tube/internal/wordlist"
+)
+
+const domain = "tube short authentication string v1"
+
+// Number of words or emoji in a short authentication string, 32 and 36 bits
+const (
+	wordCount  = 4
+	emojiCount = 6
+)
+
+// 64 emoji that are hard to confuse with each other so each stands for 6 bits
+var emoji = []string{
+	"🐶", "🐱", "🦁", "🐴", "🦄", "🐷", "🐘", "🐰",
+	"🐼", "🐓", "🐧", "🐢", "🐟", "🐙", "🦋", "🌷",
+	"🌳", "🌵", "🍄", "🌏", "🌙", "☁️", "🔥", "🍌",
+	"🍎", "🍓", "🌽", "🍕", "🎂", "❤️", "😀", "🤖",
+	"🎩", "👓", "🔧", "🎅", "👍", "☂️", "⌛", "⏰",
+	"🎁", "💡", "📕", "✏️", "📎", "✂️", "🔒", "🔑",
+	"🔨", "☎️", "🏁", "🚂", "🚲", "✈️", "🚀", "🏆",
+	"⚽", "🎸", "🎺", "🔔", "⚓", "🎧", "📁", "📌",
+}
+
+// Length of the random nonce the sender sends in VERIFY. The sender picks it
+// after READY so a relay choosing a key to swap in can't know it, and has to
+// match a 32 bit string by chance rather than by trying keys.
+const NonceLength = 16
+
+// Hash of the values the string is derived from, the share code, the
+// receiver's public key as relayed in READY and the sender's nonce
+func Derive(shareCode []byte, receiverPublicKey []byte, nonce []byte) [sha256.Size]byte {
+	h := sha256.New()
+
+	for _, value := range [][]byte{[]byte(domain), shareCode, receiverPublicKey, nonce} {
+		h.Write([]byte{byte(len(value) >> 8), byte(len(value))})
+		h.Write(value)
+	}
+
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+
+	return digest
+}
+
+// The string as words from the share code word list, for example "orbit lemon tiger sail"
+func Words(digest [sha256.Size]byte) string {
+	words := make([]string, wordCount)
+
+	for i := range words {
+		words[i] = wordlist.Words[digest[i]]
+	}
+
+	return strings.Join(words, " ")
+}
+
+// The string as emoji, each taking 6 bits of the digest
+func Emoji(digest [sha256.Size]byte) string {
+	var text strings.Builder
+
+	for i := range emojiCount {
+		bit := 6 * i
+		// the 6 bits may straddle two bytes
+		value := (uint16(digest[bit/8])<<8 | uint16(digest[bit/8+1])) >> (10 - bit%8) & 0x3F
+		text.WriteString(emoji[value])
+	}
+
+	return text.String()
+}
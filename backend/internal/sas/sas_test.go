@@ -0,0 +1,54 @@
+package sas
+
+import (
+	"bytes"
+	"testing"
+)
+
+var publicKey = bytes.Repeat([]byte{0xAB}, 512)
+
+var shareCode = []byte{0x01, 0x02, 0x03, 0x04, 0x05}
+
+var nonce = bytes.Repeat([]byte{0xCD}, NonceLength)
+
+func TestGolden(t *testing.T) {
+	digest := Derive(shareCode, publicKey, nonce)
+
+	if words := Words(digest); words != "brick agent stone elm" {
+		t.Errorf("Words should be %q are %q", "brick agent stone elm", words)
+	}
+	if text := Emoji(digest); text != "🐓🔨🌏🔧🔥😀" {
+		t.Errorf("Emoji should be %q are %q", "🐓🔨🌏🔧🔥😀", text)
+	}
+}
+
+func TestDifferentKeysGiveDifferentStrings(t *testing.T) {
+	digest := Derive(shareCode, publicKey, nonce)
+
+	otherKey := bytes.Clone(publicKey)
+	otherKey[100] ^= 0x01
+
+	otherNonce := bytes.Clone(nonce)
+	otherNonce[0] ^= 0x01
+
+	for _, other := range [][32]byte{Derive(shareCode, otherKey, nonce), Derive([]byte{0x01, 0x02, 0x03, 0x04, 0x06}, publicKey, nonce), Derive(shareCode, publicKey, otherNonce)} {
+		if Words(other) == Words(digest) || Emoji(other) == Emoji(digest) {
+			t.Errorf("Changing the key, share code or nonce should change the string")
+		}
+	}
+}
+
+func TestEmojiAreDistinct(t *testing.T) {
+	if len(emoji) != 64 {
+		t.Fatalf("There should be 64 emoji not %v", len(emoji))
+	}
+
+	seen := map[string]bool{}
+
+	for _, e := range emoji {
+		if seen[e] {
+			t.Errorf("Emoji %v is repeated", e)
+		}
+		seen[e] = true
+	}
+}
@@ -0,0 +1,852 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// The receivers of a broadcast share, from version 13 a sender may let several
+// receivers join with the same share code. Every chunk is forwarded to each
+// receiver and acknowledged to the sender once every receiver has acknowledged it.
+// Each receiver has its own writer so one that stops reading can't hold up the others.
+type broadcast struct {
+	// Most receivers that may join and the sender's drop policy
+	maxReceivers int
+	dropPolicy   uint8
+	// Receivers that have claimed a place and whether the share has stopped
+	// accepting receivers, guarded by the globalContext lock
+	claimed int
+	started bool
+	// Connections of receivers that have joined, sent by joinShare
+	joined    chan *websocket.Connection
+	receivers []*broadcastReceiver
+	// Messages from the receivers once the share started, their readers and writers
+	// stop once done is closed
+	fromReceivers chan receiverMessage
+	done          chan struct{}
+}
+
+type broadcastReceiver struct {
+	connection *websocket.Connection
+	key        protocol.ReceiverKey
+	// Chunks acknowledged by the receiver and since when it has been waiting to
+	// acknowledge one, it is dropped if that is longer than SlowReceiverTimeout. It
+	// has metadataTimeout to answer the metadata, its user may be asked first.
+	acknowledged         uint32
+	metadataAcknowledged bool
+	waitingSince         time.Time
+	dropped              bool
+	// Messages waiting for the receiver's writer once the share started, its writer
+	// stops once stopWriting is closed and closes written when it has stopped
+	outgoing    chan []byte
+	stopWriting chan struct{}
+	written     chan struct{}
+}
+
+// A message from a receiver of a broadcast share, ok is false once its connection closed
+type receiverMessage struct {
+	receiver *broadcastReceiver
+	blob     []byte
+	ok       bool
+}
+
+func newBroadcast(maxReceivers int, dropPolicy uint8) *broadcast {
+	return &broadcast{
+		maxReceivers: maxReceivers,
+		dropPolicy:   dropPolicy,
+		joined:       make(chan *websocket.Connection, maxReceivers),
+	}
+}
+
+// Claim a place in a broadcast share for a receiver joining it, the caller must
+// hold the context lock. The share stops being offered once every place is claimed.
+func claimBroadcastPlace(share *Share, context *globalContext) {
+	share.broadcast.claimed++
+
+	if share.broadcast.claimed == share.broadcast.maxReceivers {
+		delete(context.sharesAwaitingPeers, share.shareCode)
+		context.activeShares[share.shareCode] = share
+	}
+}
+
+// Give back the place of a receiver that failed to join so another receiver can take it
+func releaseBroadcastPlace(share *Share, context *globalContext) {
+	context.lock.Lock()
+	defer context.lock.Unlock()
+
+	if share.broadcast.started {
+		return
+	}
+
+	share.broadcast.claimed--
+
+	if context.activeShares[share.shareCode] == share {
+		delete(context.activeShares, share.shareCode)
+		context.sharesAwaitingPeers[share.shareCode] = share
+	}
+}
+
+// Upgrade the connection of a receiver joining a broadcast share and hand it to
+// the share, it is refused if the share stopped accepting receivers meanwhile
+func joinBroadcastShare(w http.ResponseWriter, r *http.Request, context *globalContext, share *Share) {
+	connection, err := websocket.CreateConnection()
+
+	if err != nil {
+		releaseBroadcastPlace(share, context)
+		http.Error(w, "Internal server error.", http.StatusInternalServerError)
+		return
+	}
+
+	err = websocket.UpgradeConnection(w, r, connection)
+
+	if err != nil {
+		releaseBroadcastPlace(share, context)
+		http.Error(w, "Websocket failed to upgrade.", http.StatusInternalServerError)
+		return
+	}
+
+	context.lock.Lock()
+	started := share.broadcast.started
+
+	if !started {
+		share.broadcast.joined <- connection
+	}
+	context.lock.Unlock()
+
+	if started {
+		sendError(connection, share.version, protocol.E_CLAIMED, "Broadcast share started before the receiver joined.")
+		websocket.InitiateClose(connection)
+	}
+}
+
+// AwaitingReceiver for a broadcast share: receivers join until every place is
+// taken or the time to live is over, then the share starts with those that joined
+func awaitBroadcastReceivers(share *Share, context *globalContext) (shareState, error) {
+	err := gatherReceivers(share, context)
+
+	if err != nil {
+		return stateClosing, err
+	}
+
+	return stateKeyExchange, startBroadcast(share, context)
+}
+
+// Accept receivers until every place is taken or the share's time to live is
+// over, returns an error if no receiver joined or the sender cancelled the share
+func gatherReceivers(share *Share, context *globalContext) error {
+	b := share.broadcast
+	// why the sender ended the share before it started, nil unless it did
+	var withdrawn error
+
+	expired := time.After(share.timeToLive)
+	expiring := startTimeToLive(share, context)
+	done := make(chan struct{})
+	defer close(done)
+
+	type initiation struct {
+		connection *websocket.Connection
+		blob       []byte
+		ok         bool
+	}
+
+	initiations := make(chan initiation)
+	// connections that joined but haven't sent RECEIVER_INITIATION
+	pending := map[*websocket.Connection]bool{}
+
+gathering:
+	for len(b.receivers) < b.maxReceivers {
+		select {
+		case connection := <-b.joined:
+			pending[connection] = true
+			countBroadcastReceivers(share, context, len(pending))
+			sendStatus(share, protocol.StatusPeerJoined, uint32(len(pending)+len(b.receivers)))
+
+			go func() {
+				blob, ok := <-connection.Incoming
+
+				select {
+				case initiations <- initiation{connection, blob, ok}:
+				case <-done:
+				}
+			}()
+		case joining := <-initiations:
+			delete(pending, joining.connection)
+
+			err := fail(protocol.E_PEER_GONE, "Receiver disconnected.")
+
+			if joining.ok {
+				err = addBroadcastReceiver(share, joining.connection, joining.blob)
+			}
+
+			countBroadcastReceivers(share, context, len(pending))
+
+			if err != nil {
+				websocket.InitiateClose(joining.connection)
+				releaseBroadcastPlace(share, context)
+			} else {
+				sendStatus(share, protocol.StatusReceiverKey, uint32(len(b.receivers)))
+			}
+		case blob, ok := <-share.senderConnection.Incoming:
+			// the sender sends nothing while receivers join except CANCEL
+			withdrawn = fail(protocol.E_PEER_GONE, "%v disconnected.", senderRole)
+
+			if ok {
+				withdrawn = checkCancel(blob, senderRole)
+			}
+
+			if withdrawn == nil {
+				withdrawn = fail(protocol.E_SEQUENCE, "Unexpected message while waiting for a receiver.")
+			}
+
+			break gathering
+		case <-expiring:
+			sendStatus(share, protocol.StatusExpiring, uint32(expiryWarning/time.Second))
+		case <-expired:
+			break gathering
+		}
+	}
+
+	context.lock.Lock()
+	b.started = true
+	delete(context.sharesAwaitingPeers, share.shareCode)
+
+	if withdrawn == nil && len(b.receivers) > 0 {
+		context.activeShares[share.shareCode] = share
+	} else {
+		delete(context.activeShares, share.shareCode)
+
+		if withdrawn == nil {
+			recordExpiredShareCode(context, share.shareCode)
+		}
+	}
+	context.lock.Unlock()
+
+	// receivers that joined too late are refused, nothing is sent on joined once started is set
+	for len(b.joined) > 0 {
+		pending[<-b.joined] = true
+	}
+
+	if withdrawn != nil {
+		// receivers that haven't sent their initiation are told why the share ended too
+		for connection := range pending {
+			b.receivers = append(b.receivers, &broadcastReceiver{connection: connection})
+		}
+
+		return withdrawn
+	}
+
+	for connection := range pending {
+		sendError(connection, share.version, protocol.E_CLAIMED, "Broadcast share started before the receiver joined.")
+		websocket.InitiateClose(connection)
+	}
+
+	if len(b.receivers) == 0 {
+		return fail(protocol.E_EXPIRED, "Share expired before a receiver joined.")
+	}
+
+	return nil
+}
+
+// Count the receivers of a broadcast share for the status endpoint, pending
+// receivers have joined but not sent their key
+func countBroadcastReceivers(share *Share, context *globalContext, pending int) {
+	ready := len(share.broadcast.receivers)
+
+	updateStatus(share, context, func(status *shareStatus) {
+		status.ReceiversJoined, status.ReceiversReady = pending+ready, ready
+	})
+}
+
+// Check the RECEIVER_INITIATION of a receiver joining a broadcast share, every
+// receiver must support a version the others do
+func addBroadcastReceiver(share *Share, connection *websocket.Connection, blob []byte) error {
+	// a receiver cancelling before it is accepted just leaves
+	if err := checkCancel(blob, receiverRole); err != nil {
+		return err
+	}
+
+	receiverVersions, receiverKey, err := protocol.DecodeReceiverInitiation(blob)
+
+	if err != nil {
+		err = fail(protocol.E_SEQUENCE, "Failed to decode receiver initiation message.")
+		sendError(connection, share.version, errorCode(err), err.Error())
+		return err
+	}
+
+	if receiverKey.KeyType != protocol.KeyTypeRsa4096 {
+		receiverVersions.Lowest = max(receiverVersions.Lowest, protocol.KeyTypesVersion)
+	}
+
+	negotiatedVersions, ok := share.versions.Intersect(receiverVersions)
+
+	if !ok {
+		err = fail(protocol.E_VERSION, "No protocol version is supported by the sender, receivers and relay.")
+		sendError(connection, errorVersionFor(receiverVersions), errorCode(err), err.Error())
+		return err
+	}
+
+	share.versions = negotiatedVersions
+	share.broadcast.receivers = append(share.broadcast.receivers, &broadcastReceiver{connection: connection, key: receiverKey})
+
+	return nil
+}
+
+// Send RECEIVER_ACCEPTED to every receiver and BROADCAST_READY with the keys of
+// those still connected to the sender. Broadcast shares can't be resumed, the
+// receivers' resume token is all zeros.
+func startBroadcast(share *Share, context *globalContext) error {
+	share.version = share.versions.Highest
+	share.windowSize = negotiateWindowSize(share.version, share.requestedWindowSize)
+
+	recieverAcceptance, err := protocol.EncodeReceiverAcceptance(share.version, share.receiverResumeToken[:])
+
+	if err != nil {
+		return fail(protocol.E_INTERNAL, "Failed to encode receiver acceptance message.")
+	}
+
+	var accepted []*broadcastReceiver
+	var keys []protocol.ReceiverKey
+
+	for _, receiver := range share.broadcast.receivers {
+		err = websocket.SendBlobData(receiver.connection, recieverAcceptance)
+
+		// a receiver that left before the share started is forgotten
+		if err != nil {
+			websocket.InitiateClose(receiver.connection)
+			continue
+		}
+
+		accepted = append(accepted, receiver)
+		keys = append(keys, receiver.key)
+	}
+
+	share.broadcast.receivers = accepted
+
+	if len(accepted) == 0 {
+		return fail(protocol.E_PEER_GONE, "Every receiver left the broadcast share.")
+	}
+
+	ready, err := protocol.EncodeBroadcastReady(protocol.BroadcastReady{
+		Version:      share.version,
+		WindowSize:   share.windowSize,
+		ReceiverKeys: keys,
+	})
+
+	if err != nil {
+		return fail(protocol.E_INTERNAL, "Failed to encode broadcast ready message.")
+	}
+
+	err = websocket.SendBlobData(share.senderConnection, ready)
+
+	if err != nil {
+		return fail(protocol.E_PEER_GONE, "Failed to send broadcast ready message.")
+	}
+
+	share.broadcast.fromReceivers = make(chan receiverMessage)
+	share.broadcast.done = make(chan struct{})
+
+	for _, receiver := range share.broadcast.receivers {
+		// the window limits the chunks in flight, the manifest and END are queued too
+		receiver.outgoing = make(chan []byte, int(share.windowSize)+2)
+		receiver.stopWriting = make(chan struct{})
+		receiver.written = make(chan struct{})
+		websocket.SetWriteTimeout(receiver.connection, context.config.SlowReceiverTimeout)
+
+		go readReceiver(receiver, share.broadcast.fromReceivers, share.broadcast.done)
+		go writeReceiver(receiver, share.broadcast.done)
+	}
+
+	return nil
+}
+
+// Stop the readers and writers of a broadcast share's receivers once it is closing,
+// messages still queued for the receivers are discarded
+func stopReadingReceivers(share *Share) {
+	if share.broadcast.done != nil {
+		close(share.broadcast.done)
+	}
+}
+
+// KeyExchange for a broadcast share: forward the sender's manifest to every receiver
+func relayBroadcastManifest(share *Share, context *globalContext) (shareState, error) {
+	meta, err := receiveFrom(share, senderRole)
+
+	if err != nil {
+		return stateClosing, err
+	}
+
+	files, err := protocol.DecodeManifest(meta, share.version)
+
+	if err != nil {
+		return stateClosing, fail(protocol.E_SEQUENCE, "Failed to decode manifest message.")
+	}
+
+	share.fileChunkBoundaries = protocol.ChunkBoundaries(files)
+	share.streamed = protocol.IsStreamed(files)
+	publishTotalChunks(share, context)
+
+	for _, receiver := range liveReceivers(share) {
+		err = sendToReceiver(share, context, receiver, meta)
+
+		if err != nil {
+			return stateClosing, err
+		}
+	}
+
+	return stateMetadata, nil
+}
+
+// How often receivers are checked for falling behind
+func slowReceiverInterval(context *globalContext) time.Duration {
+	return max(context.config.SlowReceiverTimeout/4, 10*time.Millisecond)
+}
+
+// Metadata for a broadcast share: acknowledge the metadata to the sender once
+// every remaining receiver has acknowledged it. Receivers that haven't answered
+// by the state's deadline are dropped rather than the whole share timing out.
+func relayBroadcastMetadata(share *Share, context *globalContext) (shareState, error) {
+	var err error
+
+	for !metadataAcknowledged(share) {
+		select {
+		case message := <-share.broadcast.fromReceivers:
+			err = acceptMetadataAcknowledge(share, context, message)
+		case <-deadlineOf(share):
+			err = dropUnansweredReceivers(share, context)
+		}
+
+		if err != nil {
+			return stateClosing, err
+		}
+	}
+
+	err = websocket.SendBlobData(share.senderConnection, protocol.EncodeMetadataAcknowledge(share.version))
+
+	if err != nil {
+		return stateClosing, fail(protocol.E_PEER_GONE, "Failed to forward awknowledgement.")
+	}
+
+	return stateTransferring, nil
+}
+
+// Transferring for a broadcast share: forward the chunks from the sender to every
+// receiver, acknowledging each chunk to the sender once every receiver has acknowledged it
+func relayBroadcast(share *Share, context *globalContext) (shareState, error) {
+	slowReceivers := time.NewTicker(slowReceiverInterval(context))
+	defer slowReceivers.Stop()
+
+	numberOfChunks := share.fileChunkBoundaries[len(share.fileChunkBoundaries)-1]
+
+	var progress transferProgress
+	var err error
+
+	defer publishProgress(share, context, &progress, true)
+
+	for !progress.ended {
+		relayed := true
+
+		select {
+		case chunk, ok := <-share.senderConnection.Incoming:
+			if !ok {
+				return stateClosing, fail(protocol.E_PEER_GONE, "%v disconnected.", senderRole)
+			}
+
+			if err := checkCancel(chunk, senderRole); err != nil {
+				return stateClosing, err
+			}
+
+			if endsTransfer(share, chunk) {
+				err = broadcastEnd(share, context, &progress, numberOfChunks, chunk)
+			} else {
+				err = broadcastDataChunk(share, context, &progress, numberOfChunks, chunk)
+			}
+		case message := <-share.broadcast.fromReceivers:
+			err = acceptBroadcastAcknowledge(share, context, &progress, message)
+		case <-slowReceivers.C:
+			relayed = false
+			err = dropSlowReceivers(share, context, &progress)
+		case <-deadlineOf(share):
+			err = timedOut(share)
+		}
+
+		if err == nil {
+			err = acknowledgeToSender(share, &progress)
+		}
+
+		if err != nil {
+			return stateClosing, err
+		}
+
+		if relayed {
+			extendDeadline(share)
+			publishProgress(share, context, &progress, false)
+		}
+	}
+
+	flushReceivers(share)
+
+	return stateClosing, nil
+}
+
+// Wait for the writers of the remaining receivers to write every queued message
+// once the transfer has ended, nothing may be queued afterwards
+func flushReceivers(share *Share) {
+	for _, receiver := range liveReceivers(share) {
+		close(receiver.outgoing)
+	}
+
+	for _, receiver := range liveReceivers(share) {
+		<-receiver.written
+	}
+}
+
+// Write the messages queued for a receiver until it leaves or the share ends. A
+// receiver that can't be written to is disconnected, which its reader reports.
+func writeReceiver(receiver *broadcastReceiver, done <-chan struct{}) {
+	defer close(receiver.written)
+
+	for {
+		select {
+		case blob, ok := <-receiver.outgoing:
+			if !ok {
+				return
+			}
+
+			select {
+			case <-receiver.stopWriting:
+				return
+			case <-done:
+				return
+			default:
+			}
+
+			if err := websocket.SendBlobData(receiver.connection, blob); err != nil {
+				websocket.Close(receiver.connection)
+				return
+			}
+		case <-receiver.stopWriting:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// Pass the messages of a receiver to the share's go-routine until it closes or the share ends
+func readReceiver(receiver *broadcastReceiver, messages chan<- receiverMessage, done <-chan struct{}) {
+	for {
+		blob, ok := <-receiver.connection.Incoming
+
+		select {
+		case messages <- receiverMessage{receiver, blob, ok}:
+		case <-done:
+			return
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
+
+func liveReceivers(share *Share) []*broadcastReceiver {
+	var live []*broadcastReceiver
+
+	for _, receiver := range share.broadcast.receivers {
+		if !receiver.dropped {
+			live = append(live, receiver)
+		}
+	}
+
+	return live
+}
+
+// Queue a message for a receiver's writer, a receiver whose queue is full has
+// fallen too far behind and is dropped
+func sendToReceiver(share *Share, context *globalContext, receiver *broadcastReceiver, blob []byte) error {
+	select {
+	case receiver.outgoing <- blob:
+		return nil
+	default:
+		return dropReceiver(share, context, receiver, protocol.E_DROPPED, "Receiver fell too far behind the broadcast share.")
+	}
+}
+
+// Stop writing to a receiver that left the share and close its connection, sending
+// an ERROR first if reason isn't empty. A receiver that stopped reading blocks
+// writes until its write timeout so it is closed on another go-routine.
+func closeReceiver(share *Share, receiver *broadcastReceiver, code protocol.ErrorCode, reason string) {
+	if receiver.stopWriting != nil {
+		close(receiver.stopWriting)
+	}
+
+	version := share.version
+
+	go func() {
+		if reason != "" {
+			sendError(receiver.connection, version, code, reason)
+		}
+		websocket.InitiateClose(receiver.connection)
+	}()
+}
+
+// Drop a receiver that left or fell behind, with the DropPolicyEndShare policy the
+// returned error ends the share for everyone
+func dropReceiver(share *Share, context *globalContext, receiver *broadcastReceiver, code protocol.ErrorCode, reason string) error {
+	if receiver.dropped {
+		return nil
+	}
+
+	if share.broadcast.dropPolicy == protocol.DropPolicyEndShare {
+		return fail(code, "%v", reason)
+	}
+
+	receiver.dropped = true
+	context.metrics.broadcastReceiversDropped.Add(1)
+
+	closeReceiver(share, receiver, code, reason)
+
+	if len(liveReceivers(share)) == 0 {
+		return fail(protocol.E_PEER_GONE, "Every receiver left the broadcast share.")
+	}
+
+	return nil
+}
+
+// Drop receivers that have been waiting to acknowledge a chunk for longer than SlowReceiverTimeout
+func dropSlowReceivers(share *Share, context *globalContext, progress *transferProgress) error {
+	for _, receiver := range liveReceivers(share) {
+		waiting := receiver.acknowledged < progress.forwarded
+
+		if waiting && time.Since(receiver.waitingSince) > context.config.SlowReceiverTimeout {
+			err := dropReceiver(share, context, receiver, protocol.E_DROPPED, "Receiver fell too far behind the broadcast share.")
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Drop the receivers that haven't answered the metadata once the Metadata state's deadline has passed
+func dropUnansweredReceivers(share *Share, context *globalContext) error {
+	log.Printf("Broadcast share timed out in the %v state.\n", share.state)
+
+	for _, receiver := range liveReceivers(share) {
+		if receiver.metadataAcknowledged {
+			continue
+		}
+
+		err := dropReceiver(share, context, receiver, protocol.E_TIMEOUT,
+			fmt.Sprintf("Receiver did not answer the metadata within %v.", metadataTimeout))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func metadataAcknowledged(share *Share) bool {
+	for _, receiver := range liveReceivers(share) {
+		if !receiver.metadataAcknowledged {
+			return false
+		}
+	}
+
+	return true
+}
+
+func acceptMetadataAcknowledge(share *Share, context *globalContext, message receiverMessage) error {
+	if message.receiver.dropped {
+		return nil
+	}
+
+	if !message.ok {
+		return dropReceiver(share, context, message.receiver, protocol.E_PEER_GONE, "Receiver disconnected.")
+	}
+
+	if err := checkCancel(message.blob, receiverRole); err != nil {
+		return cancelBroadcastReceiver(share, context, message.receiver, err.(*cancellation))
+	}
+
+	if isDecline(share, message.blob) && !message.receiver.metadataAcknowledged {
+		return declineBroadcast(share, context, message.receiver, message.blob)
+	}
+
+	err := protocol.DecodeMetadataAcknowledge(message.blob, share.version)
+
+	if err != nil || message.receiver.metadataAcknowledged {
+		return dropReceiver(share, context, message.receiver, protocol.E_SEQUENCE, "Failed to decode metadata awknowledgement.")
+	}
+
+	message.receiver.metadataAcknowledged = true
+
+	return nil
+}
+
+// Returned once every receiver of a broadcast share declined or cancelled it and
+// the last DECLINE or CANCEL has been forwarded to the sender
+var errReceiversLeft = fmt.Errorf("Every receiver declined or cancelled the broadcast share.")
+
+// Let a receiver leave a broadcast share it declined whatever the drop policy, the
+// sender is only told once every receiver has declined
+func declineBroadcast(share *Share, context *globalContext, receiver *broadcastReceiver, decline []byte) error {
+	_, err := protocol.DecodeDecline(decline, share.version)
+
+	if err != nil {
+		return dropReceiver(share, context, receiver, protocol.E_SEQUENCE, "Failed to decode decline message.")
+	}
+
+	context.metrics.sharesDeclined.Add(1)
+
+	receiver.dropped = true
+	closeReceiver(share, receiver, protocol.E_UNSPECIFIED, "")
+
+	if len(liveReceivers(share)) > 0 {
+		return nil
+	}
+
+	err = websocket.SendBlobData(share.senderConnection, decline)
+
+	if err != nil {
+		return fail(protocol.E_PEER_GONE, "Failed to forward decline message.")
+	}
+
+	return errReceiversLeft
+}
+
+// Let a receiver cancel its part of a broadcast share whatever the drop policy,
+// the share is only cancelled once every receiver has cancelled or declined it
+func cancelBroadcastReceiver(share *Share, context *globalContext, receiver *broadcastReceiver, cancelled *cancellation) error {
+	receiver.dropped = true
+	closeReceiver(share, receiver, protocol.E_UNSPECIFIED, "")
+
+	if len(liveReceivers(share)) > 0 {
+		log.Printf("A receiver left a broadcast share. %q\n", cancelled.reason)
+		return nil
+	}
+
+	recordCancellation(context, cancelled)
+	forwardCancel(share.senderConnection, share.version, cancelled)
+
+	return errReceiversLeft
+}
+
+// Forward a chunk to every receiver, the window is counted from the chunk the
+// slowest receiver is waiting to acknowledge
+func broadcastDataChunk(share *Share, context *globalContext, progress *transferProgress, numberOfChunks uint32,
+	chunk []byte) error {
+	payloadLength, err := checkDataChunk(share, progress, numberOfChunks, chunk)
+
+	if err != nil {
+		return err
+	}
+
+	for _, receiver := range liveReceivers(share) {
+		if receiver.acknowledged == progress.forwarded {
+			receiver.waitingSince = time.Now()
+		}
+
+		err = sendToReceiver(share, context, receiver, chunk)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	progress.forwarded++
+	progress.inFlight = append(progress.inFlight, payloadLength)
+
+	return nil
+}
+
+func broadcastEnd(share *Share, context *globalContext, progress *transferProgress, numberOfChunks uint32,
+	end []byte) error {
+	err := checkEnd(share, progress, numberOfChunks, end)
+
+	if err != nil {
+		return err
+	}
+
+	for _, receiver := range liveReceivers(share) {
+		err = sendToReceiver(share, context, receiver, end)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	progress.ended = true
+
+	return nil
+}
+
+// Record a receiver's cumulative acknowledgement, a receiver acknowledging a chunk
+// it wasn't sent is dropped
+func acceptBroadcastAcknowledge(share *Share, context *globalContext, progress *transferProgress,
+	message receiverMessage) error {
+	receiver := message.receiver
+
+	if receiver.dropped {
+		return nil
+	}
+
+	if !message.ok {
+		return dropReceiver(share, context, receiver, protocol.E_PEER_GONE, "Receiver disconnected.")
+	}
+
+	if err := checkCancel(message.blob, receiverRole); err != nil {
+		return cancelBroadcastReceiver(share, context, receiver, err.(*cancellation))
+	}
+
+	chunkNumber, err := protocol.DecodeAcknowledge(message.blob, share.version)
+
+	if err != nil || chunkNumber < receiver.acknowledged || chunkNumber >= progress.forwarded {
+		return dropReceiver(share, context, receiver, protocol.E_SEQUENCE,
+			"Recieved acknowledgement for a chunk which is not awaiting acknowledgement.")
+	}
+
+	receiver.acknowledged = chunkNumber + 1
+	receiver.waitingSince = time.Now()
+
+	return nil
+}
+
+// Acknowledge the chunks every remaining receiver has acknowledged that haven't
+// been acknowledged to the sender yet
+func acknowledgeToSender(share *Share, progress *transferProgress) error {
+	acknowledged := progress.forwarded
+
+	for _, receiver := range liveReceivers(share) {
+		acknowledged = min(acknowledged, receiver.acknowledged)
+	}
+
+	if acknowledged <= progress.acknowledged {
+		return nil
+	}
+
+	chunkAck, err := protocol.EncodeAcknowledge(share.version, acknowledged-1)
+
+	if err != nil {
+		return fail(protocol.E_INTERNAL, "Failed to encode awknowledgement.")
+	}
+
+	recordAcknowledged(progress, acknowledged)
+
+	err = websocket.SendBlobData(share.senderConnection, chunkAck)
+
+	if err != nil {
+		return fail(protocol.E_PEER_GONE, "Failed to forward awknowledgement.")
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+func TestBroadcastPlaces(t *testing.T) {
+	context := newGlobalContext(DefaultConfig())
+
+	share := &Share{shareCode: [5]byte{1}, broadcast: newBroadcast(2, protocol.DropPolicyEndShare)}
+	context.sharesAwaitingPeers[share.shareCode] = share
+
+	lookup := func() lookupResult {
+		context.lock.Lock()
+		defer context.lock.Unlock()
+		result, _ := lookupShare(context, share.shareCode, receiverRole)
+		return result
+	}
+
+	context.lock.Lock()
+	claimBroadcastPlace(share, context)
+	context.lock.Unlock()
+
+	if result := lookup(); result != shareAwaitingPeer {
+		t.Errorf("Broadcast share with a free place should be %v not %v", shareAwaitingPeer, result)
+	}
+
+	context.lock.Lock()
+	claimBroadcastPlace(share, context)
+	context.lock.Unlock()
+
+	if result := lookup(); result != shareClaimed {
+		t.Errorf("Broadcast share with every place claimed should be %v not %v", shareClaimed, result)
+	}
+
+	// a receiver that failed to join gives its place back
+	releaseBroadcastPlace(share, context)
+
+	if result := lookup(); result != shareAwaitingPeer || share.broadcast.claimed != 1 {
+		t.Errorf("Released place should be offered again, lookup is %v", result)
+	}
+
+	share.broadcast.started = true
+	releaseBroadcastPlace(share, context)
+
+	if share.broadcast.claimed != 1 {
+		t.Errorf("Places shouldn't be released once the share started")
+	}
+}
+
+func TestBroadcastReceiverFallsBehind(t *testing.T) {
+	context := newGlobalContext(DefaultConfig())
+
+	stalledSide, stalled := connectedPair(t)
+	readingSide, reading := connectedPair(t)
+
+	share := &Share{version: protocol.HighestVersion, broadcast: newBroadcast(2, protocol.DropPolicyContinue)}
+	share.broadcast.done = make(chan struct{})
+	defer close(share.broadcast.done)
+
+	for _, connection := range []*websocket.Connection{stalledSide, readingSide} {
+		share.broadcast.receivers = append(share.broadcast.receivers, &broadcastReceiver{
+			connection:  connection,
+			outgoing:    make(chan []byte, 1),
+			stopWriting: make(chan struct{}),
+			written:     make(chan struct{}),
+		})
+	}
+
+	// only the receiver that keeps up has a writer, the stalled receiver's queue is never emptied
+	go writeReceiver(share.broadcast.receivers[1], share.broadcast.done)
+
+	for i := range 2 {
+		for _, receiver := range share.broadcast.receivers {
+			if err := sendToReceiver(share, context, receiver, []byte{byte(i)}); err != nil {
+				t.Fatalf("Receiver falling behind shouldn't end the share: %v", err)
+			}
+		}
+
+		if message := <-reading.Incoming; message[0] != byte(i) {
+			t.Fatalf("Receiver that keeps up should get message %v is %v", i, message)
+		}
+	}
+
+	if !share.broadcast.receivers[0].dropped || share.broadcast.receivers[1].dropped {
+		t.Errorf("Only the receiver whose queue overflowed should be dropped")
+	}
+
+	_, code, _, _, err := protocol.DecodeError(<-stalled.Incoming)
+
+	if err != nil || code != protocol.E_DROPPED {
+		t.Errorf("Dropped receiver should be sent %v is %v (%v)", protocol.E_DROPPED, code, err)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// A CANCEL sent by a peer, from version 15 either peer may cancel the share while
+// the relay waits for any of its messages. Wait points return it as an error so
+// the share is closed by closeShare rather than errored out.
+type cancellation struct {
+	by     peerRole
+	reason string
+}
+
+func (c *cancellation) Error() string {
+	return fmt.Sprintf("%v cancelled the share. %v", c.by, c.reason)
+}
+
+// Returns a *cancellation if the message from the peer is a CANCEL and nil
+// otherwise, a malformed CANCEL is left for the caller to reject
+func checkCancel(blob []byte, from peerRole) error {
+	if len(blob) == 0 || protocol.Opcode(blob[0]) != protocol.CANCEL {
+		return nil
+	}
+
+	_, reason, err := protocol.DecodeCancel(blob)
+
+	if err != nil {
+		return nil
+	}
+
+	return &cancellation{by: from, reason: reason}
+}
+
+// How long to wait for the rest of the messages on a connection the relay failed
+// to write to, a peer that cancels may close its connection before the relay
+// next writes to it
+const queuedCancelTimeout = 2 * time.Second
+
+// The CANCEL a peer sent before its connection failed as a *cancellation, nil
+// if it didn't send one. Its other unread messages are discarded.
+func queuedCancel(connection *websocket.Connection, role peerRole) error {
+	expired := time.After(queuedCancelTimeout)
+
+	for {
+		select {
+		case blob, ok := <-connection.Incoming:
+			if !ok {
+				return nil
+			}
+
+			if err := checkCancel(blob, role); err != nil {
+				return err
+			}
+		case <-expired:
+			return nil
+		}
+	}
+}
+
+func recordCancellation(context *globalContext, cancelled *cancellation) {
+	if cancelled.by == senderRole {
+		context.metrics.sharesCancelledBySender.Add(1)
+	} else {
+		context.metrics.sharesCancelledByReceiver.Add(1)
+	}
+
+	log.Printf("%v cancelled a share. %q\n", cancelled.by, cancelled.reason)
+}
+
+// Send CANCEL to a peer that has joined, peers before version 15 are sent an ERROR instead
+func forwardCancel(connection *websocket.Connection, version uint8, cancelled *cancellation) {
+	if !websocket.IsConnected(connection) {
+		return
+	}
+
+	if version < protocol.IntroducedIn(protocol.CANCEL) {
+		sendError(connection, version, protocol.E_UNSPECIFIED, cancelled.Error())
+		return
+	}
+
+	blob, err := protocol.EncodeCancel(version, cancelled.reason)
+
+	if err != nil {
+		// the reason was decoded from a CANCEL so it always encodes
+		panic("Cancel reason should be valid but isn't.")
+	}
+
+	// the peer may already have left, the share is over either way
+	websocket.SendBlobData(connection, blob)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+func TestCheckCancel(t *testing.T) {
+	cases := []struct {
+		blob      []byte
+		cancelled bool
+	}{
+		{[]byte{0x17, 0x0F, 0x03, 0x00, 'b', 'y', 'e'}, true},
+		{[]byte{0x17, 0x0F, 0x00, 0x00}, true},
+		// CANCEL from before version 15 or with a truncated reason is malformed
+		{[]byte{0x17, 0x0E, 0x00, 0x00}, false},
+		{[]byte{0x17, 0x0F, 0x03, 0x00, 'b'}, false},
+		{[]byte{0x0D, 0x0F}, false},
+		{[]byte{}, false},
+	}
+
+	for _, c := range cases {
+		err := checkCancel(c.blob, receiverRole)
+		var cancelled *cancellation
+
+		if errors.As(err, &cancelled) != c.cancelled {
+			t.Errorf("%v should be a cancellation: %v", c.blob, c.cancelled)
+		}
+	}
+
+	err := checkCancel([]byte{0x17, 0x0F, 0x03, 0x00, 'b', 'y', 'e'}, senderRole)
+
+	if err == nil || err.Error() != "Sender cancelled the share. bye" {
+		t.Errorf("Cancellation should give the peer and its reason is %v", err)
+	}
+}
+
+func TestCancelBeforeFailedWrite(t *testing.T) {
+	senderSide, sender := connectedPair(t)
+	receiverSide, _ := connectedPair(t)
+
+	share := &Share{
+		version:            protocol.HighestVersion,
+		senderConnection:   senderSide,
+		receiverConnection: receiverSide,
+		resumptions:        make(chan resumption),
+	}
+
+	cancel, _ := protocol.EncodeCancel(share.version, "bye")
+
+	// the sender cancels and leaves before the relay forwards it an acknowledgement
+	websocket.SendBlobData(sender, cancel)
+	websocket.Close(sender)
+
+	progress := transferProgress{}
+	err := suspendShare(share, &progress, 4, senderRole, nil)
+	var cancelled *cancellation
+
+	if !errors.As(err, &cancelled) || cancelled.by != senderRole || cancelled.reason != "bye" {
+		t.Errorf("Sender's CANCEL should end the share instead of suspending it, ended with %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/sharecode"
+)
+
+// Settings for the relay, see DefaultConfig for the defaults
+type Config struct {
+	// How long a share waits for a receiver before it expires,
+	// senders may ask for a shorter time to live but not a longer one
+	ShareTTL time.Duration
+	// Generates share codes and parses the codes given by receivers
+	ShareCodes sharecode.Generator
+	// Shares each client address may create and receiver attempts it may make
+	SenderRateLimit   RateLimit
+	ReceiverRateLimit RateLimit
+	// A client address making MaxFailedLookups lookups of unknown or expired share
+	// codes within FailedLookupWindow is refused by the receiver endpoint for
+	// LockoutDuration, a MaxFailedLookups of 0 disables the lockout
+	MaxFailedLookups   int
+	FailedLookupWindow time.Duration
+	LockoutDuration    time.Duration
+	// Proxies trusted to set the Forwarded and X-Forwarded-For headers, requests
+	// from anywhere else are limited by their remote address
+	TrustedProxies []netip.Prefix
+	// Most receivers a broadcast share may have, senders asking for more are
+	// given this many places
+	MaxBroadcastReceivers int
+	// How long a receiver of a broadcast share may take to acknowledge a chunk, or
+	// stop reading, before it is dropped
+	SlowReceiverTimeout time.Duration
+}
+
+const defaultShareTTL = 10 * time.Minute
+
+func DefaultConfig() Config {
+	return Config{
+		ShareTTL: defaultShareTTL,
+		// understood by clients that don't read the share code text added in version 6
+		ShareCodes:            sharecode.Base64{},
+		SenderRateLimit:       RateLimit{Rate: 10.0 / 60, Burst: 10},
+		ReceiverRateLimit:     RateLimit{Rate: 20.0 / 60, Burst: 10},
+		MaxFailedLookups:      10,
+		FailedLookupWindow:    10 * time.Minute,
+		LockoutDuration:       15 * time.Minute,
+		MaxBroadcastReceivers: 32,
+		SlowReceiverTimeout:   30 * time.Second,
+	}
+}
+
+func newGlobalContext(config Config) *globalContext {
+	return &globalContext{
+		config:              config,
+		activeShares:        make(map[[5]byte]*Share),
+		sharesAwaitingPeers: make(map[[5]byte]*Share),
+		resumeTokens:        make(map[[protocol.ResumeTokenLength]byte]*Share),
+		expiredShareCodes:   make(map[[5]byte]time.Time),
+		failedLookups:       newFailedLookups(config),
+		senderLimiter:       newRateLimiter(config.SenderRateLimit),
+		receiverLimiter:     newRateLimiter(config.ReceiverRateLimit),
+	}
+}
+
+// Create a mux serving the sender, receiver, resume, metrics and share status endpoints of the relay
+func NewServeMux(config Config) *http.ServeMux {
+	context := newGlobalContext(config)
+
+	mux := http.NewServeMux()
+	mux.Handle("/send", senderHandler{context: context})
+	mux.Handle("/receive", receiverHandler{context: context})
+	mux.Handle("/resume", resumeHandler{context: context})
+	mux.Handle("/metrics", metricsHandler{context: context})
+	mux.Handle("GET /shares/{code}/status", statusHandler{context: context})
+
+	return mux
+}
+
+// Time to live of a share, requestedSeconds is the time to live asked for by the
+// sender with 0 meaning the relay's default
+func negotiateTimeToLive(config Config, requestedSeconds uint32) time.Duration {
+	requested := time.Duration(requestedSeconds) * time.Second
+
+	if requestedSeconds == 0 || requested > config.ShareTTL {
+		return config.ShareTTL
+	}
+
+	return requested
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeToLiveNegotiation(t *testing.T) {
+	config := Config{ShareTTL: 10 * time.Minute}
+
+	cases := []struct {
+		requestedSeconds uint32
+		negotiated       time.Duration
+	}{
+		{0, 10 * time.Minute},
+		{1, time.Second},
+		{60, time.Minute},
+		{600, 10 * time.Minute},
+		{601, 10 * time.Minute},
+		{0xFFFFFFFF, 10 * time.Minute},
+	}
+
+	for _, c := range cases {
+		if negotiated := negotiateTimeToLive(config, c.requestedSeconds); negotiated != c.negotiated {
+			t.Errorf("Requested time to live of %vs should negotiate %v not %v", c.requestedSeconds, c.negotiated, negotiated)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+)
+
+// A reason a share failed along with the code sent in ERROR from version 16
+type failure struct {
+	code   protocol.ErrorCode
+	reason string
+}
+
+func (f *failure) Error() string {
+	return f.reason
+}
+
+// Like fmt.Errorf for a failure with an error code
+func fail(code protocol.ErrorCode, format string, a ...any) error {
+	return &failure{code: code, reason: fmt.Sprintf(format, a...)}
+}
+
+// Code to send in the ERROR for err, E_UNSPECIFIED unless err is a failure
+func errorCode(err error) protocol.ErrorCode {
+	var failed *failure
+
+	if errors.As(err, &failed) {
+		return failed.code
+	}
+
+	return protocol.E_UNSPECIFIED
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+)
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code protocol.ErrorCode
+	}{
+		{fail(protocol.E_TIMEOUT, "Handshake did not finish within %v.", handshakeTimeout), protocol.E_TIMEOUT},
+		{fmt.Errorf("Resuming failed. %w", fail(protocol.E_PEER_GONE, "Receiver disconnected.")), protocol.E_PEER_GONE},
+		{errKeyMismatch, protocol.E_KEY_MISMATCH},
+		{fmt.Errorf("Failed to create receiver connection"), protocol.E_UNSPECIFIED},
+	}
+
+	for _, c := range cases {
+		if code := errorCode(c.err); code != c.code {
+			t.Errorf("Error %q should have code %v has %v", c.err, c.code, code)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// Between READY and the sender's METADATA (or MANIFEST) the peers may exchange
+// messages the relay forwards without understanding them, in the order each peer
+// sent them. From version 8 these are PAKE messages for shares using PAKE key
+// agreement and from version 9 VERIFY and KEY_MISMATCH for comparing short
+// authentication strings.
+//
+// How long the peers have to finish the handshake, long enough for users to compare
+// short authentication strings
+const handshakeTimeout = 5 * time.Minute
+
+// Returned once a KEY_MISMATCH has been forwarded, the share should be closed without an ERROR
+var errKeyMismatch = fail(protocol.E_KEY_MISMATCH, "Peer reported a key mismatch.")
+
+func hasHandshake(share *Share) bool {
+	return share.keyAgreement == protocol.KeyAgreementPake || share.version >= protocol.IntroducedIn(protocol.VERIFY)
+}
+
+// Forward handshake messages between the peers until the sender sends something
+// else, which is returned (it should be the METADATA or MANIFEST)
+func relayHandshakeMessages(share *Share) ([]byte, error) {
+	sent := map[peerRole]int{}
+	timeout := time.After(handshakeTimeout)
+
+	for {
+		var blob []byte
+		var ok bool
+		var from peerRole
+
+		select {
+		case blob, ok = <-share.senderConnection.Incoming:
+			from = senderRole
+		case blob, ok = <-share.receiverConnection.Incoming:
+			from = receiverRole
+		case <-timeout:
+			return nil, fail(protocol.E_TIMEOUT, "Handshake did not finish within %v.", handshakeTimeout)
+		case <-deadlineOf(share):
+			return nil, timedOut(share)
+		}
+
+		if !ok {
+			return nil, fail(protocol.E_PEER_GONE, "%v disconnected.", from)
+		}
+
+		if err := checkCancel(blob, from); err != nil {
+			return nil, err
+		}
+
+		if from == senderRole && !isHandshakeMessage(share, blob) {
+			return blob, nil
+		}
+
+		if !isHandshakeMessage(share, blob) {
+			return nil, fail(protocol.E_SEQUENCE, "Unexpected message from receiver during the handshake.")
+		}
+
+		sent[from]++
+
+		if sent[from] > maxHandshakeMessages {
+			return nil, fail(protocol.E_LIMIT, "%v sent more than %v handshake messages.", from, maxHandshakeMessages)
+		}
+
+		forwarded, err := reencodeHandshakeMessage(share, blob)
+
+		if err != nil {
+			return nil, err
+		}
+
+		to := share.receiverConnection
+		if from == receiverRole {
+			to = share.senderConnection
+		}
+
+		err = websocket.SendBlobData(to, forwarded)
+
+		if err != nil {
+			return nil, fail(protocol.E_PEER_GONE, "Failed to forward handshake message.")
+		}
+
+		if protocol.Opcode(blob[0]) == protocol.KEY_MISMATCH {
+			return nil, errKeyMismatch
+		}
+	}
+}
+
+// Most handshake messages each peer may send, SPAKE2 with key confirmation needs
+// 2 and comparing short authentication strings 1
+const maxHandshakeMessages = 8
+
+func isHandshakeMessage(share *Share, blob []byte) bool {
+	if len(blob) == 0 {
+		return false
+	}
+
+	switch protocol.Opcode(blob[0]) {
+	case protocol.PAKE:
+		return share.keyAgreement == protocol.KeyAgreementPake
+	case protocol.VERIFY, protocol.KEY_MISMATCH:
+		return share.version >= protocol.IntroducedIn(protocol.VERIFY)
+	default:
+		return false
+	}
+}
+
+// Check a handshake message is well formed and encode it again so only the
+// fields of the message are forwarded
+func reencodeHandshakeMessage(share *Share, blob []byte) ([]byte, error) {
+	switch protocol.Opcode(blob[0]) {
+	case protocol.PAKE:
+		payload, err := protocol.DecodePake(blob, share.version)
+
+		if err != nil {
+			return nil, fail(protocol.E_SEQUENCE, "Failed to decode pake message.")
+		}
+
+		if len(payload) > protocol.MaxPakePayloadLength {
+			return nil, fail(protocol.E_LIMIT, "Pake message is longer than %v bytes.", protocol.MaxPakePayloadLength)
+		}
+
+		return protocol.EncodePake(share.version, payload)
+	case protocol.VERIFY:
+		payload, err := protocol.DecodeVerify(blob, share.version)
+
+		if err != nil {
+			return nil, fail(protocol.E_SEQUENCE, "Failed to decode verify message.")
+		}
+
+		if len(payload) > protocol.MaxVerifyPayloadLength {
+			return nil, fail(protocol.E_LIMIT, "Verify message is longer than %v bytes.", protocol.MaxVerifyPayloadLength)
+		}
+
+		return protocol.EncodeVerify(share.version, payload)
+	default:
+		err := protocol.DecodeKeyMismatch(blob, share.version)
+
+		if err != nil {
+			return nil, fail(protocol.E_SEQUENCE, "Failed to decode key mismatch message.")
+		}
+
+		return protocol.EncodeKeyMismatch(share.version)
+	}
+}
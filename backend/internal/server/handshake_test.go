@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+)
+
+func TestHandshakeMessages(t *testing.T) {
+	cases := []struct {
+		version      uint8
+		keyAgreement uint8
+		blob         []byte
+		handshake    bool
+	}{
+		{8, protocol.KeyAgreementPake, []byte{0x11, 0x08, 0x01, 0x00, 0xAA}, true},
+		{8, protocol.KeyAgreementPublicKey, []byte{0x11, 0x08, 0x01, 0x00, 0xAA}, false},
+		{8, protocol.KeyAgreementPake, []byte{0x12, 0x08, 0x00, 0x00}, false},
+		{9, protocol.KeyAgreementPublicKey, []byte{0x12, 0x09, 0x00, 0x00}, true},
+		{9, protocol.KeyAgreementPublicKey, []byte{0x13, 0x09}, true},
+		{9, protocol.KeyAgreementPublicKey, []byte{0x0D, 0x09}, false},
+		{9, protocol.KeyAgreementPublicKey, []byte{}, false},
+	}
+
+	for _, c := range cases {
+		share := &Share{version: c.version, keyAgreement: c.keyAgreement}
+
+		if handshake := isHandshakeMessage(share, c.blob); handshake != c.handshake {
+			t.Errorf("%v in a version %v share with key agreement %v should be a handshake message: %v",
+				c.blob, c.version, c.keyAgreement, c.handshake)
+		}
+	}
+
+	if hasHandshake(&Share{version: 8, keyAgreement: protocol.KeyAgreementPublicKey}) {
+		t.Errorf("Version 8 shares with public key agreement have no handshake")
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+)
+
+type lookupResult int
+
+const (
+	shareAwaitingPeer lookupResult = iota
+	shareUnknown
+	shareExpired
+	shareClaimed
+)
+
+// How long the code of an expired share is remembered so receivers are told it
+// expired rather than that it doesn't exist
+const expiredShareCodeRetention = time.Hour
+
+// How long a peer that claimed a share as it expired has to finish connecting
+const peerUpgradeTimeout = 30 * time.Second
+
+// Find the share for a code given by a joining peer, the caller must hold the context lock.
+// A share created by a peer in the same role is unknown, a sender can't join another
+// sender's share.
+//
+// Every known share code is compared in constant time without stopping at a
+// match so how long a lookup takes doesn't depend on the code being looked up.
+func lookupShare(context *globalContext, shareCode [protocol.ShareCodeLength]byte, joining peerRole) (lookupResult, *Share) {
+	result := shareUnknown
+	var found *Share
+
+	for code, share := range context.sharesAwaitingPeers {
+		if subtle.ConstantTimeCompare(code[:], shareCode[:]) == 1 && share.createdBy != joining {
+			result, found = shareAwaitingPeer, share
+		}
+	}
+
+	for code := range context.activeShares {
+		if subtle.ConstantTimeCompare(code[:], shareCode[:]) == 1 {
+			result = shareClaimed
+		}
+	}
+
+	for code := range context.expiredShareCodes {
+		if subtle.ConstantTimeCompare(code[:], shareCode[:]) == 1 && result == shareUnknown {
+			result = shareExpired
+		}
+	}
+
+	return result, found
+}
+
+// Remember the code of an expired share and forget codes that expired longer
+// than expiredShareCodeRetention ago, the caller must hold the context lock
+func recordExpiredShareCode(context *globalContext, shareCode [protocol.ShareCodeLength]byte) {
+	now := time.Now()
+
+	for code, expiredAt := range context.expiredShareCodes {
+		if now.Sub(expiredAt) > expiredShareCodeRetention {
+			delete(context.expiredShareCodes, code)
+		}
+	}
+
+	context.expiredShareCodes[shareCode] = now
+}
+
+// Find the share with a code whichever peer created it, for the status endpoint.
+// The caller must hold the context lock, codes are compared as in lookupShare.
+func findShare(context *globalContext, shareCode [protocol.ShareCodeLength]byte) (lookupResult, *Share) {
+	result := shareUnknown
+	var found *Share
+
+	for code, share := range context.sharesAwaitingPeers {
+		if subtle.ConstantTimeCompare(code[:], shareCode[:]) == 1 {
+			result, found = shareAwaitingPeer, share
+		}
+	}
+
+	for code, share := range context.activeShares {
+		if subtle.ConstantTimeCompare(code[:], shareCode[:]) == 1 {
+			result, found = shareClaimed, share
+		}
+	}
+
+	for code := range context.expiredShareCodes {
+		if subtle.ConstantTimeCompare(code[:], shareCode[:]) == 1 && result == shareUnknown {
+			result = shareExpired
+		}
+	}
+
+	return result, found
+}
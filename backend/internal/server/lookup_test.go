@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestLookupShare(t *testing.T) {
+	context := newGlobalContext(DefaultConfig())
+
+	awaiting := &Share{shareCode: [5]byte{1}}
+	context.sharesAwaitingPeers[awaiting.shareCode] = awaiting
+	context.activeShares[[5]byte{2}] = &Share{shareCode: [5]byte{2}}
+	recordExpiredShareCode(context, [5]byte{3})
+
+	cases := []struct {
+		shareCode [5]byte
+		result    lookupResult
+	}{
+		{[5]byte{1}, shareAwaitingPeer},
+		{[5]byte{2}, shareClaimed},
+		{[5]byte{3}, shareExpired},
+		{[5]byte{4}, shareUnknown},
+	}
+
+	for _, c := range cases {
+		result, share := lookupShare(context, c.shareCode, receiverRole)
+
+		if result != c.result {
+			t.Errorf("Lookup of %v should be %v not %v", c.shareCode, c.result, result)
+		}
+
+		if (share != nil) != (c.result == shareAwaitingPeer) {
+			t.Errorf("Lookup of %v returned share %v", c.shareCode, share)
+		}
+	}
+
+	// a sender can't join a share created by another sender
+	if result, _ := lookupShare(context, awaiting.shareCode, senderRole); result != shareUnknown {
+		t.Errorf("Sender looking up a sender's share should be %v not %v", shareUnknown, result)
+	}
+
+	request := &Share{shareCode: [5]byte{5}, createdBy: receiverRole}
+	context.sharesAwaitingPeers[request.shareCode] = request
+
+	if result, share := lookupShare(context, request.shareCode, senderRole); result != shareAwaitingPeer || share != request {
+		t.Errorf("Sender should find a receiver's share request, found %v", result)
+	}
+}
+
+func TestExpiredShareCodesArePruned(t *testing.T) {
+	context := newGlobalContext(DefaultConfig())
+
+	context.expiredShareCodes[[5]byte{1}] = time.Now().Add(-expiredShareCodeRetention - time.Second)
+	recordExpiredShareCode(context, [5]byte{2})
+
+	if _, ok := context.expiredShareCodes[[5]byte{1}]; ok {
+		t.Errorf("Share code expired longer ago than the retention period should be forgotten")
+	}
+	if _, ok := context.expiredShareCodes[[5]byte{2}]; !ok {
+		t.Errorf("Share code that just expired should be remembered")
+	}
+}
+
+func receive(context *globalContext, shareCode [5]byte, remoteAddr string) int {
+	query := url.Values{"share_code": {context.config.ShareCodes.Format(shareCode)}}
+	r := httptest.NewRequest(http.MethodGet, "/receive?"+query.Encode(), nil)
+	r.RemoteAddr = remoteAddr
+
+	w := httptest.NewRecorder()
+	receiverHandler{context: context}.ServeHTTP(w, r)
+
+	return w.Code
+}
+
+func TestReceiverLookupStatus(t *testing.T) {
+	context := newGlobalContext(DefaultConfig())
+
+	context.activeShares[[5]byte{2}] = &Share{shareCode: [5]byte{2}}
+	recordExpiredShareCode(context, [5]byte{3})
+
+	cases := []struct {
+		shareCode [5]byte
+		status    int
+	}{
+		{[5]byte{2}, http.StatusConflict},
+		{[5]byte{3}, http.StatusGone},
+		{[5]byte{4}, http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		if status := receive(context, c.shareCode, "192.0.2.1:1234"); status != c.status {
+			t.Errorf("Receiving %v should respond %v not %v", c.shareCode, c.status, status)
+		}
+	}
+}
+
+func TestReceiverFailedLookupLockout(t *testing.T) {
+	config := DefaultConfig()
+	// only the lockout is tested
+	config.ReceiverRateLimit = RateLimit{}
+	context := newGlobalContext(config)
+
+	for i := range config.MaxFailedLookups {
+		if status := receive(context, [5]byte{byte(i)}, "192.0.2.1:1234"); status != http.StatusNotFound {
+			t.Fatalf("Failed lookup %v should respond %v not %v", i, http.StatusNotFound, status)
+		}
+	}
+
+	if status := receive(context, [5]byte{0xFF}, "192.0.2.1:5678"); status != http.StatusTooManyRequests {
+		t.Errorf("Client past the failed lookup limit should be refused with %v not %v", http.StatusTooManyRequests, status)
+	}
+
+	if status := receive(context, [5]byte{0xFF}, "192.0.2.2:1234"); status != http.StatusNotFound {
+		t.Errorf("Other clients shouldn't be locked out, responded %v", status)
+	}
+
+	if lockouts := context.metrics.lockouts.Load(); lockouts != 1 {
+		t.Errorf("There should be 1 lockout not %v", lockouts)
+	}
+}
+
+func TestReceiverRateLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.ReceiverRateLimit = RateLimit{Rate: 1.0 / 60, Burst: 3}
+	config.MaxFailedLookups = 0
+	context := newGlobalContext(config)
+
+	for i := range config.ReceiverRateLimit.Burst {
+		if status := receive(context, [5]byte{byte(i)}, "192.0.2.1:1234"); status != http.StatusNotFound {
+			t.Fatalf("Attempt %v within the burst should respond %v not %v", i, http.StatusNotFound, status)
+		}
+	}
+
+	if status := receive(context, [5]byte{0xFF}, "192.0.2.1:1234"); status != http.StatusTooManyRequests {
+		t.Errorf("Attempt past the burst should be refused with %v not %v", http.StatusTooManyRequests, status)
+	}
+
+	if limited := context.metrics.receiverAttemptsLimited.Load(); limited != 1 {
+		t.Errorf("There should be 1 rate limited attempt not %v", limited)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Counters served by the metrics endpoint
+type metrics struct {
+	sharesCreated             atomic.Uint64
+	shareCreationsLimited     atomic.Uint64
+	receiverAttemptsLimited   atomic.Uint64
+	receiverAttemptsLockedOut atomic.Uint64
+	failedLookups             atomic.Uint64
+	lockouts                  atomic.Uint64
+	broadcastReceiversDropped atomic.Uint64
+	sharesDeclined            atomic.Uint64
+	sharesCancelledBySender   atomic.Uint64
+	sharesCancelledByReceiver atomic.Uint64
+}
+
+type metricsHandler struct {
+	context *globalContext
+}
+
+// Serve the metrics and the configured limits in the Prometheus text format
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := h.context.config
+	counters := &h.context.metrics
+
+	h.context.lock.Lock()
+	sharesAwaitingReceivers, requestsAwaitingSenders := 0, 0
+	for _, share := range h.context.sharesAwaitingPeers {
+		if share.createdBy == receiverRole {
+			requestsAwaitingSenders++
+		} else {
+			sharesAwaitingReceivers++
+		}
+	}
+	activeShares := len(h.context.activeShares)
+	h.context.lock.Unlock()
+
+	values := []struct {
+		name  string
+		kind  string
+		value any
+	}{
+		{"tube_shares_created_total", "counter", counters.sharesCreated.Load()},
+		{"tube_shares_awaiting_receivers", "gauge", sharesAwaitingReceivers},
+		{"tube_share_requests_awaiting_senders", "gauge", requestsAwaitingSenders},
+		{"tube_shares_active", "gauge", activeShares},
+		{"tube_share_creations_rate_limited_total", "counter", counters.shareCreationsLimited.Load()},
+		{"tube_receiver_attempts_rate_limited_total", "counter", counters.receiverAttemptsLimited.Load()},
+		{"tube_receiver_attempts_locked_out_total", "counter", counters.receiverAttemptsLockedOut.Load()},
+		{"tube_failed_lookups_total", "counter", counters.failedLookups.Load()},
+		{"tube_lockouts_total", "counter", counters.lockouts.Load()},
+		{"tube_shares_declined_total", "counter", counters.sharesDeclined.Load()},
+		{"tube_shares_cancelled_by_sender_total", "counter", counters.sharesCancelledBySender.Load()},
+		{"tube_shares_cancelled_by_receiver_total", "counter", counters.sharesCancelledByReceiver.Load()},
+		{"tube_broadcast_receivers_dropped_total", "counter", counters.broadcastReceiversDropped.Load()},
+		{"tube_locked_out_clients", "gauge", h.context.failedLookups.lockedOutClients()},
+		{"tube_sender_rate_limit_per_second", "gauge", config.SenderRateLimit.Rate},
+		{"tube_sender_rate_limit_burst", "gauge", config.SenderRateLimit.Burst},
+		{"tube_receiver_rate_limit_per_second", "gauge", config.ReceiverRateLimit.Rate},
+		{"tube_receiver_rate_limit_burst", "gauge", config.ReceiverRateLimit.Burst},
+		{"tube_max_failed_lookups", "gauge", config.MaxFailedLookups},
+		{"tube_failed_lookup_window_seconds", "gauge", config.FailedLookupWindow.Seconds()},
+		{"tube_lockout_duration_seconds", "gauge", config.LockoutDuration.Seconds()},
+		{"tube_max_broadcast_receivers", "gauge", config.MaxBroadcastReceivers},
+		{"tube_slow_receiver_timeout_seconds", "gauge", config.SlowReceiverTimeout.Seconds()},
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, v := range values {
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", v.name, v.kind, v.name, v.value)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// Incorrect PINs a receiver may give before the share is cancelled
+const maxPinAttempts = 5
+
+// How long the receiver has to reply to PIN_CHALLENGE, long enough for a person to type the PIN
+const pinResponseTimeout = 5 * time.Minute
+
+func isPinProtected(share *Share) bool {
+	return len(share.pinVerifier) != 0
+}
+
+// Challenge the receiver for the share's PIN until it answers correctly, after
+// maxPinAttempts incorrect answers an error is returned and the share should be
+// errored out so the share code can't be guessed further. The limit only stops
+// guessing through the relay, a PIN can be brute forced offline from a challenge
+// and its response.
+func verifyReceiverPin(share *Share) error {
+	nonce := make([]byte, protocol.PinNonceLength)
+
+	for attempt := range maxPinAttempts {
+		_, err := rand.Read(nonce)
+
+		if err != nil {
+			return fail(protocol.E_INTERNAL, "Random bytes failed")
+		}
+
+		challenge, err := protocol.EncodePinChallenge(share.version, share.pinSalt, nonce, uint8(maxPinAttempts-attempt))
+
+		if err != nil {
+			return fail(protocol.E_INTERNAL, "Failed to encode pin challenge message.")
+		}
+
+		err = websocket.SendBlobData(share.receiverConnection, challenge)
+
+		if err != nil {
+			return fail(protocol.E_PEER_GONE, "Failed to send pin challenge message.")
+		}
+
+		var response []byte
+		var ok bool
+
+		select {
+		case response, ok = <-share.receiverConnection.Incoming:
+			if !ok {
+				return fail(protocol.E_PEER_GONE, "Receiver disconnected while answering the pin challenge.")
+			}
+		case <-time.After(pinResponseTimeout):
+			return fail(protocol.E_TIMEOUT, "Receiver did not answer the pin challenge within %v.", pinResponseTimeout)
+		case <-deadlineOf(share):
+			return timedOut(share)
+		}
+
+		if err := checkCancel(response, receiverRole); err != nil {
+			return err
+		}
+
+		proof, err := protocol.DecodePinResponse(response, share.version)
+
+		if err != nil {
+			return fail(protocol.E_SEQUENCE, "Failed to decode pin response message.")
+		}
+
+		if hmac.Equal(proof, protocol.PinProof(share.pinVerifier, nonce)) {
+			return nil
+		}
+	}
+
+	return fail(protocol.E_PIN, "Too many incorrect PINs, the share has been cancelled.")
+}
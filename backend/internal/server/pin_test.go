@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// A connection as the relay sees it and the peer's end of it
+func connectedPair(t *testing.T) (relaySide *websocket.Connection, peerSide *websocket.Connection) {
+	relaySide, _ = websocket.CreateConnection()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocket.UpgradeConnection(w, r, relaySide)
+	}))
+	t.Cleanup(server.Close)
+
+	peerSide, err := websocket.Dial(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	websocket.WaitUntilConnected(relaySide)
+
+	t.Cleanup(func() {
+		websocket.Close(relaySide)
+		websocket.Close(peerSide)
+	})
+
+	return relaySide, peerSide
+}
+
+func TestPinReceiverDisconnects(t *testing.T) {
+	relaySide, receiver := connectedPair(t)
+
+	share := &Share{
+		version:            protocol.HighestVersion,
+		receiverConnection: relaySide,
+		pinSalt:            make([]byte, protocol.PinSaltLength),
+		pinVerifier:        make([]byte, protocol.PinVerifierLength),
+	}
+
+	go func() {
+		// leave once challenged
+		<-receiver.Incoming
+		websocket.Close(receiver)
+	}()
+
+	err := verifyReceiverPin(share)
+
+	if errorCode(err) != protocol.E_PEER_GONE {
+		t.Errorf("Receiver leaving instead of answering the pin challenge should fail with %v not %v (%v)",
+			protocol.E_PEER_GONE, errorCode(err), err)
+	}
+}
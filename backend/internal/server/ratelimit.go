@@ -0,0 +1,247 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket limit, Rate tokens are added per second up to Burst and each
+// request takes one. A Rate of 0 disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// How often per client state that no longer affects a client is forgotten
+const rateLimitPruneInterval = time.Minute
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Token buckets per client address
+type rateLimiter struct {
+	limit     RateLimit
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+// Take a token from the client's bucket, returns false if it is empty
+func (l *rateLimiter) allow(client string) bool {
+	if l.limit.Rate <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		// a bucket that has refilled is the same as no bucket
+		for client, bucket := range l.buckets {
+			if l.refill(bucket, now) >= float64(l.limit.Burst) {
+				delete(l.buckets, client)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	bucket, ok := l.buckets[client]
+
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.limit.Burst), lastRefill: now}
+		l.buckets[client] = bucket
+	}
+
+	if l.refill(bucket, now) < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// Add the tokens earned since the last refill, the caller must hold the lock
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * l.limit.Rate
+	bucket.tokens = min(bucket.tokens, float64(l.limit.Burst))
+	bucket.lastRefill = now
+
+	return bucket.tokens
+}
+
+type failedLookupCount struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+// Clients with config.MaxFailedLookups lookups of unknown or expired share codes
+// within config.FailedLookupWindow are locked out for config.LockoutDuration
+type failedLookups struct {
+	config    Config
+	lock      sync.Mutex
+	clients   map[string]*failedLookupCount
+	lastPrune time.Time
+}
+
+func newFailedLookups(config Config) *failedLookups {
+	return &failedLookups{config: config, clients: make(map[string]*failedLookupCount)}
+}
+
+func (f *failedLookups) isLockedOut(client string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	count, ok := f.clients[client]
+
+	return ok && time.Now().Before(count.lockedUntil)
+}
+
+// Record a failed lookup, returns true if it locked the client out
+func (f *failedLookups) recordFailure(client string) bool {
+	if f.config.MaxFailedLookups <= 0 {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(f.lastPrune) > rateLimitPruneInterval {
+		for address, count := range f.clients {
+			if now.Sub(count.windowStart) > f.config.FailedLookupWindow && now.After(count.lockedUntil) {
+				delete(f.clients, address)
+			}
+		}
+		f.lastPrune = now
+	}
+
+	count, ok := f.clients[client]
+
+	if !ok {
+		count = &failedLookupCount{windowStart: now}
+		f.clients[client] = count
+	} else if now.Sub(count.windowStart) > f.config.FailedLookupWindow {
+		count.count = 0
+		count.windowStart = now
+	}
+
+	count.count++
+
+	if count.count < f.config.MaxFailedLookups {
+		return false
+	}
+
+	count.count = 0
+	count.windowStart = now
+	count.lockedUntil = now.Add(f.config.LockoutDuration)
+
+	return true
+}
+
+// Number of clients currently locked out
+func (f *failedLookups) lockedOutClients() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := time.Now()
+	lockedOut := 0
+
+	for _, count := range f.clients {
+		if now.Before(count.lockedUntil) {
+			lockedOut++
+		}
+	}
+
+	return lockedOut
+}
+
+// Address of the client that made the request. If the request came from a
+// trusted proxy the addresses in its Forwarded (or X-Forwarded-For) header are
+// read from the last, the first address not of a trusted proxy is the client.
+func clientAddress(r *http.Request, trustedProxies []netip.Prefix) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	forwarded := forwardedFor(r.Header)
+
+	for len(forwarded) > 0 && isTrustedProxy(client, trustedProxies) {
+		client = forwarded[len(forwarded)-1]
+		forwarded = forwarded[:len(forwarded)-1]
+	}
+
+	return client
+}
+
+func isTrustedProxy(address string, trustedProxies []netip.Prefix) bool {
+	ip, err := netip.ParseAddr(address)
+
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Addresses a request was forwarded for, from the Forwarded header (RFC 7239) or
+// if it isn't set X-Forwarded-For. Ports are removed, obfuscated identifiers such
+// as "unknown" are kept as is.
+func forwardedFor(header http.Header) []string {
+	var addresses []string
+
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+
+				if found && strings.EqualFold(key, "for") {
+					addresses = append(addresses, forwardedNode(strings.Trim(value, "\"")))
+				}
+			}
+		}
+
+		return addresses
+	}
+
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(value, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, forwardedNode(address))
+			}
+		}
+	}
+
+	return addresses
+}
+
+// Address of a forwarded node without its port, "[2001:db8::1]:4711" is "2001:db8::1"
+func forwardedNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
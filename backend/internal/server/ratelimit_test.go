@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefills(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 10, Burst: 2})
+
+	if !limiter.allow("a") || !limiter.allow("a") {
+		t.Fatalf("Requests within the burst should be allowed")
+	}
+	if limiter.allow("a") {
+		t.Errorf("Request past the burst should be refused")
+	}
+
+	// rewind the bucket rather than sleeping
+	limiter.buckets["a"].lastRefill = limiter.buckets["a"].lastRefill.Add(-150 * time.Millisecond)
+
+	if !limiter.allow("a") {
+		t.Errorf("Request after the bucket refilled a token should be allowed")
+	}
+	if limiter.allow("a") {
+		t.Errorf("Only one token should have been refilled")
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8:1::/48")}
+
+	cases := []struct {
+		remoteAddr string
+		headers    map[string]string
+		client     string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		// untrusted peers can't choose their address
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "192.0.2.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		// only the addresses added by trusted proxies are believed
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.7;proto=https, for="[2001:db8:1::5]:4711"`}, "198.51.100.7"},
+		{"[2001:db8:1::2]:1234", map[string]string{"Forwarded": `For="[2001:db8:2::1]:80"`}, "2001:db8:2::1"},
+		// Forwarded is preferred over X-Forwarded-For
+		{"10.0.0.1:1234", map[string]string{"Forwarded": "for=198.51.100.7", "X-Forwarded-For": "203.0.113.9"}, "198.51.100.7"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": "for=unknown"}, "unknown"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/receive", nil)
+		r.RemoteAddr = c.remoteAddr
+		for key, value := range c.headers {
+			r.Header.Set(key, value)
+		}
+
+		if client := clientAddress(r, trusted); client != c.client {
+			t.Errorf("Client of %v with %v should be %v not %v", c.remoteAddr, c.headers, c.client, client)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"crypto/rand"
+	"net/http"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// From version 3 peers are issued a resume token in SENDER_ACCEPTED and
+// RECEIVER_ACCEPTED. If a peer disconnects while chunks are being relayed the
+// share is suspended rather than errored out, the peer then has resumeGracePeriod
+// to connect to the resume endpoint and send RESUME with its token.
+const resumeGracePeriod = 2 * time.Minute
+
+// How long a connection to the resume endpoint has to send RESUME
+const resumeMessageTimeout = 10 * time.Second
+
+type peerRole uint8
+
+const (
+	senderRole peerRole = iota
+	receiverRole
+)
+
+func (role peerRole) String() string {
+	if role == senderRole {
+		return "Sender"
+	}
+	return "Receiver"
+}
+
+// The role of the peer at the other end of a share
+func (role peerRole) other() peerRole {
+	if role == senderRole {
+		return receiverRole
+	}
+	return senderRole
+}
+
+// A new connection for a peer of a suspended share
+type resumption struct {
+	role       peerRole
+	connection *websocket.Connection
+}
+
+// Progress of the data transfer, kept across suspensions
+type transferProgress struct {
+	// chunks forwarded to the receiver and chunks acknowledged by it
+	forwarded    uint32
+	acknowledged uint32
+	// from version 4 whether the sender's END has been forwarded
+	ended bool
+	// after a resumption chunks from the sender are discarded until it echoes RESUMED,
+	// anything before the echo may have been sent before the sender knew of the resumption
+	awaitingResumedEcho bool
+	// payload lengths of the chunks forwarded but not acknowledged, bytes of the
+	// chunks acknowledged and when they were last published to the status endpoint
+	inFlight          []int
+	bytesAcknowledged uint64
+	published         time.Time
+}
+
+type resumeHandler struct {
+	context *globalContext
+}
+
+func (h resumeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	connection, err := websocket.CreateConnection()
+
+	if err != nil {
+		http.Error(w, "Internal server error.", http.StatusInternalServerError)
+		return
+	}
+
+	err = websocket.UpgradeConnection(w, r, connection)
+
+	if err != nil {
+		http.Error(w, "Websocket failed to upgrade.", http.StatusInternalServerError)
+		return
+	}
+
+	go awaitResume(connection, h.context)
+}
+
+// Generate a resume token for the share and register it so it can be looked up by the resume endpoint
+func newResumeToken(share *Share, context *globalContext) ([protocol.ResumeTokenLength]byte, error) {
+	var resumeToken [protocol.ResumeTokenLength]byte
+
+	context.lock.Lock()
+	defer context.lock.Unlock()
+
+	for {
+		_, err := rand.Read(resumeToken[:])
+
+		if err != nil {
+			return resumeToken, fail(protocol.E_INTERNAL, "Random bytes failed")
+		}
+
+		if _, used := context.resumeTokens[resumeToken]; !used {
+			context.resumeTokens[resumeToken] = share
+			return resumeToken, nil
+		}
+	}
+}
+
+func rejectResume(connection *websocket.Connection, version uint8, code protocol.ErrorCode, errorReason string) {
+	sendError(connection, version, code, errorReason)
+	websocket.InitiateClose(connection)
+}
+
+// Read RESUME from a new connection and hand the connection to the share it resumes
+func awaitResume(connection *websocket.Connection, context *globalContext) {
+	websocket.WaitUntilConnected(connection)
+
+	var blob []byte
+
+	select {
+	case blob = <-connection.Incoming:
+	case <-time.After(resumeMessageTimeout):
+	}
+
+	version, resumeTokenSlice, err := protocol.DecodeResume(blob)
+
+	if err != nil {
+		// any peer able to resume supports the version RESUME was introduced in
+		rejectResume(connection, protocol.IntroducedIn(protocol.RESUME), protocol.E_SEQUENCE, "Failed to decode resume message.")
+		return
+	}
+
+	var resumeToken [protocol.ResumeTokenLength]byte
+	copy(resumeToken[:], resumeTokenSlice)
+
+	// the rejection is sent once the lock is released, a slow peer mustn't hold up the relay
+	err = queueResumption(connection, version, resumeToken, context)
+
+	if err != nil {
+		rejectResume(connection, version, errorCode(err), err.Error())
+	}
+}
+
+// Hand the connection to the share the token resumes, fails if the share can't be resumed with it
+func queueResumption(connection *websocket.Connection, version uint8, resumeToken [protocol.ResumeTokenLength]byte, context *globalContext) error {
+	context.lock.Lock()
+	defer context.lock.Unlock()
+
+	share := context.resumeTokens[resumeToken]
+
+	if share == nil || !share.acceptingResumptions {
+		return fail(protocol.E_RESUME, "No share can be resumed with the provided token.")
+	}
+
+	if version != share.version {
+		return fail(protocol.E_RESUME, "Share was negotiated with protocol version %v.", share.version)
+	}
+
+	role := senderRole
+	if resumeToken == share.receiverResumeToken {
+		role = receiverRole
+	}
+
+	select {
+	case share.resumptions <- resumption{role: role, connection: connection}:
+		return nil
+	default:
+		return fail(protocol.E_RESUME, "A resumption of this share is already pending.")
+	}
+}
+
+// Resumptions are only accepted while data chunks are being relayed, any left
+// over once the share stops accepting them are rejected
+func setAcceptingResumptions(share *Share, context *globalContext, accepting bool) {
+	var rejected []*websocket.Connection
+
+	context.lock.Lock()
+
+	share.acceptingResumptions = accepting
+
+	if !accepting {
+	draining:
+		for {
+			select {
+			case pending := <-share.resumptions:
+				rejected = append(rejected, pending.connection)
+			default:
+				break draining
+			}
+		}
+	}
+
+	context.lock.Unlock()
+
+	// rejected once the lock is released, a slow peer mustn't hold up the relay
+	for _, connection := range rejected {
+		rejectResume(connection, share.version, protocol.E_RESUME, "Share is no longer accepting resumptions.")
+	}
+}
+
+func connectionFor(share *Share, role peerRole) *websocket.Connection {
+	if role == senderRole {
+		return share.senderConnection
+	}
+	return share.receiverConnection
+}
+
+func replaceConnection(share *Share, newConnection resumption) {
+	websocket.Close(connectionFor(share, newConnection.role))
+
+	if newConnection.role == senderRole {
+		share.senderConnection = newConnection.connection
+	} else {
+		share.receiverConnection = newConnection.connection
+	}
+}
+
+// Suspend the share after a peer disconnected (or pending is a new connection
+// replacing one that still looked connected) and wait for every disconnected
+// peer to resume. Once they have RESUMED is sent to both peers, chunks that were
+// in flight to a receiver that reconnected are lost so the sender is told to
+// resend from the first unacknowledged chunk.
+func suspendShare(share *Share, progress *transferProgress, numberOfChunks uint32,
+	role peerRole, pending *resumption) error {
+	if share.version < protocol.IntroducedIn(protocol.RESUME) {
+		return fail(protocol.E_PEER_GONE, "%v disconnected.", role)
+	}
+
+	disconnected := map[peerRole]bool{}
+	receiverReconnected := false
+
+	if pending != nil {
+		replaceConnection(share, *pending)
+		receiverReconnected = pending.role == receiverRole
+	} else {
+		if err := queuedCancel(connectionFor(share, role), role); err != nil {
+			return err
+		}
+
+		websocket.Close(connectionFor(share, role))
+		disconnected[role] = true
+	}
+
+	gracePeriodOver := time.After(resumeGracePeriod)
+
+	for len(disconnected) > 0 && !transferFinished(share, progress, numberOfChunks) {
+		var senderIncoming, receiverIncoming <-chan []byte
+
+		if !disconnected[senderRole] {
+			senderIncoming = share.senderConnection.Incoming
+		}
+		if !disconnected[receiverRole] {
+			receiverIncoming = share.receiverConnection.Incoming
+		}
+
+		select {
+		case newConnection := <-share.resumptions:
+			replaceConnection(share, newConnection)
+			delete(disconnected, newConnection.role)
+
+			if newConnection.role == receiverRole {
+				receiverReconnected = true
+			}
+
+		case blob, ok := <-senderIncoming:
+			// the receiver is disconnected, chunks (and END) sent now are resent after RESUMED
+			if !ok {
+				disconnected[senderRole] = true
+				continue
+			}
+
+			if err := checkCancel(blob, senderRole); err != nil {
+				return err
+			}
+
+		case chunkAck, ok := <-receiverIncoming:
+			if !ok {
+				disconnected[receiverRole] = true
+				continue
+			}
+
+			if err := checkCancel(chunkAck, receiverRole); err != nil {
+				return err
+			}
+
+			// the sender is disconnected, it learns of the acknowledgement from RESUMED
+			err := acceptAcknowledge(share, progress, chunkAck)
+
+			if err != nil {
+				return err
+			}
+
+		case <-gracePeriodOver:
+			return fail(protocol.E_PEER_GONE, "Share was not resumed within %v.", resumeGracePeriod)
+		}
+	}
+
+	if transferFinished(share, progress, numberOfChunks) {
+		return nil
+	}
+
+	if receiverReconnected {
+		progress.forwarded = progress.acknowledged
+		progress.inFlight = nil
+	}
+
+	resumed, err := protocol.EncodeResumed(share.version, progress.acknowledged, progress.forwarded)
+
+	if err != nil {
+		return fail(protocol.E_INTERNAL, "Failed to encode resumed message.")
+	}
+
+	err = websocket.SendBlobData(share.senderConnection, resumed)
+
+	if err != nil {
+		return fail(protocol.E_PEER_GONE, "Failed to send resumed message.")
+	}
+
+	err = websocket.SendBlobData(share.receiverConnection, resumed)
+
+	if err != nil {
+		return fail(protocol.E_PEER_GONE, "Failed to send resumed message.")
+	}
+
+	progress.awaitingResumedEcho = true
+
+	return nil
+}
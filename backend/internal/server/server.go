@@ -1,41 +1,79 @@
 package server
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/billyedmoore/tube/internal/protocol"
 	"github.com/billyedmoore/tube/internal/websocket"
 )
 
-type opcode uint8
-
-const highestOpCode = 0x9
-
-const (
-	SENDER_INITIATION   opcode = 0x1
-	SENDER_ACCEPTED     opcode = 0x2
-	RECEIVER_INITIATION opcode = 0x3
-	RECEIVER_ACCEPTED   opcode = 0x4
-	READY               opcode = 0x5
-	METADATA            opcode = 0x6
-	DATA_CHUNK          opcode = 0x7
-	ACKNOWLEDGE         opcode = 0x8
-	ERROR               opcode = 0x9
-)
-
 type Share struct {
-	shareCode          [5]byte
-	senderConnection   *websocket.Connection
-	receiverConnection *websocket.Connection
+	shareCode [5]byte
+	// Peer that created the share, the other peer joins with the share code. From
+	// version 12 a receiver may create a share request for a sender to join
+	createdBy peerRole
+	// Versions supported by every party that has joined the share so far
+	versions protocol.VersionRange
+	// Protocol version negotiated for the share and used for all later decoding,
+	// until the receiver joins it is the highest version the sender and relay share
+	version uint8
+	// Number of unacknowledged chunks the sender asked to have in flight
+	requestedWindowSize uint16
+	// Window size negotiated at READY, 1 (stop-and-wait) before version 2
+	windowSize uint16
+	// How long the share waits for a receiver before it expires
+	timeToLive time.Duration
+	// Chunk number following the last chunk of each file, before version 4 a share has one file
+	fileChunkBoundaries []uint32
+	senderConnection    *websocket.Connection
+	receiverConnection  *websocket.Connection
+	// From version 11 whether the share is streamed, its number of chunks is only known from END
+	streamed bool
+	// Tokens a disconnected peer uses to resume the share, only issued from version 3
+	senderResumeToken   [protocol.ResumeTokenLength]byte
+	receiverResumeToken [protocol.ResumeTokenLength]byte
+	// From version 7 the salt and verifier of the PIN receivers must prove they
+	// know, empty if the share isn't protected by a PIN
+	pinSalt     []byte
+	pinVerifier []byte
+	// From version 8 whether the peers agree the key with PAKE messages rather
+	// than the receiver's public key
+	keyAgreement uint8
+	// Key the receiver sent in RECEIVER_INITIATION, the sender is sent it in READY
+	receiverKey protocol.ReceiverKey
+	// Phase of the share, written under the globalContext lock by the share's
+	// go-routine, and when it must leave it (see state.go)
+	state    shareState
+	deadline *time.Timer
+	// What the status endpoint reports and a channel closed when it changes, both
+	// guarded by the globalContext lock (see status.go)
+	status        shareStatus
+	statusChanged chan struct{}
+	// From version 13 the receivers of a share the sender let several receivers
+	// join, nil for other shares. Set under the globalContext lock.
+	broadcast *broadcast
+	// New connections for peers resuming the share and whether they are currently
+	// accepted, acceptingResumptions is guarded by the globalContext lock
+	resumptions          chan resumption
+	acceptingResumptions bool
 }
 
 type globalContext struct {
-	lock                    sync.Mutex
-	activeShares            map[[5]byte]*Share
-	sharesAwaitingReceivers map[[5]byte]*Share
+	config              Config
+	lock                sync.Mutex
+	activeShares        map[[5]byte]*Share
+	sharesAwaitingPeers map[[5]byte]*Share
+	resumeTokens        map[[protocol.ResumeTokenLength]byte]*Share
+	// when the codes of recently expired shares expired, see recordExpiredShareCode
+	expiredShareCodes map[[5]byte]time.Time
+	failedLookups     *failedLookups
+	senderLimiter     *rateLimiter
+	receiverLimiter   *rateLimiter
+	metrics           metrics
 }
 
 type senderHandler struct {
@@ -47,6 +85,33 @@ type receiverHandler struct {
 }
 
 func (h senderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// from version 12 a sender may join a share request created by a receiver
+	if r.URL.Query().Has("share_code") {
+		joinShare(w, r, h.context, senderRole)
+		return
+	}
+
+	startShare(w, r, h.context, senderRole)
+}
+
+func (h receiverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// from version 12 a receiver without a share code creates a share request
+	if !r.URL.Query().Has("share_code") {
+		startShare(w, r, h.context, receiverRole)
+		return
+	}
+
+	joinShare(w, r, h.context, receiverRole)
+}
+
+// Create a share for the connecting peer, the other peer joins it with the share code
+func startShare(w http.ResponseWriter, r *http.Request, context *globalContext, role peerRole) {
+	if !context.senderLimiter.allow(clientAddress(r, context.config.TrustedProxies)) {
+		context.metrics.shareCreationsLimited.Add(1)
+		http.Error(w, "Too many shares created, try again later.", http.StatusTooManyRequests)
+		return
+	}
+
 	connection, err := websocket.CreateConnection()
 
 	if err != nil {
@@ -61,30 +126,41 @@ func (h senderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newShare, err := createShare(connection, h.context)
+	_, err = createShare(connection, role, context)
 
 	if err != nil {
 		//TODO: send error frame over websocket
 		websocket.InitiateClose(connection)
 		return
 	}
-
-	h.context.lock.Lock()
-	h.context.sharesAwaitingReceivers[newShare.shareCode] = newShare
-	h.context.lock.Unlock()
 }
 
 func isValidShareCode(shareCode string) (bool, string) {
 	if len(shareCode) == 0 {
 		return false, "shareCode parameter is not set or is set to \"\"."
 	}
-	if len(shareCode) > 8 {
+	if len(shareCode) > protocol.MaxShareCodeTextLength {
 		return false, "Provided shareCode is too long to be a valid share code."
 	}
 	return true, ""
 }
 
-func (h receiverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Join the share with the code in the request as the peer that didn't create it
+func joinShare(w http.ResponseWriter, r *http.Request, context *globalContext, role peerRole) {
+	client := clientAddress(r, context.config.TrustedProxies)
+
+	if context.failedLookups.isLockedOut(client) {
+		context.metrics.receiverAttemptsLockedOut.Add(1)
+		http.Error(w, "Too many unknown share codes, try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	if !context.receiverLimiter.allow(client) {
+		context.metrics.receiverAttemptsLimited.Add(1)
+		http.Error(w, "Too many attempts to join a share, try again later.", http.StatusTooManyRequests)
+		return
+	}
+
 	encodedShareCode := r.URL.Query().Get("share_code")
 
 	isValid, reason := isValidShareCode(encodedShareCode)
@@ -94,36 +170,74 @@ func (h receiverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	shareCodeSlice, err := base64.StdEncoding.DecodeString(encodedShareCode)
+	// typos are caught by the check digit before the lookup
+	shareCode, err := context.config.ShareCodes.Parse(encodedShareCode)
 
 	if err != nil {
-		http.Error(w, "Provided shareCode could not be decoded.", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var shareCode [5]byte
-	copy(shareCode[:], shareCodeSlice)
+	context.lock.Lock()
+	result, share := lookupShare(context, shareCode, role)
+	broadcasting := share != nil && share.broadcast != nil
+
+	if result == shareAwaitingPeer && broadcasting {
+		claimBroadcastPlace(share, context)
+	} else if result == shareAwaitingPeer {
+		delete(context.sharesAwaitingPeers, shareCode)
+		context.activeShares[shareCode] = share
+	}
+	context.lock.Unlock()
 
-	h.context.lock.Lock()
-	defer h.context.lock.Unlock()
-	share := h.context.sharesAwaitingReceivers[shareCode]
-	delete(h.context.sharesAwaitingReceivers, shareCode)
-	h.context.activeShares[shareCode] = share
+	if result == shareUnknown || result == shareExpired {
+		context.metrics.failedLookups.Add(1)
 
-	err = websocket.UpgradeConnection(w, r, share.receiverConnection)
+		if context.failedLookups.recordFailure(client) {
+			context.metrics.lockouts.Add(1)
+		}
+	}
+
+	switch result {
+	case shareUnknown:
+		http.Error(w, "No share exists with the provided share code.", http.StatusNotFound)
+		return
+	case shareExpired:
+		http.Error(w, fmt.Sprintf("Share expired before a %v joined.", strings.ToLower(role.String())), http.StatusGone)
+		return
+	case shareClaimed:
+		http.Error(w, fmt.Sprintf("Share already has a %v.", strings.ToLower(role.String())), http.StatusConflict)
+		return
+	}
+
+	if broadcasting {
+		joinBroadcastShare(w, r, context, share)
+		return
+	}
+
+	err = websocket.UpgradeConnection(w, r, connectionFor(share, role))
 
 	if err != nil {
+		// give the share back so another peer can claim it
+		context.lock.Lock()
+		if context.activeShares[shareCode] == share && !websocket.IsConnected(connectionFor(share, role)) {
+			delete(context.activeShares, shareCode)
+			context.sharesAwaitingPeers[shareCode] = share
+		}
+		context.lock.Unlock()
+
 		http.Error(w, "Websocket failed to upgrade.", http.StatusInternalServerError)
 		return
 	}
-
 }
 
-func createShare(senderConnection *websocket.Connection, context *globalContext) (*Share, error) {
-	receiverConnection, err := websocket.CreateConnection()
+// Create a share for the peer that connected first, the connection of the peer
+// that joins is upgraded when it joins with the share code
+func createShare(connection *websocket.Connection, createdBy peerRole, context *globalContext) (*Share, error) {
+	joiningConnection, err := websocket.CreateConnection()
 
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create receiver connection")
+		return nil, fmt.Errorf("Failed to create %v connection", strings.ToLower(createdBy.other().String()))
 	}
 
 	var shareCode [5]byte
@@ -133,13 +247,13 @@ func createShare(senderConnection *websocket.Connection, context *globalContext)
 	defer context.lock.Unlock()
 
 	for !shareCodeSet {
-		_, err = rand.Read(shareCode[:])
+		shareCode, err = context.config.ShareCodes.Generate()
 
 		if err != nil {
-			return nil, fmt.Errorf("Random bytes failed")
+			return nil, err
 		}
 		_, shareCodeUsedByActiveShare := context.activeShares[shareCode]
-		_, shareCodeUsedByNewShare := context.sharesAwaitingReceivers[shareCode]
+		_, shareCodeUsedByNewShare := context.sharesAwaitingPeers[shareCode]
 
 		if (!shareCodeUsedByActiveShare) && (!shareCodeUsedByNewShare) {
 			shareCodeSet = true
@@ -148,203 +262,809 @@ func createShare(senderConnection *websocket.Connection, context *globalContext)
 
 	newShare := &Share{
 		shareCode:          shareCode,
-		senderConnection:   senderConnection,
-		receiverConnection: receiverConnection,
+		createdBy:          createdBy,
+		state:              initialState(createdBy),
+		senderConnection:   connection,
+		receiverConnection: joiningConnection,
+		resumptions:        make(chan resumption, 1),
+	}
+
+	if createdBy == receiverRole {
+		newShare.senderConnection, newShare.receiverConnection = joiningConnection, connection
 	}
 
+	// the code is no longer expired once it is reused
+	delete(context.expiredShareCodes, shareCode)
+
+	// registered before the share's go-routine starts so freeing the share always removes it
+	context.sharesAwaitingPeers[shareCode] = newShare
+	context.metrics.sharesCreated.Add(1)
+
 	// start the go-routine that will handle the share
 	go facilitateShare(newShare, context)
 
 	return newShare, nil
 }
 
-func errorOutShare(share *Share, context *globalContext, errorReason string) {
+// Send an ERROR to a single connection if it is connected, failures are ignored
+// since the connection is about to be closed anyway. The code is only sent from version 16.
+func sendError(connection *websocket.Connection, version uint8, code protocol.ErrorCode, errorReason string) {
 	const maxLength = 65535
 
 	if len(errorReason) > maxLength {
 		errorReason = errorReason[:maxLength]
 	}
+	// truncating may have split a multi-byte character
+	errorReason = strings.ToValidUTF8(errorReason, "")
 
-	errorEncoded, err := encodeError(errorReason)
+	errorEncoded, err := protocol.EncodeError(version, code, errorReason, relayVersions)
 
 	if err != nil {
-		// encodeError only returns an error for input too long
-		// since this case has been handled this should never happen
-		panic("ErrorReason should not be too long but is.")
+		// encodeError only returns an error for input too long or invalid utf-8
+		// since these cases have been handled this should never happen
+		panic("ErrorReason should be valid but isn't.")
 	}
 
-	if websocket.IsConnected(share.senderConnection) {
-		err = websocket.SendBlobData(share.senderConnection, errorEncoded)
+	if websocket.IsConnected(connection) {
+		err = websocket.SendBlobData(connection, errorEncoded)
 		if err != nil {
-			// failed to send error to sender
+			// failed to send error
 		}
 	}
-	if websocket.IsConnected(share.receiverConnection) {
-		err = websocket.SendBlobData(share.receiverConnection, errorEncoded)
-		if err != nil {
-			// failed to send error to reciever
-		}
-	}
-	websocket.InitiateClose(share.senderConnection)
-	websocket.InitiateClose(share.receiverConnection)
+}
 
+func freeShare(share *Share, context *globalContext) {
 	context.lock.Lock()
 	defer context.lock.Unlock()
-	// delete the last reference to the share
+	// delete the last references to the share
 	// effectively this is the free() point
 	delete(context.activeShares, share.shareCode)
+	delete(context.sharesAwaitingPeers, share.shareCode)
+	delete(context.resumeTokens, share.senderResumeToken)
+	delete(context.resumeTokens, share.receiverResumeToken)
+}
+
+// Wait for the peer joining the share to connect, returns why the share ended if
+// it expired or the creator cancelled it first
+func awaitPeer(share *Share, context *globalContext, role peerRole) error {
+	joined := make(chan bool, 1)
+
+	go func() {
+		joined <- websocket.WaitUntilConnectedOrTimeout(connectionFor(share, role), share.timeToLive)
+	}()
+
+	expiring := startTimeToLive(share, context)
+
+	// the creator sends nothing while it waits except CANCEL
+	creatorIncoming := connectionFor(share, role.other()).Incoming
+
+	for {
+		select {
+		case connected := <-joined:
+			if !connected {
+				if err := expireShare(share, context, role); err != nil {
+					return err
+				}
+			}
+
+			if role == receiverRole {
+				updateStatus(share, context, func(status *shareStatus) {
+					status.ReceiversJoined = 1
+				})
+			}
+
+			sendStatus(share, protocol.StatusPeerJoined, 1)
+			return nil
+		case <-expiring:
+			sendStatus(share, protocol.StatusExpiring, uint32(expiryWarning/time.Second))
+		case blob, ok := <-creatorIncoming:
+			if !ok {
+				// noticed once the share expires or the peer joins
+				creatorIncoming = nil
+				continue
+			}
+
+			err := checkCancel(blob, role.other())
+
+			if err == nil {
+				err = fail(protocol.E_SEQUENCE, "Unexpected message while waiting for a %v.", strings.ToLower(role.String()))
+			}
+
+			withdrawShare(share, context, role)
+			return err
+		}
+	}
+}
+
+// Stop offering a share that is waiting for a peer, a peer that claimed it is
+// given a moment to finish its upgrade so it can be told why the share ended
+func withdrawShare(share *Share, context *globalContext, role peerRole) {
+	context.lock.Lock()
+	_, awaitingPeer := context.sharesAwaitingPeers[share.shareCode]
+	delete(context.sharesAwaitingPeers, share.shareCode)
+	context.lock.Unlock()
+
+	if !awaitingPeer {
+		websocket.WaitUntilConnectedOrTimeout(connectionFor(share, role), peerUpgradeTimeout)
+	}
+}
+
+// Stop offering a share whose time to live ended before the peer joined, returns
+// nil if a peer claimed it as it expired and finished joining
+func expireShare(share *Share, context *globalContext, role peerRole) error {
+	context.lock.Lock()
+	_, awaitingPeer := context.sharesAwaitingPeers[share.shareCode]
+	delete(context.sharesAwaitingPeers, share.shareCode)
+	if awaitingPeer {
+		recordExpiredShareCode(context, share.shareCode)
+	}
+	context.lock.Unlock()
+
+	if awaitingPeer {
+		return fail(protocol.E_EXPIRED, "Share expired before a %v joined.", strings.ToLower(role.String()))
+	}
+
+	// a peer claimed the share as it expired, its upgrade should finish promptly
+	if websocket.WaitUntilConnectedOrTimeout(connectionFor(share, role), peerUpgradeTimeout) {
+		return nil
+	}
+
+	return fail(protocol.E_PEER_GONE, "%v failed to connect.", role)
+}
+
+// AwaitingSender: accept the sender that created the share, or the sender joining
+// a receiver's share request
+func awaitSender(share *Share, context *globalContext) (shareState, error) {
+	if share.createdBy == receiverRole {
+		return stateKeyExchange, joinSender(share, context)
+	}
+
+	return stateAwaitingReceiver, acceptSender(share, context)
 }
 
-func facilitateShare(share *Share, context *globalContext) {
-	/* TODO: Refactor into smaller functions to handle phases of the share
-	For example could be:
-	+ Sender Initiation and Acceptance
-	+ Reciever Initiation and Acceptance
-	+ Ready
-	+ Metadata
-	+ Data sharing
-	+ Close out
-	*/
+// AwaitingReceiver: accept the receiver that created a share request, or the
+// receiver joining the sender's share
+func awaitReceiver(share *Share, context *globalContext) (shareState, error) {
+	if share.createdBy == receiverRole {
+		return stateAwaitingSender, acceptRequest(share, context)
+	}
+
+	return stateKeyExchange, joinReceiver(share, context)
+}
 
+// Read the SENDER_INITIATION of the sender that created the share and send SENDER_ACCEPTED
+func acceptSender(share *Share, context *globalContext) error {
 	websocket.WaitUntilConnected(share.senderConnection)
-	senderInitiation := <-share.senderConnection.Incoming
-	err := decodeSenderInitiation(senderInitiation)
+	senderInitiation, err := receiveFrom(share, senderRole)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to decode sender initiation message.")
-		return
+		return err
 	}
 
-	senderAcceptance, err := encodeSenderAcceptance(share.shareCode[:])
+	initiation, err := protocol.DecodeSenderInitiation(senderInitiation)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to encode sender acceptance message.")
-		return
+		return fail(protocol.E_SEQUENCE, "Failed to decode sender initiation message.")
+	}
+
+	commonVersions, ok := initiation.Versions.Intersect(relayVersions)
+
+	if !ok {
+		share.version = errorVersionFor(initiation.Versions)
+		return fail(protocol.E_VERSION, "No protocol version is supported by both the sender and relay.")
+	}
+
+	share.versions = commonVersions
+	share.version = commonVersions.Highest
+	share.requestedWindowSize = initiation.WindowSize
+	share.timeToLive = negotiateTimeToLive(context.config, initiation.TimeToLive)
+	share.pinSalt = initiation.PinSalt
+	share.pinVerifier = initiation.PinVerifier
+
+	share.keyAgreement = initiation.KeyAgreement
+
+	if share.keyAgreement == protocol.KeyAgreementPake {
+		// only receivers able to run the key exchange may join
+		share.versions.Lowest = max(share.versions.Lowest, protocol.IntroducedIn(protocol.PAKE))
+	}
+
+	if isPinProtected(share) {
+		// only receivers able to answer PIN_CHALLENGE may join
+		share.versions.Lowest = max(share.versions.Lowest, protocol.IntroducedIn(protocol.PIN_CHALLENGE))
+	}
+
+	receivers := min(int(initiation.Receivers), context.config.MaxBroadcastReceivers)
+
+	if share.versions.Highest >= protocol.IntroducedIn(protocol.BROADCAST_READY) && receivers > 1 {
+		if isPinProtected(share) || share.keyAgreement == protocol.KeyAgreementPake {
+			return fail(protocol.E_SEQUENCE, "Broadcast shares can't be PIN protected or use PAKE key agreement.")
+		}
+
+		// only receivers able to decode a key for several receivers may join
+		share.versions.Lowest = max(share.versions.Lowest, protocol.IntroducedIn(protocol.BROADCAST_READY))
+
+		context.lock.Lock()
+		share.broadcast = newBroadcast(receivers, initiation.DropPolicy)
+		context.lock.Unlock()
+	}
+
+	// broadcast shares can't be resumed
+	if share.versions.Highest >= protocol.IntroducedIn(protocol.RESUME) && share.broadcast == nil {
+		share.senderResumeToken, err = newResumeToken(share, context)
+
+		if err != nil {
+			return fail(protocol.E_INTERNAL, "Failed to generate resume token.")
+		}
+	}
+
+	return sendSenderAcceptance(share, context)
+}
+
+func sendSenderAcceptance(share *Share, context *globalContext) error {
+	senderAcceptance, err := protocol.EncodeSenderAcceptance(protocol.SenderAcceptance{
+		Versions:      share.versions,
+		ShareCode:     share.shareCode[:],
+		ResumeToken:   share.senderResumeToken[:],
+		TimeToLive:    uint32(share.timeToLive / time.Second),
+		ShareCodeText: context.config.ShareCodes.Format(share.shareCode),
+	})
+
+	if err != nil {
+		return fail(protocol.E_INTERNAL, "Failed to encode sender acceptance message.")
 	}
 
 	err = websocket.SendBlobData(share.senderConnection, senderAcceptance)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed send sender acceptance message.")
-		return
+		return fail(protocol.E_PEER_GONE, "Failed send sender acceptance message.")
+	}
+
+	return nil
+}
+
+// Wait for a receiver to join the sender's share and negotiate the version with its RECEIVER_INITIATION
+func joinReceiver(share *Share, context *globalContext) error {
+	err := awaitPeer(share, context, receiverRole)
+
+	if err != nil {
+		return err
+	}
+
+	recieverInitiation, err := receiveFrom(share, receiverRole)
+
+	if err != nil {
+		return err
 	}
 
+	receiverVersions, recieverPublicKey, err := protocol.DecodeReceiverInitiation(recieverInitiation)
+
+	if err != nil {
+		return fail(protocol.E_SEQUENCE, "Failed to decode receiver initiation message.")
+	}
+
+	if recieverPublicKey.KeyType != protocol.KeyTypeRsa4096 {
+		// senders before version 10 only understand RSA-4096 keys
+		receiverVersions.Lowest = max(receiverVersions.Lowest, protocol.KeyTypesVersion)
+	}
+
+	negotiatedVersions, ok := share.versions.Intersect(receiverVersions)
+
+	if !ok {
+		err = fail(protocol.E_VERSION, "No protocol version is supported by the sender, receiver and relay.")
+		// the receiver may not understand the version used with the sender
+		sendError(share.receiverConnection, errorVersionFor(receiverVersions), errorCode(err), err.Error())
+		websocket.InitiateClose(share.receiverConnection)
+		return err
+	}
+
+	// the highest version shared by all three parties is used for the rest of the share
+	share.versions = negotiatedVersions
+	share.version = negotiatedVersions.Highest
+	share.windowSize = negotiateWindowSize(share.version, share.requestedWindowSize)
+	share.receiverKey = recieverPublicKey
+
+	updateStatus(share, context, func(status *shareStatus) {
+		status.ReceiversReady = 1
+	})
+	sendStatus(share, protocol.StatusReceiverKey, 1)
+
+	return nil
+}
+
+// Read the RECEIVER_INITIATION of a receiver creating a share request and send
+// REQUEST_ACCEPTED, the sender joins with the share code and is sent READY as
+// soon as it is accepted
+func acceptRequest(share *Share, context *globalContext) error {
 	websocket.WaitUntilConnected(share.receiverConnection)
-	recieverInitiation := <-share.receiverConnection.Incoming
+	recieverInitiation, err := receiveFrom(share, receiverRole)
+
+	if err != nil {
+		return err
+	}
 
-	recieverPublicKey, err := decodeReceiverInitiation(recieverInitiation)
+	receiverVersions, recieverPublicKey, err := protocol.DecodeReceiverInitiation(recieverInitiation)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to decode receiver initiation message.")
-		return
+		return fail(protocol.E_SEQUENCE, "Failed to decode receiver initiation message.")
 	}
 
-	recieverAcceptance := encodeRecieverAcceptance()
-	err = websocket.SendBlobData(share.receiverConnection, recieverAcceptance)
+	// only receivers able to understand REQUEST_ACCEPTED may create a share request
+	receiverVersions.Lowest = max(receiverVersions.Lowest, protocol.IntroducedIn(protocol.REQUEST_ACCEPTED))
+	commonVersions, ok := receiverVersions.Intersect(relayVersions)
+
+	if !ok {
+		share.version = errorVersionFor(receiverVersions)
+		return fail(protocol.E_VERSION, "No protocol version supporting share requests is supported by both the receiver and relay.")
+	}
+
+	share.versions = commonVersions
+	share.version = commonVersions.Highest
+	share.timeToLive = negotiateTimeToLive(context.config, 0)
+	share.receiverKey = recieverPublicKey
+
+	updateStatus(share, context, func(status *shareStatus) {
+		status.ReceiversJoined, status.ReceiversReady = 1, 1
+	})
+
+	requestAcceptance, err := protocol.EncodeRequestAcceptance(protocol.RequestAcceptance{
+		Versions:      share.versions,
+		ShareCode:     share.shareCode[:],
+		TimeToLive:    uint32(share.timeToLive / time.Second),
+		ShareCodeText: context.config.ShareCodes.Format(share.shareCode),
+	})
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to send receiver acceptance message.")
-		return
+		return fail(protocol.E_INTERNAL, "Failed to encode request acceptance message.")
 	}
 
-	ready, err := encodeReady(recieverPublicKey)
-	err = websocket.SendBlobData(share.senderConnection, ready)
+	err = websocket.SendBlobData(share.receiverConnection, requestAcceptance)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to send ready message.")
-		return
+		return fail(protocol.E_PEER_GONE, "Failed to send request acceptance message.")
 	}
 
-	meta := <-share.senderConnection.Incoming
-	numberOfChunks, err := decodeMetadata(meta)
+	return nil
+}
+
+// Wait for a sender to join the receiver's share request, negotiate the version
+// with its SENDER_INITIATION and send SENDER_ACCEPTED
+func joinSender(share *Share, context *globalContext) error {
+	err := awaitPeer(share, context, senderRole)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to decode metadata message.")
-		return
+		return err
 	}
 
-	err = websocket.SendBlobData(share.receiverConnection, meta)
+	senderInitiation, err := receiveFrom(share, senderRole)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to forward metadata message.")
-		return
+		return err
 	}
 
-	metaDataAck := <-share.receiverConnection.Incoming
-	chunkNumber, err := decodeAcknowledge(metaDataAck)
+	initiation, err := protocol.DecodeSenderInitiation(senderInitiation)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to decode awknowledgement.")
-		return
+		return fail(protocol.E_SEQUENCE, "Failed to decode sender initiation message.")
 	}
 
-	if chunkNumber != 0xFF {
-		errorString := fmt.Sprintf("Recieved awknowledgement for chunk %X which not yet been sent.", chunkNumber)
-		errorOutShare(share, context, errorString)
-		return
+	negotiatedVersions, ok := share.versions.Intersect(initiation.Versions)
+
+	if !ok {
+		err = fail(protocol.E_VERSION, "No protocol version is supported by the sender, receiver and relay.")
+		// the sender may not understand the version used with the receiver
+		sendError(share.senderConnection, errorVersionFor(initiation.Versions), errorCode(err), err.Error())
+		websocket.InitiateClose(share.senderConnection)
+		return err
 	}
 
-	err = websocket.SendBlobData(share.senderConnection, metaDataAck)
+	share.versions = negotiatedVersions
+	share.version = negotiatedVersions.Highest
+
+	// the receiver has already been accepted, there's no PIN for it to answer and no
+	// share code for it to run the key exchange with
+	if len(initiation.PinVerifier) > 0 || initiation.KeyAgreement == protocol.KeyAgreementPake {
+		return fail(protocol.E_SEQUENCE, "Share requests can't be PIN protected or use PAKE key agreement.")
+	}
+
+	share.requestedWindowSize = initiation.WindowSize
+	share.windowSize = negotiateWindowSize(share.version, initiation.WindowSize)
+	share.keyAgreement = initiation.KeyAgreement
+
+	share.senderResumeToken, err = newResumeToken(share, context)
 
 	if err != nil {
-		errorOutShare(share, context, "Failed to forward awknowledgement.")
-		return
+		return fail(protocol.E_INTERNAL, "Failed to generate resume token.")
 	}
 
-	for i := uint16(0); i <= numberOfChunks; i++ {
-		chunk := <-share.senderConnection.Incoming
+	return sendSenderAcceptance(share, context)
+}
 
-		chunkNumber, err = decodeDataChunk(chunk)
+// KeyExchange: check the receiver's PIN, accept it and relay the handshake until
+// the sender sends the metadata, which is forwarded to the receiver
+func exchangeKeys(share *Share, context *globalContext) (shareState, error) {
+	if isPinProtected(share) {
+		err := verifyReceiverPin(share)
 
 		if err != nil {
-			errorOutShare(share, context, "Failed to decode data chunk metadata.")
-			return
+			return stateClosing, err
 		}
+	}
+
+	err := acceptReceiver(share, context, share.receiverKey)
 
-		if chunkNumber != i {
-			errorString := fmt.Sprintf("Recieved chunk %X, expected chunk %X.", chunkNumber, i)
-			errorOutShare(share, context, errorString)
-			return
+	if err != nil {
+		return stateClosing, err
+	}
+
+	var meta []byte
+
+	if hasHandshake(share) {
+		meta, err = relayHandshakeMessages(share)
+	} else {
+		meta, err = receiveFrom(share, senderRole)
+	}
+
+	if err != nil {
+		return stateClosing, err
+	}
+
+	if share.version >= protocol.IntroducedIn(protocol.MANIFEST) {
+		files, err := protocol.DecodeManifest(meta, share.version)
+
+		if err != nil {
+			return stateClosing, fail(protocol.E_SEQUENCE, "Failed to decode manifest message.")
 		}
 
-		err = websocket.SendBlobData(share.receiverConnection, chunk)
+		share.fileChunkBoundaries = protocol.ChunkBoundaries(files)
+		share.streamed = protocol.IsStreamed(files)
+	} else {
+		_, numberOfChunks, err := protocol.DecodeMetadata(meta, share.version)
 
 		if err != nil {
-			errorOutShare(share, context, "Failed to forward data chunk.")
-			return
+			return stateClosing, fail(protocol.E_SEQUENCE, "Failed to decode metadata message.")
 		}
 
-		metaDataAck := <-share.receiverConnection.Incoming
-		chunkNumber, err := decodeAcknowledge(metaDataAck)
+		share.fileChunkBoundaries = []uint32{numberOfChunks}
+	}
+
+	publishTotalChunks(share, context)
+
+	err = websocket.SendBlobData(share.receiverConnection, meta)
+
+	if err != nil {
+		return stateClosing, fail(protocol.E_PEER_GONE, "Failed to forward metadata message.")
+	}
+
+	return stateMetadata, nil
+}
+
+// Send RECEIVER_ACCEPTED to the receiver and READY with its key to the sender once the version is negotiated
+func acceptReceiver(share *Share, context *globalContext, receiverKey protocol.ReceiverKey) error {
+	var err error
+
+	if share.version >= protocol.IntroducedIn(protocol.RESUME) {
+		share.receiverResumeToken, err = newResumeToken(share, context)
 
 		if err != nil {
-			errorOutShare(share, context, "Failed to decode awknowledgement.")
-			return
+			return fail(protocol.E_INTERNAL, "Failed to generate resume token.")
 		}
+	}
+
+	recieverAcceptance, err := protocol.EncodeReceiverAcceptance(share.version, share.receiverResumeToken[:])
+
+	if err != nil {
+		return fail(protocol.E_INTERNAL, "Failed to encode receiver acceptance message.")
+	}
+
+	err = websocket.SendBlobData(share.receiverConnection, recieverAcceptance)
+
+	if err != nil {
+		return fail(protocol.E_PEER_GONE, "Failed to send receiver acceptance message.")
+	}
+
+	ready, err := protocol.EncodeReady(share.version, receiverKey, share.windowSize)
+
+	if err != nil {
+		return fail(protocol.E_INTERNAL, "Failed to encode ready message.")
+	}
+
+	err = websocket.SendBlobData(share.senderConnection, ready)
+
+	if err != nil {
+		return fail(protocol.E_PEER_GONE, "Failed to send ready message.")
+	}
+
+	return nil
+}
 
-		if chunkNumber != i {
-			errorString := fmt.Sprintf("Recieved acknowledgement for chunk %X, expected chunk %X.", chunkNumber, i)
-			errorOutShare(share, context, errorString)
-			return
+// Metadata: forward the receiver's acknowledgement of the metadata to the
+// sender, from version 14 the receiver may decline the share instead
+func relayMetadata(share *Share, context *globalContext) (shareState, error) {
+	metaDataAck, err := receiveFrom(share, receiverRole)
+
+	if err != nil {
+		return stateClosing, err
+	}
+
+	if isDecline(share, metaDataAck) {
+		return stateClosing, declineShare(share, context, metaDataAck)
+	}
+
+	err = protocol.DecodeMetadataAcknowledge(metaDataAck, share.version)
+
+	if err != nil {
+		return stateClosing, fail(protocol.E_SEQUENCE, "Failed to decode metadata awknowledgement.")
+	}
+
+	err = websocket.SendBlobData(share.senderConnection, metaDataAck)
+
+	if err != nil {
+		return stateClosing, fail(protocol.E_PEER_GONE, "Failed to forward awknowledgement.")
+	}
+
+	return stateTransferring, nil
+}
+
+// Transferring: relay the chunks until the share finishes
+func relayTransfer(share *Share, context *globalContext) (shareState, error) {
+	numberOfChunks := share.fileChunkBoundaries[len(share.fileChunkBoundaries)-1]
+
+	return stateClosing, relayDataChunks(share, context, numberOfChunks)
+}
+
+// Whether a receiver declined the share instead of acknowledging its metadata, from version 14
+func isDecline(share *Share, blob []byte) bool {
+	return share.version >= protocol.IntroducedIn(protocol.DECLINE) && len(blob) > 0 &&
+		protocol.Opcode(blob[0]) == protocol.DECLINE
+}
+
+// Forward the receiver's DECLINE to the sender, a declined share ended normally
+// so neither peer is sent an ERROR
+func declineShare(share *Share, context *globalContext, decline []byte) error {
+	_, err := protocol.DecodeDecline(decline, share.version)
+
+	if err != nil {
+		return fail(protocol.E_SEQUENCE, "Failed to decode decline message.")
+	}
+
+	context.metrics.sharesDeclined.Add(1)
+
+	// the sender may already have left, the share is over either way
+	websocket.SendBlobData(share.senderConnection, decline)
+
+	return errDeclined
+}
+
+// Forward chunks from the sender and acknowledgements from the receiver until
+// every chunk is acknowledged. The sender may have up to share.windowSize
+// unacknowledged chunks in flight, chunks must arrive in order and acknowledgements
+// are cumulative (acknowledging a chunk acknowledges every chunk before it).
+// From version 3 a peer disconnecting suspends the share until it resumes and
+// from version 4 the share ends with the sender's END once every chunk is acknowledged.
+// From version 11 END carries the number of chunks and the loop ends on it, a
+// streamed share has no number of chunks until then (numberOfChunks is the most it may have).
+// The share times out once nothing has been relayed for transferIdleTimeout.
+func relayDataChunks(share *Share, context *globalContext, numberOfChunks uint32) error {
+	var progress transferProgress
+	defer publishProgress(share, context, &progress, true)
+
+	resumable := share.version >= protocol.IntroducedIn(protocol.RESUME)
+
+	if resumable {
+		setAcceptingResumptions(share, context, true)
+		defer setAcceptingResumptions(share, context, false)
+	}
+
+	for !transferFinished(share, &progress, numberOfChunks) {
+		senderIncoming := share.senderConnection.Incoming
+
+		// stop reading from the sender once every chunk has been sent, resumable
+		// shares keep reading so a sender disconnecting is noticed
+		if progress.forwarded == numberOfChunks && !resumable {
+			senderIncoming = nil
 		}
 
-		err = websocket.SendBlobData(share.senderConnection, metaDataAck)
+		var err error
+
+		select {
+		case chunk, ok := <-senderIncoming:
+			if !ok {
+				err = suspendShare(share, &progress, numberOfChunks, senderRole, nil)
+				break
+			}
+
+			if err = checkCancel(chunk, senderRole); err != nil {
+				break
+			}
+
+			if progress.awaitingResumedEcho {
+				_, nextChunk, decodeErr := protocol.DecodeResumed(chunk, share.version)
+
+				// anything else was sent before the sender saw RESUMED
+				if decodeErr == nil && nextChunk == progress.forwarded {
+					progress.awaitingResumedEcho = false
+				}
+				break
+			}
+
+			if progress.acknowledged == numberOfChunks || endsTransfer(share, chunk) {
+				err = forwardEnd(share, &progress, numberOfChunks, chunk)
+				break
+			}
+
+			err = forwardDataChunk(share, &progress, numberOfChunks, chunk)
+
+			if err == errForwardFailed && resumable {
+				err = suspendShare(share, &progress, numberOfChunks, receiverRole, nil)
+			}
+
+		case chunkAck, ok := <-share.receiverConnection.Incoming:
+			if !ok {
+				err = suspendShare(share, &progress, numberOfChunks, receiverRole, nil)
+				break
+			}
+
+			if err = checkCancel(chunkAck, receiverRole); err != nil {
+				break
+			}
+
+			err = acceptAcknowledge(share, &progress, chunkAck)
+
+			if err != nil {
+				break
+			}
+
+			err = websocket.SendBlobData(share.senderConnection, chunkAck)
 
-		if err != nil {
 			if err != nil {
-				errorOutShare(share, context, "Failed to forward awknowledgement.")
-				return
+				err = fail(protocol.E_PEER_GONE, "Failed to forward awknowledgement.")
+				if resumable {
+					err = suspendShare(share, &progress, numberOfChunks, senderRole, nil)
+				}
 			}
+
+		case newConnection := <-share.resumptions:
+			err = suspendShare(share, &progress, numberOfChunks, newConnection.role, &newConnection)
+
+		case <-deadlineOf(share):
+			err = timedOut(share)
+		}
+
+		if err != nil {
+			return err
 		}
 
+		extendDeadline(share)
+		publishProgress(share, context, &progress, false)
 	}
 
-	websocket.InitiateClose(share.senderConnection)
-	websocket.InitiateClose(share.receiverConnection)
+	return nil
+}
 
-	context.lock.Lock()
-	defer context.lock.Unlock()
-	// delete the last reference to the share
-	// effectively this is the free() point
-	delete(context.activeShares, share.shareCode)
+// Returned when the receiver could not be sent a chunk, the share can be suspended from version 3
+var errForwardFailed = fail(protocol.E_PEER_GONE, "Failed to forward data chunk.")
+
+func transferFinished(share *Share, progress *transferProgress, numberOfChunks uint32) bool {
+	if share.version >= protocol.StreamingVersion {
+		return progress.ended
+	}
+
+	if progress.acknowledged < numberOfChunks {
+		return false
+	}
+	return share.version < protocol.IntroducedIn(protocol.END) || progress.ended
+}
+
+func forwardDataChunk(share *Share, progress *transferProgress, numberOfChunks uint32, chunk []byte) error {
+	payloadLength, err := checkDataChunk(share, progress, numberOfChunks, chunk)
+
+	if err != nil {
+		return err
+	}
+
+	err = websocket.SendBlobData(share.receiverConnection, chunk)
+
+	if err != nil {
+		return errForwardFailed
+	}
+
+	progress.forwarded++
+	progress.inFlight = append(progress.inFlight, payloadLength)
+
+	return nil
+}
+
+// Check a chunk from the sender is the next chunk, belongs to the right file and
+// fits in the window, returns the length of its payload
+func checkDataChunk(share *Share, progress *transferProgress, numberOfChunks uint32, chunk []byte) (int, error) {
+	if progress.forwarded == numberOfChunks {
+		return 0, fail(protocol.E_SEQUENCE, "Recieved a message from the sender before the final chunk was acknowledged.")
+	}
+
+	fileIndex, chunkNumber, payload, err := protocol.DecodeDataChunk(chunk, share.version)
+
+	if err != nil {
+		return 0, fail(protocol.E_SEQUENCE, "Failed to decode data chunk metadata.")
+	}
+
+	if chunkNumber != progress.forwarded {
+		return 0, fail(protocol.E_SEQUENCE, "Recieved chunk %X, expected chunk %X.", chunkNumber, progress.forwarded)
+	}
+
+	expectedFileIndex := protocol.FileOfChunk(share.fileChunkBoundaries, chunkNumber)
+
+	if int(fileIndex) != expectedFileIndex {
+		return 0, fail(protocol.E_SEQUENCE, "Recieved chunk %X for file %v, it belongs to file %v.", chunkNumber, fileIndex, expectedFileIndex)
+	}
+
+	if progress.forwarded-progress.acknowledged >= uint32(share.windowSize) {
+		return 0, fail(protocol.E_SEQUENCE, "Recieved chunk %X outside of the window of %v unacknowledged chunks.",
+			chunkNumber, share.windowSize)
+	}
+
+	return len(payload), nil
+}
+
+// From version 11 the sender may send END before numberOfChunks chunks have been
+// acknowledged, it says how many chunks the share has
+func endsTransfer(share *Share, message []byte) bool {
+	return share.version >= protocol.StreamingVersion && len(message) > 0 && protocol.Opcode(message[0]) == protocol.END
+}
+
+// Forward the sender's END once every chunk has been acknowledged, it is the last message of a version 4 share
+func forwardEnd(share *Share, progress *transferProgress, numberOfChunks uint32, end []byte) error {
+	err := checkEnd(share, progress, numberOfChunks, end)
+
+	if err != nil {
+		return err
+	}
+
+	err = websocket.SendBlobData(share.receiverConnection, end)
+
+	if err != nil {
+		return fail(protocol.E_PEER_GONE, "Failed to forward end message.")
+	}
+
+	progress.ended = true
+
+	return nil
+}
+
+// Check the sender's END comes after every chunk was acknowledged and, from version 11, counts them
+func checkEnd(share *Share, progress *transferProgress, numberOfChunks uint32, end []byte) error {
+	endNumberOfChunks, _, err := protocol.DecodeEnd(end, share.version)
+
+	if err != nil {
+		return fail(protocol.E_SEQUENCE, "Failed to decode end message.")
+	}
+
+	if share.version >= protocol.StreamingVersion {
+		if progress.acknowledged != progress.forwarded {
+			return fail(protocol.E_SEQUENCE, "Recieved end message before chunk %X was acknowledged.", progress.acknowledged)
+		}
+
+		if endNumberOfChunks != progress.acknowledged || (!share.streamed && endNumberOfChunks != numberOfChunks) {
+			return fail(protocol.E_SEQUENCE, "Recieved end message for %v chunks, %v chunks were sent.", endNumberOfChunks, progress.acknowledged)
+		}
+	}
+
+	return nil
+}
+
+// Check a cumulative acknowledgement and record it, forwarding it is left to the caller
+func acceptAcknowledge(share *Share, progress *transferProgress, chunkAck []byte) error {
+	chunkNumber, err := protocol.DecodeAcknowledge(chunkAck, share.version)
+
+	if err != nil {
+		return fail(protocol.E_SEQUENCE, "Failed to decode awknowledgement.")
+	}
+
+	if chunkNumber < progress.acknowledged || chunkNumber >= progress.forwarded {
+		return fail(protocol.E_SEQUENCE, "Recieved acknowledgement for chunk %X which is not awaiting acknowledgement.",
+			chunkNumber)
+	}
+
+	recordAcknowledged(progress, chunkNumber+1)
+
+	return nil
 }
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// The phases of a share. The share's go-routine runs the handler of its current
+// state until one ends the share, every share then passes through Closing where
+// its connections are closed whatever ended it.
+type shareState uint8
+
+const (
+	// waiting for the sender's SENDER_INITIATION
+	stateAwaitingSender shareState = iota
+	// waiting for a receiver's RECEIVER_INITIATION, or for every receiver of a broadcast share
+	stateAwaitingReceiver
+	// from READY until the sender's METADATA or MANIFEST, including the PIN and handshake
+	stateKeyExchange
+	// waiting for the receiver to acknowledge or decline the metadata
+	stateMetadata
+	// relaying chunks and acknowledgements, including suspensions
+	stateTransferring
+	stateClosing
+	// the share has been freed
+	stateDone
+)
+
+func (state shareState) String() string {
+	switch state {
+	case stateAwaitingSender:
+		return "AwaitingSender"
+	case stateAwaitingReceiver:
+		return "AwaitingReceiver"
+	case stateKeyExchange:
+		return "KeyExchange"
+	case stateMetadata:
+		return "Metadata"
+	case stateTransferring:
+		return "Transferring"
+	case stateClosing:
+		return "Closing"
+	case stateDone:
+		return "Done"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", uint8(state))
+	}
+}
+
+// States each state may move to, the peer that created the share is awaited first
+var stateTransitions = map[shareState][]shareState{
+	stateAwaitingSender:   {stateAwaitingReceiver, stateKeyExchange, stateClosing},
+	stateAwaitingReceiver: {stateAwaitingSender, stateKeyExchange, stateClosing},
+	stateKeyExchange:      {stateMetadata, stateClosing},
+	stateMetadata:         {stateTransferring, stateClosing},
+	stateTransferring:     {stateClosing},
+	stateClosing:          {stateDone},
+}
+
+// How long the peer that created a share has to send its initiation, the peer
+// joining it has the share's time to live and peerUpgradeTimeout on top
+const initiationTimeout = 30 * time.Second
+
+// Long enough for every PIN attempt and the handshake, each has its own timeout
+const keyExchangeTimeout = maxPinAttempts*pinResponseTimeout + handshakeTimeout
+
+// How long the receiver has to acknowledge or decline the metadata, from version
+// 14 its user may be asked first
+const metadataTimeout = 10 * time.Minute
+
+// How long a transfer may go without a message from either peer, the sender of a
+// streamed share may be waiting for its input
+const transferIdleTimeout = 30 * time.Minute
+
+// How long the share may stay in a state, zero if the state has no deadline
+func stateTimeout(share *Share, state shareState) time.Duration {
+	switch state {
+	case stateAwaitingSender, stateAwaitingReceiver:
+		awaitingCreator := (state == stateAwaitingSender) == (share.createdBy == senderRole)
+
+		if awaitingCreator {
+			return initiationTimeout
+		}
+		return share.timeToLive + peerUpgradeTimeout + initiationTimeout
+	case stateKeyExchange:
+		return keyExchangeTimeout
+	case stateMetadata:
+		return metadataTimeout
+	case stateTransferring:
+		return transferIdleTimeout
+	default:
+		return 0
+	}
+}
+
+// The state a new share starts in, the peer that created it is awaited first
+func initialState(createdBy peerRole) shareState {
+	if createdBy == senderRole {
+		return stateAwaitingSender
+	}
+	return stateAwaitingReceiver
+}
+
+// The state of a share, safe to call from any go-routine
+func currentState(share *Share, context *globalContext) shareState {
+	context.lock.Lock()
+	defer context.lock.Unlock()
+
+	return share.state
+}
+
+// Move the share to its next state and start that state's deadline, only the
+// share's go-routine changes its state
+func enterState(share *Share, context *globalContext, next shareState) {
+	context.lock.Lock()
+	current := share.state
+	allowed := slices.Contains(stateTransitions[current], next)
+
+	if allowed {
+		share.state = next
+		notifyStatusWatchers(share)
+	}
+	context.lock.Unlock()
+
+	if !allowed {
+		// the handlers only return states their state may move to
+		panic(fmt.Sprintf("Share can't move from %v to %v.", current, next))
+	}
+
+	startDeadline(share)
+}
+
+// Start the deadline of the share's current state in place of the last state's
+func startDeadline(share *Share) {
+	if share.deadline != nil {
+		share.deadline.Stop()
+		share.deadline = nil
+	}
+
+	if timeout := stateTimeout(share, share.state); timeout > 0 {
+		share.deadline = time.NewTimer(timeout)
+	}
+}
+
+// Count the current state's deadline from now, the transfer's deadline is
+// counted from the last message relayed
+func extendDeadline(share *Share) {
+	if share.deadline != nil {
+		share.deadline.Reset(stateTimeout(share, share.state))
+	}
+}
+
+// Fires once the share has been in its state too long, nil if the state has no deadline
+func deadlineOf(share *Share) <-chan time.Time {
+	if share.deadline == nil {
+		return nil
+	}
+	return share.deadline.C
+}
+
+// The error a share that missed its state's deadline ends with
+func timedOut(share *Share) error {
+	timeout := stateTimeout(share, share.state)
+
+	log.Printf("Share timed out in the %v state.\n", share.state)
+
+	if share.state == stateTransferring {
+		return fail(protocol.E_TIMEOUT, "Nothing was relayed for %v.", timeout)
+	}
+
+	return fail(protocol.E_TIMEOUT, "Share spent longer than %v in the %v state.", timeout, share.state)
+}
+
+// Wait for the next message from a peer, failing if it disconnects or cancels
+// the share or the state's deadline passes first
+func receiveFrom(share *Share, role peerRole) ([]byte, error) {
+	select {
+	case blob, ok := <-connectionFor(share, role).Incoming:
+		if !ok {
+			return nil, fail(protocol.E_PEER_GONE, "%v disconnected.", role)
+		}
+
+		if err := checkCancel(blob, role); err != nil {
+			return nil, err
+		}
+
+		return blob, nil
+	case <-deadlineOf(share):
+		return nil, timedOut(share)
+	}
+}
+
+// What a share does in a state, returns the state it moves to next or why the share ended
+type stateHandler func(share *Share, context *globalContext) (shareState, error)
+
+var shareHandlers = map[shareState]stateHandler{
+	stateAwaitingSender:   awaitSender,
+	stateAwaitingReceiver: awaitReceiver,
+	stateKeyExchange:      exchangeKeys,
+	stateMetadata:         relayMetadata,
+	stateTransferring:     relayTransfer,
+}
+
+// A broadcast share becomes one once its sender has been accepted
+var broadcastHandlers = map[shareState]stateHandler{
+	stateAwaitingReceiver: awaitBroadcastReceivers,
+	stateKeyExchange:      relayBroadcastManifest,
+	stateMetadata:         relayBroadcastMetadata,
+	stateTransferring:     relayBroadcast,
+}
+
+// Handle a share from its creator's initiation until it has been closed and freed
+func facilitateShare(share *Share, context *globalContext) {
+	startDeadline(share)
+
+	var err error
+
+	for share.state != stateClosing {
+		handlers := shareHandlers
+
+		if share.broadcast != nil {
+			handlers = broadcastHandlers
+		}
+
+		var next shareState
+		next, err = handlers[share.state](share, context)
+
+		if err != nil {
+			next = stateClosing
+		}
+
+		enterState(share, context, next)
+	}
+
+	closeShare(share, context, err)
+	enterState(share, context, stateDone)
+}
+
+// Returned once a receiver's DECLINE has been forwarded, the share should be closed without an ERROR
+var errDeclined = fmt.Errorf("Receiver declined the share.")
+
+// Whether a share that ended with err should be closed without an ERROR, the
+// peers were sent the message that ended it
+func endedByPeer(err error) bool {
+	return err == errKeyMismatch || err == errDeclined || err == errReceiversLeft
+}
+
+// Close a share that ended with err (nil once it finished) and free it. A
+// cancelled share has its CANCEL forwarded, a share that failed has its ERROR
+// sent to every peer.
+func closeShare(share *Share, context *globalContext, err error) {
+	var cancelled *cancellation
+
+	// messages queued for broadcast receivers are discarded so the reason is their last message
+	if share.broadcast != nil {
+		stopReadingReceivers(share)
+	}
+
+	switch {
+	case errors.As(err, &cancelled):
+		recordCancellation(context, cancelled)
+
+		for _, connection := range peerConnections(share, cancelled.by.other()) {
+			forwardCancel(connection, share.version, cancelled)
+		}
+	case err != nil && !endedByPeer(err):
+		for _, connection := range shareConnections(share) {
+			sendError(connection, share.version, errorCode(err), err.Error())
+		}
+	}
+
+	if err != nil {
+		updateStatus(share, context, func(status *shareStatus) {
+			status.Error = err.Error()
+		})
+	}
+
+	for _, connection := range shareConnections(share) {
+		websocket.InitiateClose(connection)
+	}
+
+	freeShare(share, context)
+}
+
+// Connections of the share's peers with the role, every remaining receiver of a broadcast share
+func peerConnections(share *Share, role peerRole) []*websocket.Connection {
+	if role == senderRole || share.broadcast == nil {
+		return []*websocket.Connection{connectionFor(share, role)}
+	}
+
+	var connections []*websocket.Connection
+
+	for _, receiver := range liveReceivers(share) {
+		connections = append(connections, receiver.connection)
+	}
+
+	return connections
+}
+
+func shareConnections(share *Share) []*websocket.Connection {
+	return append(peerConnections(share, senderRole), peerConnections(share, receiverRole)...)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+func TestStateTransitions(t *testing.T) {
+	context := newGlobalContext(DefaultConfig())
+
+	// a share request created by a receiver
+	share := &Share{createdBy: receiverRole, state: initialState(receiverRole)}
+	path := []shareState{stateAwaitingSender, stateKeyExchange, stateMetadata, stateTransferring, stateClosing, stateDone}
+
+	for _, next := range path {
+		enterState(share, context, next)
+
+		if state := currentState(share, context); state != next {
+			t.Errorf("Share should be in the %v state not %v", next, state)
+		}
+	}
+
+	if share.deadline != nil {
+		t.Errorf("Share should have no deadline once done")
+	}
+
+	cases := []struct {
+		from    shareState
+		to      shareState
+		allowed bool
+	}{
+		{stateAwaitingSender, stateAwaitingReceiver, true},
+		{stateAwaitingSender, stateClosing, true},
+		{stateKeyExchange, stateTransferring, false},
+		{stateTransferring, stateMetadata, false},
+		{stateMetadata, stateDone, false},
+		{stateDone, stateClosing, false},
+	}
+
+	for _, c := range cases {
+		share := &Share{state: c.from}
+
+		func() {
+			defer func() {
+				if panicked := recover() != nil; panicked == c.allowed {
+					t.Errorf("Moving from %v to %v should be allowed: %v", c.from, c.to, c.allowed)
+				}
+			}()
+
+			enterState(share, context, c.to)
+		}()
+	}
+}
+
+func TestStateTimeouts(t *testing.T) {
+	share := &Share{createdBy: senderRole, timeToLive: time.Minute}
+
+	cases := []struct {
+		state   shareState
+		timeout time.Duration
+	}{
+		{stateAwaitingSender, initiationTimeout},
+		{stateAwaitingReceiver, time.Minute + peerUpgradeTimeout + initiationTimeout},
+		{stateKeyExchange, keyExchangeTimeout},
+		{stateMetadata, metadataTimeout},
+		{stateTransferring, transferIdleTimeout},
+		{stateClosing, 0},
+		{stateDone, 0},
+	}
+
+	for _, c := range cases {
+		if timeout := stateTimeout(share, c.state); timeout != c.timeout {
+			t.Errorf("%v state should time out after %v not %v", c.state, c.timeout, timeout)
+		}
+	}
+
+	// the sender joins a share request with the code
+	share.createdBy = receiverRole
+
+	if timeout := stateTimeout(share, stateAwaitingReceiver); timeout != initiationTimeout {
+		t.Errorf("Receiver creating a share request should have %v not %v", initiationTimeout, timeout)
+	}
+}
+
+func TestReceiveFrom(t *testing.T) {
+	connection, err := websocket.CreateConnection()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share := &Share{receiverConnection: connection, state: stateMetadata}
+
+	connection.Incoming <- []byte{0x17, 0x0F, 0x03, 0x00, 'b', 'y', 'e'}
+
+	var cancelled *cancellation
+
+	if _, err := receiveFrom(share, receiverRole); !errors.As(err, &cancelled) {
+		t.Errorf("CANCEL from the receiver should end the share not %v", err)
+	}
+
+	share.deadline = time.NewTimer(time.Millisecond)
+
+	if _, err := receiveFrom(share, receiverRole); errorCode(err) != protocol.E_TIMEOUT {
+		t.Errorf("Share past its state's deadline should time out not %v", err)
+	}
+
+	close(connection.Incoming)
+
+	if _, err := receiveFrom(share, receiverRole); errorCode(err) != protocol.E_PEER_GONE {
+		t.Errorf("Receiver disconnecting should end the share not %v", err)
+	}
+}
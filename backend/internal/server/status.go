@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/websocket"
+)
+
+// What GET /shares/{code}/status reports about a share. Anyone with the share
+// code may watch it, they could join the share with the code anyway.
+type shareStatus struct {
+	State string `json:"state"`
+	// When the share stops waiting for peers, zero until its time to live starts
+	Expires time.Time `json:"expires,omitzero"`
+	// Receivers that have connected and receivers that have sent their key, a share
+	// has at most one unless it is a broadcast share
+	ReceiversJoined int `json:"receivers_joined"`
+	ReceiversReady  int `json:"receivers_ready"`
+	// Chunks of the share, 0 until the metadata is relayed and for streamed shares
+	TotalChunks        uint32 `json:"total_chunks"`
+	ChunksAcknowledged uint32 `json:"chunks_acknowledged"`
+	// Encrypted payload bytes of the acknowledged chunks
+	BytesAcknowledged uint64 `json:"bytes_acknowledged"`
+	// Why the share ended early, empty while it's running and once it finished
+	Error string `json:"error,omitempty"`
+}
+
+// How long before a share stops waiting for peers its creator is sent StatusExpiring
+const expiryWarning = time.Minute
+
+// Shortest time between updates of a transfer's progress, acknowledgements are
+// too frequent to take the context lock for each
+const progressPublishInterval = time.Second
+
+// How often a status event stream is sent a comment so proxies keep it open
+const statusKeepAliveInterval = 30 * time.Second
+
+type statusHandler struct {
+	context *globalContext
+}
+
+// Change what the status endpoint reports about a share and wake its watchers
+func updateStatus(share *Share, context *globalContext, update func(status *shareStatus)) {
+	context.lock.Lock()
+	defer context.lock.Unlock()
+
+	update(&share.status)
+	notifyStatusWatchers(share)
+}
+
+// Wake the watchers of a share's status, the caller must hold the context lock
+func notifyStatusWatchers(share *Share) {
+	if share.statusChanged != nil {
+		close(share.statusChanged)
+		share.statusChanged = nil
+	}
+}
+
+// The status of a share and a channel closed once it changes
+func watchStatus(share *Share, context *globalContext) (shareStatus, <-chan struct{}) {
+	context.lock.Lock()
+	defer context.lock.Unlock()
+
+	if share.statusChanged == nil {
+		share.statusChanged = make(chan struct{})
+	}
+
+	status := share.status
+	status.State = share.state.String()
+
+	return status, share.statusChanged
+}
+
+// From version 17 tell the peer that created the share how its wait for the
+// other peer is going, it may have left which is noticed when it is next read
+func sendStatus(share *Share, event uint8, value uint32) {
+	if share.version < protocol.IntroducedIn(protocol.STATUS) {
+		return
+	}
+
+	blob, err := protocol.EncodeStatus(share.version, protocol.Status{Event: event, Value: value})
+
+	if err != nil {
+		return
+	}
+
+	websocket.SendBlobData(connectionFor(share, share.createdBy), blob)
+}
+
+// Start the share's time to live, returns a channel that fires when its creator
+// should be warned the share is about to expire (nil if it expires sooner)
+func startTimeToLive(share *Share, context *globalContext) <-chan time.Time {
+	updateStatus(share, context, func(status *shareStatus) {
+		status.Expires = time.Now().Add(share.timeToLive)
+	})
+
+	if share.timeToLive <= expiryWarning {
+		return nil
+	}
+
+	return time.After(share.timeToLive - expiryWarning)
+}
+
+// Give the status endpoint the number of chunks once the metadata is known
+func publishTotalChunks(share *Share, context *globalContext) {
+	if share.streamed {
+		return
+	}
+
+	updateStatus(share, context, func(status *shareStatus) {
+		status.TotalChunks = share.fileChunkBoundaries[len(share.fileChunkBoundaries)-1]
+	})
+}
+
+// Update the transfer's progress for the status endpoint at most once every
+// progressPublishInterval unless final
+func publishProgress(share *Share, context *globalContext, progress *transferProgress, final bool) {
+	if !final && time.Since(progress.published) < progressPublishInterval {
+		return
+	}
+
+	progress.published = time.Now()
+
+	updateStatus(share, context, func(status *shareStatus) {
+		status.ChunksAcknowledged = progress.acknowledged
+		status.BytesAcknowledged = progress.bytesAcknowledged
+	})
+}
+
+// Record the chunks before next as acknowledged and count their bytes
+func recordAcknowledged(progress *transferProgress, next uint32) {
+	newlyAcknowledged := next - progress.acknowledged
+
+	for _, length := range progress.inFlight[:newlyAcknowledged] {
+		progress.bytesAcknowledged += uint64(length)
+	}
+
+	progress.inFlight = progress.inFlight[newlyAcknowledged:]
+	progress.acknowledged = next
+}
+
+// Serve the status of the share with the code in the path as JSON, or as
+// Server-Sent Events until the share is done if the client accepts them. Lookups
+// of unknown codes count towards the same lockout and rate limit as receivers joining shares.
+func (h statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := clientAddress(r, h.context.config.TrustedProxies)
+
+	if h.context.failedLookups.isLockedOut(client) {
+		h.context.metrics.receiverAttemptsLockedOut.Add(1)
+		http.Error(w, "Too many unknown share codes, try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	// watching a share is limited like joining it so it isn't a cheaper way to guess codes
+	if !h.context.receiverLimiter.allow(client) {
+		h.context.metrics.receiverAttemptsLimited.Add(1)
+		http.Error(w, "Too many attempts to look up a share, try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	shareCode, err := h.context.config.ShareCodes.Parse(r.PathValue("code"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.context.lock.Lock()
+	result, share := findShare(h.context, shareCode)
+	h.context.lock.Unlock()
+
+	if share == nil {
+		h.context.metrics.failedLookups.Add(1)
+
+		if h.context.failedLookups.recordFailure(client) {
+			h.context.metrics.lockouts.Add(1)
+		}
+	}
+
+	switch result {
+	case shareUnknown:
+		http.Error(w, "No share exists with the provided share code.", http.StatusNotFound)
+		return
+	case shareExpired:
+		http.Error(w, "Share expired.", http.StatusGone)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamStatus(w, r, share, h.context)
+		return
+	}
+
+	status, _ := watchStatus(share, h.context)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Send a status event whenever the share's status changes until it is done or the client leaves
+func streamStatus(w http.ResponseWriter, r *http.Request, share *Share, context *globalContext) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+
+	keepAlive := time.NewTicker(statusKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		status, changed := watchStatus(share, context)
+		event, err := json.Marshal(status)
+
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(w, "event: status\ndata: %s\n\n", event)
+		flusher.Flush()
+
+		if status.State == stateDone.String() {
+			return
+		}
+
+	waiting:
+		for {
+			select {
+			case <-changed:
+				break waiting
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
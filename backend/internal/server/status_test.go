@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getStatus(context *globalContext, shareCode [5]byte, accept string) *httptest.ResponseRecorder {
+	code := context.config.ShareCodes.Format(shareCode)
+	r := httptest.NewRequest(http.MethodGet, "/shares/"+code+"/status", nil)
+	r.SetPathValue("code", code)
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+
+	w := httptest.NewRecorder()
+	statusHandler{context: context}.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestShareStatus(t *testing.T) {
+	context := newGlobalContext(DefaultConfig())
+
+	share := &Share{shareCode: [5]byte{1}, state: stateTransferring}
+	share.status = shareStatus{ReceiversJoined: 1, ReceiversReady: 1, TotalChunks: 4, ChunksAcknowledged: 2}
+	context.activeShares[share.shareCode] = share
+
+	w := getStatus(context, share.shareCode, "")
+
+	var status shareStatus
+
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Status of a share should be JSON, responded %v (%v)", w.Code, err)
+	}
+
+	if status.State != "Transferring" || status.TotalChunks != 4 || status.ChunksAcknowledged != 2 || status.ReceiversReady != 1 {
+		t.Errorf("Status should describe the share is %+v", status)
+	}
+}
+
+func TestShareStatusLookup(t *testing.T) {
+	config := DefaultConfig()
+	// only the lockout is tested
+	config.ReceiverRateLimit = RateLimit{}
+	context := newGlobalContext(config)
+
+	recordExpiredShareCode(context, [5]byte{3})
+
+	if w := getStatus(context, [5]byte{3}, ""); w.Code != http.StatusGone {
+		t.Errorf("Status of an expired share should respond %v not %v", http.StatusGone, w.Code)
+	}
+
+	for i := 1; i < config.MaxFailedLookups; i++ {
+		if w := getStatus(context, [5]byte{4, byte(i)}, ""); w.Code != http.StatusNotFound {
+			t.Fatalf("Status of an unknown share should respond %v not %v", http.StatusNotFound, w.Code)
+		}
+	}
+
+	if w := getStatus(context, [5]byte{4}, ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Client past the failed lookup limit should be refused with %v not %v", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestShareStatusRateLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.ReceiverRateLimit = RateLimit{Rate: 0.01, Burst: 2}
+	context := newGlobalContext(config)
+
+	share := &Share{shareCode: [5]byte{1}, state: stateAwaitingReceiver}
+	context.activeShares[share.shareCode] = share
+
+	for i := range config.ReceiverRateLimit.Burst {
+		if w := getStatus(context, share.shareCode, ""); w.Code != http.StatusOK {
+			t.Fatalf("Status request %v within the burst should respond %v not %v", i, http.StatusOK, w.Code)
+		}
+	}
+
+	if w := getStatus(context, share.shareCode, ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status request past the burst should be refused with %v not %v", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestShareStatusStream(t *testing.T) {
+	context := newGlobalContext(DefaultConfig())
+
+	share := &Share{shareCode: [5]byte{1}, state: stateClosing}
+	context.activeShares[share.shareCode] = share
+
+	done := make(chan *httptest.ResponseRecorder)
+
+	go func() {
+		done <- getStatus(context, share.shareCode, "text/event-stream")
+	}()
+
+	enterState(share, context, stateDone)
+	w := <-done
+
+	if content := w.Header().Get("Content-Type"); content != "text/event-stream" {
+		t.Errorf("Status stream should be sent as text/event-stream not %q", content)
+	}
+
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	last := events[len(events)-1]
+
+	if !strings.HasPrefix(last, "event: status\ndata: ") || !strings.Contains(last, `"state":"Done"`) {
+		t.Errorf("Status stream should end once the share is done, last event is %q", last)
+	}
+}
+
+func TestRecordAcknowledged(t *testing.T) {
+	progress := &transferProgress{inFlight: []int{10, 20, 30}}
+
+	recordAcknowledged(progress, 2)
+
+	if progress.acknowledged != 2 || progress.bytesAcknowledged != 30 || len(progress.inFlight) != 1 {
+		t.Errorf("Acknowledging 2 chunks should count their 30 bytes, progress is %+v", progress)
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import "github.com/billyedmoore/tube/internal/protocol"
+
+// Protocol versions the relay can serve, the version of a share is the highest
+// version supported by the sender, receiver and relay
+const (
+	lowestSupportedVersion  = protocol.LowestVersion
+	highestSupportedVersion = protocol.HighestVersion
+)
+
+var relayVersions = protocol.VersionRange{Lowest: lowestSupportedVersion, Highest: highestSupportedVersion}
+
+// Version of an ERROR sent to a peer before a version has been negotiated
+func errorVersionFor(peerVersions protocol.VersionRange) uint8 {
+	return min(peerVersions.Highest, highestSupportedVersion)
+}
+
+// Most unacknowledged chunks the relay will let a sender have in flight,
+// shares before version 2 are stop-and-wait (a window of 1)
+const maxWindowSize uint16 = 256
+
+func negotiateWindowSize(version uint8, requestedWindowSize uint16) uint16 {
+	if version < 2 {
+		return 1
+	}
+	return min(requestedWindowSize, maxWindowSize)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+)
+
+func versionRange(lowest uint8, highest uint8) protocol.VersionRange {
+	return protocol.VersionRange{Lowest: lowest, Highest: highest}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	cases := []struct {
+		sender     protocol.VersionRange
+		receiver   protocol.VersionRange
+		negotiated uint8
+		ok         bool
+	}{
+		{versionRange(0, 0), versionRange(0, 0), 0, true},
+		{versionRange(0, 1), versionRange(0, 0), 0, true},
+		{versionRange(0, 1), versionRange(0, 1), 1, true},
+		{versionRange(0, 1), versionRange(1, 7), 1, true},
+		{versionRange(0, 200), versionRange(1, 200), highestSupportedVersion, true},
+		{versionRange(1, 1), versionRange(0, 0), 0, false},
+		{versionRange(highestSupportedVersion+1, 200), versionRange(0, 200), 0, false},
+	}
+
+	for _, c := range cases {
+		versions, ok := c.sender.Intersect(relayVersions)
+
+		if ok {
+			versions, ok = versions.Intersect(c.receiver)
+		}
+
+		if ok != c.ok {
+			t.Errorf("Negotiation of sender %v and receiver %v should succeed=%v", c.sender, c.receiver, c.ok)
+			continue
+		}
+
+		if ok && versions.Highest != c.negotiated {
+			t.Errorf("Sender %v and receiver %v should negotiate %v not %v",
+				c.sender, c.receiver, c.negotiated, versions.Highest)
+		}
+	}
+}
+
+func TestWindowSizeNegotiation(t *testing.T) {
+	cases := []struct {
+		version   uint8
+		requested uint16
+		wanted    uint16
+	}{
+		{0, 64, 1},
+		{1, 64, 1},
+		{2, 64, 64},
+		{2, 1, 1},
+		{2, maxWindowSize + 1, maxWindowSize},
+	}
+
+	for _, c := range cases {
+		windowSize := negotiateWindowSize(c.version, c.requested)
+
+		if windowSize != c.wanted {
+			t.Errorf("Version %v with requested window %v should negotiate %v not %v",
+				c.version, c.requested, c.wanted, windowSize)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+// Package sharecode converts between the 5 bytes identifying a share and the
+// text users see. The relay generates and parses codes with it, clients parse a
+// code's text to get the bytes PAKE and short authentication strings are bound to.
+package sharecode
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/wordlist"
+)
+
+// Generates share codes and converts between the 5 bytes identifying a share and
+// the text shown to the sender and typed in by the receiver. For every generated
+// code Parse(Format(code)) must return the code.
+type Generator interface {
+	// Generate a new random share code
+	Generate() ([protocol.ShareCodeLength]byte, error)
+	// Text for a share code, sent to the sender in SENDER_ACCEPTED from version 6
+	Format(shareCode [protocol.ShareCodeLength]byte) string
+	// Share code for the text given by a receiver, fails if the text isn't a
+	// valid code (for example the check digit doesn't match) without a lookup
+	Parse(text string) ([protocol.ShareCodeLength]byte, error)
+}
+
+// Codes as 5 random bytes in standard base64, the format used before version 6
+// and understood by every client. There is no check digit.
+type Base64 struct{}
+
+func (Base64) Generate() ([protocol.ShareCodeLength]byte, error) {
+	var shareCode [protocol.ShareCodeLength]byte
+
+	_, err := rand.Read(shareCode[:])
+
+	if err != nil {
+		return shareCode, fmt.Errorf("Random bytes failed")
+	}
+
+	return shareCode, nil
+}
+
+func (Base64) Format(shareCode [protocol.ShareCodeLength]byte) string {
+	return base64.StdEncoding.EncodeToString(shareCode[:])
+}
+
+func (Base64) Parse(text string) ([protocol.ShareCodeLength]byte, error) {
+	var shareCode [protocol.ShareCodeLength]byte
+
+	// a "+" that wasn't escaped in the query string arrives as a space
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(text, " ", "+"))
+
+	if err != nil || len(decoded) != protocol.ShareCodeLength {
+		return shareCode, fmt.Errorf("Provided share code could not be decoded.")
+	}
+
+	copy(shareCode[:], decoded)
+
+	return shareCode, nil
+}
+
+// Codes as 8 Crockford base32 symbols (40 bits) and a check symbol, for example
+// "3V8K-2MQX-G". Parsing ignores case and hyphens and reads I and L as 1 and O as 0.
+type Crockford struct{}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (Crockford) Generate() ([protocol.ShareCodeLength]byte, error) {
+	return Base64{}.Generate()
+}
+
+func (Crockford) Format(shareCode [protocol.ShareCodeLength]byte) string {
+	value := uint64(shareCode[0])<<32 | uint64(binary.BigEndian.Uint32(shareCode[1:]))
+
+	symbols := make([]int, 8)
+	for i := range symbols {
+		symbols[i] = int(value>>(5*(7-i))) & 0x1F
+	}
+	symbols = append(symbols, base32Check(symbols))
+
+	var text strings.Builder
+	for i, symbol := range symbols {
+		if i == 4 || i == 8 {
+			text.WriteByte('-')
+		}
+		text.WriteByte(crockfordAlphabet[symbol])
+	}
+
+	return text.String()
+}
+
+func (Crockford) Parse(text string) ([protocol.ShareCodeLength]byte, error) {
+	var shareCode [protocol.ShareCodeLength]byte
+
+	normalised := strings.NewReplacer("-", "", " ", "", "I", "1", "L", "1", "O", "0").
+		Replace(strings.ToUpper(text))
+
+	if len(normalised) != 9 {
+		return shareCode, fmt.Errorf("Share code should be 9 symbols is %v.", len(normalised))
+	}
+
+	symbols := make([]int, len(normalised))
+	for i := range normalised {
+		symbols[i] = strings.IndexByte(crockfordAlphabet, normalised[i])
+
+		if symbols[i] < 0 {
+			return shareCode, fmt.Errorf("Share code contains invalid symbol %q.", normalised[i])
+		}
+	}
+
+	if base32Check(symbols[:8]) != symbols[8] {
+		return shareCode, fmt.Errorf("Share code check symbol does not match, check the code for typos.")
+	}
+
+	var value uint64
+	for _, symbol := range symbols[:8] {
+		value = value<<5 | uint64(symbol)
+	}
+
+	shareCode[0] = byte(value >> 32)
+	binary.BigEndian.PutUint32(shareCode[1:], uint32(value))
+
+	return shareCode, nil
+}
+
+// Codes as 12 random digits (39.9 bits) and a check digit, for example
+// "123-456-789-0123". The digits are stored as a little endian number in the
+// 5 bytes of the share code.
+type Numeric struct{}
+
+const (
+	numericDigits     = 12
+	numericShareCodes = 1_000_000_000_000
+)
+
+func (Numeric) Generate() ([protocol.ShareCodeLength]byte, error) {
+	var shareCode [protocol.ShareCodeLength]byte
+
+	value, err := randomBelow(numericShareCodes)
+
+	if err != nil {
+		return shareCode, err
+	}
+
+	putNumericValue(&shareCode, value)
+
+	return shareCode, nil
+}
+
+func (Numeric) Format(shareCode [protocol.ShareCodeLength]byte) string {
+	digits := fmt.Sprintf("%0*d", numericDigits, numericValue(shareCode))
+	check := dammCheck(decimalDigits(digits))
+
+	return fmt.Sprintf("%s-%s-%s-%s%d", digits[:3], digits[3:6], digits[6:9], digits[9:], check)
+}
+
+func (Numeric) Parse(text string) ([protocol.ShareCodeLength]byte, error) {
+	var shareCode [protocol.ShareCodeLength]byte
+
+	normalised := strings.NewReplacer("-", "", " ", "").Replace(text)
+
+	if len(normalised) != numericDigits+1 || strings.Trim(normalised, "0123456789") != "" {
+		return shareCode, fmt.Errorf("Share code should be %v digits.", numericDigits+1)
+	}
+
+	digits := decimalDigits(normalised)
+
+	if dammCheck(digits[:numericDigits]) != digits[numericDigits] {
+		return shareCode, fmt.Errorf("Share code check digit does not match, check the code for typos.")
+	}
+
+	var value uint64
+	for _, digit := range digits[:numericDigits] {
+		value = value*10 + uint64(digit)
+	}
+
+	putNumericValue(&shareCode, value)
+
+	return shareCode, nil
+}
+
+func numericValue(shareCode [protocol.ShareCodeLength]byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(shareCode[:4])) | uint64(shareCode[4])<<32
+}
+
+func putNumericValue(shareCode *[protocol.ShareCodeLength]byte, value uint64) {
+	binary.LittleEndian.PutUint32(shareCode[:4], uint32(value))
+	shareCode[4] = byte(value >> 32)
+}
+
+// Codes as 5 words (40 bits) and a check word, for example
+// "acid-orbit-zinc-lemon-tiger-jam". Parsing ignores case and accepts spaces
+// between the words.
+type Words struct{}
+
+const wordsPerShareCode = protocol.ShareCodeLength
+
+func (Words) Generate() ([protocol.ShareCodeLength]byte, error) {
+	return Base64{}.Generate()
+}
+
+func (Words) Format(shareCode [protocol.ShareCodeLength]byte) string {
+	words := make([]string, 0, wordsPerShareCode+1)
+	for _, index := range shareCode {
+		words = append(words, wordlist.Words[index])
+	}
+	words = append(words, wordlist.Words[byteCheck(shareCode[:])])
+
+	return strings.Join(words, "-")
+}
+
+func (Words) Parse(text string) ([protocol.ShareCodeLength]byte, error) {
+	var shareCode [protocol.ShareCodeLength]byte
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return r == '-' || r == ' '
+	})
+
+	if len(words) != wordsPerShareCode+1 {
+		return shareCode, fmt.Errorf("Share code should be %v words.", wordsPerShareCode+1)
+	}
+
+	indices := make([]byte, len(words))
+	for i, word := range words {
+		index := wordlist.IndexOf(word)
+
+		if index < 0 {
+			return shareCode, fmt.Errorf("Share code contains unknown word %q.", word)
+		}
+
+		indices[i] = byte(index)
+	}
+
+	if byteCheck(indices[:wordsPerShareCode]) != indices[wordsPerShareCode] {
+		return shareCode, fmt.Errorf("Share code check word does not match, check the code for typos.")
+	}
+
+	copy(shareCode[:], indices)
+
+	return shareCode, nil
+}
+
+// Damm check digit, catches every single digit error and every transposition of adjacent digits
+func dammCheck(digits []int) int {
+	table := [10][10]int{
+		{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+		{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+		{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+		{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+		{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+		{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+		{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+		{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+		{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+		{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+	}
+
+	interim := 0
+	for _, digit := range digits {
+		interim = table[interim][digit]
+	}
+
+	return interim
+}
+
+// Check symbol for base32 symbols, the sum over GF(32) of each symbol multiplied by
+// a distinct weight. This catches every single symbol error and every transposition
+// of adjacent symbols (Luhn mod 32 misses swapping 0 and Z).
+func base32Check(symbols []int) int {
+	check := 0
+	weight := 1
+
+	for _, symbol := range symbols {
+		weight = gf32Multiply(weight, 2)
+		check ^= gf32Multiply(weight, symbol)
+	}
+
+	return check
+}
+
+// Check byte for bytes, the sum over GF(256) of each byte multiplied by a distinct
+// weight. Like base32Check this catches every single byte error (so every change
+// of one word of a word share code) and every transposition of adjacent bytes.
+func byteCheck(values []byte) byte {
+	var check byte
+	var weight byte = 1
+
+	for _, value := range values {
+		weight = gf256Multiply(weight, 2)
+		check ^= gf256Multiply(weight, value)
+	}
+
+	return check
+}
+
+// Multiply in GF(256) with the reducing polynomial x^8 + x^4 + x^3 + x + 1
+func gf256Multiply(a byte, b byte) byte {
+	var product byte
+
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		b >>= 1
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1B
+		}
+	}
+
+	return product
+}
+
+// Multiply in GF(32) with the reducing polynomial x^5 + x^2 + 1
+func gf32Multiply(a int, b int) int {
+	product := 0
+
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		b >>= 1
+		a <<= 1
+		if a&0x20 != 0 {
+			a ^= 0x25
+		}
+	}
+
+	return product
+}
+
+func decimalDigits(text string) []int {
+	digits := make([]int, len(text))
+	for i := range text {
+		digits[i] = int(text[i] - '0')
+	}
+	return digits
+}
+
+// Uniformly random number below limit, which must be at most 2^63
+func randomBelow(limit uint64) (uint64, error) {
+	randomBytes := make([]byte, 8)
+	// largest multiple of limit that fits, values above it are redrawn to avoid bias
+	bound := (1 << 63) / limit * limit
+
+	for {
+		_, err := rand.Read(randomBytes)
+
+		if err != nil {
+			return 0, fmt.Errorf("Random bytes failed")
+		}
+
+		value := binary.LittleEndian.Uint64(randomBytes) >> 1
+
+		if value < bound {
+			return value % limit, nil
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package sharecode
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/billyedmoore/tube/internal/protocol"
+	"github.com/billyedmoore/tube/internal/wordlist"
+)
+
+var shareCodeGenerators = map[string]Generator{
+	"base64":    Base64{},
+	"crockford": Crockford{},
+	"numeric":   Numeric{},
+	"word":      Words{},
+}
+
+func TestShareCodesRoundTrip(t *testing.T) {
+	for name, generator := range shareCodeGenerators {
+		for range 1000 {
+			shareCode, err := generator.Generate()
+
+			if err != nil {
+				t.Fatalf("%v failed to generate: %v", name, err)
+			}
+
+			text := generator.Format(shareCode)
+
+			if !protocol.IsValidShareCodeText(text) {
+				t.Fatalf("%v formatted %v as %q which isn't valid share code text", name, shareCode, text)
+			}
+
+			parsed, err := generator.Parse(text)
+
+			if err != nil {
+				t.Fatalf("%v failed to parse %q: %v", name, text, err)
+			}
+
+			if parsed != shareCode {
+				t.Fatalf("%v parsed %q as %v should be %v", name, text, parsed, shareCode)
+			}
+		}
+	}
+}
+
+// Every bit of the share code should vary between generated codes, a format
+// leaving bits unused is far easier to guess than the 40 bits of the others
+func TestShareCodesUseEveryBit(t *testing.T) {
+	for name, generator := range shareCodeGenerators {
+		var ones, zeros [protocol.ShareCodeLength]byte
+
+		for range 1000 {
+			shareCode, err := generator.Generate()
+
+			if err != nil {
+				t.Fatalf("%v failed to generate: %v", name, err)
+			}
+
+			for i, b := range shareCode {
+				ones[i] |= b
+				zeros[i] |= ^b
+			}
+		}
+
+		for i := range ones {
+			if ones[i] != 0xFF || zeros[i] != 0xFF {
+				t.Errorf("%v never varies bits %08b of byte %v", name, ^(ones[i] & zeros[i]), i)
+			}
+		}
+	}
+}
+
+func TestGoldenShareCodes(t *testing.T) {
+	vectors := []struct {
+		generator Generator
+		shareCode [protocol.ShareCodeLength]byte
+		text      string
+	}{
+		{Base64{}, [5]byte{0x01, 0x02, 0x03, 0x04, 0x05}, "AQIDBAU="},
+		{Crockford{}, [5]byte{0x00, 0x00, 0x00, 0x00, 0x00}, "0000-0000-0"},
+		{Crockford{}, [5]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, "ZZZZ-ZZZZ-3"},
+		{Numeric{}, [5]byte{0x14, 0x1A, 0x99, 0xBE, 0x1C}, "123-456-789-0123"},
+		{Words{}, [5]byte{wordIndex(t, "acid"), wordIndex(t, "orbit"), wordIndex(t, "zinc"), wordIndex(t, "lemon"), wordIndex(t, "tiger")}, "acid-orbit-zinc-lemon-tiger-jam"},
+	}
+
+	for _, vector := range vectors {
+		text := vector.generator.Format(vector.shareCode)
+
+		if vector.text != "" && text != vector.text {
+			t.Errorf("%v should format as %q is %q", vector.shareCode, vector.text, text)
+		}
+
+		parsed, err := vector.generator.Parse(text)
+
+		if err != nil || parsed != vector.shareCode {
+			t.Errorf("%q should parse as %v is %v (%v)", text, vector.shareCode, parsed, err)
+		}
+	}
+}
+
+func wordIndex(t *testing.T, word string) byte {
+	index := wordlist.IndexOf(word)
+
+	if index < 0 {
+		t.Fatalf("%q is not in the word list", word)
+	}
+
+	return byte(index)
+}
+
+func TestShareCodesAreForgiving(t *testing.T) {
+	parsable := []struct {
+		generator Generator
+		text      string
+	}{
+		{Base64{}, "  ++AQI="},
+		{Crockford{}, "zzzz zzzz 3"},
+		{Crockford{}, "oooo-oooo-o"},
+		{Numeric{}, "1234567890123"},
+		{Numeric{}, "123 456 789 0123"},
+		{Words{}, "ACID orbit zinc lemon tiger jam"},
+	}
+
+	for _, code := range parsable {
+		if _, err := code.generator.Parse(code.text); err != nil {
+			t.Errorf("%q should parse: %v", code.text, err)
+		}
+	}
+}
+
+func TestShareCodeCheckDigitsCatchTypos(t *testing.T) {
+	for name, generator := range shareCodeGenerators {
+		if name == "base64" {
+			continue
+		}
+
+		for range 100 {
+			shareCode, err := generator.Generate()
+
+			if err != nil {
+				t.Fatalf("%v failed to generate: %v", name, err)
+			}
+
+			text := generator.Format(shareCode)
+
+			for _, typo := range typos(name, text) {
+				if _, err := generator.Parse(typo); err == nil {
+					t.Errorf("%v typo %q of %q should not parse", name, typo, text)
+				}
+			}
+		}
+	}
+}
+
+// Every code with one symbol changed or two adjacent symbols swapped, skipping
+// changes the format treats as the same symbol
+func typos(name string, text string) []string {
+	var alphabet string
+	var fields []string
+
+	switch name {
+	case "crockford":
+		alphabet = crockfordAlphabet
+		fields = []string{strings.ReplaceAll(text, "-", "")}
+	case "numeric":
+		alphabet = "0123456789"
+		fields = []string{strings.ReplaceAll(text, "-", "")}
+	case "word":
+		// a typo in a word gives an unknown word or another word, every change of
+		// word is checked
+		words := strings.Split(text, "-")
+		var typos []string
+		for i := range words {
+			for _, word := range wordlist.Words {
+				if word != words[i] {
+					changed := slices.Clone(words)
+					changed[i] = word
+					typos = append(typos, strings.Join(changed, "-"))
+				}
+			}
+			// the check word swapped with the last word isn't always caught
+			if i+2 < len(words) && words[i] != words[i+1] {
+				changed := slices.Clone(words)
+				changed[i], changed[i+1] = words[i+1], words[i]
+				typos = append(typos, strings.Join(changed, "-"))
+			}
+		}
+		return typos
+	}
+
+	var typos []string
+	for _, field := range fields {
+		for i := range len(field) {
+			for j := range len(alphabet) {
+				if alphabet[j] != field[i] {
+					typos = append(typos, field[:i]+string(alphabet[j])+field[i+1:])
+				}
+			}
+			if i+1 < len(field) && field[i] != field[i+1] {
+				typos = append(typos, field[:i]+string(field[i+1])+string(field[i])+field[i+2:])
+			}
+		}
+	}
+	return typos
+}
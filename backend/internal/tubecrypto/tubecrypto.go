@@ -0,0 +1,553 @@
+// Package tubecrypto implements version 1 of the tube payload format, see
+// documentation/Encryption.md. A random AES-256-GCM content key is wrapped once
+// with the receiver's RSA-OAEP key, or agreed with the receiver's P-256 or X25519
+// ECDH key, and every chunk is sealed with a nonce bound to its file index and
+// chunk number. Everything is compatible with WebCrypto so Go clients can share
+// files with the browser client.
+package tubecrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// Version of the payload format implemented by this package
+const FormatVersion = 1
+
+const (
+	// RSA modulus length of receiver keys in bits, as the 512 byte public key of RECEIVER_INITIATION
+	RSAKeyBits = 4096
+	// Length of a public key as sent in RECEIVER_INITIATION, the big endian modulus
+	PublicKeyLength = RSAKeyBits / 8
+	// Length of a content key wrapped with RSA-OAEP
+	WrappedKeyLength = RSAKeyBits / 8
+	// Length of an AES-256-GCM content key
+	ContentKeyLength = 32
+	// Bytes added to each sealed chunk (the GCM tag)
+	Overhead = 16
+	// Plaintext bytes per chunk senders should use, the last chunk of a file may be shorter
+	ChunkSize = 64 * 1024
+)
+
+// Every receiver key uses the WebCrypto default public exponent
+const publicExponent = 65537
+
+// Kinds of sealed values, part of the nonce so a chunk can't be passed off as metadata
+const (
+	kindDataChunk = 0x00
+	kindMetadata  = 0x01
+	kindEnd       = 0x02
+)
+
+// Generate a receiver key pair
+func GenerateKeyPair() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, RSAKeyBits)
+}
+
+// The public key as sent in RECEIVER_INITIATION
+func EncodePublicKey(publicKey *rsa.PublicKey) ([]byte, error) {
+	if publicKey.E != publicExponent || publicKey.N.BitLen() != RSAKeyBits {
+		return nil, fmt.Errorf("Public key must be %v bits with exponent %v.", RSAKeyBits, publicExponent)
+	}
+
+	return publicKey.N.FillBytes(make([]byte, PublicKeyLength)), nil
+}
+
+// The public key from RECEIVER_INITIATION or READY
+func DecodePublicKey(encoded []byte) (*rsa.PublicKey, error) {
+	if len(encoded) != PublicKeyLength {
+		return nil, fmt.Errorf("Public key should be %v bytes is %v.", PublicKeyLength, len(encoded))
+	}
+
+	modulus := new(big.Int).SetBytes(encoded)
+
+	if modulus.BitLen() != RSAKeyBits || modulus.Bit(0) == 0 {
+		return nil, fmt.Errorf("Public key is not a %v bit RSA modulus.", RSAKeyBits)
+	}
+
+	return &rsa.PublicKey{N: modulus, E: publicExponent}, nil
+}
+
+// Type of a receiver's public key, sent in RECEIVER_INITIATION from protocol version 10
+type KeyType uint8
+
+const (
+	KeyTypeRSA4096 KeyType = 0x00
+	KeyTypeP256    KeyType = 0x01
+	KeyTypeX25519  KeyType = 0x02
+)
+
+// Length of an encoded public key of the type, 0 for unknown types. ECDH keys
+// are encoded as WebCrypto's raw format, an uncompressed P-256 point or the 32
+// byte X25519 key.
+func (t KeyType) PublicKeyLength() int {
+	switch t {
+	case KeyTypeRSA4096:
+		return PublicKeyLength
+	case KeyTypeP256:
+		return 65
+	case KeyTypeX25519:
+		return 32
+	default:
+		return 0
+	}
+}
+
+func (t KeyType) curve() (ecdh.Curve, error) {
+	switch t {
+	case KeyTypeP256:
+		return ecdh.P256(), nil
+	case KeyTypeX25519:
+		return ecdh.X25519(), nil
+	default:
+		return nil, fmt.Errorf("Key type %#02x is not an ECDH key type.", uint8(t))
+	}
+}
+
+// Generate a receiver ECDH key pair, generating one is much faster than an RSA
+// key pair on slow devices. The public key is sent as publicKey.Bytes().
+func GenerateECDHKey(keyType KeyType) (*ecdh.PrivateKey, error) {
+	curve, err := keyType.curve()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return curve.GenerateKey(rand.Reader)
+}
+
+// The ECDH public key from RECEIVER_INITIATION or READY
+func DecodeECDHPublicKey(keyType KeyType, encoded []byte) (*ecdh.PublicKey, error) {
+	curve, err := keyType.curve()
+
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := curve.NewPublicKey(encoded)
+
+	if err != nil {
+		return nil, fmt.Errorf("Public key is not a valid key of type %#02x.", uint8(keyType))
+	}
+
+	return publicKey, nil
+}
+
+// Agree a content key with the receiver's ECDH public key using an ephemeral key
+// pair on the same curve, returns (content key, ephemeral public key for the key header)
+func AgreeContentKey(receiverKey *ecdh.PublicKey) ([]byte, []byte, error) {
+	ephemeralKey, err := receiverKey.Curve().GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Random bytes failed")
+	}
+
+	ephemeralPublicKey := ephemeralKey.PublicKey().Bytes()
+
+	contentKey, err := agreedContentKey(ephemeralKey, receiverKey, contentKeyInfo, ephemeralPublicKey, receiverKey.Bytes())
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return contentKey, ephemeralPublicKey, nil
+}
+
+// The content key agreed by the sender, from the sender's ephemeral public key in the key header
+func ReceiveContentKey(privateKey *ecdh.PrivateKey, ephemeralPublicKey []byte) ([]byte, error) {
+	peerKey, err := privateKey.Curve().NewPublicKey(ephemeralPublicKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("Ephemeral key is not a valid public key.")
+	}
+
+	return agreedContentKey(privateKey, peerKey, contentKeyInfo, ephemeralPublicKey, privateKey.PublicKey().Bytes())
+}
+
+// Labels of the keys agreed with ECDH, the start of the HKDF info
+const (
+	contentKeyInfo       = "tube content key v1 ecdh"
+	keyEncryptionKeyInfo = "tube key encryption key v1 ecdh"
+)
+
+// HKDF-SHA256 of the ECDH shared secret without a salt, both public keys are
+// bound into the info. The share code isn't used as receivers only know its text.
+func agreedContentKey(privateKey *ecdh.PrivateKey, peerKey *ecdh.PublicKey, label string, ephemeralPublicKey []byte,
+	receiverPublicKey []byte) ([]byte, error) {
+	secret, err := privateKey.ECDH(peerKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("Key agreement failed.")
+	}
+
+	info := label + string(ephemeralPublicKey) + string(receiverPublicKey)
+
+	return hkdf.Key(sha256.New, secret, nil, info, ContentKeyLength)
+}
+
+// Generate a random content key for a share
+func NewContentKey() ([]byte, error) {
+	key := make([]byte, ContentKeyLength)
+
+	_, err := rand.Read(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("Random bytes failed")
+	}
+
+	return key, nil
+}
+
+// Wrap the content key with the receiver's public key using RSA-OAEP with SHA-512
+// (for both the hash and MGF1) and no label, as WebCrypto does
+func WrapContentKey(publicKey *rsa.PublicKey, contentKey []byte) ([]byte, error) {
+	if len(contentKey) != ContentKeyLength {
+		return nil, fmt.Errorf("Content key should be %v bytes is %v.", ContentKeyLength, len(contentKey))
+	}
+
+	return rsa.EncryptOAEP(sha512.New(), rand.Reader, publicKey, contentKey, nil)
+}
+
+func UnwrapContentKey(privateKey *rsa.PrivateKey, wrappedKey []byte) ([]byte, error) {
+	contentKey, err := rsa.DecryptOAEP(sha512.New(), nil, privateKey, wrappedKey, nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unwrap content key.")
+	}
+
+	if len(contentKey) != ContentKeyLength {
+		return nil, fmt.Errorf("Content key should be %v bytes is %v.", ContentKeyLength, len(contentKey))
+	}
+
+	return contentKey, nil
+}
+
+// Length of a content key sealed for an ECDH receiver of a broadcast share, after the ephemeral public key
+const SealedKeyLength = ContentKeyLength + Overhead
+
+// Seal the content key of a broadcast share for a receiver's ECDH public key, returns
+// the ephemeral public key followed by the content key sealed with AES-256-GCM under
+// a key encryption key agreed like a content key. Each key encryption key seals one
+// content key so the nonce is all zeros.
+func SealContentKey(receiverKey *ecdh.PublicKey, contentKey []byte) ([]byte, error) {
+	if len(contentKey) != ContentKeyLength {
+		return nil, fmt.Errorf("Content key should be %v bytes is %v.", ContentKeyLength, len(contentKey))
+	}
+
+	ephemeralKey, err := receiverKey.Curve().GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, fmt.Errorf("Random bytes failed")
+	}
+
+	ephemeralPublicKey := ephemeralKey.PublicKey().Bytes()
+
+	keyEncryptionKey, err := agreedContentKey(ephemeralKey, receiverKey, keyEncryptionKeyInfo, ephemeralPublicKey, receiverKey.Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyCipher, err := NewCipher(keyEncryptionKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keyCipher.aead.Seal(ephemeralPublicKey, make([]byte, 12), contentKey, additionalData), nil
+}
+
+// Open a content key sealed with SealContentKey, fails if it was sealed for another receiver
+func OpenContentKey(privateKey *ecdh.PrivateKey, sealed []byte) ([]byte, error) {
+	ephemeralLength := len(privateKey.PublicKey().Bytes())
+
+	if len(sealed) != ephemeralLength+SealedKeyLength {
+		return nil, fmt.Errorf("Sealed key should be %v bytes is %v.", ephemeralLength+SealedKeyLength, len(sealed))
+	}
+
+	ephemeralPublicKey := sealed[:ephemeralLength]
+	peerKey, err := privateKey.Curve().NewPublicKey(ephemeralPublicKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("Ephemeral key is not a valid public key.")
+	}
+
+	keyEncryptionKey, err := agreedContentKey(privateKey, peerKey, keyEncryptionKeyInfo, ephemeralPublicKey,
+		privateKey.PublicKey().Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyCipher, err := NewCipher(keyEncryptionKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	contentKey, err := keyCipher.aead.Open(nil, make([]byte, 12), sealed[ephemeralLength:], additionalData)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open sealed content key.")
+	}
+
+	return contentKey, nil
+}
+
+// Derive the content key from a secret the peers agreed without the relay,
+// for example the SPAKE2 key of a share using PAKE key agreement
+func DeriveContentKey(secret []byte, shareCode []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, secret, shareCode, "tube content key v1", ContentKeyLength)
+}
+
+// How the receiver gets the content key, the second byte of the key header
+const (
+	KeyWrapped uint8 = 0x00
+	KeyDerived uint8 = 0x01
+	KeyAgreed  uint8 = 0x02
+	// From protocol version 13, the content key of a broadcast share wrapped or sealed for each receiver
+	KeyBroadcast uint8 = 0x03
+)
+
+// Entries of a KeyBroadcast key header, one per receiver in the order of
+// BROADCAST_READY. Each is the content key wrapped with WrapContentKey for an
+// RSA receiver or sealed with SealContentKey for an ECDH receiver.
+func EncodeKeyEntries(entries [][]byte) ([]byte, error) {
+	if len(entries) == 0 || len(entries) > 255 {
+		return nil, fmt.Errorf("Key header should have between 1 and 255 entries has %v.", len(entries))
+	}
+
+	key := []byte{uint8(len(entries))}
+
+	for _, entry := range entries {
+		if len(entry) == 0 || len(entry) > 0xFFFF {
+			return nil, fmt.Errorf("Key entry should be between 1 and 65535 bytes is %v.", len(entry))
+		}
+
+		key = binary.BigEndian.AppendUint16(key, uint16(len(entry)))
+		key = append(key, entry...)
+	}
+
+	return key, nil
+}
+
+// Split the key of a KeyBroadcast key header into its entries, the receiver
+// tries each entry until one opens with its private key
+func DecodeKeyEntries(key []byte) ([][]byte, error) {
+	entries, _, err := splitKeyEntries(key)
+	return entries, err
+}
+
+// Returns (entries, bytes of key they take up, error)
+func splitKeyEntries(key []byte) ([][]byte, int, error) {
+	if len(key) < 1 || key[0] == 0 {
+		return nil, 0, fmt.Errorf("Key header has no entries.")
+	}
+
+	entries := make([][]byte, key[0])
+	offset := 1
+
+	for i := range entries {
+		if len(key) < offset+2 {
+			return nil, 0, fmt.Errorf("Key header is incomplete.")
+		}
+
+		length := int(binary.BigEndian.Uint16(key[offset:]))
+		offset += 2
+
+		if length == 0 || len(key) < offset+length {
+			return nil, 0, fmt.Errorf("Key header is incomplete.")
+		}
+
+		entries[i] = key[offset : offset+length]
+		offset += length
+	}
+
+	return entries, offset, nil
+}
+
+// The key header sent before the sealed path of the first file of the MANIFEST,
+// format version || key mode || key. The key is the wrapped key for KeyWrapped,
+// the length (1 byte) and ephemeral public key for KeyAgreed, the entries from
+// EncodeKeyEntries for KeyBroadcast and empty for KeyDerived.
+func EncodeKeyHeader(mode uint8, key []byte) ([]byte, error) {
+	if mode == KeyBroadcast {
+		_, length, err := splitKeyEntries(key)
+
+		if err != nil || length != len(key) {
+			return nil, fmt.Errorf("Broadcast key should be encoded with EncodeKeyEntries.")
+		}
+
+		return append([]byte{FormatVersion, mode}, key...), nil
+	}
+
+	switch {
+	case mode == KeyWrapped && len(key) != WrappedKeyLength:
+		return nil, fmt.Errorf("Wrapped key should be %v bytes is %v.", WrappedKeyLength, len(key))
+	case mode == KeyDerived && len(key) != 0:
+		return nil, fmt.Errorf("Derived keys aren't sent.")
+	case mode == KeyAgreed && (len(key) == 0 || len(key) > 255):
+		return nil, fmt.Errorf("Ephemeral key should be between 1 and 255 bytes is %v.", len(key))
+	case mode != KeyWrapped && mode != KeyDerived && mode != KeyAgreed && mode != KeyBroadcast:
+		return nil, fmt.Errorf("Unknown key mode %#02x.", mode)
+	}
+
+	header := []byte{FormatVersion, mode}
+
+	if mode == KeyAgreed {
+		header = append(header, uint8(len(key)))
+	}
+
+	return append(header, key...), nil
+}
+
+// Split the key header from the start of a field, returns (key mode, wrapped or
+// ephemeral public key, rest of the field, error)
+func DecodeKeyHeader(field []byte) (uint8, []byte, []byte, error) {
+	if len(field) < 2 {
+		return 0, nil, nil, fmt.Errorf("Key header is incomplete.")
+	}
+
+	if field[0] != FormatVersion {
+		return 0, nil, nil, fmt.Errorf("Payload format version %v is not supported.", field[0])
+	}
+
+	switch field[1] {
+	case KeyWrapped:
+		if len(field[2:]) < WrappedKeyLength {
+			return 0, nil, nil, fmt.Errorf("Key header is incomplete.")
+		}
+		return KeyWrapped, field[2 : 2+WrappedKeyLength], field[2+WrappedKeyLength:], nil
+	case KeyDerived:
+		return KeyDerived, nil, field[2:], nil
+	case KeyAgreed:
+		if len(field) < 3 || field[2] == 0 || len(field[3:]) < int(field[2]) {
+			return 0, nil, nil, fmt.Errorf("Key header is incomplete.")
+		}
+		end := 3 + int(field[2])
+		return KeyAgreed, field[3:end], field[end:], nil
+	case KeyBroadcast:
+		_, length, err := splitKeyEntries(field[2:])
+
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		return KeyBroadcast, field[2 : 2+length], field[2+length:], nil
+	default:
+		return 0, nil, nil, fmt.Errorf("Unknown key mode %#02x.", field[1])
+	}
+}
+
+// Seals and opens the chunks and metadata of one share
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+func NewCipher(contentKey []byte) (*Cipher, error) {
+	if len(contentKey) != ContentKeyLength {
+		return nil, fmt.Errorf("Content key should be %v bytes is %v.", ContentKeyLength, len(contentKey))
+	}
+
+	block, err := aes.NewCipher(contentKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead}, nil
+}
+
+// The 12 byte nonce of a sealed value, kind || final || file index || number || 4 zero bytes
+// (all big endian). Each content key seals one share so a nonce is never reused
+// for different plaintext.
+func nonce(kind byte, final bool, fileIndex uint16, number uint32) []byte {
+	nonce := make([]byte, 12)
+	nonce[0] = kind
+	if final {
+		nonce[1] = 0x01
+	}
+	binary.BigEndian.PutUint16(nonce[2:4], fileIndex)
+	binary.BigEndian.PutUint32(nonce[4:8], number)
+	return nonce
+}
+
+// Additional data of every sealed value, the format version
+var additionalData = []byte{FormatVersion}
+
+// Seal the payload of a DATA_CHUNK, final is true for the last chunk of the share
+// so a receiver can tell a share that was cut short
+func (c *Cipher) SealChunk(fileIndex uint16, chunkNumber uint32, final bool, plaintext []byte) []byte {
+	return c.aead.Seal(nil, nonce(kindDataChunk, final, fileIndex, chunkNumber), plaintext, additionalData)
+}
+
+// Open the payload of a DATA_CHUNK, fails if it was modified, moved to another
+// chunk number or file or its final flag doesn't match
+func (c *Cipher) OpenChunk(fileIndex uint16, chunkNumber uint32, final bool, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.aead.Open(nil, nonce(kindDataChunk, final, fileIndex, chunkNumber), ciphertext, additionalData)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open chunk %v of file %v.", chunkNumber, fileIndex)
+	}
+
+	return plaintext, nil
+}
+
+// Seal an encrypted field of METADATA or MANIFEST, field numbers the fields of a file
+// (0 for the file name or path)
+func (c *Cipher) SealMetadata(fileIndex uint16, field uint32, plaintext []byte) []byte {
+	return c.aead.Seal(nil, nonce(kindMetadata, false, fileIndex, field), plaintext, additionalData)
+}
+
+func (c *Cipher) OpenMetadata(fileIndex uint16, field uint32, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.aead.Open(nil, nonce(kindMetadata, false, fileIndex, field), ciphertext, additionalData)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open field %v of file %v.", field, fileIndex)
+	}
+
+	return plaintext, nil
+}
+
+// Hash of the plaintext of every chunk of a share in order, sealed in END from protocol version 11
+func NewDigest() hash.Hash {
+	return sha256.New()
+}
+
+// Seal the digest of the share for END, bound to the number of chunks so the relay
+// can't cut a streamed share short
+func (c *Cipher) SealEnd(numberOfChunks uint32, digest []byte) []byte {
+	return c.aead.Seal(nil, nonce(kindEnd, true, 0, numberOfChunks), digest, additionalData)
+}
+
+// Open the digest from END and check it matches the digest of the chunks received
+func (c *Cipher) OpenEnd(numberOfChunks uint32, sealed []byte, digest []byte) error {
+	sent, err := c.aead.Open(nil, nonce(kindEnd, true, 0, numberOfChunks), sealed, additionalData)
+
+	if err != nil {
+		return fmt.Errorf("Failed to open the digest of %v chunks.", numberOfChunks)
+	}
+
+	if subtle.ConstantTimeCompare(sent, digest) != 1 {
+		return fmt.Errorf("Digest of the chunks received doesn't match the digest sent.")
+	}
+
+	return nil
+}
@@ -0,0 +1,415 @@
+package tubecrypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var goldenContentKey = func() []byte {
+	key := make([]byte, ContentKeyLength)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}()
+
+// Generating a 4096 bit key is slow so the tests share one
+var testKey = sync.OnceValues(GenerateKeyPair)
+
+// Sealed with WebCrypto (AES-GCM, iv 00 01 0001 00000003 00000000, additionalData 01)
+// and checked against this package
+func TestGoldenChunk(t *testing.T) {
+	c, err := NewCipher(goldenContentKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted, _ := hex.DecodeString("89a5d0985321d4dada1ec38ffacdc2ae3a6ab679943cc9412ad9523b")
+	sealed := c.SealChunk(1, 3, true, []byte("Hello World!"))
+
+	if !bytes.Equal(sealed, wanted) {
+		t.Errorf("Sealed chunk should be %x is %x", wanted, sealed)
+	}
+
+	plaintext, err := c.OpenChunk(1, 3, true, wanted)
+
+	if err != nil || string(plaintext) != "Hello World!" {
+		t.Errorf("Opened chunk should be %q is %q (%v)", "Hello World!", plaintext, err)
+	}
+}
+
+func TestOpenChunkRejectsMovedChunks(t *testing.T) {
+	c, _ := NewCipher(goldenContentKey)
+	sealed := c.SealChunk(1, 3, false, []byte("Hello World!"))
+
+	cases := []struct {
+		name        string
+		fileIndex   uint16
+		chunkNumber uint32
+		final       bool
+		ciphertext  []byte
+	}{
+		{"other chunk number", 1, 4, false, sealed},
+		{"other file", 0, 3, false, sealed},
+		{"marked final", 1, 3, true, sealed},
+		{"modified", 1, 3, false, append([]byte{sealed[0] ^ 0x01}, sealed[1:]...)},
+		{"truncated", 1, 3, false, sealed[:len(sealed)-1]},
+	}
+
+	for _, c2 := range cases {
+		if _, err := c.OpenChunk(c2.fileIndex, c2.chunkNumber, c2.final, c2.ciphertext); err == nil {
+			t.Errorf("Opening a chunk with %v should fail", c2.name)
+		}
+	}
+
+	// metadata fields use different nonces to chunks with the same numbers
+	if _, err := c.OpenMetadata(1, 3, sealed); err == nil {
+		t.Errorf("A chunk should not open as metadata")
+	}
+}
+
+func TestOpenEnd(t *testing.T) {
+	c, _ := NewCipher(goldenContentKey)
+
+	digest := NewDigest()
+	digest.Write([]byte("Hello World!"))
+	sealed := c.SealEnd(3, digest.Sum(nil))
+
+	if err := c.OpenEnd(3, sealed, digest.Sum(nil)); err != nil {
+		t.Errorf("Digest should open: %v", err)
+	}
+
+	if err := c.OpenEnd(2, sealed, digest.Sum(nil)); err == nil {
+		t.Errorf("Digest should not open with another number of chunks")
+	}
+
+	other := NewDigest()
+	other.Write([]byte("Hello"))
+
+	if err := c.OpenEnd(3, sealed, other.Sum(nil)); err == nil {
+		t.Errorf("Digest of other chunks should not match")
+	}
+}
+
+func TestWrapContentKey(t *testing.T) {
+	privateKey, err := testKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := EncodePublicKey(&privateKey.PublicKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := DecodePublicKey(encoded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := WrapContentKey(publicKey, goldenContentKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := EncodeKeyHeader(KeyWrapped, wrapped)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mode, headerKey, rest, err := DecodeKeyHeader(append(header, 0xAA))
+
+	if err != nil || mode != KeyWrapped || !bytes.Equal(headerKey, wrapped) || !bytes.Equal(rest, []byte{0xAA}) {
+		t.Fatalf("Key header decoded to (%v, %x, %x, %v)", mode, headerKey, rest, err)
+	}
+
+	contentKey, err := UnwrapContentKey(privateKey, headerKey)
+
+	if err != nil || !bytes.Equal(contentKey, goldenContentKey) {
+		t.Errorf("Unwrapped key should be %x is %x (%v)", goldenContentKey, contentKey, err)
+	}
+
+	wrapped[len(wrapped)-1] ^= 0x01
+
+	if _, err := UnwrapContentKey(privateKey, wrapped); err == nil {
+		t.Errorf("Unwrapping a modified key should fail")
+	}
+}
+
+// testdata holds a key pair generated by WebCrypto (RSA-OAEP, 4096 bits, SHA-512)
+// and the golden content key wrapped by WebCrypto with it
+func TestUnwrapWebCryptoKey(t *testing.T) {
+	pemBytes, err := os.ReadFile("testdata/webcrypto_key.pem")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey := parsed.(*rsa.PrivateKey)
+
+	wrappedHex, err := os.ReadFile("testdata/webcrypto_wrapped_key.hex")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := hex.DecodeString(strings.TrimSpace(string(wrappedHex)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contentKey, err := UnwrapContentKey(privateKey, wrapped)
+
+	if err != nil || !bytes.Equal(contentKey, goldenContentKey) {
+		t.Errorf("Unwrapped key should be %x is %x (%v)", goldenContentKey, contentKey, err)
+	}
+
+	if _, err := EncodePublicKey(&privateKey.PublicKey); err != nil {
+		t.Errorf("WebCrypto public key should encode: %v", err)
+	}
+}
+
+func TestAgreeContentKey(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeP256, KeyTypeX25519} {
+		privateKey, err := GenerateECDHKey(keyType)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := privateKey.PublicKey().Bytes()
+
+		if len(encoded) != keyType.PublicKeyLength() {
+			t.Fatalf("Public key should be %v bytes is %v", keyType.PublicKeyLength(), len(encoded))
+		}
+
+		publicKey, err := DecodeECDHPublicKey(keyType, encoded)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contentKey, ephemeralPublicKey, err := AgreeContentKey(publicKey)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, err := EncodeKeyHeader(KeyAgreed, ephemeralPublicKey)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mode, sentKey, rest, err := DecodeKeyHeader(append(header, 0xAA))
+
+		if err != nil || mode != KeyAgreed || !bytes.Equal(rest, []byte{0xAA}) {
+			t.Fatalf("Decoded header (%v, %x, %v) should be (%v, %x, nil)", mode, rest, err, KeyAgreed, []byte{0xAA})
+		}
+
+		received, err := ReceiveContentKey(privateKey, sentKey)
+
+		if err != nil || !bytes.Equal(received, contentKey) {
+			t.Errorf("Key type %v: received key %x should be %x (%v)", keyType, received, contentKey, err)
+		}
+
+		otherKey, err := GenerateECDHKey(keyType)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received, err = ReceiveContentKey(otherKey, sentKey)
+
+		if err != nil || bytes.Equal(received, contentKey) {
+			t.Errorf("Key type %v: another receiver key should agree a different content key", keyType)
+		}
+	}
+}
+
+func TestBroadcastKeyHeader(t *testing.T) {
+	contentKey, err := NewContentKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var receivers []*ecdh.PrivateKey
+	var entries [][]byte
+
+	for _, keyType := range []KeyType{KeyTypeX25519, KeyTypeP256, KeyTypeX25519} {
+		privateKey, err := GenerateECDHKey(keyType)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sealed, err := SealContentKey(privateKey.PublicKey(), contentKey)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receivers = append(receivers, privateKey)
+		entries = append(entries, sealed)
+	}
+
+	key, err := EncodeKeyEntries(entries)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := EncodeKeyHeader(KeyBroadcast, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mode, sentKey, rest, err := DecodeKeyHeader(append(header, 0xAA))
+
+	if err != nil || mode != KeyBroadcast || !bytes.Equal(rest, []byte{0xAA}) {
+		t.Fatalf("Decoded header (%v, %x, %v) should be (%v, %x, nil)", mode, rest, err, KeyBroadcast, []byte{0xAA})
+	}
+
+	sentEntries, err := DecodeKeyEntries(sentKey)
+
+	if err != nil || len(sentEntries) != len(entries) {
+		t.Fatalf("Header should have %v entries has %v (%v)", len(entries), len(sentEntries), err)
+	}
+
+	// each receiver opens only its own entry
+	for i, privateKey := range receivers {
+		for j, entry := range sentEntries {
+			received, err := OpenContentKey(privateKey, entry)
+
+			if (i == j) != (err == nil) || (err == nil && !bytes.Equal(received, contentKey)) {
+				t.Errorf("Receiver %v opening entry %v: %x (%v)", i, j, received, err)
+			}
+		}
+	}
+}
+
+// Private keys generated by WebCrypto and the content key WebCrypto derived from them
+// (deriveBits with ECDH or X25519 then HKDF-SHA256 with an empty salt)
+func TestWebCryptoAgreedContentKey(t *testing.T) {
+	vectors := []struct {
+		keyType    KeyType
+		receiver   string
+		ephemeral  string
+		contentKey string
+	}{
+		{KeyTypeP256, "79357819b6115d0403e8f9f519d59d09cf8f6f6ed91e61a539ed1c31929f9dfd",
+			"d023b5c84b5815576eff8841847138c5093be06d8641ef4e0742e005a10c278f",
+			"0cc450bf03dfb50f7490b5e954bd98c16030ee8105ac6f914ef7f11124f2deb6"},
+		{KeyTypeX25519, "8038aaaf17c9bde0332562deee1f6d2059569782c7b20a18367ef20b526d2779",
+			"f07ccb975018f4bce5b1c839093793da7734a14e962db9e7855a8131be48837a",
+			"423e6884b5c83dab0d79c216ac074d84534729af4107174c6b77ae52642aaad9"},
+	}
+
+	for _, vector := range vectors {
+		curve, err := vector.keyType.curve()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiverKey, err := curve.NewPrivateKey(mustDecodeHex(t, vector.receiver))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ephemeralKey, err := curve.NewPrivateKey(mustDecodeHex(t, vector.ephemeral))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ephemeralPublicKey := ephemeralKey.PublicKey().Bytes()
+		wanted := mustDecodeHex(t, vector.contentKey)
+
+		sent, err := agreedContentKey(ephemeralKey, receiverKey.PublicKey(), contentKeyInfo, ephemeralPublicKey,
+			receiverKey.PublicKey().Bytes())
+
+		if err != nil || !bytes.Equal(sent, wanted) {
+			t.Errorf("Key type %v: sender's key %x should be %x (%v)", vector.keyType, sent, wanted, err)
+		}
+
+		received, err := ReceiveContentKey(receiverKey, ephemeralPublicKey)
+
+		if err != nil || !bytes.Equal(received, wanted) {
+			t.Errorf("Key type %v: receiver's key %x should be %x (%v)", vector.keyType, received, wanted, err)
+		}
+	}
+}
+
+func mustDecodeHex(t *testing.T, encoded string) []byte {
+	decoded, err := hex.DecodeString(encoded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+func TestDecodeECDHPublicKeyRejectsInvalidKeys(t *testing.T) {
+	invalid := []struct {
+		keyType KeyType
+		encoded []byte
+	}{
+		{KeyTypeRSA4096, bytes.Repeat([]byte{0xAB}, PublicKeyLength)},
+		{KeyTypeP256, bytes.Repeat([]byte{0x04}, 65)},
+		{KeyTypeP256, bytes.Repeat([]byte{0x04}, 32)},
+		{KeyTypeX25519, bytes.Repeat([]byte{0x09}, 31)},
+	}
+
+	for _, key := range invalid {
+		if _, err := DecodeECDHPublicKey(key.keyType, key.encoded); err == nil {
+			t.Errorf("Key %x... of type %v should be rejected", key.encoded[:4], key.keyType)
+		}
+	}
+}
+
+func TestDecodeKeyHeaderRejectsMalformedHeaders(t *testing.T) {
+	for _, field := range [][]byte{{}, {0x01}, {0x02, 0x01}, {0x01, 0x04}, {0x01, 0x00, 0xAA}, {0x01, 0x02}, {0x01, 0x02, 0x00}, {0x01, 0x02, 0x20, 0xAA},
+		{0x01, 0x03}, {0x01, 0x03, 0x00}, {0x01, 0x03, 0x01, 0x00, 0x00}, {0x01, 0x03, 0x02, 0x00, 0x01, 0xAA}} {
+		if _, _, _, err := DecodeKeyHeader(field); err == nil {
+			t.Errorf("Key header %x should be rejected", field)
+		}
+	}
+}
+
+func TestDecodePublicKeyRejectsInvalidKeys(t *testing.T) {
+	even := bytes.Repeat([]byte{0xFF}, PublicKeyLength)
+	even[PublicKeyLength-1] = 0xFE
+
+	for _, encoded := range [][]byte{nil, bytes.Repeat([]byte{0xFF}, PublicKeyLength-1), make([]byte, PublicKeyLength), even} {
+		if _, err := DecodePublicKey(encoded); err == nil {
+			t.Errorf("Public key %x... should be rejected", encoded[:min(len(encoded), 4)])
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Returned by Dial when the server answers the opening handshake without
+// upgrading the connection, the relay uses the status code to say why a
+// receiver can't join a share
+type HandshakeError struct {
+	StatusCode int
+	// Body of the response, the reason given by the server
+	Message string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("Websocket upgrade refused with status %v. %v", e.StatusCode, e.Message)
+}
+
+// Longest response body kept in a HandshakeError
+const maxHandshakeErrorMessage = 1024
+
+// Open a connection to a ws://, wss://, http:// or https:// URL as a client,
+// frames sent over a client connection are masked
+func Dial(rawURL string) (*Connection, error) {
+	u, err := url.Parse(rawURL)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URL %q.", rawURL)
+	}
+
+	var secure bool
+
+	switch u.Scheme {
+	case "ws", "http":
+		secure = false
+	case "wss", "https":
+		secure = true
+	default:
+		return nil, fmt.Errorf("Unsupported URL scheme %q.", u.Scheme)
+	}
+
+	address := u.Host
+
+	if u.Port() == "" {
+		if secure {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+
+	if secure {
+		conn, err = tls.Dial("tcp", address, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := clientHandshake(conn, u)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	connection, err := CreateConnection()
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	connection.client = true
+
+	instantiateConnection(connection, conn, reader)
+
+	return connection, nil
+}
+
+// Send the opening handshake and check the server's response, returns a reader
+// holding any bytes the server sent after the response
+func clientHandshake(conn net.Conn, u *url.URL) (*bufio.Reader, error) {
+	challenge := make([]byte, 16)
+
+	_, err := rand.Read(challenge)
+
+	if err != nil {
+		return nil, fmt.Errorf("Random bytes failed")
+	}
+
+	challengeKey := base64.StdEncoding.EncodeToString(challenge)
+
+	request, err := http.NewRequest(http.MethodGet, u.String(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", challengeKey)
+	request.Header.Set("Sec-WebSocket-Version", "13")
+
+	err = request.Write(conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid response to the websocket upgrade. %w", err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, maxHandshakeErrorMessage))
+		response.Body.Close()
+		return nil, &HandshakeError{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+
+	if response.Header.Get("Sec-WebSocket-Accept") != generateAcceptKey(challengeKey) {
+		return nil, fmt.Errorf("Server sent the wrong Sec-WebSocket-Accept key.")
+	}
+
+	return reader, nil
+}
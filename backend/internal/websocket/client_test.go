@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(testWebsocketConnectHandler))
+	defer server.Close()
+
+	connection, err := Dial("ws" + strings.TrimPrefix(server.URL, "http"))
+
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+
+	select {
+	case message := <-connection.Incoming:
+		if !bytes.Equal(message, []byte("Hello Client")) {
+			t.Fatalf("Message should be %q is %q", "Hello Client", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message from the server")
+	}
+
+	// the server closes the connection once it has read a masked frame
+	err = SendBlobData(connection, []byte("Recieved"))
+
+	if err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	select {
+	case _, ok := <-connection.Incoming:
+		if ok {
+			t.Errorf("Connection should have been closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Server did not close the connection")
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "No share exists with the provided share code.", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := Dial(server.URL)
+
+	var handshakeErr *HandshakeError
+
+	if !errors.As(err, &handshakeErr) || handshakeErr.StatusCode != http.StatusNotFound ||
+		handshakeErr.Message != "No share exists with the provided share code." {
+		t.Errorf("Error should be a 404 HandshakeError is %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	connected := make(chan *Connection, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, _ := CreateConnection()
+		UpgradeConnection(w, r, connection)
+		connected <- connection
+	}))
+	defer server.Close()
+
+	// the client never reads Incoming so it stops reading once the channel is full
+	client, err := Dial(server.URL)
+
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer Close(client)
+
+	connection := <-connected
+	defer Close(connection)
+
+	SetWriteTimeout(connection, 100*time.Millisecond)
+	message := make([]byte, 1024*1024)
+
+	for i := range 1024 {
+		if err := SendBlobData(connection, message); err != nil {
+			return
+		}
+
+		if i == 1023 {
+			t.Errorf("Writes to a peer that stopped reading should time out")
+		}
+	}
+}
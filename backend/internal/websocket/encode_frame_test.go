@@ -54,3 +54,50 @@ func TestDecodeBinaryFrame(t *testing.T) {
 	}
 
 }
+
+func TestDecodeExtendedLengthFrames(t *testing.T) {
+	// 126 uses the 16 bit extended payload length, 70000 the 64 bit one
+	for _, length := range []int{126, 300, 65535, 70000} {
+		frm, err := newBinaryFrame(bytes.Repeat([]byte{0x61}, length))
+
+		if err != nil {
+			t.Fatal("Failed to create frame")
+		}
+
+		data, err := encodeFrame(frm)
+
+		if err != nil {
+			t.Fatal("Failed to encode frame")
+		}
+
+		newFrame, err := decodeFrame(data)
+
+		if err != nil {
+			t.Fatalf("Failed to decode frame of length %v %v", length, err)
+		}
+
+		if !reflect.DeepEqual(frm, newFrame) {
+			t.Errorf("Decoded frame of length %v doesnt match", length)
+		}
+	}
+}
+
+func TestReadFrameRejectsOversizedPayload(t *testing.T) {
+	frm, err := newBinaryFrame(bytes.Repeat([]byte{0x61}, 300))
+
+	if err != nil {
+		t.Fatal("Failed to create frame")
+	}
+
+	data, err := encodeFrame(frm)
+
+	if err != nil {
+		t.Fatal("Failed to encode frame")
+	}
+
+	_, err = readFrame(bytes.NewReader(data), 299)
+
+	if err == nil {
+		t.Errorf("Frame with payload longer than the maximum should not be read")
+	}
+}
@@ -1,12 +1,15 @@
 package websocket
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"strings"
@@ -20,9 +23,16 @@ type Connection struct {
 	connected                     bool
 	connectionStatusChangedSignal *sync.Cond
 	conn                          net.Conn
-	closing                       bool
-	closeRetryTime                time.Duration
-	closeGiveUpTime               time.Duration
+	// Buffered reader over conn, it may hold bytes read past the opening handshake
+	reader *bufio.Reader
+	// Client connections (opened with Dial) mask the frames they send
+	client          bool
+	closing         bool
+	closeRetryTime  time.Duration
+	closeGiveUpTime time.Duration
+	maxMessageSize  uint64
+	// Longest a write may block for, 0 for no limit
+	writeTimeout time.Duration
 }
 
 type frame struct {
@@ -37,6 +47,9 @@ type frame struct {
 
 type opcode uint8
 
+// Largest message (after reassembling fragments) a connection will accept
+const defaultMaxMessageSize = 32 * 1024 * 1024
+
 const (
 	CONTINUATION_FRAME opcode = 0x0
 	TEXT_FRAME         opcode = 0x1
@@ -66,7 +79,6 @@ func isValidChallengeKey(str string) bool {
 }
 
 func generateAcceptKey(challengeString string) string {
-	fmt.Println("\"" + challengeString + "\"")
 	// Specified in RFC 6455
 
 	str := challengeString + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
@@ -75,46 +87,62 @@ func generateAcceptKey(challengeString string) string {
 }
 
 func readWorker(connection *Connection) {
-	buffer := make([]byte, 4096)
+	// Only the readWorker writes to Incoming so it is responsible for closing it
+	defer close(connection.Incoming)
+
+	connection.lock.Lock()
+	reader := connection.reader
+	maxMessageSize := connection.maxMessageSize
+	connection.lock.Unlock()
+
+	// Payloads of a fragmented binary message, delivered once the final frame arrives
+	var message []byte
+	fragmented := false
+
 	for {
-		select {
-		case _, ok := <-connection.Incoming:
-			if !ok {
-				fmt.Println("Channel is closed stopping ReadWorker")
-				return
+		frm, err := readFrame(reader, maxMessageSize)
+
+		if err != nil {
+			if IsConnected(connection) {
+				log.Printf("Failed to read frame, closing connection. %v\n", err)
+				closeServer(connection)
 			}
-		default:
-			n, err := connection.conn.Read(buffer)
-			if (err == nil) && (n != 0) {
-				data := make([]byte, n)
-				copy(data, buffer[:n])
-				frm, err := decodeFrame(data)
-
-				if err != nil {
-					fmt.Println(hex.EncodeToString(data))
-					fmt.Printf("Failed to decode frame. %e", err)
-				}
-
-				fmt.Printf("Frame recieved %v", frm.operation)
-				switch frm.operation {
-				case BINARY_FRAME:
-					connection.Incoming <- frm.payload
-				case PING_FRAME:
-					sendPongFrame(connection, frm)
-				case CLOSE_FRAME:
-					fmt.Println("CLOSE_FRAME")
-
-					if IsClosing(connection) {
-						closeServer(connection)
-					} else {
-						sendCloseFrame(connection)
-						closeServer(connection)
-					}
-
-				default:
-					fmt.Println("Ignored recieved data. ")
-				}
+			return
+		}
+
+		switch frm.operation {
+		case BINARY_FRAME, CONTINUATION_FRAME:
+			if (frm.operation == CONTINUATION_FRAME) != fragmented {
+				log.Println("Unexpected continuation frame, closing connection.")
+				closeServer(connection)
+				continue
+			}
+
+			if uint64(len(message))+frm.payloadLength > maxMessageSize {
+				log.Println("Message too large, closing connection.")
+				closeServer(connection)
+				continue
+			}
+
+			message = append(message, frm.payload...)
+			fragmented = !frm.fin
+
+			if frm.fin {
+				connection.Incoming <- message
+				message = nil
+			}
+		case PING_FRAME:
+			sendPongFrame(connection, frm)
+		case CLOSE_FRAME:
+			if IsClosing(connection) {
+				closeServer(connection)
+			} else {
+				sendCloseFrame(connection)
+				closeServer(connection)
 			}
+
+		default:
+			// text frames aren't used by the protocol and pongs need no reply
 		}
 	}
 }
@@ -126,6 +154,7 @@ func CreateConnection() (*Connection, error) {
 		connected:       false,
 		closeRetryTime:  time.Second * 2,
 		closeGiveUpTime: time.Second * 30,
+		maxMessageSize:  defaultMaxMessageSize,
 	}
 
 	connection.connectionStatusChangedSignal = sync.NewCond(&connection.lock)
@@ -133,11 +162,12 @@ func CreateConnection() (*Connection, error) {
 	return connection, nil
 }
 
-// Update the connection with the underlying connection
-func instantiateConnection(connection *Connection, conn net.Conn) error {
+// Update the connection with the underlying connection, reader must read from conn
+func instantiateConnection(connection *Connection, conn net.Conn, reader *bufio.Reader) error {
 	connection.lock.Lock()
 	defer connection.lock.Unlock()
 	connection.conn = conn
+	connection.reader = reader
 	connection.connected = true
 	connection.connectionStatusChangedSignal.Signal()
 
@@ -151,7 +181,11 @@ func write(connection *Connection, data []byte) error {
 	// TODO: look into the implications of partial writes
 	connection.lock.Lock()
 	defer connection.lock.Unlock()
-	fmt.Printf("Writing %v bytes to connection data : %v\n", len(data), data)
+
+	if connection.writeTimeout > 0 {
+		connection.conn.SetWriteDeadline(time.Now().Add(connection.writeTimeout))
+	}
+
 	writtenBytes := 0
 	for writtenBytes < len(data) {
 		n, err := connection.conn.Write(data[writtenBytes:])
@@ -164,62 +198,97 @@ func write(connection *Connection, data []byte) error {
 
 }
 
+// Fail writes (including SendBlobData) that block for longer than timeout, for
+// peers that stop reading. A connection whose write timed out should be closed.
+func SetWriteTimeout(connection *Connection, timeout time.Duration) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.writeTimeout = timeout
+}
+
 // Doesn't send any Close Frames should be used after close handshake is
 // complete
 func closeServer(connection *Connection) error {
-	// Closing the channel will kill the workers
-	close(connection.Incoming)
 	connection.lock.Lock()
 	defer connection.lock.Unlock()
+
+	if !connection.connected {
+		return nil
+	}
+
 	connection.connected = false
-	connection.connectionStatusChangedSignal.Signal()
+	connection.connectionStatusChangedSignal.Broadcast()
+	// Closing the underlying connection will stop the readWorker which
+	// closes the Incoming channel
 	return connection.conn.Close()
 }
 
 func decodeFrame(recievedData []byte) (frame, error) {
-	if len(recievedData) < 2 {
-		return frame{}, fmt.Errorf("Not a valid frame, not enough bytes.")
+	return readFrame(bytes.NewReader(recievedData), uint64(len(recievedData)))
+}
+
+// Read exactly one frame from the reader, frames with a payload longer than
+// maxPayloadLength are rejected without reading the payload
+func readFrame(reader io.Reader, maxPayloadLength uint64) (frame, error) {
+	header := make([]byte, 2)
+
+	_, err := io.ReadFull(reader, header)
+
+	if err != nil {
+		return frame{}, fmt.Errorf("Not a valid frame, not enough bytes. %w", err)
 	}
 
-	var fin bool = (recievedData[0] & 0x80) != 0
-	var operation opcode = opcode((recievedData[0] & 0x0F))
-	var mask bool = (recievedData[1] & 0x80) != 0
-	var payloadLength uint64 = uint64((recievedData[1]) & 0x7F)
+	var fin bool = (header[0] & 0x80) != 0
+	var operation opcode = opcode((header[0] & 0x0F))
+	var mask bool = (header[1] & 0x80) != 0
+	var payloadLength uint64 = uint64((header[1]) & 0x7F)
 	var maskKey uint32 = 0
 
-	nextByteIndex := 2
-
 	switch payloadLength {
 	case 126:
-		payloadLength = binary.BigEndian.Uint64(recievedData[nextByteIndex:(nextByteIndex + 2)])
-		nextByteIndex += 2
+		extendedLength := make([]byte, 2)
+		_, err = io.ReadFull(reader, extendedLength)
+		if err != nil {
+			return frame{}, fmt.Errorf("Not a valid frame, not enough bytes (16 bit payload length). %w", err)
+		}
+		payloadLength = uint64(binary.BigEndian.Uint16(extendedLength))
 	case 127:
-		payloadLength = binary.BigEndian.Uint64(recievedData[nextByteIndex:(nextByteIndex + 8)])
-		nextByteIndex += 8
+		extendedLength := make([]byte, 8)
+		_, err = io.ReadFull(reader, extendedLength)
+		if err != nil {
+			return frame{}, fmt.Errorf("Not a valid frame, not enough bytes (64 bit payload length). %w", err)
+		}
+		payloadLength = binary.BigEndian.Uint64(extendedLength)
+	}
+
+	if payloadLength > maxPayloadLength {
+		return frame{}, fmt.Errorf("Frame payload length %v exceeds the maximum of %v.", payloadLength, maxPayloadLength)
 	}
 
 	if mask {
-		if len(recievedData[nextByteIndex:]) < 4 {
-			return frame{}, fmt.Errorf("Not a valid frame, not enough bytes (mask true but no mask key).")
+		maskKeyBytes := make([]byte, 4)
+		_, err = io.ReadFull(reader, maskKeyBytes)
+		if err != nil {
+			return frame{}, fmt.Errorf("Not a valid frame, not enough bytes (mask true but no mask key). %w", err)
 		}
-		maskKey = binary.BigEndian.Uint32(recievedData[nextByteIndex:(nextByteIndex + 4)])
-		nextByteIndex += 4
+		maskKey = binary.BigEndian.Uint32(maskKeyBytes)
 	}
-	if uint64(len(recievedData[nextByteIndex:])) < payloadLength {
+
+	var payload []byte = make([]byte, payloadLength)
+	n, err := io.ReadFull(reader, payload)
+
+	if err != nil {
 		err := fmt.Errorf(
 			"Not a valid frame, not enough bytes (payload length %v shorter than specified payload length %v).",
-			uint64(len(recievedData[nextByteIndex:])), payloadLength)
+			n, payloadLength)
 		return frame{}, err
 	}
-	var payload []byte = make([]byte, payloadLength)
+
 	if mask {
-		payloadBytes, err := applyMask(maskKey, recievedData[nextByteIndex:])
+		payload, err = applyMask(maskKey, payload)
 		if err != nil {
 			return frame{}, fmt.Errorf("Masking failed.")
 		}
-		copy(payload, payloadBytes)
-	} else {
-		copy(payload, recievedData[nextByteIndex:])
 	}
 
 	data := frame{fin: fin, operation: operation, mask: mask,
@@ -238,29 +307,33 @@ func SendBlobData(connection *Connection, data []byte) error {
 	frm, err := newBinaryFrame(data)
 
 	if err != nil {
-		return fmt.Errorf("Couldn't create binary frame for data: %v.", data)
+		return fmt.Errorf("Couldn't create binary frame for %v bytes of data.", len(data))
 	}
 
-	payload, err := encodeFrame(frm)
+	payload, err := encodeFrameFor(connection, frm)
 
 	if err != nil {
-		return fmt.Errorf("Couldn't encode binary frame for data: %v.", data)
+		return fmt.Errorf("Couldn't encode binary frame for %v bytes of data.", len(data))
 	}
 
 	err = write(connection, payload)
 
 	if err != nil {
-		return fmt.Errorf("Couldn't write binary frame for data: %v.", data)
+		return fmt.Errorf("Couldn't write binary frame for %v bytes of data.", len(data))
 	}
 
 	return nil
 }
 
+// Close the underlying connection immediately without a closing handshake, for
+// connections that are known to be dead or are being replaced
+func Close(connection *Connection) error {
+	return closeServer(connection)
+}
+
 // This is the external class to allow the inititation of a close by external users
 // TODO: design such that if there are errors sending the close frame there is visibility
 func InitiateClose(connection *Connection) error {
-	fmt.Println("CLOSE INITATED")
-
 	if !IsConnected(connection) {
 		return fmt.Errorf("Connection not connected.")
 	}
@@ -298,7 +371,6 @@ func InitiateClose(connection *Connection) error {
 }
 
 func sendCloseFrame(connection *Connection) error {
-	fmt.Println("SENDING CLOSE FRAME")
 	if !IsConnected(connection) {
 		return fmt.Errorf("Connection not connected.")
 	}
@@ -309,7 +381,7 @@ func sendCloseFrame(connection *Connection) error {
 		return fmt.Errorf("Couldn't create close frame.")
 	}
 
-	payload, err := encodeFrame(frm)
+	payload, err := encodeFrameFor(connection, frm)
 
 	if err != nil {
 		return fmt.Errorf("Couldn't encode close frame %v.", frm)
@@ -337,13 +409,13 @@ func sendPongFrame(connection *Connection, pingFrame frame) error {
 	if err != nil {
 		return fmt.Errorf("Failed to create pong frame.")
 	}
-	pongFrameBytes, err := encodeFrame(pong)
+	pongFrameBytes, err := encodeFrameFor(connection, pong)
 	if err != nil {
 		return fmt.Errorf("Failed to encode pong frame %v.", pong)
 	}
 	err = write(connection, pongFrameBytes)
 	if err != nil {
-		fmt.Println("Failed to write pong frame.")
+		log.Println("Failed to write pong frame.")
 		return fmt.Errorf("Failed to write ping frame %v encoded as %v.", pong, pongFrameBytes)
 	}
 	return nil
@@ -362,7 +434,7 @@ func sendPingFrame(connection *Connection, pingFrame frame) error {
 	if err != nil {
 		return fmt.Errorf("Failed to create ping frame.")
 	}
-	pingFrameBytes, err := encodeFrame(ping)
+	pingFrameBytes, err := encodeFrameFor(connection, ping)
 	if err != nil {
 		return fmt.Errorf("Failed to encode ping frame %v.", ping)
 	}
@@ -450,7 +522,7 @@ func encodeFrame(data frame) ([]byte, error) {
 	if data.payloadLength <= 125 {
 		payloadLength7bit = uint8(data.payloadLength)
 		payloadLengthBytes = make([]byte, 0)
-	} else if data.payloadLength < 65535 {
+	} else if data.payloadLength <= 65535 {
 		payloadLength7bit = uint8(126)
 		payloadLengthBytes = make([]byte, 2)
 		binary.BigEndian.PutUint16(payloadLengthBytes, uint16(data.payloadLength))
@@ -489,11 +561,28 @@ func encodeFrame(data frame) ([]byte, error) {
 	buffer.Write(maskKeyBytes)
 	buffer.Write(payloadBytes)
 
-	println("encodedFrame :", buffer.Bytes())
 	return buffer.Bytes(), nil
 
 }
 
+// Client frames must be masked with a new random key each (RFC 6455 section 5.3)
+func encodeFrameFor(connection *Connection, frm frame) ([]byte, error) {
+	if connection.client {
+		maskKey := make([]byte, 4)
+
+		_, err := rand.Read(maskKey)
+
+		if err != nil {
+			return nil, fmt.Errorf("Random bytes failed")
+		}
+
+		frm.mask = true
+		frm.maskKey = binary.BigEndian.Uint32(maskKey)
+	}
+
+	return encodeFrame(frm)
+}
+
 // Do nothing just wait until the connection is connected
 func WaitUntilConnected(connection *Connection) {
 	connection.lock.Lock()
@@ -504,6 +593,28 @@ func WaitUntilConnected(connection *Connection) {
 	}
 }
 
+// Waits until the connection is connected or the timeout passes, returns whether it is connected
+func WaitUntilConnectedOrTimeout(connection *Connection, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	// wake the waiter below once the deadline has passed
+	timer := time.AfterFunc(timeout, func() {
+		connection.lock.Lock()
+		defer connection.lock.Unlock()
+		connection.connectionStatusChangedSignal.Broadcast()
+	})
+	defer timer.Stop()
+
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	for !connection.connected && time.Now().Before(deadline) {
+		connection.connectionStatusChangedSignal.Wait()
+	}
+
+	return connection.connected
+}
+
 // Is the connection obj connected and ready to send data
 func IsConnected(connection *Connection) bool {
 	connection.lock.Lock()
@@ -521,8 +632,6 @@ func IsClosing(connection *Connection) bool {
 // Upgrade from http -> websocket, hijacks the connection if successful
 // We dont
 func UpgradeConnection(w http.ResponseWriter, r *http.Request, connection *Connection) error {
-	println("Upgrading the connection")
-
 	var challengeKey string = r.Header.Get("Sec-Websocket-Key")
 
 	if (!checkHeader(r, "Upgrade", "websocket")) ||
@@ -551,7 +660,7 @@ func UpgradeConnection(w http.ResponseWriter, r *http.Request, connection *Conne
 		return err
 	}
 
-	instantiateConnection(connection, underlyingConnection)
+	instantiateConnection(connection, underlyingConnection, buffer.Reader)
 
 	// Build the response
 	response := []string{
@@ -563,7 +672,6 @@ func UpgradeConnection(w http.ResponseWriter, r *http.Request, connection *Conne
 		"",
 	}
 
-	fmt.Println(strings.Join(response, "\r\n"))
 	_, err = buffer.WriteString(strings.Join(response, "\r\n"))
 
 	//TODO: Consider if there is a way of handling these such that the client
@@ -579,6 +687,5 @@ func UpgradeConnection(w http.ResponseWriter, r *http.Request, connection *Conne
 	if err != nil {
 		return err
 	}
-	println("Upgraded the connection")
 	return nil
 }
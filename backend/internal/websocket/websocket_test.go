@@ -130,3 +130,21 @@ func TestWebsocketConnect(t *testing.T) {
 		fmt.Println("Ran with no errors")
 	}
 }
+
+func TestWaitUntilConnectedOrTimeoutExpires(t *testing.T) {
+	connection, err := CreateConnection()
+
+	if err != nil {
+		t.Fatalf("Failed to create connection: %v", err)
+	}
+
+	start := time.Now()
+
+	if WaitUntilConnectedOrTimeout(connection, 50*time.Millisecond) {
+		t.Errorf("Connection should not be connected")
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Wait should last the timeout, returned after %v", elapsed)
+	}
+}
@@ -0,0 +1,23 @@
+// Package wordlist holds the 256 words used for word share codes and short
+// authentication strings, so each word stands for one byte
+package wordlist
+
+import (
+	_ "embed"
+	"strings"
+)
+
+//go:embed wordlist.txt
+var text string
+
+var Words = strings.Fields(text)
+
+// Index of a word in Words or -1 if it isn't in the list
+func IndexOf(word string) int {
+	for i, candidate := range Words {
+		if candidate == word {
+			return i
+		}
+	}
+	return -1
+}
@@ -26,4 +26,36 @@ test("encode-decode test", () => {
 	testEncodeDecodeKey().then(txt => expect(txt).toEqual("Hello World!"))
 })
 
+function hex(data: ArrayBuffer): string {
+	return Array.from(new Uint8Array(data)).map(b => b.toString(16).padStart(2, "0")).join("")
+}
+
+async function goldenContentKey(): Promise<CryptoKey> {
+	const rawKey = new Uint8Array(32).map((_, i) => i)
+	return crypto.subtle.importKey("raw", rawKey, "AES-GCM", false, ["encrypt", "decrypt"])
+}
+
+// the same vector is checked by backend/internal/tubecrypto
+test("golden chunk test", async () => {
+	const contentKey = await goldenContentKey()
+	const sealed = await tubeCrypto.sealChunk(contentKey, 1, 3, true, new TextEncoder().encode("Hello World!").buffer)
+	expect(hex(sealed)).toEqual("89a5d0985321d4dada1ec38ffacdc2ae3a6ab679943cc9412ad9523b")
+})
+
+test("moved chunk test", async () => {
+	const contentKey = await goldenContentKey()
+	const sealed = await tubeCrypto.sealChunk(contentKey, 1, 3, false, new TextEncoder().encode("Hello World!").buffer)
+	await expect(tubeCrypto.openChunk(contentKey, 1, 4, false, sealed)).rejects.toBeDefined()
+	await expect(tubeCrypto.openChunk(contentKey, 1, 3, true, sealed)).rejects.toBeDefined()
+	await expect(tubeCrypto.openMetadata(contentKey, 1, 3, sealed)).rejects.toBeDefined()
+})
 
+test("wrap-unwrap content key test", async () => {
+	const keys = await tubeCrypto.generateKeyPair()
+	const contentKey = await tubeCrypto.generateContentKey()
+	const wrapped = await tubeCrypto.wrapContentKey(keys.publicKey, contentKey)
+	const unwrapped = await tubeCrypto.unwrapContentKey(keys.privateKey, wrapped)
+	const sealed = await tubeCrypto.sealChunk(contentKey, 0, 0, true, new TextEncoder().encode("Hello World!").buffer)
+	const opened = await tubeCrypto.openChunk(unwrapped, 0, 0, true, sealed)
+	expect(new TextDecoder().decode(opened)).toEqual("Hello World!")
+})
@@ -37,6 +37,86 @@ namespace tubeCrypto {
 	export async function decrypt(privateKey: CryptoKey, data: ArrayBuffer): Promise<ArrayBuffer> {
 		return crypto.subtle.decrypt({ name: encryptionAlgoName }, privateKey, data)
 	}
+
+	// Version 1 of the payload format (documentation/Encryption.md), a random AES-256-GCM
+	// content key is wrapped once with the receiver's key and every chunk is sealed
+	// with a nonce bound to its file index and chunk number
+
+	export const formatVersion: number = 1
+	const contentAlgoName: string = "AES-GCM"
+	const kindDataChunk: number = 0x00
+	const kindMetadata: number = 0x01
+	const kindEnd: number = 0x02
+	const additionalData = new Uint8Array([formatVersion])
+
+	export async function generateContentKey(): Promise<CryptoKey> {
+		return crypto.subtle.generateKey({ name: contentAlgoName, length: 256 }, true, ["encrypt", "decrypt"])
+	}
+
+	export async function wrapContentKey(publicKey: CryptoKey, contentKey: CryptoKey): Promise<ArrayBuffer> {
+		const rawKey = await crypto.subtle.exportKey("raw", contentKey)
+		return encrypt(publicKey, rawKey)
+	}
+
+	export async function unwrapContentKey(privateKey: CryptoKey, wrappedKey: ArrayBuffer): Promise<CryptoKey> {
+		const rawKey = await decrypt(privateKey, wrappedKey)
+		return crypto.subtle.importKey("raw", rawKey, contentAlgoName, false, ["encrypt", "decrypt"])
+	}
+
+	// kind || final || file index || number || 4 zero bytes, all big endian
+	function nonce(kind: number, final: boolean, fileIndex: number, num: number): Uint8Array {
+		const nonce = new Uint8Array(12)
+		const view = new DataView(nonce.buffer)
+		view.setUint8(0, kind)
+		view.setUint8(1, final ? 1 : 0)
+		view.setUint16(2, fileIndex)
+		view.setUint32(4, num)
+		return nonce
+	}
+
+	export async function sealChunk(contentKey: CryptoKey, fileIndex: number, chunkNumber: number,
+		final: boolean, data: ArrayBuffer): Promise<ArrayBuffer> {
+		return crypto.subtle.encrypt(
+			{ name: contentAlgoName, iv: nonce(kindDataChunk, final, fileIndex, chunkNumber), additionalData },
+			contentKey, data)
+	}
+
+	export async function openChunk(contentKey: CryptoKey, fileIndex: number, chunkNumber: number,
+		final: boolean, data: ArrayBuffer): Promise<ArrayBuffer> {
+		return crypto.subtle.decrypt(
+			{ name: contentAlgoName, iv: nonce(kindDataChunk, final, fileIndex, chunkNumber), additionalData },
+			contentKey, data)
+	}
+
+	export async function sealMetadata(contentKey: CryptoKey, fileIndex: number, field: number,
+		data: ArrayBuffer): Promise<ArrayBuffer> {
+		return crypto.subtle.encrypt(
+			{ name: contentAlgoName, iv: nonce(kindMetadata, false, fileIndex, field), additionalData },
+			contentKey, data)
+	}
+
+	export async function openMetadata(contentKey: CryptoKey, fileIndex: number, field: number,
+		data: ArrayBuffer): Promise<ArrayBuffer> {
+		return crypto.subtle.decrypt(
+			{ name: contentAlgoName, iv: nonce(kindMetadata, false, fileIndex, field), additionalData },
+			contentKey, data)
+	}
+
+	// From protocol version 11 END carries the SHA-256 digest of every chunk's plaintext,
+	// sealed with the number of chunks so the relay can't cut a streamed share short
+	export async function sealEnd(contentKey: CryptoKey, numberOfChunks: number,
+		digest: ArrayBuffer): Promise<ArrayBuffer> {
+		return crypto.subtle.encrypt(
+			{ name: contentAlgoName, iv: nonce(kindEnd, true, 0, numberOfChunks), additionalData },
+			contentKey, digest)
+	}
+
+	export async function openEnd(contentKey: CryptoKey, numberOfChunks: number,
+		data: ArrayBuffer): Promise<ArrayBuffer> {
+		return crypto.subtle.decrypt(
+			{ name: contentAlgoName, iv: nonce(kindEnd, true, 0, numberOfChunks), additionalData },
+			contentKey, data)
+	}
 }
 
 export default tubeCrypto